@@ -0,0 +1,392 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "errors"
+    "flag"
+    "fmt"
+    "os"
+    "path/filepath"
+    "strconv"
+    "strings"
+    "text/tabwriter"
+    "time"
+
+    "github.com/eparoshin/tors_hw/2/client/kvclient"
+)
+
+type adminCommand struct {
+    name string
+    args string
+    help string
+    nargs [2]int //min and max number of arguments
+    run func(admin *adminSession, ctx context.Context, args []string) error
+}
+
+type adminSession struct {
+    kv *kvclient.Client
+    learner bool
+    index uint64
+}
+
+var adminCommands = []adminCommand{
+    {"members", "", "roles and replication progress of the nodes as the leader sees them", [2]int{0, 0}, (*adminSession).members},
+    {"status", "", "term, commit, applied and snapshot index of every node", [2]int{0, 0}, (*adminSession).status},
+    {"snapshot", "[node]", "snapshot the state machine and compact the log of the node or of all nodes", [2]int{0, 1}, (*adminSession).snapshot},
+    {"transfer", "[node]", "transfer leadership to the node or to any up to date voter", [2]int{0, 1}, (*adminSession).transfer},
+    {"add", "node", "make a removed node a learner, then a voter once it catches up unless -learner is set. The node has to be in the nodes config of every node, a new one is added there and the nodes restarted first", [2]int{1, 1}, (*adminSession).add},
+    {"remove", "node", "stop replicating to the node and take its vote, the process should be stopped afterwards", [2]int{1, 1}, (*adminSession).remove},
+    {"promote", "node", "make a caught up learner a voter", [2]int{1, 1}, (*adminSession).promote},
+    {"demote", "node", "make a voter a learner", [2]int{1, 1}, (*adminSession).demote},
+    {"verify", "", "check that all members have the same state machine hash at -index", [2]int{0, 0}, (*adminSession).verify},
+    {"backup", "file", "write the state machine to the file, start new nodes with -restore-from to restore it. Refused once keys are split into ranges, the raft groups of the ranges give no single point in time to back up", [2]int{1, 1}, (*adminSession).backup},
+    {"ranges", "[node]", "key ranges with their leaders as the node or the first reachable node sees them", [2]int{0, 1}, (*adminSession).ranges},
+    {"split", "key", "split the range holding the key, the key starts the new range", [2]int{1, 1}, (*adminSession).split},
+}
+
+func (admin *adminSession) nodeArg(arg string) (int, error) {
+    nodeId, err := strconv.Atoi(arg)
+    if err != nil || nodeId < 0 || nodeId >= len(admin.kv.Nodes()) {
+        return 0, fmt.Errorf("Unknown node %q, members are the nodes of the nodes config", arg)
+    }
+    return nodeId, nil
+}
+
+func newTable() *tabwriter.Writer {
+    return tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+}
+
+func (admin *adminSession) members(ctx context.Context, args []string) error {
+    members, err := admin.kv.Members(ctx)
+    if err != nil {
+        return err
+    }
+    table := newTable()
+    fmt.Fprintln(table, "NODE\tADDRESS\tROLE\tLEADER\tMATCH\tLAST HB")
+    for _, member := range members {
+        lastHB := "-"
+        if member.SinceLastHBMs != nil {
+            lastHB = fmt.Sprintf("%dms", *member.SinceLastHBMs)
+        }
+        fmt.Fprintf(table, "%d\t%s\t%s\t%t\t%d\t%s\n", member.NodeId, member.ExternalUri, member.Role, member.Leader, member.MatchIndex, lastHB)
+    }
+    return table.Flush()
+}
+
+func (admin *adminSession) status(ctx context.Context, args []string) error {
+    table := newTable()
+    fmt.Fprintln(table, "NODE\tROLE\tTERM\tLEADER\tCOMMIT\tAPPLIED\tLAST INDEX\tSNAPSHOT")
+    var failed error
+    for i := range admin.kv.Nodes() {
+        status, err := admin.kv.Status(ctx, i)
+        if err != nil {
+            fmt.Fprintf(table, "%d\tunreachable: %v\n", i, err)
+            failed = errors.New("Some nodes are unreachable")
+            continue
+        }
+        leader := "-"
+        if status.LeaderId != nil {
+            leader = strconv.FormatUint(*status.LeaderId, 10)
+        }
+        fmt.Fprintf(table, "%d\t%s\t%d\t%s\t%d\t%d\t%d\t%d\n", i, status.Role, status.CurrentTerm, leader, status.CommitIndex, status.LastApplied, status.LogLength - 1, status.SnapshotIndex)
+    }
+    if err := table.Flush(); err != nil {
+        return err
+    }
+    return failed
+}
+
+func (admin *adminSession) snapshot(ctx context.Context, args []string) error {
+    nodes := make([]int, 0, len(admin.kv.Nodes()))
+    if len(args) == 1 {
+        nodeId, err := admin.nodeArg(args[0])
+        if err != nil {
+            return err
+        }
+        nodes = append(nodes, nodeId)
+    } else {
+        for i := range admin.kv.Nodes() {
+            nodes = append(nodes, i)
+        }
+    }
+
+    var failed error
+    for _, nodeId := range nodes {
+        info, err := admin.kv.Snapshot(ctx, nodeId)
+        if err != nil {
+            fmt.Printf("node %d: %v\n", nodeId, err)
+            failed = errors.New("Some snapshots failed")
+            continue
+        }
+        fmt.Printf("node %d: snapshot at index %d term %d with %d items, %d entries compacted\n", nodeId, info.Index, info.Term, info.Items, info.Compacted)
+    }
+    return failed
+}
+
+func (admin *adminSession) transfer(ctx context.Context, args []string) error {
+    target := -1
+    if len(args) == 1 {
+        var err error
+        if target, err = admin.nodeArg(args[0]); err != nil {
+            return err
+        }
+    }
+    if err := admin.kv.TransferLeadership(ctx, target); err != nil {
+        return err
+    }
+    fmt.Println("leadership transferred")
+    return nil
+}
+
+func (admin *adminSession) setRole(ctx context.Context, arg string, role string) error {
+    nodeId, err := admin.nodeArg(arg)
+    if err != nil {
+        return err
+    }
+    if err := admin.kv.SetRole(ctx, nodeId, role); err != nil {
+        return err
+    }
+    fmt.Printf("node %d: role set to %s\n", nodeId, role)
+    return nil
+}
+
+//a new voter is promoted as soon as the leader reports it has caught up
+func (admin *adminSession) add(ctx context.Context, args []string) error {
+    if err := admin.setRole(ctx, args[0], kvclient.RoleLearner); err != nil || admin.learner {
+        return err
+    }
+    for {
+        err := admin.setRole(ctx, args[0], kvclient.RoleVoter)
+        if !errors.Is(err, kvclient.ErrConflict) {
+            return err
+        }
+        select {
+        case <- ctx.Done():
+            return fmt.Errorf("Node did not catch up: %w", err)
+        case <- time.After(200 * time.Millisecond):
+        }
+    }
+}
+
+func (admin *adminSession) remove(ctx context.Context, args []string) error {
+    return admin.setRole(ctx, args[0], kvclient.RoleRemoved)
+}
+
+func (admin *adminSession) promote(ctx context.Context, args []string) error {
+    return admin.setRole(ctx, args[0], kvclient.RoleVoter)
+}
+
+func (admin *adminSession) demote(ctx context.Context, args []string) error {
+    return admin.setRole(ctx, args[0], kvclient.RoleLearner)
+}
+
+//removed nodes get no entries, so they are not compared
+func (admin *adminSession) replicas(ctx context.Context) []int {
+    var nodes []int
+    members, err := admin.kv.Members(ctx)
+    if err != nil {
+        logger.Warn("Members are unknown, verifying all nodes", "err", err)
+        for i := range admin.kv.Nodes() {
+            nodes = append(nodes, i)
+        }
+        return nodes
+    }
+    for _, member := range members {
+        if member.Role != kvclient.RoleRemoved {
+            nodes = append(nodes, int(member.NodeId))
+        }
+    }
+    return nodes
+}
+
+//without -index the lowest index applied on every replica and kept in every log is used
+func (admin *adminSession) verify(ctx context.Context, args []string) error {
+    nodes := admin.replicas(ctx)
+    index := admin.index
+    if index == 0 {
+        var minApplied, maxSnapshot uint64 = ^uint64(0), 0
+        for _, nodeId := range nodes {
+            status, err := admin.kv.Status(ctx, nodeId)
+            if err != nil {
+                return fmt.Errorf("Node %d: %w", nodeId, err)
+            }
+            minApplied = min(minApplied, status.LastApplied)
+            maxSnapshot = max(maxSnapshot, status.SnapshotIndex)
+        }
+        index = max(minApplied, maxSnapshot)
+    }
+
+    hashes := make([]kvclient.StateHash, len(nodes))
+    for i, nodeId := range nodes {
+        for {
+            var err error
+            hashes[i], err = admin.kv.StateHash(ctx, nodeId, index)
+            if err == nil {
+                break
+            }
+            if errors.Is(err, kvclient.ErrCompacted) {
+                return fmt.Errorf("Node %d: %w, pass a later -index", nodeId, err)
+            }
+            //the node has not committed the index yet
+            if !errors.Is(err, kvclient.ErrConflict) {
+                return fmt.Errorf("Node %d: %w", nodeId, err)
+            }
+            select {
+            case <- ctx.Done():
+                return fmt.Errorf("Node %d: %w", nodeId, err)
+            case <- time.After(100 * time.Millisecond):
+            }
+        }
+    }
+
+    table := newTable()
+    fmt.Fprintln(table, "NODE\tINDEX\tITEMS\tHASH")
+    for _, hash := range hashes {
+        fmt.Fprintf(table, "%d\t%d\t%d\t%s\n", hash.NodeId, hash.Index, hash.Items, hash.Hash)
+    }
+    if err := table.Flush(); err != nil {
+        return err
+    }
+    for _, hash := range hashes[1:] {
+        if hash.Hash != hashes[0].Hash {
+            return fmt.Errorf("Replicas diverge at index %d", index)
+        }
+    }
+    fmt.Printf("%d replicas have the same state at index %d\n", len(hashes), index)
+    return nil
+}
+
+//the file is replaced only once the whole backup is written
+func (admin *adminSession) backup(ctx context.Context, args []string) error {
+    backup, err := admin.kv.Backup(ctx)
+    if err != nil {
+        return err
+    }
+    data, err := json.Marshal(backup)
+    if err != nil {
+        return err
+    }
+
+    file, err := os.CreateTemp(filepath.Dir(args[0]), "backup-*")
+    if err != nil {
+        return err
+    }
+    _, err = file.Write(data)
+    err = errors.Join(err, file.Sync(), file.Close())
+    if err == nil {
+        err = os.Rename(file.Name(), args[0])
+    }
+    if err != nil {
+        os.Remove(file.Name())
+        return err
+    }
+    fmt.Printf("backup of %d items at index %d term %d written to %s\n", len(backup.Items), backup.Index, backup.Term, args[0])
+    return nil
+}
+
+//-1 asks the nodes in order until one answers
+func (admin *adminSession) routingTable(ctx context.Context, nodeId int) ([]kvclient.Range, error) {
+    if nodeId >= 0 {
+        return admin.kv.Ranges(ctx, nodeId)
+    }
+    var err error
+    for i := range admin.kv.Nodes() {
+        var ranges []kvclient.Range
+        if ranges, err = admin.kv.Ranges(ctx, i); err == nil {
+            return ranges, nil
+        }
+    }
+    return nil, err
+}
+
+func (admin *adminSession) ranges(ctx context.Context, args []string) error {
+    nodeId := -1
+    if len(args) == 1 {
+        var err error
+        if nodeId, err = admin.nodeArg(args[0]); err != nil {
+            return err
+        }
+    }
+    ranges, err := admin.routingTable(ctx, nodeId)
+    if err != nil {
+        return err
+    }
+    table := newTable()
+    fmt.Fprintln(table, "RANGE\tSTART\tEND\tLEADER\tREADY\tAPPLIED\tKEYS\tSIZE")
+    for _, rng := range ranges {
+        leader := "-"
+        if rng.LeaderId != nil {
+            leader = strconv.FormatUint(*rng.LeaderId, 10)
+        }
+        end := strconv.Quote(rng.End)
+        if rng.End == "" {
+            end = "-"
+        }
+        fmt.Fprintf(table, "%d\t%q\t%s\t%s\t%t\t%d\t%d\t%d\n", rng.Id, rng.Start, end, leader, rng.Ready, rng.AppliedIndex, rng.Keys, rng.Size)
+    }
+    return table.Flush()
+}
+
+func (admin *adminSession) split(ctx context.Context, args []string) error {
+    rng, err := admin.kv.Split(ctx, args[0])
+    if err != nil {
+        return err
+    }
+    fmt.Printf("range %d starts at %q\n", rng.Id, rng.Start)
+    return nil
+}
+
+func adminUsage(flags *flag.FlagSet) {
+    fmt.Fprintf(flags.Output(), "Usage: %s admin [flags] nodes-config command [args]\n\nCommands:\n", os.Args[0])
+    table := tabwriter.NewWriter(flags.Output(), 0, 4, 2, ' ', 0)
+    for _, command := range adminCommands {
+        fmt.Fprintf(table, "  %s %s\t%s\n", command.name, command.args, command.help)
+    }
+    table.Flush()
+    fmt.Fprintln(flags.Output(), "\nFlags:")
+    flags.PrintDefaults()
+}
+
+//exits with 1 if the command failed and with 2 on usage errors
+func runAdmin(args []string) {
+    flags := flag.NewFlagSet("admin", flag.ExitOnError)
+    var options clientOptions
+    options.register(flags)
+    timeout := flags.Duration("timeout", 30 * time.Second, "timeout of the command")
+    learner := flags.Bool("learner", false, "add the node as a learner only")
+    index := flags.Uint64("index", 0, "log index for verify, chosen automatically if zero")
+    flags.Usage = func() {
+        adminUsage(flags)
+    }
+    flags.Parse(args)
+    if flags.NArg() < 2 {
+        flags.Usage()
+        os.Exit(2)
+    }
+
+    name, commandArgs := flags.Arg(1), flags.Args()[2:]
+    var command *adminCommand
+    for i := range adminCommands {
+        if adminCommands[i].name == name {
+            command = &adminCommands[i]
+        }
+    }
+    if command == nil || len(commandArgs) < command.nargs[0] || len(commandArgs) > command.nargs[1] {
+        if command == nil {
+            fmt.Fprintf(flags.Output(), "Unknown command %q\n", name)
+        } else {
+            fmt.Fprintf(flags.Output(), "Usage: %s %s\n", command.name, strings.TrimSpace(command.args))
+        }
+        os.Exit(2)
+    }
+
+    admin := &adminSession{kv: options.newClient(flags.Arg(0)), learner: *learner, index: *index}
+    ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+    defer cancel()
+    if err := command.run(admin, ctx, commandArgs); err != nil {
+        fmt.Fprintf(os.Stderr, "error: %v\n", err)
+        cancel()
+        os.Exit(1)
+    }
+}
@@ -0,0 +1,415 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "errors"
+    "flag"
+    "fmt"
+    "math"
+    "math/rand"
+    "net/http"
+    "os"
+    "sort"
+    "strconv"
+    "sync"
+    "sync/atomic"
+    "time"
+
+    "github.com/eparoshin/tors_hw/2/client/history"
+    "github.com/eparoshin/tors_hw/2/client/kvclient"
+)
+
+type BenchConfig struct {
+    ReadRatio float64 `json:"read_ratio"`
+    Keys int `json:"keys"`
+    KeyDist string `json:"key_dist"`
+    ZipfS float64 `json:"zipf_s,omitempty"`
+    KeyPrefix string `json:"key_prefix"`
+    ValueSize int `json:"value_size"`
+    Concurrency int `json:"concurrency"`
+    DurationS float64 `json:"duration_s"`
+    TargetQps float64 `json:"target_qps"` //zero for as fast as possible
+    Preload bool `json:"preload"`
+}
+
+type LatencySummary struct {
+    Mean float64 `json:"mean"`
+    P50 float64 `json:"p50"`
+    P90 float64 `json:"p90"`
+    P99 float64 `json:"p99"`
+    P999 float64 `json:"p999"`
+    Max float64 `json:"max"`
+}
+
+type OpReport struct {
+    Count int `json:"count"` //successful ops
+    Errors int `json:"errors"`
+    ErrorKinds map[string]int `json:"error_kinds,omitempty"` //by status code, "transport" for requests without a response
+    Misses int `json:"misses,omitempty"` //reads of missing keys, counted as successful
+    Throughput float64 `json:"throughput"`
+    LatencyMs LatencySummary `json:"latency_ms"`
+}
+
+type BenchReport struct {
+    Config BenchConfig `json:"config"`
+    Start time.Time `json:"start"`
+    ElapsedS float64 `json:"elapsed_s"`
+    TotalOps int `json:"total_ops"`
+    Throughput float64 `json:"throughput"`
+    Ops map[string]OpReport `json:"ops"`
+}
+
+const (
+    benchRead = "read"
+    benchWrite = "write"
+)
+
+//results of one worker, merged after the run
+type opStats struct {
+    latencies []time.Duration
+    errorKinds map[string]int
+    misses int
+}
+
+func errorKind(err error) string {
+    var statusErr *kvclient.Error
+    if errors.As(err, &statusErr) {
+        return strconv.Itoa(statusErr.StatusCode)
+    }
+    return "transport"
+}
+
+func randomValue(rng *rand.Rand, size int) string {
+    const letters = "abcdefghijklmnopqrstuvwxyz0123456789"
+    value := make([]byte, size)
+    for i := range value {
+        value[i] = letters[rng.Intn(len(letters))]
+    }
+    return string(value)
+}
+
+//sends the time each op is scheduled at, so latency includes the time an op waited for a free worker
+//and a slow cluster is not hidden by the workers sending less
+func pace(ctx context.Context, qps float64) <-chan time.Time {
+    schedule := make(chan time.Time, 1024)
+    go func() {
+        defer close(schedule)
+        start := time.Now()
+        ticker := time.NewTicker(time.Millisecond)
+        defer ticker.Stop()
+        sent := 0
+        for {
+            due := int(time.Since(start).Seconds() * qps) + 1
+            for ; sent < due; sent++ {
+                select {
+                case schedule <- start.Add(time.Duration(float64(sent) / qps * float64(time.Second))):
+                case <- ctx.Done():
+                    return
+                }
+            }
+            select {
+            case <- ticker.C:
+            case <- ctx.Done():
+                return
+            }
+        }
+    }()
+    return schedule
+}
+
+//upserts every key once, so reads do not miss. Recorded as ops of the client after the last worker
+func preload(kv *kvclient.Client, config BenchConfig) error {
+    const batchSize = 100
+    rng := rand.New(rand.NewSource(time.Now().UnixNano()))
+    for first := 0; first < config.Keys; first += batchSize {
+        var ops []kvclient.Op
+        for i := first; i < min(first + batchSize, config.Keys); i++ {
+            ops = append(ops, kvclient.Op{Op: "upsert", Key: config.KeyPrefix + strconv.Itoa(i), Value: randomValue(rng, config.ValueSize)})
+        }
+        ctx, cancel := context.WithTimeout(context.Background(), timeout)
+        call := time.Now()
+        results, err := kv.Batch(ctx, ops)
+        cancel()
+        //keys of the batch belong to different ranges
+        if errors.Is(err, kvclient.ErrCrossRange) {
+            results, err = upsertEach(kv, ops)
+        }
+        for i, op := range ops {
+            opErr := err
+            if err == nil {
+                opErr = results[i].Err()
+            }
+            recorder.Record(config.Concurrency, history.Operation{Op: history.OpWrite, Key: op.Key, Value: op.Value}, call, opErr)
+        }
+        if err != nil {
+            return err
+        }
+        for _, result := range results {
+            if err := result.Err(); err != nil {
+                return err
+            }
+        }
+    }
+    return nil
+}
+
+func upsertEach(kv *kvclient.Client, ops []kvclient.Op) ([]kvclient.OpResult, error) {
+    results := make([]kvclient.OpResult, len(ops))
+    for i, op := range ops {
+        ctx, cancel := context.WithTimeout(context.Background(), timeout)
+        _, err := kv.Upsert(ctx, op.Key, op.Value)
+        cancel()
+        if err != nil {
+            return nil, err
+        }
+        results[i].Status = http.StatusOK
+    }
+    return results, nil
+}
+
+func runWorker(ctx context.Context, kv *kvclient.Client, worker int, config BenchConfig, schedule <-chan time.Time, done *atomic.Int64) map[string]*opStats {
+    rng := rand.New(rand.NewSource(time.Now().UnixNano()))
+    var zipf *rand.Zipf
+    if config.KeyDist == "zipfian" {
+        zipf = rand.NewZipf(rng, config.ZipfS, 1, uint64(config.Keys - 1))
+    }
+    stats := map[string]*opStats{
+        benchRead: {errorKinds: map[string]int{}},
+        benchWrite: {errorKinds: map[string]int{}},
+    }
+
+    for {
+        scheduled := time.Now()
+        if schedule != nil {
+            var ok bool
+            if scheduled, ok = <- schedule; !ok {
+                return stats
+            }
+        }
+        if ctx.Err() != nil {
+            return stats
+        }
+
+        var key string
+        if zipf != nil {
+            key = config.KeyPrefix + strconv.FormatUint(zipf.Uint64(), 10)
+        } else {
+            key = config.KeyPrefix + strconv.Itoa(rng.Intn(config.Keys))
+        }
+        op := benchWrite
+        var err error
+        call := time.Now()
+        if rng.Float64() < config.ReadRatio {
+            op = benchRead
+            var item kvclient.Item
+            item, err = kv.Get(ctx, key)
+            recorder.Record(worker, history.Operation{Op: history.OpRead, Key: key, Value: item.Value, Found: err == nil}, call, err)
+            if errors.Is(err, kvclient.ErrNotFound) {
+                stats[op].misses++
+                err = nil
+            }
+        } else {
+            value := randomValue(rng, config.ValueSize)
+            _, err = kv.Upsert(ctx, key, value)
+            recorder.Record(worker, history.Operation{Op: history.OpWrite, Key: key, Value: value}, call, err)
+        }
+        latency := time.Since(scheduled)
+
+        //ops cut by the end of the run are not counted, but recorded with unknown outcome
+        if ctx.Err() != nil {
+            return stats
+        }
+        if err != nil {
+            logger.Debug("Op failed", "op", op, "key", key, "err", err)
+            stats[op].errorKinds[errorKind(err)]++
+        } else {
+            stats[op].latencies = append(stats[op].latencies, latency)
+        }
+        done.Add(1)
+    }
+}
+
+func toMs(duration time.Duration) float64 {
+    return float64(duration) / float64(time.Millisecond)
+}
+
+func summarize(latencies []time.Duration) LatencySummary {
+    if len(latencies) == 0 {
+        return LatencySummary{}
+    }
+    sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+    percentile := func(p float64) float64 {
+        i := int(math.Ceil(p * float64(len(latencies)))) - 1
+        return toMs(latencies[max(i, 0)])
+    }
+    var total time.Duration
+    for _, latency := range latencies {
+        total += latency
+    }
+    return LatencySummary{
+        Mean: toMs(total / time.Duration(len(latencies))),
+        P50: percentile(0.5),
+        P90: percentile(0.9),
+        P99: percentile(0.99),
+        P999: percentile(0.999),
+        Max: toMs(latencies[len(latencies) - 1]),
+    }
+}
+
+func buildReport(config BenchConfig, start time.Time, elapsed time.Duration, workers []map[string]*opStats) BenchReport {
+    report := BenchReport{Config: config, Start: start, ElapsedS: elapsed.Seconds(), Ops: map[string]OpReport{}}
+    for _, op := range []string{benchRead, benchWrite} {
+        merged := opStats{errorKinds: map[string]int{}}
+        for _, worker := range workers {
+            merged.latencies = append(merged.latencies, worker[op].latencies...)
+            merged.misses += worker[op].misses
+            for kind, count := range worker[op].errorKinds {
+                merged.errorKinds[kind] += count
+            }
+        }
+        opReport := OpReport{Count: len(merged.latencies), Misses: merged.misses, LatencyMs: summarize(merged.latencies)}
+        for _, count := range merged.errorKinds {
+            opReport.Errors += count
+        }
+        if opReport.Errors != 0 {
+            opReport.ErrorKinds = merged.errorKinds
+        }
+        opReport.Throughput = float64(opReport.Count) / elapsed.Seconds()
+        report.Ops[op] = opReport
+        report.TotalOps += opReport.Count
+    }
+    report.Throughput = float64(report.TotalOps) / elapsed.Seconds()
+    return report
+}
+
+func printReport(report BenchReport) {
+    fmt.Printf("%.1fs, %d ops, %.1f ops/s\n", report.ElapsedS, report.TotalOps, report.Throughput)
+    fmt.Printf("%-6s %9s %7s %10s %8s %8s %8s %8s %8s %8s\n", "op", "count", "errors", "ops/s", "mean", "p50", "p90", "p99", "p99.9", "max")
+    for _, op := range []string{benchRead, benchWrite} {
+        opReport := report.Ops[op]
+        latency := opReport.LatencyMs
+        fmt.Printf("%-6s %9d %7d %10.1f %8.2f %8.2f %8.2f %8.2f %8.2f %8.2f\n", op, opReport.Count, opReport.Errors, opReport.Throughput,
+            latency.Mean, latency.P50, latency.P90, latency.P99, latency.P999, latency.Max)
+    }
+    fmt.Println("latencies in ms")
+}
+
+func runBench(args []string) {
+    flags := flag.NewFlagSet("bench", flag.ExitOnError)
+    var options clientOptions
+    options.register(flags)
+    readRatio := flags.Float64("read-ratio", 0.5, "share of reads, the rest are upserts")
+    keys := flags.Int("keys", 1000, "number of distinct keys")
+    keyDist := flags.String("key-dist", "uniform", "uniform or zipfian")
+    zipfS := flags.Float64("zipf-s", 1.1, "skew of the zipfian distribution, greater than 1")
+    keyPrefix := flags.String("key-prefix", "bench/", "prefix of the keys")
+    valueSize := flags.Int("value-size", 100, "size of written values in bytes")
+    concurrency := flags.Int("concurrency", 16, "number of concurrent requests")
+    duration := flags.Duration("duration", 10 * time.Second, "duration of the run")
+    targetQps := flags.Float64("qps", 0, "target ops per second over all workers, as fast as possible if zero")
+    noPreload := flags.Bool("no-preload", false, "do not write every key before the run")
+    out := flags.String("out", "bench.json", "file for the JSON report, not written if empty")
+    flags.Usage = func() {
+        fmt.Fprintf(flags.Output(), "Usage: %s bench [flags] nodes-config\n", os.Args[0])
+        flags.PrintDefaults()
+    }
+    flags.Parse(args)
+    if flags.NArg() < 1 {
+        flags.Usage()
+        os.Exit(2)
+    }
+
+    config := BenchConfig{
+        ReadRatio: *readRatio,
+        Keys: *keys,
+        KeyDist: *keyDist,
+        KeyPrefix: *keyPrefix,
+        ValueSize: *valueSize,
+        Concurrency: *concurrency,
+        DurationS: duration.Seconds(),
+        TargetQps: *targetQps,
+        Preload: !*noPreload,
+    }
+    switch {
+    case config.ReadRatio < 0 || config.ReadRatio > 1:
+        fatal("Read ratio must be between 0 and 1")
+    case config.Keys < 1 || config.Concurrency < 1 || config.ValueSize < 0 || *duration <= 0 || config.TargetQps < 0:
+        fatal("Keys, concurrency and duration must be positive")
+    case config.KeyDist == "zipfian":
+        if *zipfS <= 1 {
+            fatal("Zipf s must be greater than 1")
+        }
+        config.ZipfS = *zipfS
+    case config.KeyDist != "uniform":
+        fatal("Unknown key distribution", "key_dist", config.KeyDist)
+    }
+
+    kv := options.newClient(flags.Arg(0))
+    timeout = time.Second * 10
+    if recorder != nil && !config.Preload {
+        logger.Warn("Keys are not preloaded, the checker assumes they do not exist before the recorded ops")
+    }
+
+    if config.Preload {
+        logger.Info("Preloading keys", "keys", config.Keys)
+        if err := preload(kv, config); err != nil {
+            fatal("Error while preloading keys", "err", err)
+        }
+    }
+
+    ctx, cancel := context.WithTimeout(context.Background(), *duration)
+    defer cancel()
+    var schedule <-chan time.Time
+    if config.TargetQps > 0 {
+        schedule = pace(ctx, config.TargetQps)
+    }
+
+    logger.Info("Starting benchmark", "config", config)
+    var done atomic.Int64
+    workers := make([]map[string]*opStats, config.Concurrency)
+    var wg sync.WaitGroup
+    start := time.Now()
+    for i := range workers {
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+            workers[i] = runWorker(ctx, kv, i, config, schedule, &done)
+        }()
+    }
+
+    go func() {
+        ticker := time.NewTicker(time.Second)
+        defer ticker.Stop()
+        last := int64(0)
+        for {
+            select {
+            case <- ticker.C:
+                total := done.Load()
+                logger.Info("Progress", "ops", total, "ops_per_s", total - last)
+                last = total
+            case <- ctx.Done():
+                return
+            }
+        }
+    }()
+
+    wg.Wait()
+    elapsed := min(time.Since(start), *duration)
+    if err := recorder.Close(); err != nil {
+        fatal("Error while writing history", "err", err)
+    }
+    report := buildReport(config, start, elapsed, workers)
+    printReport(report)
+
+    if *out != "" {
+        data, err := json.MarshalIndent(report, "", "    ")
+        if err != nil {
+            fatal("Error while encoding report", "err", err)
+        }
+        if err := os.WriteFile(*out, append(data, '\n'), 0644); err != nil {
+            fatal("Error while writing report", "err", err)
+        }
+        logger.Info("Report written", "file", *out)
+    }
+}
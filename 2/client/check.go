@@ -0,0 +1,98 @@
+package main
+
+import (
+    "flag"
+    "fmt"
+    "os"
+    "time"
+
+    "github.com/eparoshin/tors_hw/2/client/history"
+)
+
+func printViolation(violation history.Violation, start int64) {
+    fmt.Printf("key %q: not linearizable, minimal sub-history of %d of %d ops:\n", violation.Key, len(violation.Ops), violation.KeyOps)
+    for _, op := range violation.Ops {
+        returned := "?"
+        if op.Outcome != history.Unknown {
+            returned = fmt.Sprintf("%.3f", float64(op.Return - start) / float64(time.Millisecond))
+        }
+        fmt.Printf("  #%-6d %-24s [%.3f, %s]ms %s\n", op.Id, op.Client, float64(op.Call - start) / float64(time.Millisecond), returned, history.Describe(op))
+    }
+    if len(violation.Linearized) == 0 {
+        fmt.Println("  no op can be linearized first")
+        return
+    }
+    fmt.Print("  longest linearizable prefix:")
+    for _, id := range violation.Linearized {
+        fmt.Printf(" #%d", id)
+    }
+    fmt.Println(", no other op can follow it")
+}
+
+//exits with 1 if the history is not linearizable or the check timed out
+func runCheck(args []string) {
+    flags := flag.NewFlagSet("check", flag.ExitOnError)
+    timeout := flags.Duration("timeout", time.Minute, "limit for checking and minimizing each key")
+    viz := flags.String("viz", "", "HTML file for the visualization of violations")
+    maxViolations := flags.Int("max-violations", 10, "violations to print, all are checked")
+    flags.Usage = func() {
+        fmt.Fprintf(flags.Output(), "Usage: %s check [flags] history-file...\n", os.Args[0])
+        flags.PrintDefaults()
+    }
+    flags.Parse(args)
+    if flags.NArg() < 1 {
+        flags.Usage()
+        os.Exit(2)
+    }
+
+    ops, err := history.Load(flags.Args()...)
+    if err != nil {
+        fatal("Error while reading history", "err", err)
+    }
+    checkStart := time.Now()
+    result := history.Check(ops, *timeout)
+    logger.Debug("History checked", "elapsed", time.Since(checkStart))
+
+    var start int64
+    if len(ops) > 0 {
+        start = ops[0].Call
+        for _, op := range ops {
+            start = min(start, op.Call)
+        }
+    }
+    for i, violation := range result.Violations {
+        if i == *maxViolations {
+            fmt.Printf("%d more violations\n", len(result.Violations) - i)
+            break
+        }
+        printViolation(violation, start)
+    }
+    if len(result.TimedOut) != 0 {
+        fmt.Printf("check timed out for %d keys: %q\n", len(result.TimedOut), result.TimedOut)
+    }
+    switch {
+    case len(result.Violations) != 0:
+        fmt.Printf("%d ops on %d keys: not linearizable, %d keys violate\n", result.Ops, result.Keys, len(result.Violations))
+    case len(result.TimedOut) != 0:
+        fmt.Printf("%d ops on %d keys: unknown\n", result.Ops, result.Keys)
+    default:
+        fmt.Printf("%d ops on %d keys: linearizable\n", result.Ops, result.Keys)
+    }
+
+    if *viz != "" {
+        file, err := os.Create(*viz)
+        if err != nil {
+            fatal("Error while creating visualization", "err", err)
+        }
+        err = history.WriteHTML(file, result, ops)
+        if closeErr := file.Close(); err == nil {
+            err = closeErr
+        }
+        if err != nil {
+            fatal("Error while writing visualization", "err", err)
+        }
+    }
+    if !result.Ok() {
+        os.Exit(1)
+    }
+}
@@ -0,0 +1,399 @@
+package history
+
+import (
+    "math"
+    "sort"
+    "strconv"
+    "time"
+)
+
+//state of one key of the register model
+type register struct {
+    value string
+    exists bool
+}
+
+//applies op to the state, returns false if its recorded result is impossible in this state.
+//Ops with unknown outcome are applied the way the server would, they are placed last if they never happened
+func step(state register, op *Operation) (bool, register) {
+    switch op.Op {
+    case OpRead:
+        return op.Found == state.exists && (!op.Found || op.Value == state.value), state
+    case OpWrite:
+        return op.Outcome != Fail, register{value: op.Value, exists: true}
+    }
+
+    var applies bool
+    var result string
+    next := state
+    switch op.Op {
+    case OpCreate:
+        applies = !state.exists
+        next = register{value: op.Value, exists: true}
+    case OpUpdate:
+        applies = state.exists
+        next = register{value: op.Value, exists: true}
+    case OpDelete:
+        applies = state.exists
+        next = register{}
+    case OpCas:
+        applies = state.exists && state.value == op.PrevValue
+        next = register{value: op.Value, exists: true}
+    case OpDeleteIfEquals:
+        applies = state.exists && state.value == op.PrevValue
+        next = register{}
+    case OpIncrement:
+        result, applies = increment(state.value, op.Value)
+        next = register{value: result, exists: true}
+    case OpAppend:
+        applies = true
+        next = register{value: state.value + op.Value, exists: true}
+        result = strconv.Itoa(len(next.value))
+    }
+    if !applies {
+        return op.Outcome != Ok, state
+    }
+    //a successful increment or append returned the value it made
+    if op.Outcome == Ok && op.Result != result {
+        return false, state
+    }
+    return op.Outcome != Fail, next
+}
+
+//value after adding delta the way the server does, a missing or empty value counts as zero.
+//False if the value is not an integer or the result overflows
+func increment(value string, delta string) (string, bool) {
+    d, err := strconv.ParseInt(delta, 10, 64)
+    if err != nil {
+        return "", false
+    }
+    var n int64
+    if value != "" {
+        if n, err = strconv.ParseInt(value, 10, 64); err != nil {
+            return "", false
+        }
+    }
+    if (d > 0 && n > math.MaxInt64 - d) || (d < 0 && n < math.MinInt64 - d) {
+        return "", false
+    }
+    return strconv.FormatInt(n + d, 10), true
+}
+
+type bitset []uint64
+
+func newBitset(n int) bitset {
+    return make(bitset, (n + 63) / 64)
+}
+
+func (set bitset) set(i int) {
+    set[i / 64] |= 1 << (i % 64)
+}
+
+func (set bitset) clear(i int) {
+    set[i / 64] &^= 1 << (i % 64)
+}
+
+func (set bitset) clone() bitset {
+    return append(bitset(nil), set...)
+}
+
+func (set bitset) equals(other bitset) bool {
+    for i := range set {
+        if set[i] != other[i] {
+            return false
+        }
+    }
+    return true
+}
+
+func (set bitset) hash() uint64 {
+    hash := uint64(14695981039346656037)
+    for _, word := range set {
+        hash = (hash ^ word) * 1099511628211
+    }
+    return hash
+}
+
+//call or return of an op in the doubly linked list of events ordered by time
+type event struct {
+    op int
+    call bool
+    time int64
+    match *event //return of a call
+    prev *event
+    next *event
+}
+
+func buildEvents(ops []Operation) *event {
+    events := make([]*event, 0, 2 * len(ops))
+    for i := range ops {
+        ret := &event{op: i, time: ops[i].Return}
+        if ops[i].Outcome == Unknown {
+            ret.time = math.MaxInt64
+        }
+        events = append(events, &event{op: i, call: true, time: ops[i].Call, match: ret}, ret)
+    }
+    //ops returning at the same time as another one is called are concurrent with it
+    sort.SliceStable(events, func(i, j int) bool {
+        if events[i].time != events[j].time {
+            return events[i].time < events[j].time
+        }
+        return events[i].call && !events[j].call
+    })
+
+    head := &event{}
+    last := head
+    for _, e := range events {
+        last.next = e
+        e.prev = last
+        last = e
+    }
+    return head
+}
+
+//removes the call and the return of an op from the list
+func lift(call *event) {
+    call.prev.next = call.next
+    if call.next != nil {
+        call.next.prev = call.prev
+    }
+    ret := call.match
+    ret.prev.next = ret.next
+    if ret.next != nil {
+        ret.next.prev = ret.prev
+    }
+}
+
+func unlift(call *event) {
+    ret := call.match
+    ret.prev.next = ret
+    if ret.next != nil {
+        ret.next.prev = ret
+    }
+    call.prev.next = call
+    if call.next != nil {
+        call.next.prev = call
+    }
+}
+
+type cacheEntry struct {
+    linearized bitset
+    state register
+}
+
+type checkResult struct {
+    ok bool
+    timedOut bool
+    longest []int //longest partial linearization found, indices into ops
+}
+
+//Wing & Gong search with the memoization of Lowe: ops are linearized in the order of their calls while possible,
+//backtracking when an op returns before being linearized. Configurations already seen are skipped
+func checkOps(ops []Operation, deadline time.Time) checkResult {
+    head := buildEvents(ops)
+    var state register
+    linearized := newBitset(len(ops))
+    cache := map[uint64][]cacheEntry{}
+    type frame struct {
+        call *event
+        state register
+    }
+    var calls []frame
+    var result checkResult
+
+    entry := head.next
+    for steps := 0; head.next != nil; steps++ {
+        if steps % 1024 == 0 && time.Now().After(deadline) {
+            result.timedOut = true
+            return result
+        }
+        if entry.call {
+            ok, next := step(state, &ops[entry.op])
+            if ok {
+                newLinearized := linearized.clone()
+                newLinearized.set(entry.op)
+                hash := newLinearized.hash() ^ uint64(len(next.value))
+                seen := false
+                for _, cached := range cache[hash] {
+                    if cached.state == next && cached.linearized.equals(newLinearized) {
+                        seen = true
+                        break
+                    }
+                }
+                if !seen {
+                    cache[hash] = append(cache[hash], cacheEntry{linearized: newLinearized, state: next})
+                    calls = append(calls, frame{call: entry, state: state})
+                    state = next
+                    linearized.set(entry.op)
+                    lift(entry)
+                    entry = head.next
+                    continue
+                }
+            }
+            entry = entry.next
+            continue
+        }
+
+        //the op returned before it could be linearized
+        if len(calls) > len(result.longest) {
+            result.longest = result.longest[:0]
+            for _, frame := range calls {
+                result.longest = append(result.longest, frame.call.op)
+            }
+        }
+        if len(calls) == 0 {
+            return result
+        }
+        top := calls[len(calls) - 1]
+        calls = calls[:len(calls) - 1]
+        state = top.state
+        linearized.clear(top.call.op)
+        unlift(top.call)
+        entry = top.call.next
+    }
+
+    result.ok = true
+    result.longest = result.longest[:0]
+    for _, frame := range calls {
+        result.longest = append(result.longest, frame.call.op)
+    }
+    return result
+}
+
+//reports whether the values, presence and absence observed by the ops of the sub-history can still come from its
+//writes and deletes, so that minimizing does not turn a stale read into a read of a value nobody wrote
+func explained(sub []Operation, all []Operation) bool {
+    writes := func(ops []Operation, value *string, before *Operation) bool {
+        for i := range ops {
+            op := &ops[i]
+            if op.Id == before.Id || op.Call >= before.Return || op.Outcome == Fail {
+                continue
+            }
+            if op.Op != OpRead && op.Op != OpDelete && (value == nil || op.Value == *value) {
+                return true
+            }
+        }
+        return false
+    }
+    deletes := func(ops []Operation, before *Operation) bool {
+        for i := range ops {
+            if ops[i].Op == OpDelete && ops[i].Outcome != Fail && ops[i].Call < before.Return {
+                return true
+            }
+        }
+        return false
+    }
+
+    for i := range sub {
+        op := &sub[i]
+        ok := op.Outcome == Ok
+        fail := op.Outcome == Fail
+        switch {
+        case op.Op == OpRead && ok && op.Found:
+            if writes(all, &op.Value, op) && !writes(sub, &op.Value, op) {
+                return false
+            }
+        case op.Op == OpCas && ok:
+            if writes(all, &op.PrevValue, op) && !writes(sub, &op.PrevValue, op) {
+                return false
+            }
+        case (op.Op == OpDelete || op.Op == OpUpdate) && ok, op.Op == OpCreate && fail:
+            if writes(all, nil, op) && !writes(sub, nil, op) {
+                return false
+            }
+        case op.Op == OpRead && ok, op.Op == OpCreate && ok, (op.Op == OpDelete || op.Op == OpUpdate) && fail:
+            if writes(sub, nil, op) && deletes(all, op) && !deletes(sub, op) {
+                return false
+            }
+        }
+    }
+    return true
+}
+
+func without(ops []Operation, from int, to int) []Operation {
+    return append(append([]Operation(nil), ops[:from]...), ops[to:]...)
+}
+
+//removes chunks of halving size while the rest is still not linearizable, single ops are removed until none can be.
+//A write can only be removed after the reads observing it, so the last pass is repeated
+func minimize(ops []Operation, deadline time.Time) []Operation {
+    for chunk := max(len(ops) / 2, 1); ; chunk = max(chunk / 2, 1) {
+        removed := false
+        for from := 0; from < len(ops); {
+            to := min(from + chunk, len(ops))
+            rest := without(ops, from, to)
+            if time.Now().After(deadline) {
+                return ops
+            }
+            if len(rest) > 0 && explained(rest, ops) {
+                if result := checkOps(rest, deadline); !result.ok && !result.timedOut {
+                    ops = rest
+                    removed = true
+                    continue
+                }
+            }
+            from = to
+        }
+        if chunk == 1 && !removed {
+            return ops
+        }
+    }
+}
+
+type Violation struct {
+    Key string
+    KeyOps int //ops of the key in the history
+    Ops []Operation //minimal sub-history that is not linearizable, ordered by call time
+    Linearized []int //ids of the longest linearizable prefix of Ops, the next op can not be placed after it
+}
+
+type Result struct {
+    Ops int
+    Keys int
+    Violations []Violation
+    TimedOut []string //keys whose check did not finish
+}
+
+func (result Result) Ok() bool {
+    return len(result.Violations) == 0 && len(result.TimedOut) == 0
+}
+
+//checks every key on its own, keys of a linearizable history are independent registers.
+//Failed reads are ignored, timeout limits the check and the minimization of each key
+func Check(ops []Operation, timeout time.Duration) Result {
+    byKey := map[string][]Operation{}
+    var keys []string
+    for _, op := range ops {
+        if op.Op == OpRead && op.Outcome != Ok {
+            continue
+        }
+        if _, ok := byKey[op.Key]; !ok {
+            keys = append(keys, op.Key)
+        }
+        byKey[op.Key] = append(byKey[op.Key], op)
+    }
+    sort.Strings(keys)
+
+    result := Result{Ops: len(ops), Keys: len(keys)}
+    for _, key := range keys {
+        keyOps := byKey[key]
+        deadline := time.Now().Add(timeout)
+        check := checkOps(keyOps, deadline)
+        if check.timedOut {
+            result.TimedOut = append(result.TimedOut, key)
+            continue
+        }
+        if check.ok {
+            continue
+        }
+
+        minimal := minimize(keyOps, deadline)
+        sort.SliceStable(minimal, func(i, j int) bool { return minimal[i].Call < minimal[j].Call })
+        violation := Violation{Key: key, KeyOps: len(keyOps), Ops: minimal}
+        for _, i := range checkOps(minimal, time.Now().Add(timeout)).longest {
+            violation.Linearized = append(violation.Linearized, minimal[i].Id)
+        }
+        result.Violations = append(result.Violations, violation)
+    }
+    return result
+}
@@ -0,0 +1,166 @@
+package history
+
+import (
+    "fmt"
+    "net/http"
+    "testing"
+    "time"
+
+    "github.com/eparoshin/tors_hw/2/client/kvclient"
+)
+
+//ops of one key with call and return in ms, ids are their indices
+func history(ops ...Operation) []Operation {
+    for i := range ops {
+        ops[i].Id = i
+        ops[i].Key = "k"
+        ops[i].Call *= int64(time.Millisecond)
+        ops[i].Return *= int64(time.Millisecond)
+    }
+    return ops
+}
+
+func write(value string, call int64, ret int64) Operation {
+    return Operation{Op: OpWrite, Value: value, Call: call, Return: ret, Outcome: Ok}
+}
+
+func read(value string, call int64, ret int64) Operation {
+    return Operation{Op: OpRead, Value: value, Found: true, Call: call, Return: ret, Outcome: Ok}
+}
+
+func cas(prev string, value string, call int64, ret int64, outcome string) Operation {
+    return Operation{Op: OpCas, PrevValue: prev, Value: value, Call: call, Return: ret, Outcome: outcome}
+}
+
+func deadline() time.Time {
+    return time.Now().Add(10 * time.Second)
+}
+
+func TestLinearizable(t *testing.T) {
+    ops := history(
+        write("1", 0, 10),
+        read("1", 5, 15), //overlaps the write, so it may see it
+        write("2", 20, 30),
+        read("1", 25, 35), //overlaps the second write, so it may still see the first one
+        read("2", 40, 50),
+    )
+    if result := checkOps(ops, deadline()); !result.ok || result.timedOut {
+        t.Fatalf("History is not linearizable: %+v", result)
+    }
+    if len(checkOps(ops, deadline()).longest) != len(ops) {
+        t.Fatalf("Linearization does not have all ops")
+    }
+}
+
+func TestStaleRead(t *testing.T) {
+    ops := history(
+        write("0", 0, 5),
+        write("1", 10, 15),
+        read("1", 12, 18),
+        write("2", 20, 30),
+        read("1", 40, 50), //the second write returned before the read was called
+    )
+    result := checkOps(ops, deadline())
+    if result.ok || result.timedOut {
+        t.Fatalf("Stale read is linearizable: %+v", result)
+    }
+
+    //the first write explains the stale read and the second one makes it stale, the rest is not needed
+    minimal := minimize(ops, deadline())
+    var ids []int
+    for _, op := range minimal {
+        ids = append(ids, op.Id)
+    }
+    if fmt.Sprint(ids) != "[1 3 4]" {
+        t.Fatalf("Unexpected minimal history %v", ids)
+    }
+}
+
+func TestExplained(t *testing.T) {
+    ops := history(
+        write("1", 0, 10),
+        write("2", 20, 30),
+        read("1", 40, 50),
+    )
+    if !explained(ops, ops) {
+        t.Fatalf("Whole history is not explained")
+    }
+    //without the first write the read sees a value nobody wrote
+    if explained(without(ops, 0, 1), ops) {
+        t.Fatalf("Read of a removed write is explained")
+    }
+    if !explained(without(ops, 1, 2), ops) {
+        t.Fatalf("Read of a kept write is not explained")
+    }
+}
+
+func TestUnknownCas(t *testing.T) {
+    for _, c := range []struct {
+        name string
+        outcome string
+        observed string
+        ok bool
+    }{
+        {"unknown cas applied", Unknown, "2", true},
+        {"unknown cas not applied", Unknown, "1", true},
+        {"failed cas applied", Fail, "2", false},
+        {"successful cas not applied", Ok, "1", false},
+    } {
+        t.Run(c.name, func(t *testing.T) {
+            ops := history(
+                write("1", 0, 10),
+                cas("1", "2", 20, 30, c.outcome),
+                read(c.observed, 40, 50),
+            )
+            if result := checkOps(ops, deadline()); result.ok != c.ok || result.timedOut {
+                t.Fatalf("Expected linearizable %v, got %+v", c.ok, result)
+            }
+        })
+    }
+}
+
+func TestOutcome(t *testing.T) {
+    conflict := &kvclient.Error{StatusCode: http.StatusConflict, Message: "Entry already exists"}
+    maybe := fmt.Errorf("%w: %w", kvclient.ErrMaybeApplied, &kvclient.Error{StatusCode: http.StatusServiceUnavailable})
+    for _, c := range []struct {
+        op string
+        err error
+        outcome string
+    }{
+        {OpCreate, nil, Ok},
+        {OpCreate, conflict, Fail},
+        {OpCreate, fmt.Errorf("%w: %w", kvclient.ErrMaybeApplied, conflict), Unknown},
+        {OpWrite, maybe, Unknown},
+        {OpCas, maybe, Unknown},
+    } {
+        if got := outcome(c.op, c.err); got != c.outcome {
+            t.Errorf("Outcome of %s with %v is %s, expected %s", c.op, c.err, got, c.outcome)
+        }
+    }
+}
+
+func TestCounterOps(t *testing.T) {
+    op := func(name string, value string, result string, call int64, ret int64) Operation {
+        return Operation{Op: name, Value: value, Result: result, Call: call, Return: ret, Outcome: Ok}
+    }
+    for _, c := range []struct {
+        name string
+        ops []Operation
+        ok bool
+    }{
+        {"increment of a missing key", []Operation{op(OpIncrement, "5", "5", 0, 10), read("5", 20, 30)}, true},
+        {"concurrent increments", []Operation{op(OpIncrement, "1", "2", 0, 10), op(OpIncrement, "1", "1", 0, 10)}, true},
+        {"increment lost", []Operation{op(OpIncrement, "1", "1", 0, 10), op(OpIncrement, "1", "1", 20, 30)}, false},
+        {"increment of a string", []Operation{write("a", 0, 10), {Op: OpIncrement, Value: "1", Call: 20, Return: 30, Outcome: Fail}}, true},
+        {"append returns the length", []Operation{write("ab", 0, 10), op(OpAppend, "cd", "4", 20, 30), read("abcd", 40, 50)}, true},
+        {"append of a wrong length", []Operation{write("ab", 0, 10), op(OpAppend, "cd", "2", 20, 30)}, false},
+        {"delete if equals", []Operation{write("1", 0, 10), {Op: OpDeleteIfEquals, PrevValue: "1", Call: 20, Return: 30, Outcome: Ok}, {Op: OpRead, Call: 40, Return: 50, Outcome: Ok}}, true},
+        {"delete if equals of another value", []Operation{write("1", 0, 10), {Op: OpDeleteIfEquals, PrevValue: "2", Call: 20, Return: 30, Outcome: Ok}}, false},
+    } {
+        t.Run(c.name, func(t *testing.T) {
+            if result := checkOps(history(c.ops...), deadline()); result.ok != c.ok || result.timedOut {
+                t.Fatalf("Expected linearizable %v, got %+v", c.ok, result)
+            }
+        })
+    }
+}
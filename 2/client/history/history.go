@@ -0,0 +1,172 @@
+//Package history records the operations of KV clients and checks that they are linearizable.
+package history
+
+import (
+    "bufio"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "os"
+    "sync"
+    "time"
+
+    "github.com/eparoshin/tors_hw/2/client/kvclient"
+)
+
+const (
+    OpRead = "read"
+    OpWrite = "write" //stores the value whether the key exists or not
+    OpCreate = "create"
+    OpUpdate = "update"
+    OpDelete = "delete"
+    OpCas = "cas"
+    OpDeleteIfEquals = "delete_if_equals"
+    OpIncrement = "increment" //Value has the delta
+    OpAppend = "append"
+)
+
+const (
+    Ok = "ok"
+    Fail = "fail" //definitely had no effect
+    Unknown = "unknown" //may or may not have taken effect
+)
+
+type Operation struct {
+    Id int `json:"-"` //index in the loaded history
+    Client string `json:"client"`
+    Op string `json:"op"`
+    Key string `json:"key"`
+    Value string `json:"value,omitempty"` //written value, or the value read
+    PrevValue string `json:"prev_value,omitempty"` //for cas and delete_if_equals
+    Result string `json:"result,omitempty"` //new value of a successful increment, new length of a successful append
+    Found bool `json:"found,omitempty"` //for reads
+    Call int64 `json:"call"` //unix ns
+    Return int64 `json:"return"` //unix ns
+    Outcome string `json:"outcome"`
+}
+
+//failure of each op that means the op had no effect, other errors make the outcome unknown
+var failErrors = map[string]error{
+    OpCreate: kvclient.ErrConflict,
+    OpUpdate: kvclient.ErrNotFound,
+    OpDelete: kvclient.ErrNotFound,
+    OpCas: kvclient.ErrNotFound,
+    OpDeleteIfEquals: kvclient.ErrConflict,
+    OpIncrement: kvclient.ErrConflict, //the value is not an integer or the result overflows
+}
+
+func outcome(op string, err error) string {
+    if err == nil {
+        return Ok
+    }
+    //an attempt reached a node before the failure, so even a conflict may come from it
+    if errors.Is(err, kvclient.ErrMaybeApplied) {
+        return Unknown
+    }
+    if failErr, ok := failErrors[op]; ok && errors.Is(err, failErr) {
+        return Fail
+    }
+    return Unknown
+}
+
+//appends operations to a JSON lines file, safe for concurrent use. A nil recorder records nothing.
+//The client retries writes only when the earlier attempts were not applied, so their failures are definite
+type Recorder struct {
+    m sync.Mutex
+    file *os.File
+    buffer []byte //whole lines, so that several processes can share the file
+    prefix string
+}
+
+//clients of several processes may record into the same file
+func NewRecorder(fileName string) (*Recorder, error) {
+    file, err := os.OpenFile(fileName, os.O_WRONLY | os.O_APPEND | os.O_CREATE, 0644)
+    if err != nil {
+        return nil, err
+    }
+    host, _ := os.Hostname()
+    return &Recorder{file: file, prefix: fmt.Sprintf("%s-%d", host, os.Getpid())}, nil
+}
+
+//records op invoked at call by the given client of this process and completed now with err.
+//Ops of one client must not overlap. For reads the caller sets Value and Found, not found is a successful read
+func (recorder *Recorder) Record(client int, op Operation, call time.Time, err error) {
+    if recorder == nil {
+        return
+    }
+    op.Client = fmt.Sprintf("%s/%d", recorder.prefix, client)
+    op.Call = call.UnixNano()
+    op.Return = time.Now().UnixNano()
+    if op.Op == OpRead && errors.Is(err, kvclient.ErrNotFound) {
+        err = nil
+        op.Found = false
+    }
+    op.Outcome = outcome(op.Op, err)
+    if op.Outcome != Ok {
+        op.Result = ""
+    }
+    data, _ := json.Marshal(op)
+
+    recorder.m.Lock()
+    defer recorder.m.Unlock()
+    recorder.buffer = append(append(recorder.buffer, data...), '\n')
+    if len(recorder.buffer) > 64 << 10 {
+        recorder.flush()
+    }
+}
+
+func (recorder *Recorder) flush() error {
+    _, err := recorder.file.Write(recorder.buffer)
+    recorder.buffer = recorder.buffer[:0]
+    return err
+}
+
+func (recorder *Recorder) Flush() error {
+    if recorder == nil {
+        return nil
+    }
+    recorder.m.Lock()
+    defer recorder.m.Unlock()
+    return recorder.flush()
+}
+
+func (recorder *Recorder) Close() error {
+    if recorder == nil {
+        return nil
+    }
+    recorder.m.Lock()
+    defer recorder.m.Unlock()
+    if err := recorder.flush(); err != nil {
+        recorder.file.Close()
+        return err
+    }
+    return recorder.file.Close()
+}
+
+//reads the operations of the given files, ids are assigned in order
+func Load(fileNames ...string) ([]Operation, error) {
+    var ops []Operation
+    for _, fileName := range fileNames {
+        file, err := os.Open(fileName)
+        if err != nil {
+            return nil, err
+        }
+        scanner := bufio.NewScanner(file)
+        scanner.Buffer(nil, 64 << 20)
+        for line := 1; scanner.Scan(); line++ {
+            var op Operation
+            if err := json.Unmarshal(scanner.Bytes(), &op); err != nil {
+                file.Close()
+                return nil, fmt.Errorf("%s:%d: %w", fileName, line, err)
+            }
+            op.Id = len(ops)
+            ops = append(ops, op)
+        }
+        err = scanner.Err()
+        file.Close()
+        if err != nil {
+            return nil, err
+        }
+    }
+    return ops, nil
+}
@@ -0,0 +1,192 @@
+package history
+
+import (
+    "fmt"
+    "html/template"
+    "io"
+    "sort"
+    "time"
+)
+
+const (
+    vizLaneHeight = 40
+    vizStep = 70 //horizontal space between two consecutive event times
+    vizMargin = 180
+)
+
+type vizOp struct {
+    X, Y, Width int
+    Label string
+    Details string
+    Class string
+    Order int //position in the longest linearization, zero if not linearized
+}
+
+type vizViolation struct {
+    Key string
+    KeyOps int
+    Width, Height int
+    Lanes []vizLane
+    Ops []vizOp
+}
+
+type vizLane struct {
+    Y int
+    Client string
+}
+
+func shorten(value string) string {
+    runes := []rune(value)
+    if len(runes) > 10 {
+        return string(runes[:9]) + "…"
+    }
+    return value
+}
+
+//short description of the op and its result
+func Describe(op Operation) string {
+    var text string
+    switch op.Op {
+    case OpRead:
+        if op.Found {
+            text = "read → " + shorten(op.Value)
+        } else {
+            text = "read → none"
+        }
+    case OpCas:
+        text = fmt.Sprintf("cas %s → %s", shorten(op.PrevValue), shorten(op.Value))
+    case OpDelete:
+        text = "delete"
+    case OpDeleteIfEquals:
+        text = "delete if " + shorten(op.PrevValue)
+    case OpIncrement, OpAppend:
+        text = op.Op + " " + shorten(op.Value)
+        if op.Result != "" {
+            text += " → " + op.Result
+        }
+    default:
+        text = op.Op + " " + shorten(op.Value)
+    }
+    if op.Outcome != Ok {
+        text += " (" + op.Outcome + ")"
+    }
+    return text
+}
+
+func relativeMs(ns int64, start int64) float64 {
+    return float64(ns - start) / float64(time.Millisecond)
+}
+
+//one lane per client, time is compressed so that consecutive distinct call and return times are evenly spaced,
+//only the order of the events matters for linearizability
+func layoutViolation(violation Violation, start int64) vizViolation {
+    var times []int64
+    lanes := map[string]int{}
+    viz := vizViolation{Key: violation.Key, KeyOps: violation.KeyOps}
+    for _, op := range violation.Ops {
+        times = append(times, op.Call)
+        if op.Outcome != Unknown {
+            times = append(times, op.Return)
+        }
+        if _, ok := lanes[op.Client]; !ok {
+            lanes[op.Client] = len(lanes)
+            viz.Lanes = append(viz.Lanes, vizLane{Y: 20 + len(viz.Lanes) * vizLaneHeight, Client: op.Client})
+        }
+    }
+    sort.Slice(times, func(i, j int) bool { return times[i] < times[j] })
+    position := map[int64]int{}
+    for _, t := range times {
+        if _, ok := position[t]; !ok {
+            position[t] = vizMargin + len(position) * vizStep
+        }
+    }
+    end := vizMargin + len(position) * vizStep
+
+    order := map[int]int{}
+    for i, id := range violation.Linearized {
+        order[id] = i + 1
+    }
+    for _, op := range violation.Ops {
+        x := position[op.Call]
+        width := end - x
+        class := "unknown"
+        if op.Outcome != Unknown {
+            width = position[op.Return] - x
+            class = "pending"
+        }
+        if order[op.Id] != 0 {
+            class = "linearized"
+        }
+        viz.Ops = append(viz.Ops, vizOp{
+            X: x,
+            Y: 20 + lanes[op.Client] * vizLaneHeight + 8,
+            Width: max(width, 6),
+            Label: Describe(op),
+            Details: fmt.Sprintf("#%d %s %q by %s, %.3fms - %.3fms, %s", op.Id, Describe(op), op.Key, op.Client,
+                relativeMs(op.Call, start), relativeMs(op.Return, start), op.Outcome),
+            Class: class,
+            Order: order[op.Id],
+        })
+    }
+    viz.Width = end + 40
+    viz.Height = 20 + len(lanes) * vizLaneHeight + 10
+    return viz
+}
+
+var vizTemplate = template.Must(template.New("viz").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Linearizability check</title>
+<style>
+body { font-family: sans-serif; font-size: 13px; }
+rect.linearized { fill: #b7e1b0; stroke: #3a7d32; }
+rect.pending { fill: #f4b6b6; stroke: #a33; }
+rect.unknown { fill: #eee; stroke: #999; stroke-dasharray: 4 3; }
+text.lane { fill: #555; }
+text.order { font-weight: bold; }
+</style>
+</head>
+<body>
+<h1>{{if .Violations}}Not linearizable{{else if .TimedOut}}Check timed out{{else}}Linearizable{{end}}</h1>
+<p>{{.Ops}} ops on {{.Keys}} keys.{{if .TimedOut}} Timed out keys: {{range .TimedOut}}{{.}} {{end}}{{end}}</p>
+{{if .Violations}}
+<p>Each key shows a minimal sub-history that is not linearizable. Green ops form the longest linearizable prefix,
+numbered in linearization order, no red op can follow it. Dashed ops failed with an unknown outcome,
+they may take effect at any time after their call. Hover an op for details.</p>
+{{end}}
+{{range .Violations}}
+<h2>Key {{printf "%q" .Key}}, {{len .Ops}} of {{.KeyOps}} ops</h2>
+<svg width="{{.Width}}" height="{{.Height}}">
+{{range .Lanes}}<text class="lane" x="4" y="{{.Y}}" dy="22">{{.Client}}</text>
+{{end}}
+{{range .Ops}}<g>
+<title>{{.Details}}</title>
+<rect class="{{.Class}}" x="{{.X}}" y="{{.Y}}" width="{{.Width}}" height="22" rx="3"></rect>
+<text x="{{.X}}" y="{{.Y}}" dx="4" dy="15">{{if .Order}}<tspan class="order">{{.Order}}.</tspan> {{end}}{{.Label}}</text>
+</g>
+{{end}}
+</svg>
+{{end}}
+</body>
+</html>
+`))
+
+//writes an HTML page with a timeline of every violation
+func WriteHTML(w io.Writer, result Result, ops []Operation) error {
+    var start int64
+    if len(ops) > 0 {
+        start = ops[0].Call
+        for _, op := range ops {
+            start = min(start, op.Call)
+        }
+    }
+    data := struct {
+        Result
+        Violations []vizViolation
+    }{Result: result}
+    for _, violation := range result.Violations {
+        data.Violations = append(data.Violations, layoutViolation(violation, start))
+    }
+    return vizTemplate.Execute(w, data)
+}
@@ -0,0 +1,123 @@
+package kvclient
+
+import (
+    "context"
+    "encoding/json"
+    "fmt"
+    "net/url"
+    "strconv"
+)
+
+const (
+    RoleVoter = "voter"
+    RoleLearner = "learner"
+    RoleRemoved = "removed"
+)
+
+type Member struct {
+    NodeId uint64 `json:"node_id"`
+    ExternalUri string `json:"external_uri"`
+    InternalUri string `json:"internal_uri"`
+    Role string `json:"role"`
+    Leader bool `json:"leader"`
+    MatchIndex uint64 `json:"match_index"`
+    SinceLastHBMs *int64 `json:"since_last_hb_ms"`
+}
+
+//members with their roles as the leader sees them
+func (client *Client) Members(ctx context.Context) ([]Member, error) {
+    var members []Member
+    _, err := client.do(ctx, jsonRequest("GET", "/admin/members", nil, true), &members)
+    return members, err
+}
+
+//voters have to catch up with the leader first, ErrConflict is returned otherwise
+func (client *Client) SetRole(ctx context.Context, nodeId int, role string) error {
+    _, err := client.do(ctx, jsonRequest("PUT", fmt.Sprintf("/admin/members/%d", nodeId), map[string]string{"role": role}, true), nil)
+    return err
+}
+
+//hands leadership to the given voter, or to any up to date one if nodeId is -1
+func (client *Client) TransferLeadership(ctx context.Context, nodeId int) error {
+    path := "/admin/transfer-leadership"
+    if nodeId >= 0 {
+        path += "?to=" + strconv.Itoa(nodeId)
+    }
+    _, err := client.do(ctx, jsonRequest("POST", path, nil, true), nil)
+    if err == nil {
+        client.leader.Store(-1)
+    }
+    return err
+}
+
+type SnapshotInfo struct {
+    Index uint64 `json:"index"`
+    Term uint64 `json:"term"`
+    Items int `json:"items"`
+    Compacted uint64 `json:"compacted"`
+}
+
+//snapshots the state machine of the node and compacts its log
+func (client *Client) Snapshot(ctx context.Context, nodeId int) (SnapshotInfo, error) {
+    var info SnapshotInfo
+    err := client.doNode(ctx, nodeId, "POST", "/admin/snapshot", &info)
+    return info, err
+}
+
+type StateHash struct {
+    NodeId uint64 `json:"node_id"`
+    Index uint64 `json:"index"`
+    Hash string `json:"hash"`
+    Items int `json:"items"`
+}
+
+//hash of the state machine of the node after applying the log up to index, 0 for its current state.
+//ErrConflict means the node has not committed index yet and ErrCompacted that its log starts after index
+func (client *Client) StateHash(ctx context.Context, nodeId int, index uint64) (StateHash, error) {
+    var hash StateHash
+    query := url.Values{}
+    if index > 0 {
+        query.Set("index", strconv.FormatUint(index, 10))
+    }
+    err := client.doNode(ctx, nodeId, "GET", "/admin/hash?" + query.Encode(), &hash)
+    return hash, err
+}
+
+//state machine of the leader, items are kept as the server encodes them so the backup can be written out as is
+type Backup struct {
+    Index uint64 `json:"index"`
+    Term uint64 `json:"term"`
+    Items []json.RawMessage `json:"items"`
+}
+
+//consistent copy of the state applied on the leader, for starting a new cluster with -restore-from
+func (client *Client) Backup(ctx context.Context) (Backup, error) {
+    var backup Backup
+    _, err := client.do(ctx, jsonRequest("GET", "/admin/backup", nil, true), &backup)
+    return backup, err
+}
+
+type Range struct {
+    Id uint64 `json:"id"`
+    Start string `json:"start"`
+    End string `json:"end"`
+    LeaderId *uint64 `json:"leader_id"`
+    Ready bool `json:"ready"`
+    AppliedIndex uint64 `json:"applied_index"`
+    Keys int `json:"keys"`
+    Size int64 `json:"size"`
+}
+
+//routing table with the replicas kept by the node
+func (client *Client) Ranges(ctx context.Context, nodeId int) ([]Range, error) {
+    var ranges []Range
+    err := client.doNode(ctx, nodeId, "GET", "/admin/ranges", &ranges)
+    return ranges, err
+}
+
+//splits the range holding the key, the key starts the new range. ErrConflict means a range already starts at it
+func (client *Client) Split(ctx context.Context, key string) (Range, error) {
+    var rng Range
+    _, err := client.do(ctx, jsonRequest("POST", "/admin/ranges/split?key=" + url.QueryEscape(key), nil, true), &rng)
+    return rng, err
+}
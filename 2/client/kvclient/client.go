@@ -0,0 +1,424 @@
+//Package kvclient is a client for the external API of the Raft KV cluster.
+//It finds and caches the leader, follows redirects and retries with backoff when nodes are unavailable.
+//Writes are retried only when they certainly were not applied, otherwise they fail with ErrMaybeApplied.
+package kvclient
+
+import (
+    "bytes"
+    "context"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io"
+    "log/slog"
+    "math/rand"
+    "net"
+    "net/http"
+    "net/url"
+    "os"
+    "strconv"
+    "sync/atomic"
+    "time"
+)
+
+type Node struct {
+    Host string `json:"host"`
+    InternalPort int `json:"internal_port"`
+    ExternalPort int `json:"external_port"`
+    TLS bool `json:"tls"`
+}
+
+func (node Node) ExternalUri() string {
+    if node.TLS {
+        return fmt.Sprintf("https://%s:%d", node.Host, node.ExternalPort)
+    }
+    return fmt.Sprintf("http://%s:%d", node.Host, node.ExternalPort)
+}
+
+//reads the nodes config used by the servers
+func LoadNodes(fileName string) ([]Node, error) {
+    data, err := os.ReadFile(fileName)
+    if err != nil {
+        return nil, err
+    }
+    var nodes []Node
+    err = json.Unmarshal(data, &nodes)
+    return nodes, err
+}
+
+type Config struct {
+    Nodes []Node
+    HTTPClient *http.Client //its redirect policy is replaced, http.DefaultClient transport is used if nil
+    Token string //bearer token for clusters with auth enabled
+    MaxAttempts int //attempts per call including redirects, 10 if zero
+    MinBackoff time.Duration //50ms if zero
+    MaxBackoff time.Duration //2s if zero
+    Logger *slog.Logger
+}
+
+type Client struct {
+    nodes []Node
+    http *http.Client
+    token string
+    maxAttempts int
+    minBackoff time.Duration
+    maxBackoff time.Duration
+    logger *slog.Logger
+    leader *atomic.Int64 //index of the last node that accepted a write, -1 if unknown
+    pinned int //node tried first by every call, -1 for none
+}
+
+func New(config Config) (*Client, error) {
+    if len(config.Nodes) == 0 {
+        return nil, errors.New("No nodes configured")
+    }
+
+    httpClient := &http.Client{}
+    if config.HTTPClient != nil {
+        *httpClient = *config.HTTPClient
+    }
+    //redirects are followed by the client itself to learn the leader
+    httpClient.CheckRedirect = func(*http.Request, []*http.Request) error {
+        return http.ErrUseLastResponse
+    }
+
+    client := &Client{
+        nodes: config.Nodes,
+        http: httpClient,
+        token: config.Token,
+        maxAttempts: config.MaxAttempts,
+        minBackoff: config.MinBackoff,
+        maxBackoff: config.MaxBackoff,
+        logger: config.Logger,
+        leader: &atomic.Int64{},
+        pinned: -1,
+    }
+    if client.maxAttempts == 0 {
+        client.maxAttempts = 10
+    }
+    if client.minBackoff == 0 {
+        client.minBackoff = 50 * time.Millisecond
+    }
+    if client.maxBackoff == 0 {
+        client.maxBackoff = 2 * time.Second
+    }
+    if client.logger == nil {
+        client.logger = slog.Default()
+    }
+    client.leader.Store(-1)
+    return client, nil
+}
+
+//returns a client sending requests to the given node first, it shares the leader cache with the original one.
+//Servers still redirect reads from the leader and writes to the leader
+func (client *Client) Node(nodeId int) *Client {
+    pinned := *client
+    pinned.pinned = nodeId
+    return &pinned
+}
+
+func (client *Client) Nodes() []Node {
+    return client.nodes
+}
+
+//index of the cached leader, -1 if unknown
+func (client *Client) Leader() int {
+    return int(client.leader.Load())
+}
+
+var (
+    ErrNotFound = errors.New("Not found")
+    ErrConflict = errors.New("Conflict")
+    ErrUnauthorized = errors.New("Unauthorized")
+    ErrForbidden = errors.New("Permission denied")
+    ErrTooLarge = errors.New("Request too large")
+    ErrNoSpace = errors.New("Space quota exceeded")
+    ErrTooManyRequests = errors.New("Too many requests")
+    ErrUnavailable = errors.New("Node unavailable")
+    ErrNotLeader = errors.New("Leader not found")
+    ErrCompacted = errors.New("Log index compacted")
+    ErrCrossRange = errors.New("Keys belong to different ranges")
+    //the write reached a node but failed without a known outcome, it is not retried because it could be applied twice.
+    //The error wraps the cause too
+    ErrMaybeApplied = errors.New("Write may have been applied")
+)
+
+//codes servers send with errors of writes that were certainly not applied: the write was rejected before it was
+//appended to the log, or its key moved to another range before it was applied
+var notAppliedCodes = map[string]bool{
+    "too_many_pending": true,
+    "wrong_range": true,
+    "shutting_down": true,
+    "not_leader": true,
+}
+
+func notApplied(err error) bool {
+    var serverErr *Error
+    return errors.As(err, &serverErr) && (serverErr.StatusCode == http.StatusTooManyRequests || notAppliedCodes[serverErr.Code])
+}
+
+//the connection failed, so the request never reached the node
+func dialError(err error) bool {
+    var opErr *net.OpError
+    return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+var statusErrors = map[int]error{
+    http.StatusNotFound: ErrNotFound,
+    http.StatusConflict: ErrConflict,
+    http.StatusUnauthorized: ErrUnauthorized,
+    http.StatusForbidden: ErrForbidden,
+    http.StatusRequestEntityTooLarge: ErrTooLarge,
+    http.StatusInsufficientStorage: ErrNoSpace,
+    http.StatusTooManyRequests: ErrTooManyRequests,
+    http.StatusServiceUnavailable: ErrUnavailable,
+    http.StatusBadGateway: ErrUnavailable,
+    http.StatusGatewayTimeout: ErrUnavailable,
+    http.StatusGone: ErrCompacted,
+    http.StatusUnprocessableEntity: ErrCrossRange,
+}
+
+//error response of a server, errors.Is matches it with the Err* value for its status
+type Error struct {
+    StatusCode int
+    Message string
+    Code string //machine readable kind of the error, empty if the server sent none
+}
+
+func (err *Error) Error() string {
+    return fmt.Sprintf("%d %s: %s", err.StatusCode, http.StatusText(err.StatusCode), err.Message)
+}
+
+func (err *Error) Is(target error) bool {
+    return statusErrors[err.StatusCode] == target
+}
+
+func responseError(statusCode int, body []byte) error {
+    var errorResponse struct {
+        Error string `json:"error"`
+        Code string `json:"code"`
+    }
+    message := string(bytes.TrimSpace(body))
+    if json.Unmarshal(body, &errorResponse) == nil && errorResponse.Error != "" {
+        message = errorResponse.Error
+    }
+    return &Error{StatusCode: statusCode, Message: message, Code: errorResponse.Code}
+}
+
+func retryable(statusCode int) bool {
+    return errors.Is(&Error{StatusCode: statusCode}, ErrUnavailable) || statusCode == http.StatusTooManyRequests
+}
+
+type request struct {
+    method string
+    path string //with the query
+    body []byte
+    header http.Header
+    write bool //writes go to the leader
+}
+
+func (client *Client) firstNode(write bool) int {
+    if client.pinned >= 0 {
+        return client.pinned
+    }
+    if leader := client.leader.Load(); write && leader >= 0 {
+        return int(leader)
+    }
+    return rand.Intn(len(client.nodes))
+}
+
+func (client *Client) nodeByUrl(uri *url.URL) int {
+    for i, node := range client.nodes {
+        if uri.Host == fmt.Sprintf("%s:%d", node.Host, node.ExternalPort) {
+            return i
+        }
+    }
+    return -1
+}
+
+func (client *Client) backoff(ctx context.Context, attempt int, retryAfter time.Duration) error {
+    wait := client.minBackoff << min(attempt, 16)
+    wait = time.Duration(rand.Int63n(int64(min(wait, client.maxBackoff)) + 1))
+    wait = max(wait, min(retryAfter, client.maxBackoff))
+    timer := time.NewTimer(wait)
+    defer timer.Stop()
+    select {
+    case <- timer.C:
+        return nil
+    case <- ctx.Done():
+        return ctx.Err()
+    }
+}
+
+//sends the request following redirects, transport errors and unavailable nodes are retried on other nodes.
+//Writes are retried only if they were not delivered or were rejected before the log. Returns the response of the node that served it
+func (client *Client) send(ctx context.Context, req request) (*http.Response, error) {
+    nodeId := client.firstNode(req.write)
+    uri := client.nodes[nodeId].ExternalUri() + req.path
+    var lastErr error = ErrNotLeader
+    for attempt := 0; attempt < client.maxAttempts; attempt++ {
+        httpReq, err := http.NewRequestWithContext(ctx, req.method, uri, bytes.NewReader(req.body))
+        if err != nil {
+            return nil, err
+        }
+        for name, values := range req.header {
+            httpReq.Header[name] = values
+        }
+        if client.token != "" {
+            httpReq.Header.Set("Authorization", "Bearer " + client.token)
+        }
+
+        client.logger.Debug("Sending request", "method", req.method, "url", uri, "attempt", attempt)
+        resp, err := client.http.Do(httpReq)
+        if err != nil {
+            if ctx.Err() != nil {
+                return nil, ctx.Err()
+            }
+            if req.write && !dialError(err) {
+                client.leader.Store(-1)
+                return nil, fmt.Errorf("%w: %w", ErrMaybeApplied, err)
+            }
+            client.logger.Warn("Request failed, retrying with random node", "url", uri, "err", err)
+            lastErr = err
+            client.leader.Store(-1)
+        } else if location := resp.Header.Get("Location"); resp.StatusCode >= 300 && resp.StatusCode < 400 && location != "" {
+            io.Copy(io.Discard, resp.Body)
+            resp.Body.Close()
+            next, err := httpReq.URL.Parse(location)
+            if err != nil {
+                return nil, err
+            }
+            client.logger.Debug("Redirect", "url", uri, "location", next.String())
+            uri = next.String()
+            //nodes redirect to a random node while there is no leader, give the election some time
+            if attempt >= len(client.nodes) {
+                if err := client.backoff(ctx, attempt, 0); err != nil {
+                    return nil, err
+                }
+            }
+            continue
+        } else if retryable(resp.StatusCode) {
+            body, _ := io.ReadAll(resp.Body)
+            resp.Body.Close()
+            lastErr = responseError(resp.StatusCode, body)
+            if resp.StatusCode != http.StatusTooManyRequests {
+                client.leader.Store(-1)
+            }
+            if req.write && !notApplied(lastErr) {
+                return nil, fmt.Errorf("%w: %w", ErrMaybeApplied, lastErr)
+            }
+            client.logger.Warn("Node unavailable, retrying", "url", uri, "err", lastErr)
+            seconds, _ := strconv.Atoi(resp.Header.Get("Retry-After"))
+            if err := client.backoff(ctx, attempt, time.Duration(seconds) * time.Second); err != nil {
+                return nil, err
+            }
+            //overloaded leader is retried, other errors move to a random node
+            if resp.StatusCode == http.StatusTooManyRequests {
+                continue
+            }
+            uri = client.nodes[rand.Intn(len(client.nodes))].ExternalUri() + req.path
+            continue
+        } else {
+            if req.write {
+                if nodeId := client.nodeByUrl(resp.Request.URL); nodeId >= 0 {
+                    client.leader.Store(int64(nodeId))
+                }
+            }
+            return resp, nil
+        }
+
+        if err := client.backoff(ctx, attempt, 0); err != nil {
+            return nil, err
+        }
+        uri = client.nodes[rand.Intn(len(client.nodes))].ExternalUri() + req.path
+    }
+    return nil, lastErr
+}
+
+//sends the request and decodes the JSON response into out if it is not nil, non 2xx statuses are returned as *Error
+func (client *Client) do(ctx context.Context, req request, out any) (int, error) {
+    resp, err := client.send(ctx, req)
+    if err != nil {
+        return 0, err
+    }
+    defer resp.Body.Close()
+
+    body, err := io.ReadAll(resp.Body)
+    if err != nil {
+        return resp.StatusCode, err
+    }
+    if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+        return resp.StatusCode, responseError(resp.StatusCode, body)
+    }
+    if out != nil {
+        if err := json.Unmarshal(body, out); err != nil {
+            return resp.StatusCode, fmt.Errorf("Malformed response: %w", err)
+        }
+    }
+    return resp.StatusCode, nil
+}
+
+func jsonRequest(method string, path string, body any, write bool) request {
+    req := request{method: method, path: path, write: write, header: http.Header{"Accept": {"application/json"}}}
+    if body != nil {
+        data, err := json.Marshal(body)
+        if err != nil {
+            panic(err)
+        }
+        req.body = data
+        req.header.Set("Content-Type", "application/json")
+    }
+    return req
+}
+
+type PeerStatus struct {
+    NodeId uint64 `json:"node_id"`
+    NextIndex uint64 `json:"next_index"`
+    MatchIndex uint64 `json:"match_index"`
+    Learner bool `json:"learner"`
+    SinceLastHBMs *int64 `json:"since_last_hb_ms"`
+}
+
+type NodeStatus struct {
+    NodeId uint64 `json:"node_id"`
+    Role string `json:"role"`
+    CurrentTerm uint64 `json:"current_term"`
+    VotedFor *uint64 `json:"voted_for"`
+    LeaderId *uint64 `json:"leader_id"`
+    CommitIndex uint64 `json:"commit_index"`
+    LastApplied uint64 `json:"last_applied"`
+    LogLength int `json:"log_length"`
+    SnapshotIndex uint64 `json:"snapshot_index"`
+    Peers []PeerStatus `json:"peers,omitempty"`
+}
+
+//sends the request to one node without redirects or retries
+func (client *Client) doNode(ctx context.Context, nodeId int, method string, path string, out any) error {
+    httpReq, err := http.NewRequestWithContext(ctx, method, client.nodes[nodeId].ExternalUri() + path, nil)
+    if err != nil {
+        return err
+    }
+    if client.token != "" {
+        httpReq.Header.Set("Authorization", "Bearer " + client.token)
+    }
+    resp, err := client.http.Do(httpReq)
+    if err != nil {
+        return err
+    }
+    defer resp.Body.Close()
+    body, err := io.ReadAll(resp.Body)
+    if err != nil {
+        return err
+    }
+    if resp.StatusCode != http.StatusOK {
+        return responseError(resp.StatusCode, body)
+    }
+    return json.Unmarshal(body, out)
+}
+
+//status of one node, it is not redirected or retried
+func (client *Client) Status(ctx context.Context, nodeId int) (NodeStatus, error) {
+    var status NodeStatus
+    err := client.doNode(ctx, nodeId, "GET", "/status", &status)
+    return status, err
+}
@@ -0,0 +1,250 @@
+package kvclient
+
+import (
+    "context"
+    "fmt"
+    "net/http"
+    "net/url"
+    "unicode/utf8"
+)
+
+type Item struct {
+    Key string
+    Value string
+    ContentType string
+    Flags uint64
+}
+
+type itemResponse struct {
+    Key string `json:"key"`
+    Value *string `json:"value"`
+    ValueB64 []byte `json:"value_b64"`
+    ContentType string `json:"content_type"`
+    Flags uint64 `json:"flags"`
+}
+
+func (resp itemResponse) value() string {
+    if resp.ValueB64 != nil {
+        return string(resp.ValueB64)
+    }
+    if resp.Value != nil {
+        return *resp.Value
+    }
+    return ""
+}
+
+type writeRequest struct {
+    Key string `json:"key,omitempty"`
+    Value *string `json:"value,omitempty"`
+    ValueB64 []byte `json:"value_b64,omitempty"`
+    PrevValue *string `json:"prev_value,omitempty"`
+    PrevValueB64 []byte `json:"prev_value_b64,omitempty"`
+    ContentType string `json:"content_type,omitempty"`
+    Flags uint64 `json:"flags,omitempty"`
+}
+
+type WriteOption func(*writeRequest)
+
+func WithContentType(contentType string) WriteOption {
+    return func(req *writeRequest) {
+        req.ContentType = contentType
+    }
+}
+
+func WithFlags(flags uint64) WriteOption {
+    return func(req *writeRequest) {
+        req.Flags = flags
+    }
+}
+
+//values that are not valid UTF-8 are sent base64 encoded
+func (req *writeRequest) setValue(value string) {
+    if utf8.ValidString(value) {
+        req.Value = &value
+    } else {
+        req.ValueB64 = []byte(value)
+    }
+}
+
+func (req *writeRequest) setPrevValue(prevValue string) {
+    if utf8.ValidString(prevValue) {
+        req.PrevValue = &prevValue
+    } else {
+        req.PrevValueB64 = []byte(prevValue)
+    }
+}
+
+func newWriteRequest(value string, options []WriteOption) *writeRequest {
+    req := &writeRequest{}
+    req.setValue(value)
+    for _, option := range options {
+        option(req)
+    }
+    return req
+}
+
+func entryPath(key string) string {
+    return "/entry/" + url.PathEscape(key)
+}
+
+//reads are served by followers and may be stale
+func (client *Client) Get(ctx context.Context, key string) (Item, error) {
+    var resp itemResponse
+    if _, err := client.do(ctx, jsonRequest("GET", entryPath(key), nil, false), &resp); err != nil {
+        return Item{}, err
+    }
+    return Item{Key: key, Value: resp.value(), ContentType: resp.ContentType, Flags: resp.Flags}, nil
+}
+
+//returns ErrConflict if the key exists
+func (client *Client) Create(ctx context.Context, key string, value string, options ...WriteOption) error {
+    _, err := client.do(ctx, jsonRequest("POST", entryPath(key), newWriteRequest(value, options), true), nil)
+    return err
+}
+
+//returns ErrNotFound if the key does not exist
+func (client *Client) Update(ctx context.Context, key string, value string, options ...WriteOption) error {
+    _, err := client.do(ctx, jsonRequest("PUT", entryPath(key), newWriteRequest(value, options), true), nil)
+    return err
+}
+
+//returns ErrNotFound if the key does not exist or has a different value
+func (client *Client) CAS(ctx context.Context, key string, prevValue string, value string, options ...WriteOption) error {
+    req := newWriteRequest(value, options)
+    req.setPrevValue(prevValue)
+    _, err := client.do(ctx, jsonRequest("PUT", entryPath(key), req, true), nil)
+    return err
+}
+
+//returns ErrNotFound if the key does not exist
+func (client *Client) Delete(ctx context.Context, key string) error {
+    _, err := client.do(ctx, jsonRequest("DELETE", entryPath(key), nil, true), nil)
+    return err
+}
+
+//returns ErrConflict if the key does not exist or has a different value
+func (client *Client) DeleteIfEquals(ctx context.Context, key string, prevValue string) error {
+    req := &writeRequest{}
+    req.setPrevValue(prevValue)
+    _, err := client.do(ctx, jsonRequest("DELETE", entryPath(key), req, true), nil)
+    return err
+}
+
+//stores the value whether the key exists or not, returns true if the key was created
+func (client *Client) Upsert(ctx context.Context, key string, value string, options ...WriteOption) (bool, error) {
+    code, err := client.do(ctx, jsonRequest("PUT", "/upsert/" + url.PathEscape(key), newWriteRequest(value, options), true), nil)
+    return code == http.StatusCreated, err
+}
+
+//adds delta to the integer value of the key, missing keys start from zero. Returns the new value,
+//ErrConflict if the value is not an integer or the result overflows
+func (client *Client) Increment(ctx context.Context, key string, delta int64) (int64, error) {
+    var resp struct {
+        Value int64 `json:"value"`
+    }
+    _, err := client.do(ctx, jsonRequest("POST", "/increment/" + url.PathEscape(key), map[string]int64{"delta": delta}, true), &resp)
+    return resp.Value, err
+}
+
+//appends to the value of the key, missing keys are created. Returns the new length of the value
+func (client *Client) Append(ctx context.Context, key string, value string, options ...WriteOption) (int, error) {
+    var resp struct {
+        Length int `json:"length"`
+    }
+    _, err := client.do(ctx, jsonRequest("POST", "/append/" + url.PathEscape(key), newWriteRequest(value, options), true), &resp)
+    return resp.Length, err
+}
+
+type Op struct {
+    Op string //create, update, delete, cas, increment, append, upsert or delete_if_equals
+    Key string
+    Value string
+    PrevValue *string //for cas and delete_if_equals
+    Delta int64 //for increment
+    ContentType string
+    Flags uint64
+}
+
+type OpResult struct {
+    Status int `json:"status"`
+    Message string `json:"message"`
+    Error string `json:"error"`
+    Code string `json:"code"`
+    Value *int64 `json:"value"` //new value for increment
+    Length *int `json:"length"` //new length for append
+}
+
+//error of the op, nil if it succeeded
+func (result OpResult) Err() error {
+    if result.Status >= 200 && result.Status < 300 {
+        return nil
+    }
+    return &Error{StatusCode: result.Status, Message: result.Error, Code: result.Code}
+}
+
+//ops are appended to the log together and applied in order, each one succeeds or fails on its own.
+//All keys have to belong to one range, ops of keys that moved to a new range before they were applied are sent again.
+//Ops that failed with 503 otherwise may have been applied
+func (client *Client) Batch(ctx context.Context, ops []Op) ([]OpResult, error) {
+    results := make([]OpResult, len(ops))
+    pending := make([]int, len(ops))
+    for i := range pending {
+        pending[i] = i
+    }
+    for attempt := 0; ; attempt++ {
+        batch := make([]Op, len(pending))
+        for j, i := range pending {
+            batch[j] = ops[i]
+        }
+        batchResults, err := client.batch(ctx, batch)
+        if err != nil {
+            return nil, err
+        }
+        if len(batchResults) != len(batch) {
+            return nil, fmt.Errorf("Malformed response: %d results for %d ops", len(batchResults), len(batch))
+        }
+
+        var moved []int
+        for j, i := range pending {
+            results[i] = batchResults[j]
+            if notApplied(batchResults[j].Err()) {
+                moved = append(moved, i)
+            }
+        }
+        if len(moved) == 0 || attempt + 1 >= client.maxAttempts {
+            return results, nil
+        }
+        client.logger.Debug("Ops of the batch moved to another range, retrying", "ops", len(moved))
+        if err := client.backoff(ctx, attempt, 0); err != nil {
+            return nil, err
+        }
+        pending = moved
+    }
+}
+
+func (client *Client) batch(ctx context.Context, ops []Op) ([]OpResult, error) {
+    type batchOp struct {
+        Op string `json:"op"`
+        Delta *int64 `json:"delta,omitempty"`
+        *writeRequest
+    }
+    batch := make([]batchOp, len(ops))
+    for i, op := range ops {
+        req := &writeRequest{Key: op.Key, ContentType: op.ContentType, Flags: op.Flags}
+        req.setValue(op.Value)
+        if op.PrevValue != nil {
+            req.setPrevValue(*op.PrevValue)
+        }
+        batch[i] = batchOp{Op: op.Op, writeRequest: req}
+        if op.Op == "increment" {
+            delta := op.Delta
+            batch[i].Delta = &delta
+        }
+    }
+
+    var resp struct {
+        Results []OpResult `json:"results"`
+    }
+    _, err := client.do(ctx, jsonRequest("POST", "/batch", map[string]any{"ops": batch}, true), &resp)
+    return resp.Results, err
+}
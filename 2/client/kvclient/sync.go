@@ -0,0 +1,207 @@
+package kvclient
+
+import (
+    "bufio"
+    "context"
+    "encoding/json"
+    "net/http"
+    "net/url"
+    "time"
+)
+
+//Token is the fencing token, the log index of the entry that acquired the lock
+type Lock struct {
+    Name string `json:"name"`
+    Owner string `json:"owner"`
+    Token uint64 `json:"token"`
+    ExpiresMs int64 `json:"expires_ms"`
+    Value string `json:"value"`
+}
+
+type lockRequest struct {
+    Owner string `json:"owner"`
+    Token uint64 `json:"token,omitempty"`
+    TtlMs int64 `json:"ttl_ms,omitempty"`
+    WaitMs int64 `json:"wait_ms,omitempty"`
+    Value string `json:"value,omitempty"`
+}
+
+func (client *Client) lockCall(ctx context.Context, method string, path string, req lockRequest) (Lock, error) {
+    var lock Lock
+    _, err := client.do(ctx, jsonRequest(method, path, req, true), &lock)
+    return lock, err
+}
+
+//waits up to wait for the lock to be released or expire, negative wait waits until ctx is done.
+//Returns ErrConflict if the lock is held by another owner
+func (client *Client) AcquireLock(ctx context.Context, name string, owner string, ttl time.Duration, wait time.Duration) (Lock, error) {
+    return client.lockCall(ctx, "POST", "/locks/" + url.PathEscape(name), lockRequest{Owner: owner, TtlMs: ttl.Milliseconds(), WaitMs: wait.Milliseconds()})
+}
+
+//returns ErrConflict if the lock was acquired by someone else since
+func (client *Client) RenewLock(ctx context.Context, lock Lock, ttl time.Duration) (Lock, error) {
+    return client.lockCall(ctx, "PUT", "/locks/" + url.PathEscape(lock.Name), lockRequest{Owner: lock.Owner, Token: lock.Token, TtlMs: ttl.Milliseconds()})
+}
+
+func (client *Client) ReleaseLock(ctx context.Context, lock Lock) error {
+    _, err := client.lockCall(ctx, "DELETE", "/locks/" + url.PathEscape(lock.Name), lockRequest{Owner: lock.Owner, Token: lock.Token})
+    return err
+}
+
+//returns ErrNotFound if the lock is not held
+func (client *Client) GetLock(ctx context.Context, name string) (Lock, error) {
+    var lock Lock
+    _, err := client.do(ctx, jsonRequest("GET", "/locks/" + url.PathEscape(name), nil, false), &lock)
+    return lock, err
+}
+
+func electionPath(name string, action string) string {
+    return "/elections/" + url.PathEscape(name) + "/" + action
+}
+
+//blocks until the candidate is elected or ctx is done, the returned lock is used to proclaim, keep alive and resign
+func (client *Client) Campaign(ctx context.Context, name string, candidate string, value string, ttl time.Duration) (Lock, error) {
+    return client.lockCall(ctx, "POST", electionPath(name, "campaign"), lockRequest{Owner: candidate, Value: value, TtlMs: ttl.Milliseconds()})
+}
+
+func (client *Client) Proclaim(ctx context.Context, leader Lock, value string) (Lock, error) {
+    return client.lockCall(ctx, "POST", electionPath(leader.Name, "proclaim"), lockRequest{Owner: leader.Owner, Token: leader.Token, Value: value})
+}
+
+//returns ErrConflict if the leadership is lost
+func (client *Client) KeepAlive(ctx context.Context, leader Lock, ttl time.Duration) (Lock, error) {
+    return client.lockCall(ctx, "POST", electionPath(leader.Name, "keepalive"), lockRequest{Owner: leader.Owner, Token: leader.Token, TtlMs: ttl.Milliseconds()})
+}
+
+func (client *Client) Resign(ctx context.Context, leader Lock) error {
+    _, err := client.lockCall(ctx, "POST", electionPath(leader.Name, "resign"), lockRequest{Owner: leader.Owner, Token: leader.Token})
+    return err
+}
+
+type ElectionEvent struct {
+    Name string `json:"name"`
+    Leader *Lock `json:"leader"` //nil when there is no leader
+}
+
+//returns ErrNotFound if there is no leader
+func (client *Client) ElectionLeader(ctx context.Context, name string) (Lock, error) {
+    var event ElectionEvent
+    if _, err := client.do(ctx, jsonRequest("GET", "/elections/" + url.PathEscape(name), nil, false), &event); err != nil {
+        return Lock{}, err
+    }
+    event.Leader.Name = name
+    return *event.Leader, nil
+}
+
+//sends the current leader and then its changes until ctx is done, reconnects to other nodes on errors.
+//The channel is closed when ctx is done
+func (client *Client) Observe(ctx context.Context, name string) <-chan ElectionEvent {
+    events := make(chan ElectionEvent)
+    go func() {
+        defer close(events)
+        for attempt := 0; ; attempt++ {
+            resp, err := client.send(ctx, jsonRequest("GET", electionPath(name, "observe"), nil, false))
+            if err == nil && resp.StatusCode == http.StatusOK {
+                attempt = 0
+                scanner := bufio.NewScanner(resp.Body)
+                for scanner.Scan() {
+                    var event ElectionEvent
+                    if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+                        client.logger.Warn("Malformed election event", "err", err)
+                        continue
+                    }
+                    if event.Leader != nil {
+                        event.Leader.Name = name
+                    }
+                    select {
+                    case events <- event:
+                    case <- ctx.Done():
+                    }
+                }
+            }
+            if resp != nil {
+                resp.Body.Close()
+            }
+            if ctx.Err() != nil || client.backoff(ctx, attempt, 0) != nil {
+                return
+            }
+            client.logger.Warn("Observe stream ended, reconnecting", "election", name, "err", err)
+        }
+    }()
+    return events
+}
+
+type Message struct {
+    Id uint64
+    Value string
+    ContentType string
+    Flags uint64
+    Receipt uint64 //used to ack, zero for peeked messages
+    Deliveries int
+    VisibleAtMs int64
+}
+
+type messageResponse struct {
+    Id uint64 `json:"id"`
+    itemResponse
+    Receipt uint64 `json:"receipt"`
+    Deliveries int `json:"deliveries"`
+    VisibleAtMs int64 `json:"visible_at_ms"`
+}
+
+func (resp messageResponse) message() Message {
+    return Message{Id: resp.Id, Value: resp.value(), ContentType: resp.ContentType, Flags: resp.Flags, Receipt: resp.Receipt, Deliveries: resp.Deliveries, VisibleAtMs: resp.VisibleAtMs}
+}
+
+func queuePath(name string, action string) string {
+    if action == "" {
+        return "/queues/" + url.PathEscape(name)
+    }
+    return "/queues/" + url.PathEscape(name) + "/" + action
+}
+
+//returns the id of the item
+func (client *Client) Enqueue(ctx context.Context, queue string, value string, options ...WriteOption) (uint64, error) {
+    var resp struct {
+        Id uint64 `json:"id"`
+    }
+    _, err := client.do(ctx, jsonRequest("POST", queuePath(queue, ""), newWriteRequest(value, options), true), &resp)
+    return resp.Id, err
+}
+
+//takes the first visible item for visibility, it is delivered again if not acked in time.
+//Waits up to wait for an item, returns ErrNotFound if there is none
+func (client *Client) Dequeue(ctx context.Context, queue string, visibility time.Duration, wait time.Duration) (Message, error) {
+    var resp messageResponse
+    req := map[string]int64{"visibility_timeout_ms": visibility.Milliseconds(), "wait_ms": wait.Milliseconds()}
+    if _, err := client.do(ctx, jsonRequest("POST", queuePath(queue, "dequeue"), req, true), &resp); err != nil {
+        return Message{}, err
+    }
+    return resp.message(), nil
+}
+
+//returns ErrConflict if the item was delivered again since
+func (client *Client) Ack(ctx context.Context, queue string, msg Message) error {
+    _, err := client.do(ctx, jsonRequest("POST", queuePath(queue, "ack"), map[string]uint64{"id": msg.Id, "receipt": msg.Receipt}, true), nil)
+    return err
+}
+
+//returns the first visible item without taking it, ErrNotFound if there is none
+func (client *Client) Peek(ctx context.Context, queue string) (Message, error) {
+    var resp messageResponse
+    if _, err := client.do(ctx, jsonRequest("GET", queuePath(queue, "peek"), nil, false), &resp); err != nil {
+        return Message{}, err
+    }
+    return resp.message(), nil
+}
+
+type QueueStats struct {
+    Length int `json:"length"`
+    InFlight int `json:"in_flight"`
+}
+
+func (client *Client) QueueStats(ctx context.Context, queue string) (QueueStats, error) {
+    var stats QueueStats
+    _, err := client.do(ctx, jsonRequest("GET", queuePath(queue, ""), nil, false), &stats)
+    return stats, err
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+    "bufio"
+    "errors"
+    "fmt"
+    "io"
+    "os"
+    "strings"
+)
+
+var errInterrupted = errors.New("Interrupted")
+
+//minimal emacs style line editor for terminals with history and completion
+type lineEditor struct {
+    fd int
+    in *bufio.Reader
+    out io.Writer
+    history []string
+    //candidates for the word before the cursor, line is the text before it
+    complete func(line string) []string
+}
+
+func newLineEditor(file *os.File, out io.Writer) *lineEditor {
+    return &lineEditor{fd: int(file.Fd()), in: bufio.NewReader(file), out: out}
+}
+
+func (editor *lineEditor) addHistory(line string) {
+    if len(editor.history) == 0 || editor.history[len(editor.history) - 1] != line {
+        editor.history = append(editor.history, line)
+    }
+}
+
+type editState struct {
+    prompt string
+    line []rune
+    pos int
+}
+
+func (editor *lineEditor) refresh(state *editState) {
+    fmt.Fprintf(editor.out, "\r%s%s\x1b[K", state.prompt, string(state.line))
+    if back := len(state.line) - state.pos; back > 0 {
+        fmt.Fprintf(editor.out, "\x1b[%dD", back)
+    }
+}
+
+func (state *editState) insert(text []rune) {
+    line := append([]rune(nil), state.line[:state.pos]...)
+    line = append(append(line, text...), state.line[state.pos:]...)
+    state.line = line
+    state.pos += len(text)
+}
+
+func (state *editState) set(text string) {
+    state.line = []rune(text)
+    state.pos = len(state.line)
+}
+
+func commonPrefix(words []string) string {
+    prefix := words[0]
+    for _, word := range words[1:] {
+        for !strings.HasPrefix(word, prefix) {
+            prefix = prefix[:len(prefix) - 1]
+        }
+    }
+    return prefix
+}
+
+func (editor *lineEditor) completeWord(state *editState) {
+    if editor.complete == nil {
+        return
+    }
+    before := string(state.line[:state.pos])
+    candidates := editor.complete(before)
+    if len(candidates) == 0 {
+        return
+    }
+    word := before[strings.LastIndexAny(before, " \t") + 1:]
+    prefix := commonPrefix(candidates)
+    if len(candidates) == 1 {
+        prefix += " "
+    }
+    if len(prefix) > len(word) {
+        state.insert([]rune(prefix[len(word):]))
+        return
+    }
+    fmt.Fprintf(editor.out, "\r\n%s\r\n", strings.Join(candidates, "  "))
+}
+
+//reads a line in raw mode, returns io.EOF on ^D at an empty line and errInterrupted on ^C
+func (editor *lineEditor) readLine(prompt string) (string, error) {
+    restore, err := makeRaw(editor.fd)
+    if err != nil {
+        return "", err
+    }
+    defer restore()
+
+    state := &editState{prompt: prompt}
+    historyPos := len(editor.history)
+    var edited string //line being edited while browsing the history
+    editor.refresh(state)
+    for {
+        r, _, err := editor.in.ReadRune()
+        if err != nil {
+            return "", err
+        }
+        switch r {
+        case '\r', '\n':
+            fmt.Fprint(editor.out, "\r\n")
+            return string(state.line), nil
+        case 3: //^C
+            fmt.Fprint(editor.out, "^C\r\n")
+            return "", errInterrupted
+        case 4: //^D
+            if len(state.line) == 0 {
+                fmt.Fprint(editor.out, "\r\n")
+                return "", io.EOF
+            }
+            if state.pos < len(state.line) {
+                state.line = append(state.line[:state.pos], state.line[state.pos + 1:]...)
+            }
+        case 127, 8: //backspace
+            if state.pos > 0 {
+                state.line = append(state.line[:state.pos - 1], state.line[state.pos:]...)
+                state.pos--
+            }
+        case 1: //^A
+            state.pos = 0
+        case 5: //^E
+            state.pos = len(state.line)
+        case 2: //^B
+            state.pos = max(state.pos - 1, 0)
+        case 6: //^F
+            state.pos = min(state.pos + 1, len(state.line))
+        case 11: //^K
+            state.line = state.line[:state.pos]
+        case 21: //^U
+            state.line = state.line[state.pos:]
+            state.pos = 0
+        case 23: //^W
+            start := state.pos
+            for start > 0 && state.line[start - 1] == ' ' {
+                start--
+            }
+            for start > 0 && state.line[start - 1] != ' ' {
+                start--
+            }
+            state.line = append(state.line[:start], state.line[state.pos:]...)
+            state.pos = start
+        case 12: //^L
+            fmt.Fprint(editor.out, "\x1b[H\x1b[2J")
+        case '\t':
+            editor.completeWord(state)
+        case 27: //escape sequences of the arrows, home, end and delete
+            if next, _, _ := editor.in.ReadRune(); next != '[' && next != 'O' {
+                break
+            }
+            code, _, _ := editor.in.ReadRune()
+            switch code {
+            case 'A', 'B':
+                if code == 'A' && historyPos > 0 {
+                    if historyPos == len(editor.history) {
+                        edited = string(state.line)
+                    }
+                    historyPos--
+                    state.set(editor.history[historyPos])
+                } else if code == 'B' && historyPos < len(editor.history) {
+                    historyPos++
+                    if historyPos == len(editor.history) {
+                        state.set(edited)
+                    } else {
+                        state.set(editor.history[historyPos])
+                    }
+                }
+            case 'C':
+                state.pos = min(state.pos + 1, len(state.line))
+            case 'D':
+                state.pos = max(state.pos - 1, 0)
+            case 'H':
+                state.pos = 0
+            case 'F':
+                state.pos = len(state.line)
+            case '3':
+                editor.in.ReadRune() //~
+                if state.pos < len(state.line) {
+                    state.line = append(state.line[:state.pos], state.line[state.pos + 1:]...)
+                }
+            }
+        default:
+            if r >= ' ' {
+                state.insert([]rune{r})
+            }
+        }
+        editor.refresh(state)
+    }
+}
+
+//loads the history file, missing files are ignored
+func (editor *lineEditor) loadHistory(fileName string) {
+    data, err := os.ReadFile(fileName)
+    if err != nil {
+        return
+    }
+    for _, line := range strings.Split(string(data), "\n") {
+        if line != "" {
+            editor.addHistory(line)
+        }
+    }
+}
+
+//keeps the last limit lines
+func (editor *lineEditor) saveHistory(fileName string, limit int) error {
+    history := editor.history[max(len(editor.history) - limit, 0):]
+    return os.WriteFile(fileName, []byte(strings.Join(history, "\n") + "\n"), 0600)
+}
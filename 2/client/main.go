@@ -2,266 +2,188 @@ package main
 
 import (
     "fmt"
-    "encoding/json"
-    "io"
-    "log"
+    "log/slog"
+    "flag"
     "net/http"
-    "bufio"
-    "strings"
-    "math/rand"
-    "bytes"
     "os"
+    "path/filepath"
     "time"
-    "context"
-)
-
-type NodeConfig struct {
-    Host string `json:"host"`
-    InternalPort int `json:"internal_port"`
-    ExternalPort int `json:"external_port"`
-}
-
-func (node NodeConfig) ExternalUri() string {
-    return fmt.Sprintf("http://%s:%d", node.Host, node.ExternalPort)
-}
-
-type NodesConfig []NodeConfig
+    "crypto/tls"
+    "crypto/x509"
 
-var nodes NodesConfig
+    "github.com/eparoshin/tors_hw/2/client/history"
+    "github.com/eparoshin/tors_hw/2/client/kvclient"
+)
 
-var client *http.Client
+//records the ops for the linearizability checker if -history is set
+var recorder *history.Recorder
 
+//timeout of the requests, a command can override it with -timeout
 var timeout time.Duration
 
-func getNodeId(nodeId int) int {
-    if nodeId < 0 {
-        return rand.Intn(len(nodes))
-    } else {
-        return nodeId
-    }
-}
+var logger = slog.Default()
 
-func ProcessCreate(ctx context.Context, key string, value string, nodeId int) string {
-    for {
-        nodeId = getNodeId(nodeId)
-        data, err := json.Marshal(map[string]string{"key": key, "value": value})
-        if err != nil {
-            log.Fatal(err)
-        }
-        req, err := http.NewRequestWithContext(ctx, "POST", nodes[nodeId].ExternalUri() + "/entry", bytes.NewReader(data))
-        if err != nil {
-            log.Fatal(err)
-        }
-        log.Print(req.URL)
-        resp, err := client.Do(req)
-        if err != nil {
-            log.Println(err)
-            nodeId = -1
-            continue
-        }
-
-        respBody, err := io.ReadAll(resp.Body)
-        if err != nil {
-            log.Print(err)
-            nodeId = -1
-            continue
-        }
-        resp.Body.Close()
-
-        return fmt.Sprintf("resp: %+v\t body: %s", resp, string(respBody))
-    }
+func fatal(msg string, args ...any) {
+    logger.Error(msg, args...)
+    os.Exit(1)
 }
 
-func ProcessRead(ctx context.Context, key string, nodeId int) string {
-    for {
-        nodeId = getNodeId(nodeId)
-        req, err := http.NewRequestWithContext(ctx, "GET", nodes[nodeId].ExternalUri() + "/entry/" + key, nil)
-        if err != nil {
-            log.Fatal(err)
-        }
-        log.Print(req.URL)
-        resp, err := client.Do(req)
-        if err != nil {
-            log.Println(err)
-            nodeId = -1
-            continue
-        }
-
-        respBody, err := io.ReadAll(resp.Body)
-        if err != nil {
-            log.Print(err)
-            nodeId = -1
-            continue
-        }
-        resp.Body.Close()
+func setupLogging(format string, levelName string) error {
+    var level slog.Level
+    if err := level.UnmarshalText([]byte(levelName)); err != nil {
+        return err
+    }
 
-        return fmt.Sprintf("resp: %+v\t body: %s", resp, string(respBody))
+    options := &slog.HandlerOptions{Level: level}
+    switch format {
+    case "text":
+        logger = slog.New(slog.NewTextHandler(os.Stderr, options))
+    case "json":
+        logger = slog.New(slog.NewJSONHandler(os.Stderr, options))
+    default:
+        return fmt.Errorf("Unknown log format %q", format)
     }
+    slog.SetDefault(logger)
+    return nil
 }
 
-func ProcessUpdate(ctx context.Context, key string, value string, nodeId int) string {
-    for {
-        nodeId = getNodeId(nodeId)
-        data, err := json.Marshal(map[string]string{"value": value})
-        if err != nil {
-            log.Fatal(err)
-        }
-        req, err := http.NewRequestWithContext(ctx, "PUT", nodes[nodeId].ExternalUri() + "/entry/" + key, bytes.NewReader(data))
+func newTLSConfig(caFile string, certFile string, keyFile string) (*tls.Config, error) {
+    config := &tls.Config{MinVersion: tls.VersionTLS12}
+    if caFile != "" {
+        caData, err := os.ReadFile(caFile)
         if err != nil {
-            log.Fatal(err)
+            return nil, err
         }
-        log.Print(req.URL)
-        resp, err := client.Do(req)
-        if err != nil {
-            log.Println(err)
-            nodeId = -1
-            continue
+        config.RootCAs = x509.NewCertPool()
+        if !config.RootCAs.AppendCertsFromPEM(caData) {
+            return nil, fmt.Errorf("No certificates found in %s", caFile)
         }
-
-        respBody, err := io.ReadAll(resp.Body)
+    }
+    if certFile != "" {
+        cert, err := tls.LoadX509KeyPair(certFile, keyFile)
         if err != nil {
-            log.Print(err)
-            nodeId = -1
-            continue
+            return nil, err
         }
-        resp.Body.Close()
-
-        return fmt.Sprintf("resp: %+v\t body: %s", resp, string(respBody))
+        config.Certificates = []tls.Certificate{cert}
     }
+    return config, nil
 }
 
-func ProcessDelete(ctx context.Context, key string, nodeId int) string {
-    for {
-        nodeId = getNodeId(nodeId)
-        req, err := http.NewRequestWithContext(ctx, "DELETE", nodes[nodeId].ExternalUri() + "/entry/" + key, nil)
-        if err != nil {
-            log.Fatal(err)
-        }
-        log.Print(req.URL)
-        resp, err := client.Do(req)
-        if err != nil {
-            log.Println(err)
-            nodeId = -1
-            continue
-        }
-
-        respBody, err := io.ReadAll(resp.Body)
-        if err != nil {
-            log.Print(err)
-            nodeId = -1
-            continue
-        }
-        resp.Body.Close()
+//flags shared by the interactive mode and the subcommands
+type clientOptions struct {
+    logFormat string
+    logLevel string
+    caFile string
+    certFile string
+    keyFile string
+    token string
+    history string
+}
 
-        return fmt.Sprintf("resp: %+v\t body: %s", resp, string(respBody))
-    }
+func (options *clientOptions) register(flags *flag.FlagSet) {
+    flags.StringVar(&options.logFormat, "log-format", "text", "text or json")
+    flags.StringVar(&options.logLevel, "log-level", "info", "debug, info, warn or error")
+    flags.StringVar(&options.caFile, "ca-file", "", "CA to verify nodes serving TLS, system roots if empty")
+    flags.StringVar(&options.certFile, "cert-file", "", "client certificate for nodes requiring mTLS")
+    flags.StringVar(&options.keyFile, "key-file", "", "client certificate key")
+    flags.StringVar(&options.token, "token", os.Getenv("KV_TOKEN"), "bearer token, $KV_TOKEN by default")
+    flags.StringVar(&options.history, "history", "", "file to append the ops to for the check subcommand")
 }
 
-func ProcessCas(ctx context.Context, key string, prevVal string, newVal string, nodeId int) string {
-    for {
-        nodeId = getNodeId(nodeId)
-        data, err := json.Marshal(map[string]string{"prev_value": prevVal, "value": newVal})
-        if err != nil {
-            log.Fatal(err)
-        }
-        req, err := http.NewRequestWithContext(ctx, "PUT", nodes[nodeId].ExternalUri() + "/entry/" + key, bytes.NewReader(data))
-        if err != nil {
-            log.Fatal(err)
-        }
-        log.Print(req.URL)
-        resp, err := client.Do(req)
-        if err != nil {
-            log.Println(err)
-            nodeId = -1
-            continue
-        }
+//sets up logging, the history recorder and creates the client, exits on errors
+func (options *clientOptions) newClient(configFile string) *kvclient.Client {
+    if err := setupLogging(options.logFormat, options.logLevel); err != nil {
+        fatal("Error while setting up logging", "err", err)
+    }
 
-        respBody, err := io.ReadAll(resp.Body)
-        if err != nil {
-            log.Print(err)
-            nodeId = -1
-            continue
-        }
-        resp.Body.Close()
+    tlsConfig, err := newTLSConfig(options.caFile, options.certFile, options.keyFile)
+    if err != nil {
+        fatal("Error while loading TLS config", "err", err)
+    }
+    transport := http.DefaultTransport.(*http.Transport).Clone()
+    transport.TLSClientConfig = tlsConfig
+    //benchmarks keep many requests in flight to the same nodes
+    transport.MaxIdleConnsPerHost = 256
 
-        return fmt.Sprintf("resp: %+v\t body: %s", resp, string(respBody))
+    nodes, err := kvclient.LoadNodes(configFile)
+    if err != nil {
+        fatal("Error while reading nodes config", "err", err)
+    }
+    kv, err := kvclient.New(kvclient.Config{
+        Nodes: nodes,
+        HTTPClient: &http.Client{Transport: transport},
+        Token: options.token,
+        Logger: logger,
+    })
+    if err != nil {
+        fatal("Error while creating client", "err", err)
     }
-}
 
-func Process(line string) string {
-    lines := strings.Fields(strings.ToLower(line))
-    log.Printf("Len lines: %d\n", len(lines))
-    nodeId := -1
-    ctx, cancel := context.WithTimeout(context.Background(), timeout)
-    defer cancel()
-    switch lines[0] {
-    case "c":
-        if len(lines) > 3 {
-            fmt.Sscanf(lines[3], "%d", &nodeId)
-        }
-        return ProcessCreate(ctx, lines[1], lines[2], nodeId)
-    case "r":
-        if len(lines) > 2 {
-            fmt.Sscanf(lines[2], "%d", &nodeId)
-        }
-        return ProcessRead(ctx, lines[1], nodeId)
-    case "u":
-        if len(lines) > 3 {
-            fmt.Sscanf(lines[3], "%d", &nodeId)
-        }
-        return ProcessUpdate(ctx, lines[1], lines[2], nodeId)
-    case "d":
-        if len(lines) > 2 {
-            fmt.Sscanf(lines[2], "%d", &nodeId)
+    if options.history != "" {
+        if recorder, err = history.NewRecorder(options.history); err != nil {
+            fatal("Error while opening history", "err", err)
         }
-        return ProcessDelete(ctx, lines[1], nodeId)
-    case "cas":
-        if len(lines) > 4 {
-            fmt.Sscanf(lines[4], "%d", &nodeId)
-        }
-        return ProcessCas(ctx, lines[1], lines[2], lines[3], nodeId)
-    default:
-        log.Fatalln(line)
     }
-    return "UNREACHABLE"
+    return kv
 }
 
-func NewNodesConfig(fileName string) (config NodesConfig, err error) {
-    data, err := os.ReadFile(fileName)
-    if err != nil {
+func main() {
+    if len(os.Args) > 1 && os.Args[1] == "bench" {
+        runBench(os.Args[2:])
         return
     }
-    err = json.Unmarshal(data, &config)
-    return
-}
-
-func main() {
-    client = &http.Client {
-        CheckRedirect: func(req *http.Request, via []*http.Request) error {
-            log.Println("Redirect", *req)
-            for _, r := range via {
-                log.Println("via", *r)
-            }
-
-            return nil
-        },
+    if len(os.Args) > 1 && os.Args[1] == "check" {
+        runCheck(os.Args[2:])
+        return
     }
-    configFile := os.Args[1]
-    var err error
-    nodes, err = NewNodesConfig(configFile)
-    if err != nil {
-        log.Fatal(err)
+    if len(os.Args) > 1 && os.Args[1] == "admin" {
+        runAdmin(os.Args[2:])
+        return
     }
 
-    timeout = time.Second * 10
-
-    stdin := bufio.NewReader(os.Stdin)
-    for {
-        line, err := stdin.ReadString('\n')
-        if err != nil {
-            log.Fatal(err)
-        }
-        fmt.Println(Process(line))
+    var options clientOptions
+    options.register(flag.CommandLine)
+    flag.DurationVar(&timeout, "timeout", 10 * time.Second, "timeout of each command")
+    jsonOutput := flag.Bool("json", false, "print results as JSON lines")
+    script := flag.String("script", "", "run the commands of the file and exit, - for stdin")
+    keepGoing := flag.Bool("keep-going", false, "do not stop the script at the first failed command")
+    historyFile := flag.String("repl-history", defaultHistoryFile(), "file keeping the lines entered in the REPL, none if empty")
+    flag.Usage = func() {
+        fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] nodes-config\n       %s bench [flags] nodes-config\n       %s check [flags] history-file...\n       %s admin [flags] nodes-config command [args]\n", os.Args[0], os.Args[0], os.Args[0], os.Args[0])
+        fmt.Fprintln(flag.CommandLine.Output(), "Starts a REPL if stdin is a terminal and runs the commands of stdin as a script otherwise.")
+        flag.PrintDefaults()
+    }
+    flag.Parse()
+    if flag.NArg() < 1 {
+        flag.Usage()
+        os.Exit(2)
     }
+    session := &session{kv: options.newClient(flag.Arg(0)), timeout: timeout, json: *jsonOutput}
+    defer recorder.Close()
+
+    switch {
+    case *script != "" && *script != "-":
+        file, err := os.Open(*script)
+        if err != nil {
+            fatal("Error while opening script", "err", err)
+        }
+        status := session.runScript(file, *script, *keepGoing)
+        file.Close()
+        recorder.Close()
+        os.Exit(status)
+    case *script == "-" || !isTerminal(int(os.Stdin.Fd())):
+        status := session.runScript(os.Stdin, "stdin", *keepGoing)
+        recorder.Close()
+        os.Exit(status)
+    default:
+        session.repl(*historyFile)
+    }
+}
 
+func defaultHistoryFile() string {
+    home, err := os.UserHomeDir()
+    if err != nil {
+        return ""
+    }
+    return filepath.Join(home, ".kv_history")
 }
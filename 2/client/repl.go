@@ -0,0 +1,531 @@
+package main
+
+import (
+    "bufio"
+    "context"
+    "encoding/json"
+    "errors"
+    "flag"
+    "fmt"
+    "io"
+    "os"
+    "os/signal"
+    "sort"
+    "strconv"
+    "strings"
+    "time"
+
+    "github.com/eparoshin/tors_hw/2/client/history"
+    "github.com/eparoshin/tors_hw/2/client/kvclient"
+)
+
+//splits a line into words like a shell: single quotes are literal, double quotes and bare words
+//take backslash escapes
+func splitWords(line string) ([]string, error) {
+    var words []string
+    var word strings.Builder
+    inWord := false
+    runes := []rune(line)
+    for i := 0; i < len(runes); i++ {
+        r := runes[i]
+        switch {
+        case r == ' ' || r == '\t' || r == '\n' || r == '\r':
+            if inWord {
+                words = append(words, word.String())
+                word.Reset()
+                inWord = false
+            }
+        case r == '\'':
+            inWord = true
+            end := i + 1
+            for end < len(runes) && runes[end] != '\'' {
+                end++
+            }
+            if end == len(runes) {
+                return nil, errors.New("Unterminated single quote")
+            }
+            word.WriteString(string(runes[i + 1:end]))
+            i = end
+        case r == '"':
+            inWord = true
+            i++
+            for ; i < len(runes) && runes[i] != '"'; i++ {
+                if runes[i] == '\\' && i + 1 < len(runes) {
+                    i++
+                    word.WriteRune(unescape(runes[i]))
+                } else {
+                    word.WriteRune(runes[i])
+                }
+            }
+            if i == len(runes) {
+                return nil, errors.New("Unterminated double quote")
+            }
+        case r == '\\':
+            inWord = true
+            if i + 1 == len(runes) {
+                return nil, errors.New("Trailing backslash")
+            }
+            i++
+            word.WriteRune(unescape(runes[i]))
+        default:
+            inWord = true
+            word.WriteRune(r)
+        }
+    }
+    if inWord {
+        words = append(words, word.String())
+    }
+    return words, nil
+}
+
+func unescape(r rune) rune {
+    switch r {
+    case 'n':
+        return '\n'
+    case 't':
+        return '\t'
+    case 'r':
+        return '\r'
+    case '0':
+        return 0
+    }
+    return r
+}
+
+//error in the command line itself, not in the request
+type usageError struct {
+    message string
+}
+
+func (err usageError) Error() string {
+    return err.message
+}
+
+type command struct {
+    name string
+    aliases []string
+    args string //usage of the positional arguments
+    minArgs int
+    maxArgs int
+    help string
+    run func(session *session, ctx context.Context, kv *kvclient.Client, args []string) (any, error)
+}
+
+type session struct {
+    kv *kvclient.Client
+    timeout time.Duration
+    json bool
+    editor *lineEditor //nil when not interactive
+}
+
+//output of get, printed as the value alone in text mode
+type itemOutput struct {
+    Key string `json:"key"`
+    Value string `json:"value"`
+    ContentType string `json:"content_type,omitempty"`
+    Flags uint64 `json:"flags,omitempty"`
+}
+
+func (item itemOutput) String() string {
+    return item.Value
+}
+
+type message string
+
+//performs a write and records it for the linearizability checker, write sets the result of op if it has one
+func recordWrite(op *history.Operation, write func() error) error {
+    call := time.Now()
+    err := write()
+    recorder.Record(0, *op, call, err)
+    return err
+}
+
+var commands []*command
+
+func init() {
+    commands = []*command{
+        {name: "get", aliases: []string{"r"}, args: "key", minArgs: 1, maxArgs: 1, help: "reads the value of the key, reads are served by followers and may be stale",
+            run: func(_ *session, ctx context.Context, kv *kvclient.Client, args []string) (any, error) {
+                call := time.Now()
+                item, err := kv.Get(ctx, args[0])
+                recorder.Record(0, history.Operation{Op: history.OpRead, Key: args[0], Value: item.Value, Found: err == nil}, call, err)
+                if err != nil {
+                    return nil, err
+                }
+                return itemOutput{Key: args[0], Value: item.Value, ContentType: item.ContentType, Flags: item.Flags}, nil
+            }},
+        {name: "create", aliases: []string{"c"}, args: "key value", minArgs: 2, maxArgs: 2, help: "creates the key, fails if it exists",
+            run: func(_ *session, ctx context.Context, kv *kvclient.Client, args []string) (any, error) {
+                return nil, recordWrite(&history.Operation{Op: history.OpCreate, Key: args[0], Value: args[1]}, func() error {
+                    return kv.Create(ctx, args[0], args[1])
+                })
+            }},
+        {name: "update", aliases: []string{"u"}, args: "key value", minArgs: 2, maxArgs: 2, help: "updates the key, fails if it does not exist",
+            run: func(_ *session, ctx context.Context, kv *kvclient.Client, args []string) (any, error) {
+                return nil, recordWrite(&history.Operation{Op: history.OpUpdate, Key: args[0], Value: args[1]}, func() error {
+                    return kv.Update(ctx, args[0], args[1])
+                })
+            }},
+        {name: "upsert", args: "key value", minArgs: 2, maxArgs: 2, help: "stores the value whether the key exists or not",
+            run: func(_ *session, ctx context.Context, kv *kvclient.Client, args []string) (any, error) {
+                var created bool
+                err := recordWrite(&history.Operation{Op: history.OpWrite, Key: args[0], Value: args[1]}, func() (err error) {
+                    created, err = kv.Upsert(ctx, args[0], args[1])
+                    return
+                })
+                if err != nil {
+                    return nil, err
+                }
+                if created {
+                    return message("created"), nil
+                }
+                return message("updated"), nil
+            }},
+        {name: "delete", aliases: []string{"d"}, args: "key [prev]", minArgs: 1, maxArgs: 2, help: "deletes the key, only if it has the value prev if given",
+            run: func(_ *session, ctx context.Context, kv *kvclient.Client, args []string) (any, error) {
+                if len(args) == 2 {
+                    return nil, recordWrite(&history.Operation{Op: history.OpDeleteIfEquals, Key: args[0], PrevValue: args[1]}, func() error {
+                        return kv.DeleteIfEquals(ctx, args[0], args[1])
+                    })
+                }
+                return nil, recordWrite(&history.Operation{Op: history.OpDelete, Key: args[0]}, func() error {
+                    return kv.Delete(ctx, args[0])
+                })
+            }},
+        {name: "cas", args: "key prev value", minArgs: 3, maxArgs: 3, help: "sets the value if the key has the value prev",
+            run: func(_ *session, ctx context.Context, kv *kvclient.Client, args []string) (any, error) {
+                return nil, recordWrite(&history.Operation{Op: history.OpCas, Key: args[0], PrevValue: args[1], Value: args[2]}, func() error {
+                    return kv.CAS(ctx, args[0], args[1], args[2])
+                })
+            }},
+        {name: "incr", args: "key [delta]", minArgs: 1, maxArgs: 2, help: "adds delta, 1 by default, to the integer value of the key and prints the result",
+            run: func(_ *session, ctx context.Context, kv *kvclient.Client, args []string) (any, error) {
+                delta := int64(1)
+                if len(args) == 2 {
+                    var err error
+                    if delta, err = strconv.ParseInt(args[1], 10, 64); err != nil {
+                        return nil, usageError{fmt.Sprintf("Bad delta %q", args[1])}
+                    }
+                }
+                op := history.Operation{Op: history.OpIncrement, Key: args[0], Value: strconv.FormatInt(delta, 10)}
+                var value int64
+                err := recordWrite(&op, func() (err error) {
+                    value, err = kv.Increment(ctx, args[0], delta)
+                    op.Result = strconv.FormatInt(value, 10)
+                    return
+                })
+                if err != nil {
+                    return nil, err
+                }
+                return value, nil
+            }},
+        {name: "append", args: "key value", minArgs: 2, maxArgs: 2, help: "appends to the value of the key and prints the new length",
+            run: func(_ *session, ctx context.Context, kv *kvclient.Client, args []string) (any, error) {
+                op := history.Operation{Op: history.OpAppend, Key: args[0], Value: args[1]}
+                var length int
+                err := recordWrite(&op, func() (err error) {
+                    length, err = kv.Append(ctx, args[0], args[1])
+                    op.Result = strconv.Itoa(length)
+                    return
+                })
+                if err != nil {
+                    return nil, err
+                }
+                return length, nil
+            }},
+        {name: "status", args: "[node]", maxArgs: 1, help: "prints the raft status of the node, of every node if not given",
+            run: func(_ *session, ctx context.Context, kv *kvclient.Client, args []string) (any, error) {
+                if len(args) == 1 {
+                    nodeId, err := parseNode(args[0], kv)
+                    if err != nil {
+                        return nil, err
+                    }
+                    return kv.Status(ctx, nodeId)
+                }
+                type nodeStatus struct {
+                    Node int `json:"node"`
+                    Status *kvclient.NodeStatus `json:"status,omitempty"`
+                    Error string `json:"error,omitempty"`
+                }
+                var statuses []nodeStatus
+                for i := range kv.Nodes() {
+                    status, err := kv.Status(ctx, i)
+                    if err != nil {
+                        statuses = append(statuses, nodeStatus{Node: i, Error: err.Error()})
+                    } else {
+                        statuses = append(statuses, nodeStatus{Node: i, Status: &status})
+                    }
+                }
+                return statuses, nil
+            }},
+        {name: "output", args: "text|json", minArgs: 1, maxArgs: 1, help: "switches the output format",
+            run: func(session *session, _ context.Context, _ *kvclient.Client, args []string) (any, error) {
+                switch args[0] {
+                case "text", "json":
+                    session.json = args[0] == "json"
+                    return nil, nil
+                }
+                return nil, usageError{fmt.Sprintf("Unknown output format %q", args[0])}
+            }},
+        {name: "history", help: "prints the lines entered in this and previous sessions",
+            run: func(session *session, _ context.Context, _ *kvclient.Client, _ []string) (any, error) {
+                if session.editor == nil {
+                    return nil, usageError{"History is only kept in interactive mode"}
+                }
+                var lines []string
+                for i, line := range session.editor.history {
+                    lines = append(lines, fmt.Sprintf("%5d  %s", i + 1, line))
+                }
+                return message(strings.Join(lines, "\n")), nil
+            }},
+        {name: "help", args: "[command]", maxArgs: 1, help: "lists the commands or describes one",
+            run: func(_ *session, _ context.Context, _ *kvclient.Client, args []string) (any, error) {
+                if len(args) == 1 {
+                    cmd := findCommand(args[0])
+                    if cmd == nil {
+                        return nil, usageError{fmt.Sprintf("Unknown command %q", args[0])}
+                    }
+                    return message(commandHelp(cmd)), nil
+                }
+                return message(generalHelp()), nil
+            }},
+        {name: "exit", aliases: []string{"quit"}, help: "leaves the REPL"},
+    }
+}
+
+func findCommand(name string) *command {
+    for _, cmd := range commands {
+        if cmd.name == name {
+            return cmd
+        }
+        for _, alias := range cmd.aliases {
+            if alias == name {
+                return cmd
+            }
+        }
+    }
+    return nil
+}
+
+func commandUsage(cmd *command) string {
+    return strings.TrimSpace(fmt.Sprintf("%s [-node N] [-timeout D] %s", cmd.name, cmd.args))
+}
+
+func commandHelp(cmd *command) string {
+    text := commandUsage(cmd) + "\n    " + cmd.help
+    if len(cmd.aliases) > 0 {
+        text += "\n    aliases: " + strings.Join(cmd.aliases, ", ")
+    }
+    return text
+}
+
+func generalHelp() string {
+    lines := []string{"Commands:"}
+    for _, cmd := range commands {
+        lines = append(lines, fmt.Sprintf("  %-40s %s", cmd.name + " " + cmd.args, cmd.help))
+    }
+    lines = append(lines,
+        "Every command takes -node N to send the request to node N first and -timeout D to override the timeout.",
+        "Words are split like in a shell: quote them with '...' or \"...\", escape with \\. Use -- before values starting with -.")
+    return strings.Join(lines, "\n")
+}
+
+//candidates for the word before the cursor, commands for the first word and the argument of help
+func completeLine(line string) []string {
+    words := strings.Fields(line)
+    if strings.HasSuffix(line, " ") || len(words) == 0 {
+        words = append(words, "")
+    }
+    if len(words) > 2 || len(words) == 2 && findCommand(words[0]) != findCommand("help") {
+        return nil
+    }
+    var candidates []string
+    for _, cmd := range commands {
+        for _, name := range append([]string{cmd.name}, cmd.aliases...) {
+            if strings.HasPrefix(name, words[len(words) - 1]) && len(name) > 1 {
+                candidates = append(candidates, name)
+            }
+        }
+    }
+    sort.Strings(candidates)
+    return candidates
+}
+
+func parseNode(text string, kv *kvclient.Client) (int, error) {
+    nodeId, err := strconv.Atoi(text)
+    if err != nil || nodeId < 0 || nodeId >= len(kv.Nodes()) {
+        return 0, usageError{fmt.Sprintf("Bad node %q, the cluster has %d nodes", text, len(kv.Nodes()))}
+    }
+    return nodeId, nil
+}
+
+var errExit = errors.New("Exit")
+
+//runs one line, ctx cancels the request. Returns errExit for exit and usageError for bad commands
+func (session *session) execute(ctx context.Context, line string) (any, error) {
+    words, err := splitWords(line)
+    if err != nil {
+        return nil, usageError{err.Error()}
+    }
+    if len(words) == 0 {
+        return nil, nil
+    }
+    cmd := findCommand(words[0])
+    if cmd == nil {
+        return nil, usageError{fmt.Sprintf("Unknown command %q, try help", words[0])}
+    }
+    if cmd.run == nil {
+        return nil, errExit
+    }
+
+    flags := flag.NewFlagSet(cmd.name, flag.ContinueOnError)
+    flags.SetOutput(io.Discard)
+    node := flags.Int("node", -1, "")
+    timeout := flags.Duration("timeout", session.timeout, "")
+    if err := flags.Parse(words[1:]); err != nil {
+        return nil, usageError{fmt.Sprintf("%v, usage: %s", err, commandUsage(cmd))}
+    }
+    args := flags.Args()
+    //a trailing node id of the fixed arity commands is kept for compatibility with older scripts
+    if len(args) == cmd.maxArgs + 1 && cmd.minArgs == cmd.maxArgs && *node < 0 {
+        if nodeId, err := strconv.Atoi(args[len(args) - 1]); err == nil {
+            *node = nodeId
+            args = args[:len(args) - 1]
+        }
+    }
+    if len(args) < cmd.minArgs || len(args) > cmd.maxArgs {
+        return nil, usageError{"Usage: " + commandUsage(cmd)}
+    }
+
+    kv := session.kv
+    if *node >= 0 {
+        if _, err := parseNode(strconv.Itoa(*node), kv); err != nil {
+            return nil, err
+        }
+        kv = kv.Node(*node)
+    }
+    ctx, cancel := context.WithTimeout(ctx, *timeout)
+    defer cancel()
+    return cmd.run(session, ctx, kv, args)
+}
+
+//prints the result of a command, errors go to stdout too so that scripts see them in order
+func (session *session) print(out io.Writer, result any, err error) {
+    if session.json {
+        response := map[string]any{"ok": err == nil}
+        if err != nil {
+            response["error"] = err.Error()
+            var statusErr *kvclient.Error
+            if errors.As(err, &statusErr) {
+                response["status"] = statusErr.StatusCode
+                response["error"] = statusErr.Message
+            }
+        } else if result != nil {
+            response["result"] = result
+        }
+        data, _ := json.Marshal(response)
+        fmt.Fprintln(out, string(data))
+        return
+    }
+
+    switch value := result.(type) {
+    case nil:
+        if err != nil {
+            fmt.Fprintf(out, "error: %v\n", err)
+        } else {
+            fmt.Fprintln(out, "ok")
+        }
+    case message:
+        if value != "" {
+            fmt.Fprintln(out, value)
+        }
+    case fmt.Stringer:
+        fmt.Fprintln(out, value.String())
+    case int, int64:
+        fmt.Fprintln(out, value)
+    default:
+        data, _ := json.MarshalIndent(value, "", "  ")
+        fmt.Fprintln(out, string(data))
+    }
+}
+
+//interactive loop, ^C cancels the running command
+func (session *session) repl(historyFile string) {
+    editor := newLineEditor(os.Stdin, os.Stdout)
+    editor.complete = completeLine
+    session.editor = editor
+    if historyFile != "" {
+        editor.loadHistory(historyFile)
+    }
+    fmt.Println("Type help for the list of commands, ^D to exit")
+    for {
+        line, err := editor.readLine("kv> ")
+        if errors.Is(err, errInterrupted) {
+            continue
+        }
+        if err != nil {
+            if !errors.Is(err, io.EOF) {
+                logger.Error("Error while reading stdin", "err", err)
+            }
+            break
+        }
+        if strings.TrimSpace(line) == "" {
+            continue
+        }
+        editor.addHistory(line)
+
+        ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+        result, err := session.execute(ctx, line)
+        stop()
+        if errors.Is(err, errExit) {
+            break
+        }
+        session.print(os.Stdout, result, err)
+        recorder.Flush()
+    }
+    if historyFile != "" {
+        if err := editor.saveHistory(historyFile, 1000); err != nil {
+            logger.Warn("Error while saving history", "err", err)
+        }
+    }
+}
+
+//runs every line of the script, blank lines and lines starting with # are skipped.
+//Returns the exit status: 0 if every command succeeded, 1 if a request failed, 2 for a bad command.
+//Stops at the first failure unless keepGoing
+func (session *session) runScript(script io.Reader, name string, keepGoing bool) int {
+    scanner := bufio.NewScanner(script)
+    scanner.Buffer(nil, 16 << 20)
+    status := 0
+    for lineNo := 1; scanner.Scan(); lineNo++ {
+        line := strings.TrimSpace(scanner.Text())
+        if line == "" || strings.HasPrefix(line, "#") {
+            continue
+        }
+        result, err := session.execute(context.Background(), line)
+        if errors.Is(err, errExit) {
+            break
+        }
+        session.print(os.Stdout, result, err)
+        if err == nil {
+            continue
+        }
+
+        failure := 1
+        var usage usageError
+        if errors.As(err, &usage) {
+            failure = 2
+        }
+        logger.Debug("Command failed", "script", name, "line", lineNo, "err", err)
+        status = max(status, failure)
+        if !keepGoing {
+            fmt.Fprintf(os.Stderr, "%s:%d: %v\n", name, lineNo, err)
+            return status
+        }
+    }
+    if err := scanner.Err(); err != nil {
+        logger.Error("Error while reading script", "script", name, "err", err)
+        return max(status, 1)
+    }
+    return status
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+    "syscall"
+    "unsafe"
+)
+
+func getTermios(fd int) (syscall.Termios, error) {
+    var termios syscall.Termios
+    if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), syscall.TCGETS, uintptr(unsafe.Pointer(&termios))); errno != 0 {
+        return termios, errno
+    }
+    return termios, nil
+}
+
+func setTermios(fd int, termios syscall.Termios) error {
+    if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), syscall.TCSETS, uintptr(unsafe.Pointer(&termios))); errno != 0 {
+        return errno
+    }
+    return nil
+}
+
+func isTerminal(fd int) bool {
+    _, err := getTermios(fd)
+    return err == nil
+}
+
+//disables echo, line buffering and signals, returns the function restoring the previous mode
+func makeRaw(fd int) (func(), error) {
+    termios, err := getTermios(fd)
+    if err != nil {
+        return nil, err
+    }
+    old := termios
+    termios.Lflag &^= syscall.ECHO | syscall.ICANON | syscall.ISIG | syscall.IEXTEN
+    termios.Iflag &^= syscall.ICRNL | syscall.IXON
+    termios.Cc[syscall.VMIN] = 1
+    termios.Cc[syscall.VTIME] = 0
+    if err := setTermios(fd, termios); err != nil {
+        return nil, err
+    }
+    return func() { setTermios(fd, old) }, nil
+}
@@ -0,0 +1,15 @@
+//go:build !linux
+
+package main
+
+import "errors"
+
+//line editing is only supported on Linux, other systems read plain lines
+
+func isTerminal(fd int) bool {
+    return false
+}
+
+func makeRaw(fd int) (func(), error) {
+    return nil, errors.New("Raw terminal mode is not supported")
+}
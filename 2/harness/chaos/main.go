@@ -0,0 +1,282 @@
+//Runs clients against a local cluster while injecting faults, then checks that the recorded history is linearizable.
+package main
+
+import (
+    "context"
+    "errors"
+    "flag"
+    "fmt"
+    "log/slog"
+    "math/rand"
+    "os"
+    "os/signal"
+    "path/filepath"
+    "strings"
+    "sync"
+    "syscall"
+    "time"
+
+    "github.com/eparoshin/tors_hw/2/client/history"
+    "github.com/eparoshin/tors_hw/2/client/kvclient"
+    "github.com/eparoshin/tors_hw/2/harness"
+)
+
+var logger = slog.Default()
+
+func fatal(msg string, args ...any) {
+    logger.Error(msg, args...)
+    os.Exit(1)
+}
+
+type workload struct {
+    kv *kvclient.Client
+    recorder *history.Recorder
+    keys int
+    readRatio float64
+    casRatio float64
+    opTimeout time.Duration
+}
+
+//reads, writes and compare-and-sets of random keys, cas expects the last value the client saw
+func (load workload) run(ctx context.Context, worker int) {
+    rng := rand.New(rand.NewSource(time.Now().UnixNano() + int64(worker)))
+    seen := map[string]string{}
+    for n := 0; ctx.Err() == nil; n++ {
+        key := fmt.Sprintf("chaos/%d", rng.Intn(load.keys))
+        value := fmt.Sprintf("%d-%d", worker, n)
+        opCtx, cancel := context.WithTimeout(ctx, load.opTimeout)
+        call := time.Now()
+        choice := rng.Float64()
+        prev, haveSeen := seen[key]
+        switch {
+        case choice < load.readRatio:
+            item, err := load.kv.Get(opCtx, key)
+            load.recorder.Record(worker, history.Operation{Op: history.OpRead, Key: key, Value: item.Value, Found: err == nil}, call, err)
+            if err == nil {
+                seen[key] = item.Value
+            }
+        case choice < load.readRatio + load.casRatio && haveSeen:
+            err := load.kv.CAS(opCtx, key, prev, value)
+            load.recorder.Record(worker, history.Operation{Op: history.OpCas, Key: key, PrevValue: prev, Value: value}, call, err)
+            if err == nil {
+                seen[key] = value
+            }
+        default:
+            _, err := load.kv.Upsert(opCtx, key, value)
+            load.recorder.Record(worker, history.Operation{Op: history.OpWrite, Key: key, Value: value}, call, err)
+            if err == nil {
+                seen[key] = value
+            }
+        }
+        cancel()
+    }
+}
+
+//injects one fault and returns the function that undoes it
+func injectFault(ctx context.Context, cluster *harness.Cluster, fault string) func() {
+    n := cluster.Size()
+    node := rand.Intn(n)
+    switch fault {
+    case "partition":
+        nodes := rand.Perm(n)
+        cluster.Partition(nodes[:n / 2], nodes[n / 2:])
+    case "isolate-leader":
+        leader, err := cluster.Leader(ctx)
+        if err != nil {
+            logger.Warn("No leader to isolate", "err", err)
+            return func() {}
+        }
+        cluster.Isolate(leader)
+    case "kill":
+        cluster.Kill(node)
+        return func() {
+            if err := cluster.Start(node); err != nil {
+                logger.Error("Error while starting node", "node", node, "err", err)
+            }
+        }
+    case "pause":
+        cluster.Pause(node)
+    case "latency":
+        cluster.SetLatency(50 * time.Millisecond, 100 * time.Millisecond)
+    case "loss":
+        cluster.SetLoss(0.1)
+    }
+    return cluster.Heal
+}
+
+var faultNames = []string{"partition", "isolate-leader", "kill", "pause", "latency", "loss"}
+
+func main() {
+    binary := flag.String("binary", "", "server binary, built from -server-dir if empty")
+    serverDir := flag.String("server-dir", "2/server", "server sources")
+    nodes := flag.Int("nodes", 3, "cluster size")
+    dir := flag.String("dir", "", "directory for the nodes and results, temporary if empty")
+    duration := flag.Duration("duration", 30 * time.Second, "duration of the workload")
+    clients := flag.Int("clients", 5, "concurrent clients")
+    keys := flag.Int("keys", 3, "number of keys")
+    readRatio := flag.Float64("read-ratio", 0.4, "share of reads")
+    casRatio := flag.Float64("cas-ratio", 0.3, "share of compare-and-sets, the rest are writes")
+    faults := flag.String("faults", strings.Join(faultNames, ","), "faults to inject, comma separated, none if empty")
+    interval := flag.Duration("interval", 3 * time.Second, "duration of each fault and of the healthy period after it")
+    checkTimeout := flag.Duration("check-timeout", time.Minute, "limit for checking each key")
+    logLevel := flag.String("log-level", "info", "debug, info, warn or error")
+    clientLogLevel := flag.String("client-log-level", "error", "level of the client, it warns about every retry")
+    snapshotEntries := flag.Int("snapshot-entries", 0, "nodes snapshot and compact their logs after this many entries, never if zero")
+    storage := flag.String("storage", "", "storage engine of the nodes, memory or lsm, the server default if empty")
+    splitKeys := flag.Int("split-keys", 0, "ranges with more keys are split during the run, a single range if zero")
+    flag.Parse()
+
+    var level, clientLevel slog.Level
+    if err := level.UnmarshalText([]byte(*logLevel)); err != nil {
+        fatal("Bad log level", "err", err)
+    }
+    if err := clientLevel.UnmarshalText([]byte(*clientLogLevel)); err != nil {
+        fatal("Bad client log level", "err", err)
+    }
+    logger = slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: level}))
+    clientLogger := slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: clientLevel}))
+    var faultList []string
+    if *faults != "" {
+        faultList = strings.Split(*faults, ",")
+    }
+    for _, fault := range faultList {
+        known := false
+        for _, name := range faultNames {
+            known = known || fault == name
+        }
+        if !known {
+            fatal("Unknown fault", "fault", fault, "known", faultNames)
+        }
+    }
+
+    ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+    defer stop()
+
+    keep := *dir != ""
+    if !keep {
+        var err error
+        if *dir, err = os.MkdirTemp("", "kv-chaos-"); err != nil {
+            fatal("Error while creating directory", "err", err)
+        }
+    }
+    if *binary == "" {
+        *binary = filepath.Join(*dir, "server")
+        logger.Info("Building server", "dir", *serverDir)
+        if err := harness.Build(*serverDir, *binary); err != nil {
+            fatal("Error while building server", "err", err)
+        }
+    }
+
+    app := make(map[string]any)
+    if *snapshotEntries > 0 {
+        app["snapshot"] = map[string]any{"log_entries": *snapshotEntries, "check_interval_ms": 500}
+    }
+    if *storage != "" {
+        //small memtables make the nodes flush and compact often
+        app["storage"] = map[string]any{"engine": *storage, "memtable_bytes": 16 << 10}
+    }
+    if *splitKeys > 0 {
+        app["ranges"] = map[string]any{"split_keys": *splitKeys, "check_interval_ms": 500}
+    }
+    cluster, err := harness.Start(harness.Options{Binary: *binary, Nodes: *nodes, Dir: filepath.Join(*dir, "cluster"), App: app, Logger: logger})
+    if err != nil {
+        fatal("Error while starting cluster", "err", err)
+    }
+    defer cluster.Close()
+    waitCtx, cancel := context.WithTimeout(ctx, 10 * time.Second)
+    _, err = cluster.WaitForLeader(waitCtx)
+    cancel()
+    if err != nil {
+        fatal("Cluster did not elect a leader", "err", err)
+    }
+
+    historyFile := filepath.Join(*dir, "history.jsonl")
+    recorder, err := history.NewRecorder(historyFile)
+    if err != nil {
+        fatal("Error while creating history", "err", err)
+    }
+    kv, err := kvclient.New(kvclient.Config{Nodes: cluster.Nodes(), Logger: clientLogger, MaxAttempts: 5})
+    if err != nil {
+        fatal("Error while creating client", "err", err)
+    }
+    load := workload{kv: kv, recorder: recorder, keys: *keys, readRatio: *readRatio, casRatio: *casRatio, opTimeout: time.Second}
+
+    loadCtx, stopLoad := context.WithTimeout(ctx, *duration)
+    defer stopLoad()
+    var wg sync.WaitGroup
+    for worker := 0; worker < *clients; worker++ {
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+            load.run(loadCtx, worker)
+        }()
+    }
+
+    //faults and healthy periods alternate until the end of the workload
+    for len(faultList) > 0 && loadCtx.Err() == nil {
+        select {
+        case <- loadCtx.Done():
+        case <- time.After(*interval):
+        }
+        if loadCtx.Err() != nil {
+            break
+        }
+        fault := faultList[rand.Intn(len(faultList))]
+        logger.Info("Injecting fault", "fault", fault)
+        undo := injectFault(loadCtx, cluster, fault)
+        select {
+        case <- loadCtx.Done():
+        case <- time.After(*interval):
+        }
+        undo()
+    }
+    wg.Wait()
+    cluster.Heal()
+    for i := 0; i < cluster.Size(); i++ {
+        if err := cluster.Start(i); err != nil {
+            logger.Error("Error while starting node", "node", i, "err", err)
+        }
+    }
+    if err := recorder.Close(); err != nil {
+        fatal("Error while writing history", "err", err)
+    }
+    if ctx.Err() != nil {
+        fatal("Interrupted", "dir", *dir)
+    }
+
+    ops, err := history.Load(historyFile)
+    if err != nil {
+        fatal("Error while reading history", "err", err)
+    }
+    result := history.Check(ops, *checkTimeout)
+    vizFile := filepath.Join(*dir, "history.html")
+    if file, err := os.Create(vizFile); err == nil {
+        err = errors.Join(history.WriteHTML(file, result, ops), file.Close())
+        if err != nil {
+            logger.Error("Error while writing visualization", "err", err)
+        }
+    }
+
+    switch {
+    case len(result.Violations) != 0:
+        fmt.Printf("%d ops on %d keys: not linearizable, %d keys violate, see %s\n", result.Ops, result.Keys, len(result.Violations), vizFile)
+    case len(result.TimedOut) != 0:
+        fmt.Printf("%d ops on %d keys: unknown, check timed out for %q\n", result.Ops, result.Keys, result.TimedOut)
+    default:
+        fmt.Printf("%d ops on %d keys: linearizable\n", result.Ops, result.Keys)
+    }
+    if !result.Ok() {
+        //the nodes logs and the history are kept for investigation
+        keep = true
+    }
+    if !keep {
+        cluster.Close()
+        os.RemoveAll(*dir)
+    } else {
+        fmt.Printf("results are in %s\n", *dir)
+    }
+    if !result.Ok() {
+        cluster.Close()
+        os.Exit(1)
+    }
+}
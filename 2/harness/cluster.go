@@ -0,0 +1,458 @@
+//Package harness runs a local cluster of server processes for fault injection scenarios.
+//Internal traffic between every pair of nodes goes through a Link proxy, so links can be cut, delayed or made lossy,
+//and the processes can be killed, paused and restarted. Clients talk to the external ports directly.
+package harness
+
+import (
+    "context"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "log/slog"
+    "net"
+    "os"
+    "os/exec"
+    "path/filepath"
+    "strings"
+    "sync"
+    "syscall"
+    "time"
+
+    "github.com/eparoshin/tors_hw/2/client/kvclient"
+)
+
+var logger = slog.Default()
+
+type Options struct {
+    Binary string //server binary, see Build
+    Nodes int //3 if zero
+    Dir string //workdirs, configs and logs of the nodes, a temporary directory removed by Close if empty
+    App map[string]any //app config, timeouts default to fast elections
+    Args []string //extra server flags
+    Logger *slog.Logger
+}
+
+type node struct {
+    id int
+    cmd *exec.Cmd
+    done chan struct{} //closed when the process exits
+    paused bool
+}
+
+type Cluster struct {
+    options Options
+    dir string
+    temporary bool
+    nodes []kvclient.Node //as clients see them
+    links map[[2]int]*Link
+
+    m sync.Mutex
+    procs []*node
+}
+
+//builds the server package in serverDir into output, the package is built from its files so no module is needed
+func Build(serverDir string, output string) error {
+    files, err := filepath.Glob(filepath.Join(serverDir, "*.go"))
+    if err != nil {
+        return err
+    }
+    var sources []string
+    for _, file := range files {
+        if !strings.HasSuffix(file, "_test.go") {
+            sources = append(sources, filepath.Base(file))
+        }
+    }
+    if len(sources) == 0 {
+        return fmt.Errorf("No Go files in %s", serverDir)
+    }
+    output, err = filepath.Abs(output)
+    if err != nil {
+        return err
+    }
+    cmd := exec.Command("go", append([]string{"build", "-o", output}, sources...)...)
+    cmd.Dir = serverDir
+    if out, err := cmd.CombinedOutput(); err != nil {
+        return fmt.Errorf("Build failed: %w\n%s", err, out)
+    }
+    return nil
+}
+
+func freePort() (int, error) {
+    listener, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        return 0, err
+    }
+    defer listener.Close()
+    return listener.Addr().(*net.TCPAddr).Port, nil
+}
+
+func writeJson(fileName string, value any) error {
+    data, err := json.MarshalIndent(value, "", "    ")
+    if err != nil {
+        return err
+    }
+    return os.WriteFile(fileName, data, 0644)
+}
+
+//writes the configs and starts every node
+func Start(options Options) (*Cluster, error) {
+    if options.Nodes == 0 {
+        options.Nodes = 3
+    }
+    if options.Logger != nil {
+        logger = options.Logger
+    }
+    cluster := &Cluster{options: options, dir: options.Dir, links: map[[2]int]*Link{}, procs: make([]*node, options.Nodes)}
+    if cluster.dir == "" {
+        dir, err := os.MkdirTemp("", "kv-harness-")
+        if err != nil {
+            return nil, err
+        }
+        cluster.dir = dir
+        cluster.temporary = true
+    }
+    if err := cluster.setup(); err != nil {
+        cluster.Close()
+        return nil, err
+    }
+    for i := range cluster.procs {
+        if err := cluster.Start(i); err != nil {
+            cluster.Close()
+            return nil, err
+        }
+    }
+    return cluster, nil
+}
+
+func (cluster *Cluster) setup() error {
+    type nodeConfig struct {
+        Host string `json:"host"`
+        InternalPort int `json:"internal_port"`
+        ExternalPort int `json:"external_port"`
+    }
+    config := make([]nodeConfig, cluster.options.Nodes)
+    for i := range config {
+        internal, err := freePort()
+        if err != nil {
+            return err
+        }
+        external, err := freePort()
+        if err != nil {
+            return err
+        }
+        config[i] = nodeConfig{Host: "127.0.0.1", InternalPort: internal, ExternalPort: external}
+        cluster.nodes = append(cluster.nodes, kvclient.Node{Host: "127.0.0.1", InternalPort: internal, ExternalPort: external})
+        if err := os.MkdirAll(cluster.workdir(i), 0755); err != nil {
+            return err
+        }
+    }
+    if err := writeJson(cluster.NodesConfig(), config); err != nil {
+        return err
+    }
+
+    //every node reaches its peers through its own links
+    for from := range config {
+        peers := append([]nodeConfig(nil), config...)
+        for to := range config {
+            if from == to {
+                continue
+            }
+            link, err := newLink(from, to, fmt.Sprintf("127.0.0.1:%d", config[to].InternalPort))
+            if err != nil {
+                return err
+            }
+            cluster.links[[2]int{from, to}] = link
+            peers[to].InternalPort = link.Port()
+        }
+        if err := writeJson(cluster.nodeConfigFile(from), peers); err != nil {
+            return err
+        }
+    }
+
+    app := map[string]any{
+        "hb_timeout_ms": 500,
+        "random_shift_ms": 300,
+        "vote_request_timeout_ms": 200,
+        "append_entries_timeout_ms": 200,
+        "hb_interval_ms": 100,
+        "shutdown_timeout_ms": 2000,
+    }
+    for name, value := range cluster.options.App {
+        app[name] = value
+    }
+    return writeJson(cluster.appConfigFile(), app)
+}
+
+func (cluster *Cluster) Dir() string {
+    return cluster.dir
+}
+
+//nodes config with the real ports for clients
+func (cluster *Cluster) NodesConfig() string {
+    return filepath.Join(cluster.dir, "nodes.json")
+}
+
+func (cluster *Cluster) nodeConfigFile(i int) string {
+    return filepath.Join(cluster.dir, fmt.Sprintf("nodes%d.json", i))
+}
+
+func (cluster *Cluster) appConfigFile() string {
+    return filepath.Join(cluster.dir, "app.json")
+}
+
+func (cluster *Cluster) workdir(i int) string {
+    return filepath.Join(cluster.dir, fmt.Sprintf("node%d", i))
+}
+
+//output of the node, appended to by every start
+func (cluster *Cluster) LogFile(i int) string {
+    return filepath.Join(cluster.dir, fmt.Sprintf("node%d.log", i))
+}
+
+func (cluster *Cluster) Size() int {
+    return len(cluster.procs)
+}
+
+func (cluster *Cluster) Nodes() []kvclient.Node {
+    return cluster.nodes
+}
+
+func (cluster *Cluster) Client() (*kvclient.Client, error) {
+    return kvclient.New(kvclient.Config{Nodes: cluster.nodes, Logger: logger})
+}
+
+func (cluster *Cluster) Link(from int, to int) *Link {
+    return cluster.links[[2]int{from, to}]
+}
+
+//starts the node with its existing workdir, does nothing if it is running
+func (cluster *Cluster) Start(i int) error {
+    cluster.m.Lock()
+    defer cluster.m.Unlock()
+    if proc := cluster.procs[i]; proc != nil && !proc.exited() {
+        return nil
+    }
+
+    logFile, err := os.OpenFile(cluster.LogFile(i), os.O_WRONLY | os.O_APPEND | os.O_CREATE, 0644)
+    if err != nil {
+        return err
+    }
+    args := append([]string{
+        "-nodeid", fmt.Sprint(i),
+        "-workdir", cluster.workdir(i),
+        "-nodes-config", cluster.nodeConfigFile(i),
+        "-app-config", cluster.appConfigFile(),
+    }, cluster.options.Args...)
+    cmd := exec.Command(cluster.options.Binary, args...)
+    cmd.Stdout = logFile
+    cmd.Stderr = logFile
+    cmd.SysProcAttr = procAttr()
+    if err := cmd.Start(); err != nil {
+        logFile.Close()
+        return err
+    }
+    proc := &node{id: i, cmd: cmd, done: make(chan struct{})}
+    go func() {
+        err := cmd.Wait()
+        logFile.Close()
+        logger.Info("Node exited", "node", i, "err", err)
+        close(proc.done)
+    }()
+    cluster.procs[i] = proc
+    logger.Info("Node started", "node", i, "pid", cmd.Process.Pid)
+    return nil
+}
+
+func (proc *node) exited() bool {
+    select {
+    case <- proc.done:
+        return true
+    default:
+        return false
+    }
+}
+
+func (cluster *Cluster) running(i int) *node {
+    cluster.m.Lock()
+    defer cluster.m.Unlock()
+    if proc := cluster.procs[i]; proc != nil && !proc.exited() {
+        return proc
+    }
+    return nil
+}
+
+func (cluster *Cluster) Running(i int) bool {
+    return cluster.running(i) != nil
+}
+
+func (cluster *Cluster) signal(i int, signal syscall.Signal) *node {
+    proc := cluster.running(i)
+    if proc == nil {
+        return nil
+    }
+    if err := proc.cmd.Process.Signal(signal); err != nil && !errors.Is(err, os.ErrProcessDone) {
+        logger.Warn("Error while signalling node", "node", i, "signal", signal, "err", err)
+    }
+    return proc
+}
+
+//SIGKILL, waits for the process to exit
+func (cluster *Cluster) Kill(i int) {
+    if proc := cluster.signal(i, syscall.SIGKILL); proc != nil {
+        logger.Info("Killing node", "node", i)
+        <- proc.done
+    }
+}
+
+//graceful shutdown with SIGTERM, the node is killed if it does not exit in time
+func (cluster *Cluster) Stop(i int, timeout time.Duration) {
+    cluster.Resume(i)
+    proc := cluster.signal(i, syscall.SIGTERM)
+    if proc == nil {
+        return
+    }
+    logger.Info("Stopping node", "node", i)
+    select {
+    case <- proc.done:
+    case <- time.After(timeout):
+        cluster.Kill(i)
+    }
+}
+
+//kills and starts the node again
+func (cluster *Cluster) Restart(i int) error {
+    cluster.Kill(i)
+    return cluster.Start(i)
+}
+
+//SIGSTOP, the node keeps its connections but does not answer
+func (cluster *Cluster) Pause(i int) {
+    if proc := cluster.signal(i, syscall.SIGSTOP); proc != nil {
+        logger.Info("Paused node", "node", i)
+        cluster.m.Lock()
+        proc.paused = true
+        cluster.m.Unlock()
+    }
+}
+
+func (cluster *Cluster) Resume(i int) {
+    proc := cluster.running(i)
+    if proc == nil {
+        return
+    }
+    cluster.m.Lock()
+    paused := proc.paused
+    proc.paused = false
+    cluster.m.Unlock()
+    if paused {
+        cluster.signal(i, syscall.SIGCONT)
+        logger.Info("Resumed node", "node", i)
+    }
+}
+
+//cuts the links between nodes of different groups in both directions, nodes that are in no group are isolated
+func (cluster *Cluster) Partition(groups ...[]int) {
+    group := make([]int, cluster.Size())
+    for i := range group {
+        group[i] = -1 - i
+    }
+    for g, nodes := range groups {
+        for _, i := range nodes {
+            group[i] = g
+        }
+    }
+    for key, link := range cluster.links {
+        if group[key[0]] != group[key[1]] {
+            link.Block()
+        } else {
+            link.Unblock()
+        }
+    }
+    logger.Info("Partitioned", "groups", groups)
+}
+
+//cuts the node off from every other node
+func (cluster *Cluster) Isolate(i int) {
+    for key, link := range cluster.links {
+        if key[0] == i || key[1] == i {
+            link.Block()
+        }
+    }
+    logger.Info("Isolated node", "node", i)
+}
+
+func (cluster *Cluster) SetLatency(latency time.Duration, jitter time.Duration) {
+    for _, link := range cluster.links {
+        link.SetLatency(latency, jitter)
+    }
+    logger.Info("Set latency", "latency", latency, "jitter", jitter)
+}
+
+func (cluster *Cluster) SetLoss(probability float64) {
+    for _, link := range cluster.links {
+        link.SetLoss(probability)
+    }
+    logger.Info("Set loss", "probability", probability)
+}
+
+//removes every link fault and resumes paused nodes, stopped nodes stay stopped
+func (cluster *Cluster) Heal() {
+    for _, link := range cluster.links {
+        link.Heal()
+    }
+    for i := range cluster.procs {
+        cluster.Resume(i)
+    }
+    logger.Info("Healed")
+}
+
+//node that reports itself leader with the highest term among the reachable nodes
+func (cluster *Cluster) Leader(ctx context.Context) (int, error) {
+    client, err := cluster.Client()
+    if err != nil {
+        return -1, err
+    }
+    leader, term := -1, uint64(0)
+    for i := range cluster.nodes {
+        statusCtx, cancel := context.WithTimeout(ctx, 500 * time.Millisecond)
+        status, err := client.Status(statusCtx, i)
+        cancel()
+        if err == nil && status.Role == "leader" && (leader < 0 || status.CurrentTerm > term) {
+            leader, term = i, status.CurrentTerm
+        }
+    }
+    if leader < 0 {
+        return -1, errors.New("No leader")
+    }
+    return leader, nil
+}
+
+//polls until a leader is elected or ctx is done
+func (cluster *Cluster) WaitForLeader(ctx context.Context) (int, error) {
+    for {
+        leader, err := cluster.Leader(ctx)
+        if err == nil {
+            return leader, nil
+        }
+        select {
+        case <- ctx.Done():
+            return -1, fmt.Errorf("Waiting for leader: %w", ctx.Err())
+        case <- time.After(100 * time.Millisecond):
+        }
+    }
+}
+
+//kills every node and closes the links, the directory is removed if it was created by Start
+func (cluster *Cluster) Close() error {
+    for i := range cluster.procs {
+        cluster.Resume(i)
+        cluster.Kill(i)
+    }
+    for _, link := range cluster.links {
+        link.Close()
+    }
+    if cluster.temporary {
+        return os.RemoveAll(cluster.dir)
+    }
+    return nil
+}
@@ -0,0 +1,155 @@
+package harness
+
+import (
+    "context"
+    "fmt"
+    "os/exec"
+    "path/filepath"
+    "slices"
+    "sync"
+    "testing"
+    "time"
+
+    "github.com/eparoshin/tors_hw/2/client/history"
+    "github.com/eparoshin/tors_hw/2/client/kvclient"
+)
+
+//builds the server and starts a cluster removed at the end of the test
+func startCluster(t *testing.T) *Cluster {
+    if testing.Short() {
+        t.Skip("Starts a cluster of server processes")
+    }
+    if _, err := exec.LookPath("go"); err != nil {
+        t.Skip("Go toolchain is needed to build the server")
+    }
+
+    dir := t.TempDir()
+    binary := filepath.Join(dir, "server")
+    if err := Build("../server", binary); err != nil {
+        t.Fatal(err)
+    }
+    cluster, err := Start(Options{Binary: binary, Dir: filepath.Join(dir, "cluster")})
+    if err != nil {
+        t.Fatal(err)
+    }
+    t.Cleanup(func() { cluster.Close() })
+
+    ctx, cancel := context.WithTimeout(context.Background(), 10 * time.Second)
+    defer cancel()
+    if _, err := cluster.WaitForLeader(ctx); err != nil {
+        t.Fatal(err)
+    }
+    return cluster
+}
+
+//waits until every node applied the same index, reads served by followers see all writes after that
+func waitConverged(ctx context.Context, cluster *Cluster, kv *kvclient.Client) error {
+    for {
+        var applied []uint64
+        for i := 0; i < cluster.Size(); i++ {
+            if status, err := kv.Status(ctx, i); err == nil && status.LastApplied == status.CommitIndex {
+                applied = append(applied, status.LastApplied)
+            }
+        }
+        if len(applied) == cluster.Size() && slices.Min(applied) == slices.Max(applied) {
+            return nil
+        }
+        select {
+        case <- ctx.Done():
+            return fmt.Errorf("Waiting for the nodes to apply the log: %w", ctx.Err())
+        case <- time.After(100 * time.Millisecond):
+        }
+    }
+}
+
+//writers keep upserting and compare-and-setting a few keys while the leader is cut off from the other nodes
+//and after the heal. Followers serve reads from their own state, so the keys are read once the nodes converged
+func TestPartitionedLeader(t *testing.T) {
+    cluster := startCluster(t)
+    historyFile := filepath.Join(t.TempDir(), "history.jsonl")
+    recorder, err := history.NewRecorder(historyFile)
+    if err != nil {
+        t.Fatal(err)
+    }
+    kv, err := kvclient.New(kvclient.Config{Nodes: cluster.Nodes(), MaxAttempts: 5})
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    keys := []string{"partition/0", "partition/1"}
+    ctx, stop := context.WithCancel(context.Background())
+    var wg sync.WaitGroup
+    for worker := 0; worker < 3; worker++ {
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+            written := map[string]string{}
+            for n := 0; ctx.Err() == nil; n++ {
+                key := keys[n % len(keys)]
+                value := fmt.Sprintf("%d-%d", worker, n)
+                opCtx, cancel := context.WithTimeout(ctx, time.Second)
+                call := time.Now()
+                var err error
+                if prev, ok := written[key]; ok && n % 3 == 0 {
+                    err = kv.CAS(opCtx, key, prev, value)
+                    recorder.Record(worker, history.Operation{Op: history.OpCas, Key: key, PrevValue: prev, Value: value}, call, err)
+                } else {
+                    _, err = kv.Upsert(opCtx, key, value)
+                    recorder.Record(worker, history.Operation{Op: history.OpWrite, Key: key, Value: value}, call, err)
+                }
+                if err == nil {
+                    written[key] = value
+                }
+                cancel()
+            }
+        }()
+    }
+
+    time.Sleep(time.Second)
+    leader, err := cluster.Leader(ctx)
+    if err != nil {
+        t.Fatal(err)
+    }
+    cluster.Isolate(leader)
+    time.Sleep(3 * time.Second)
+    cluster.Heal()
+    time.Sleep(2 * time.Second)
+    stop()
+    wg.Wait()
+
+    waitCtx, cancel := context.WithTimeout(context.Background(), 10 * time.Second)
+    defer cancel()
+    if err := waitConverged(waitCtx, cluster, kv); err != nil {
+        t.Fatal(err)
+    }
+    for i := 0; i < cluster.Size(); i++ {
+        for _, key := range keys {
+            call := time.Now()
+            item, err := kv.Node(i).Get(waitCtx, key)
+            recorder.Record(cluster.Size() + i, history.Operation{Op: history.OpRead, Key: key, Value: item.Value, Found: err == nil}, call, err)
+            if err != nil {
+                t.Fatalf("Error while reading %s from node %d: %v", key, i, err)
+            }
+        }
+    }
+    if err := recorder.Close(); err != nil {
+        t.Fatal(err)
+    }
+
+    ops, err := history.Load(historyFile)
+    if err != nil {
+        t.Fatal(err)
+    }
+    result := history.Check(ops, 30 * time.Second)
+    if !result.Ok() {
+        t.Fatalf("History of %d ops is not linearizable, violations %+v, timed out %q", result.Ops, result.Violations, result.TimedOut)
+    }
+    outcomes := map[string]int{}
+    for _, op := range ops {
+        outcomes[op.Outcome]++
+    }
+    if outcomes[history.Ok] == 0 {
+        t.Fatalf("No op succeeded in %d ops", len(ops))
+    }
+    t.Logf("%d ops with outcomes %v", len(ops), outcomes)
+}
@@ -0,0 +1,8 @@
+package harness
+
+import "syscall"
+
+//nodes are killed with the harness so that they do not keep the ports
+func procAttr() *syscall.SysProcAttr {
+    return &syscall.SysProcAttr{Pdeathsig: syscall.SIGKILL}
+}
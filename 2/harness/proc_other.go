@@ -0,0 +1,9 @@
+//go:build !linux
+
+package harness
+
+import "syscall"
+
+func procAttr() *syscall.SysProcAttr {
+    return nil
+}
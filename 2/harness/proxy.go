@@ -0,0 +1,195 @@
+package harness
+
+import (
+    "errors"
+    "math/rand"
+    "net"
+    "sync"
+    "time"
+)
+
+//TCP proxy for the internal traffic sent from one node to another
+type Link struct {
+    From int
+    To int
+    listener net.Listener
+    target string
+
+    m sync.Mutex
+    blocked bool
+    healed chan struct{} //closed when the link is unblocked
+    latency time.Duration
+    jitter time.Duration
+    loss float64
+    conns map[net.Conn]struct{}
+}
+
+func newLink(from int, to int, target string) (*Link, error) {
+    listener, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        return nil, err
+    }
+    link := &Link{From: from, To: to, listener: listener, target: target, conns: map[net.Conn]struct{}{}}
+    go link.accept()
+    return link, nil
+}
+
+func (link *Link) Port() int {
+    return link.listener.Addr().(*net.TCPAddr).Port
+}
+
+func (link *Link) accept() {
+    for {
+        conn, err := link.listener.Accept()
+        if err != nil {
+            if !errors.Is(err, net.ErrClosed) {
+                logger.Warn("Proxy accept failed", "from", link.From, "to", link.To, "err", err)
+            }
+            return
+        }
+        go link.handle(conn)
+    }
+}
+
+func (link *Link) track(conns ...net.Conn) {
+    link.m.Lock()
+    defer link.m.Unlock()
+    for _, conn := range conns {
+        link.conns[conn] = struct{}{}
+    }
+}
+
+func (link *Link) untrack(conns ...net.Conn) {
+    link.m.Lock()
+    defer link.m.Unlock()
+    for _, conn := range conns {
+        delete(link.conns, conn)
+        conn.Close()
+    }
+}
+
+//connections to a blocked link hang like packets sent into a partition until the sender gives up or the link heals
+func (link *Link) handle(conn net.Conn) {
+    link.m.Lock()
+    blocked, healed := link.blocked, link.healed
+    link.m.Unlock()
+    if blocked {
+        link.track(conn)
+        <- healed
+        link.untrack(conn)
+        return
+    }
+
+    upstream, err := net.DialTimeout("tcp", link.target, time.Second)
+    if err != nil {
+        conn.Close()
+        return
+    }
+    link.track(conn, upstream)
+    go link.pipe(conn, upstream)
+    link.pipe(upstream, conn)
+}
+
+type chunk struct {
+    data []byte
+    deliverAt time.Time
+}
+
+//copies src to dst delaying every chunk by the latency of the link, the connection is reset when a chunk is lost
+func (link *Link) pipe(dst net.Conn, src net.Conn) {
+    defer link.untrack(dst, src)
+    chunks := make(chan chunk, 64)
+    go func() {
+        defer close(chunks)
+        for {
+            buffer := make([]byte, 32 << 10)
+            n, err := src.Read(buffer)
+            if err != nil {
+                return
+            }
+            link.m.Lock()
+            latency := link.latency
+            if link.jitter > 0 {
+                latency += time.Duration(rand.Int63n(int64(link.jitter)))
+            }
+            lost := link.blocked || link.loss > 0 && rand.Float64() < link.loss
+            link.m.Unlock()
+            if lost {
+                return
+            }
+            chunks <- chunk{data: buffer[:n], deliverAt: time.Now().Add(latency)}
+        }
+    }()
+
+    for chunk := range chunks {
+        time.Sleep(time.Until(chunk.deliverAt))
+        if _, err := dst.Write(chunk.data); err != nil {
+            break
+        }
+    }
+    //unblocks the reader if the writer failed
+    src.Close()
+    for range chunks {
+    }
+}
+
+//drops the open connections and makes new ones hang until Unblock
+func (link *Link) Block() {
+    link.m.Lock()
+    if link.blocked {
+        link.m.Unlock()
+        return
+    }
+    link.blocked = true
+    link.healed = make(chan struct{})
+    conns := make([]net.Conn, 0, len(link.conns))
+    for conn := range link.conns {
+        conns = append(conns, conn)
+    }
+    link.m.Unlock()
+
+    for _, conn := range conns {
+        conn.Close()
+    }
+}
+
+func (link *Link) Unblock() {
+    link.m.Lock()
+    defer link.m.Unlock()
+    if link.blocked {
+        link.blocked = false
+        close(link.healed)
+    }
+}
+
+//every chunk is delayed by latency plus a random duration up to jitter
+func (link *Link) SetLatency(latency time.Duration, jitter time.Duration) {
+    link.m.Lock()
+    defer link.m.Unlock()
+    link.latency = latency
+    link.jitter = jitter
+}
+
+//TCP does not lose packets, a lost chunk resets its connection instead, so the request or response in it is lost
+func (link *Link) SetLoss(probability float64) {
+    link.m.Lock()
+    defer link.m.Unlock()
+    link.loss = probability
+}
+
+//removes all faults
+func (link *Link) Heal() {
+    link.Unblock()
+    link.SetLatency(0, 0)
+    link.SetLoss(0)
+}
+
+func (link *Link) Close() {
+    link.listener.Close()
+    link.Unblock()
+    link.m.Lock()
+    defer link.m.Unlock()
+    for conn := range link.conns {
+        conn.Close()
+    }
+}
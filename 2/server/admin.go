@@ -0,0 +1,247 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "net/http"
+    "strconv"
+    "strings"
+    "time"
+)
+
+type MemberStatus struct {
+    NodeId uint64 `json:"node_id"`
+    ExternalUri string `json:"external_uri"`
+    InternalUri string `json:"internal_uri"`
+    Role string `json:"role"`
+    Leader bool `json:"leader"`
+    MatchIndex uint64 `json:"match_index"`
+    SinceLastHBMs *int64 `json:"since_last_hb_ms"`
+}
+
+//GET /admin/members lists the nodes with their roles as the leader sees them,
+//PUT /admin/members/<id> with {"role": "voter"|"learner"|"removed"} changes the role of a node.
+//Members are the nodes of the static nodes config, roles only change which of them vote or get entries.
+//A new node has to be added to the nodes config of every node, which are restarted one by one, before it is made a member
+func (state ExternalState) handleMembers(w http.ResponseWriter, r *http.Request) {
+    if !state.isLeader() {
+        state.redirectToLeader(w, r)
+        return
+    }
+
+    if r.URL.Path == "/admin/members" {
+        if r.Method != "GET" {
+            w.Header().Add("Allow", "GET")
+            w.WriteHeader(http.StatusMethodNotAllowed)
+            return
+        }
+        writeJson(w, http.StatusOK, state.members())
+        return
+    }
+
+    if r.Method != "PUT" {
+        w.Header().Add("Allow", "PUT")
+        w.WriteHeader(http.StatusMethodNotAllowed)
+        return
+    }
+    if !state.changesMembership(w) {
+        return
+    }
+    nodeId, err := strconv.ParseUint(strings.TrimPrefix(r.URL.Path, "/admin/members/"), 10, 64)
+    if err != nil {
+        writeJson(w, http.StatusNotFound, map[string]string{"error": "Node not found"})
+        return
+    }
+    if nodeId >= uint64(len(state.nodes)) {
+        writeJson(w, http.StatusNotFound, map[string]string{"error": fmt.Sprintf("Node %d is not in the nodes config, add it to the nodes config of every node and restart them first", nodeId)})
+        return
+    }
+    var request struct {
+        Role string `json:"role"`
+    }
+    if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+    if request.Role != RoleVoter && request.Role != RoleLearner && request.Role != RoleRemoved {
+        http.Error(w, "Role must be voter, learner or removed", http.StatusBadRequest)
+        return
+    }
+    state.setRole(w, r, nodeId, request.Role)
+}
+
+func (state ExternalState) members() (members []MemberStatus) {
+    state.env.WithLock(func(env *TEnv) {
+        for i, node := range state.nodes {
+            member := MemberStatus{
+                NodeId: uint64(i),
+                ExternalUri: node.ExternalUri(),
+                InternalUri: node.InternalUri(),
+                Role: env.roles[i],
+                Leader: uint64(i) == state.nodeId,
+            }
+            if env.leaderState != nil && !member.Leader {
+                member.MatchIndex = env.leaderState.MatchIndex[i]
+                member.SinceLastHBMs = sinceMs(env.leaderState.LastContact[i])
+            } else {
+                member.MatchIndex = env.l.LastIndex()
+            }
+            members = append(members, member)
+        }
+    })
+    return
+}
+
+//the other ranges follow the roles of range 0, a change made to one of them would be reverted
+func (state ExternalState) changesMembership(w http.ResponseWriter) bool {
+    if state.db != state.rootDb() {
+        writeJson(w, http.StatusConflict, map[string]string{"error": "Roles are changed through range 0, the other ranges follow it"})
+        return false
+    }
+    return true
+}
+
+//new voters have to catch up first, the leader keeps its vote until it hands leadership over
+func (state ExternalState) setRole(w http.ResponseWriter, r *http.Request, nodeId uint64, role string) {
+    var current string
+    var caughtUp bool
+    var voters int
+    state.env.WithLock(func(env *TEnv) {
+        current = env.roles[nodeId]
+        caughtUp = env.leaderState != nil && env.leaderState.MatchIndex[nodeId] >= env.commitIndex
+        voters = env.numVoters()
+    })
+
+    switch {
+    case current == role:
+        writeJson(w, http.StatusOK, map[string]string{"message": "Role unchanged"})
+        return
+    case nodeId == state.nodeId:
+        writeJson(w, http.StatusConflict, map[string]string{"error": "Transfer leadership before changing the role of the leader"})
+        return
+    case role == RoleVoter && !caughtUp:
+        writeJson(w, http.StatusConflict, map[string]string{"error": "Node has not caught up with the leader yet"})
+        return
+    //the leader is one of the voters and keeps its role here
+    case current == RoleVoter && role != RoleVoter && voters - 1 < 2:
+        writeJson(w, http.StatusConflict, map[string]string{"error": "Change would leave no voter besides the leader"})
+        return
+    }
+
+    if _, err := state.env.ApplyRequestSync(SET_ROLE, strconv.FormatUint(nodeId, 10), role, ""); err != nil {
+        writeApplyError(w, err)
+        return
+    }
+
+    requestLogger(extLogger, r).Info("Node role changed", "node", nodeId, "from", current, "to", role)
+    writeJson(w, http.StatusOK, map[string]string{"message": "Role changed successfully"})
+}
+
+//POST /admin/transfer-leadership?to=<id> hands leadership to the given voter or to any up to date one
+func (state ExternalState) handleTransferLeadership(w http.ResponseWriter, r *http.Request) {
+    if r.Method != "POST" {
+        w.Header().Add("Allow", "POST")
+        w.WriteHeader(http.StatusMethodNotAllowed)
+        return
+    }
+
+    if !state.isLeader() {
+        state.redirectToLeader(w, r)
+        return
+    }
+
+    target := -1
+    if to := r.URL.Query().Get("to"); to != "" {
+        nodeId, err := strconv.ParseUint(to, 10, 64)
+        if err != nil || nodeId >= uint64(len(state.nodes)) {
+            writeJson(w, http.StatusNotFound, map[string]string{"error": "Node not found"})
+            return
+        }
+        if nodeId == state.nodeId {
+            writeJson(w, http.StatusOK, map[string]string{"message": "Node is the leader already"})
+            return
+        }
+        if !state.env.IsVoter(nodeId) {
+            writeJson(w, http.StatusConflict, map[string]string{"error": "Node is not a voter"})
+            return
+        }
+        target = int(nodeId)
+    }
+
+    timeout := 10 * time.Duration(int64(state.raft.appConfig.HBTimeout)) * time.Millisecond
+    ctx, cancel := context.WithTimeout(r.Context(), timeout)
+    defer cancel()
+    logger := requestLogger(extLogger, r)
+    if !state.raft.TransferLeadershipTo(ctx, target) {
+        logger.Warn("Leadership transfer failed", "target", target)
+        writeJson(w, http.StatusConflict, map[string]string{"error": "Leadership transfer failed, the target did not catch up or win the election"})
+        return
+    }
+
+    logger.Info("Leadership transferred", "target", target)
+    writeJson(w, http.StatusOK, map[string]string{"message": "Leadership transferred"})
+}
+
+//POST /admin/snapshot snapshots the state machine of this node and compacts its log, nodes do it independently
+func (state ExternalState) handleSnapshot(w http.ResponseWriter, r *http.Request) {
+    if r.Method != "POST" {
+        w.Header().Add("Allow", "POST")
+        w.WriteHeader(http.StatusMethodNotAllowed)
+        return
+    }
+
+    info, err := state.env.TakeSnapshot(state.db)
+    if err != nil {
+        requestLogger(extLogger, r).Error("Error while taking snapshot", "err", err)
+        writeJson(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+        return
+    }
+    writeJson(w, http.StatusOK, info)
+}
+
+type StateHash struct {
+    NodeId uint64 `json:"node_id"`
+    Index uint64 `json:"index"`
+    Hash string `json:"hash"`
+    Items int `json:"items"`
+}
+
+//GET /admin/hash?index=<n> hashes the state machine of this node after applying the log up to n,
+//the current state is hashed without index
+func (state ExternalState) handleHash(w http.ResponseWriter, r *http.Request) {
+    if r.Method != "GET" {
+        w.Header().Add("Allow", "GET")
+        w.WriteHeader(http.StatusMethodNotAllowed)
+        return
+    }
+
+    var index uint64
+    if value := r.URL.Query().Get("index"); value != "" {
+        var err error
+        if index, err = strconv.ParseUint(value, 10, 64); err != nil {
+            http.Error(w, "Invalid index", http.StatusBadRequest)
+            return
+        }
+    }
+
+    snapshot, err := state.env.StateAt(state.db, index, state.storage)
+    defer snapshot.Close()
+    var hash string
+    var items int
+    if err == nil {
+        hash, items, err = snapshot.Hash()
+    }
+    switch {
+    case errors.Is(err, ErrCompacted):
+        writeJson(w, http.StatusGone, map[string]string{"error": err.Error()})
+    case errors.Is(err, ErrNotCommitted):
+        writeJson(w, http.StatusConflict, map[string]string{"error": err.Error()})
+    case err != nil:
+        requestLogger(extLogger, r).Error("Error while rebuilding state", "index", index, "err", err)
+        writeJson(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+    default:
+        writeJson(w, http.StatusOK, StateHash{NodeId: state.nodeId, Index: snapshot.Index, Hash: hash, Items: items})
+    }
+}
@@ -0,0 +1,368 @@
+package main
+
+import (
+    "crypto/sha256"
+    "crypto/subtle"
+    "encoding/hex"
+    "encoding/json"
+    "fmt"
+    "log/slog"
+    "net/http"
+    "strings"
+)
+
+type AuthConfig struct {
+    Enabled bool `json:"enabled"`
+    RootTokenSha256 string `json:"root_token_sha256"` //token with admin access to every key, used to create the first users
+}
+
+//keys with this prefix hold replicated system state and are hidden from the external API
+const sysPrefix = "\x00"
+
+const (
+    authUserPrefix = sysPrefix + "auth/user/"
+    authRolePrefix = sysPrefix + "auth/role/"
+    authTokenPrefix = sysPrefix + "auth/token/"
+)
+
+func isSystemKey(key string) bool {
+    return strings.HasPrefix(key, sysPrefix)
+}
+
+type Access int
+
+const (
+    AccessNone Access = iota
+    AccessRead
+    AccessWrite
+    AccessAdmin //write access and management of users and roles if granted for the empty prefix
+)
+
+var accessNames = map[string]Access{"read": AccessRead, "write": AccessWrite, "admin": AccessAdmin}
+
+type Permission struct {
+    Prefix string `json:"prefix"`
+    Access string `json:"access"`
+}
+
+type Role struct {
+    Permissions []Permission `json:"permissions"`
+}
+
+type User struct {
+    TokenSha256 string `json:"token_sha256"`
+    Roles []string `json:"roles"`
+}
+
+func hashToken(token string) string {
+    sum := sha256.Sum256([]byte(token))
+    return hex.EncodeToString(sum[:])
+}
+
+//compares the decoded hashes in constant time, a malformed or empty hash matches no token
+func tokenMatches(token string, tokenSha256 string) bool {
+    expected, err := hex.DecodeString(tokenSha256)
+    if err != nil || len(expected) != sha256.Size {
+        return false
+    }
+    sum := sha256.Sum256([]byte(token))
+    return subtle.ConstantTimeCompare(sum[:], expected) == 1
+}
+
+func (config AuthConfig) isRootToken(token string) bool {
+    return tokenMatches(token, config.RootTokenSha256)
+}
+
+//AUTH_PUT and AUTH_DELETE entries keep "user/<name>" or "role/<name>" in Key
+func authKey(key string) string {
+    return sysPrefix + "auth/" + key
+}
+
+func (db *Db) commitAuthPut(key string, value string) bool {
+    db.m.Lock()
+    defer db.m.Unlock()
+
+    if name, ok := strings.CutPrefix(key, "user/"); ok {
+        var user User
+        if err := json.Unmarshal([]byte(value), &user); err != nil {
+            dbLogger.Warn("Ignoring malformed user", "user", name, "err", err)
+            return false
+        }
+        //a token identifies one user, deleting either user would drop the mapping of the other one
+        if owner, ok := db.data.Get(authTokenPrefix + user.TokenSha256); ok && owner.Value != name {
+            return false
+        }
+        db.dropUserToken(name)
+        db.set(authTokenPrefix + user.TokenSha256, Item{Value: name})
+    }
+    db.set(authKey(key), Item{Value: value})
+    return true
+}
+
+func (db *Db) commitAuthDelete(key string) bool {
+    db.m.Lock()
+    defer db.m.Unlock()
+
+    if _, ok := db.data.Get(authKey(key)); !ok {
+        return false
+    }
+    if name, ok := strings.CutPrefix(key, "user/"); ok {
+        db.dropUserToken(name)
+    }
+    db.remove(authKey(key))
+    return true
+}
+
+func (db *Db) dropUserToken(name string) {
+    var user User
+    if item, ok := db.data.Get(authUserPrefix + name); ok && json.Unmarshal([]byte(item.Value), &user) == nil {
+        db.remove(authTokenPrefix + user.TokenSha256)
+    }
+}
+
+func (db *Db) getJson(key string, v any) bool {
+    data, ok := db.Get(key)
+    return ok && json.Unmarshal([]byte(data), v) == nil
+}
+
+func (db *Db) UserByToken(token string) (string, *User) {
+    name, ok := db.Get(authTokenPrefix + hashToken(token))
+    if !ok {
+        return "", nil
+    }
+    //the index is looked up by the hash, the hash of the user is compared in constant time
+    var user User
+    if !db.getJson(authUserPrefix + name, &user) || !tokenMatches(token, user.TokenSha256) {
+        return "", nil
+    }
+    return name, &user
+}
+
+func (db *Db) UserAccess(user *User, key string) (access Access) {
+    for _, roleName := range user.Roles {
+        var role Role
+        if !db.getJson(authRolePrefix + roleName, &role) {
+            continue
+        }
+        for _, permission := range role.Permissions {
+            if strings.HasPrefix(key, permission.Prefix) && accessNames[permission.Access] > access {
+                access = accessNames[permission.Access]
+            }
+        }
+    }
+    return
+}
+
+func bearerToken(r *http.Request) (string, bool) {
+    return strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+}
+
+//checks that the caller has at least the given access to the key, writes 401/403 otherwise
+func (state ExternalState) authorize(w http.ResponseWriter, r *http.Request, key string, access Access) bool {
+    code, msg := state.accessError(r, key, access)
+    if code == 0 {
+        return true
+    }
+    if code == http.StatusUnauthorized {
+        w.Header().Set("WWW-Authenticate", "Bearer")
+    }
+    writeJson(w, code, map[string]string{"error": msg})
+    return false
+}
+
+//returns zero code if the access is granted
+func (state ExternalState) accessError(r *http.Request, key string, access Access) (int, string) {
+    if !state.auth.Enabled {
+        return 0, ""
+    }
+
+    token, ok := bearerToken(r)
+    if !ok || token == "" {
+        return http.StatusUnauthorized, "Missing bearer token"
+    }
+    return state.tokenAccess(requestLogger(extLogger, r), token, key, access)
+}
+
+//same as accessError for a token that is already known, auth has to be enabled
+func (state ExternalState) tokenAccess(logger *slog.Logger, token string, key string, access Access) (int, string) {
+    if state.auth.isRootToken(token) {
+        return 0, ""
+    }
+
+    name, user := state.rootDb().UserByToken(token)
+    if user == nil {
+        return http.StatusUnauthorized, "Invalid token"
+    }
+
+    if state.rootDb().UserAccess(user, key) < access {
+        logger.Info("Access denied", "user", name, "key", key, "access", access)
+        return http.StatusForbidden, "Permission denied"
+    }
+    return 0, ""
+}
+
+func validAuthName(name string) bool {
+    return name != "" && !strings.ContainsAny(name, "/\x00")
+}
+
+func (state ExternalState) handleAuthObject(w http.ResponseWriter, r *http.Request, kind string, name string, validate func([]byte) (string, error)) {
+    if !validAuthName(name) {
+        writeJson(w, http.StatusNotFound, map[string]string{"error": fmt.Sprintf("Invalid %s name", kind)})
+        return
+    }
+    key := kind + "/" + name
+
+    switch r.Method {
+    case "GET":
+        if !state.authorize(w, r, "", AccessAdmin) {
+            return
+        }
+        data, ok := state.db.Get(authKey(key))
+        if !ok {
+            writeJson(w, http.StatusNotFound, map[string]string{"error": fmt.Sprintf("No such %s", kind)})
+            return
+        }
+        var object map[string]any
+        if err := json.Unmarshal([]byte(data), &object); err != nil {
+            fatal(extLogger, "Malformed auth object", "key", key, "err", err)
+        }
+        delete(object, "token_sha256")
+        writeJson(w, http.StatusOK, object)
+
+    case "PUT", "DELETE":
+        if !state.isLeader() {
+            state.redirectToLeader(w, r)
+            return
+        }
+        if !state.authorize(w, r, "", AccessAdmin) {
+            return
+        }
+
+        var ok bool
+        var err error
+        if r.Method == "PUT" {
+            var data []byte
+            if data, err = readBody(w, r); err != nil {
+                return
+            }
+            var value string
+            if value, err = validate(data); err != nil {
+                http.Error(w, fmt.Sprint(err), http.StatusBadRequest)
+                return
+            }
+            if kind == "user" && state.tokenTaken(name, value) {
+                writeJson(w, http.StatusConflict, map[string]string{"error": errTokenTaken})
+                return
+            }
+            ok, err = state.env.ApplyRequestSync(AUTH_PUT, key, value, "")
+        } else {
+            ok, err = state.env.ApplyRequestSync(AUTH_DELETE, key, "", "")
+        }
+        if err != nil {
+            writeApplyError(w, err)
+            return
+        }
+        //the state machine rejects a token that another user got in the meantime
+        if !ok && r.Method == "PUT" {
+            writeJson(w, http.StatusConflict, map[string]string{"error": errTokenTaken})
+            return
+        }
+        if !ok {
+            writeJson(w, http.StatusNotFound, map[string]string{"error": fmt.Sprintf("No such %s", kind)})
+            return
+        }
+        requestLogger(extLogger, r).Info("Auth data changed", kind, name, "method", r.Method)
+        if r.Method == "PUT" {
+            writeJson(w, http.StatusOK, map[string]string{"message": fmt.Sprintf("The %s is saved", kind)})
+        } else {
+            writeJson(w, http.StatusOK, map[string]string{"message": fmt.Sprintf("The %s is deleted", kind)})
+        }
+
+    default:
+        w.Header().Add("Allow", "GET, PUT, DELETE")
+        w.WriteHeader(http.StatusMethodNotAllowed)
+    }
+}
+
+const errTokenTaken = "Token belongs to another user"
+
+//value is a validated user, the root token can not be given to users either
+func (state ExternalState) tokenTaken(name string, value string) bool {
+    var user User
+    if json.Unmarshal([]byte(value), &user) != nil {
+        return false
+    }
+    if user.TokenSha256 == state.auth.RootTokenSha256 {
+        return true
+    }
+    owner, ok := state.db.Get(authTokenPrefix + user.TokenSha256)
+    return ok && owner != name
+}
+
+func validateUser(data []byte) (string, error) {
+    var userRequest struct {
+        Token string `json:"token"`
+        Roles []string `json:"roles"`
+    }
+    if err := json.Unmarshal(data, &userRequest); err != nil {
+        return "", err
+    }
+    if userRequest.Token == "" {
+        return "", fmt.Errorf("Token must not be empty")
+    }
+
+    value, err := json.Marshal(User{TokenSha256: hashToken(userRequest.Token), Roles: userRequest.Roles})
+    return string(value), err
+}
+
+func validateRole(data []byte) (string, error) {
+    var role Role
+    if err := json.Unmarshal(data, &role); err != nil {
+        return "", err
+    }
+    for _, permission := range role.Permissions {
+        if _, ok := accessNames[permission.Access]; !ok {
+            return "", fmt.Errorf("Unknown access %q, expected read, write or admin", permission.Access)
+        }
+    }
+
+    value, err := json.Marshal(role)
+    return string(value), err
+}
+
+func (state ExternalState) handleUsers(w http.ResponseWriter, r *http.Request) {
+    state.handleAuthObject(w, r, "user", strings.TrimPrefix(r.URL.Path, "/auth/users/"), validateUser)
+}
+
+func (state ExternalState) handleRoles(w http.ResponseWriter, r *http.Request) {
+    state.handleAuthObject(w, r, "role", strings.TrimPrefix(r.URL.Path, "/auth/roles/"), validateRole)
+}
+
+func (state ExternalState) requireAdmin(handler http.HandlerFunc) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        if state.authorize(w, r, "", AccessAdmin) {
+            handler(w, r)
+        }
+    }
+}
+
+func (state ExternalState) handleWhoami(w http.ResponseWriter, r *http.Request) {
+    if !state.auth.Enabled {
+        writeJson(w, http.StatusOK, map[string]any{"auth_enabled": false})
+        return
+    }
+
+    token, _ := bearerToken(r)
+    if state.auth.isRootToken(token) {
+        writeJson(w, http.StatusOK, map[string]any{"auth_enabled": true, "root": true})
+        return
+    }
+
+    name, user := state.rootDb().UserByToken(token)
+    if user == nil {
+        w.Header().Set("WWW-Authenticate", "Bearer")
+        writeJson(w, http.StatusUnauthorized, map[string]string{"error": "Invalid token"})
+        return
+    }
+    writeJson(w, http.StatusOK, map[string]any{"auth_enabled": true, "user": name, "roles": user.Roles})
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+    "errors"
+    "fmt"
+    "io/fs"
+    "net/http"
+    "os"
+    "path/filepath"
+)
+
+//a backup is a snapshot file without roles, node ids of the old cluster mean nothing to the new one
+
+//applied state of the node with the term of its last applied entry, the caller closes it
+func (env *TEnv) Backup(db *Db) (backup *Snapshot, err error) {
+    //an installed snapshot can compact the log before the state machine catches up with it
+    for attempt := 0; attempt < 3; attempt++ {
+        backup = db.Snapshot()
+        env.WithLock(func(env *TEnv) {
+            if env.l.Contains(backup.Index) {
+                backup.Term = env.l.Term(backup.Index)
+                err = nil
+            } else {
+                err = ErrCompacted
+            }
+        })
+        if err == nil {
+            return
+        }
+        backup.Close()
+    }
+    return nil, err
+}
+
+//GET /admin/backup streams the state machine of the leader as a snapshot to restore a new cluster from.
+//Once keys are split into ranges the backup is refused: every range applies writes in its own raft group
+//with no order across the groups, so no set of range snapshots is a single point in time of the cluster
+func (state ExternalState) handleBackup(w http.ResponseWriter, r *http.Request) {
+    if r.Method != "GET" {
+        w.Header().Add("Allow", "GET")
+        w.WriteHeader(http.StatusMethodNotAllowed)
+        return
+    }
+
+    if !state.isLeader() {
+        state.redirectToLeader(w, r)
+        return
+    }
+
+    backup, err := state.env.Backup(state.db)
+    logger := requestLogger(extLogger, r)
+    if err != nil {
+        logger.Error("Error while taking backup", "err", err)
+        writeJson(w, http.StatusServiceUnavailable, map[string]string{"error": err.Error()})
+        return
+    }
+    defer backup.Close()
+    //descriptors only shrink, a range holding the whole key space now held it when the snapshot was taken
+    if state.db.Range() != (RangeDescriptor{}) {
+        writeJson(w, http.StatusConflict, map[string]string{"error": "Keys are split into ranges, backups are only taken of a single range cluster"})
+        return
+    }
+    w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(http.StatusOK)
+    //the status is sent already, the client sees a truncated snapshot
+    items, err := writeSnapshot(w, backup)
+    if err != nil {
+        logger.Warn("Error while writing backup", "index", backup.Index, "items", items, "err", err)
+        return
+    }
+    logger.Info("Backup taken", "index", backup.Index, "term", backup.Term, "items", items)
+}
+
+//prepares an empty workdir to start a node of a new cluster from the backup. The log starts after the
+//backup and the current term is the term of the backup, so terms in the log never go back.
+//Every node of the new cluster has to be restored from the same backup
+func RestoreWorkdir(workdir string, backupFile string) error {
+    backup, err := openSnapshot(backupFile)
+    if err != nil {
+        return err
+    }
+    if backup == nil {
+        return fmt.Errorf("Backup %s not found", backupFile)
+    }
+    defer backup.Close()
+    backup.Roles = nil
+    //the new cluster starts with a single range holding all keys and splits it again as it grows
+    items := backup.items
+    backup.items = func(f func(key string, item Item) error) error {
+        return items(func(key string, item Item) error {
+            if key == rangeKey || key == rangeIdKey {
+                return nil
+            }
+            return f(key, item)
+        })
+    }
+
+    if err := restoreWorkdir(workdir, backup); err != nil {
+        return err
+    }
+    mainLogger.Info("Workdir restored from backup", "backup", backupFile, "index", backup.Index, "term", backup.Term)
+    return nil
+}
+
+//a zero index leaves the state machine empty
+func restoreWorkdir(workdir string, backup *Snapshot) error {
+    pStateFile := filepath.Join(workdir, "pstate.json")
+    //pstate is written last, a workdir without it is restored again
+    if _, err := os.Stat(pStateFile); err == nil {
+        return fmt.Errorf("Workdir %s already has a state, start without restoring or use an empty workdir", workdir)
+    } else if !errors.Is(err, fs.ErrNotExist) {
+        return err
+    }
+
+    if err := os.MkdirAll(workdir, 0700); err != nil {
+        return err
+    }
+
+    //state of a disk engine left in the workdir would be taken over the backup
+    if err := os.RemoveAll(filepath.Join(workdir, storageDir)); err != nil {
+        return err
+    }
+    if backup.Index > 0 {
+        if err := os.Remove(filepath.Join(workdir, "snapshot.json")); err != nil && !errors.Is(err, fs.ErrNotExist) {
+            return err
+        }
+        snapshots := &SnapshotStore{fileName: filepath.Join(workdir, "snapshot.json")}
+        if _, err := snapshots.Save(backup); err != nil {
+            return err
+        }
+    }
+
+    if err := os.Remove(filepath.Join(workdir, "log.json")); err != nil && !errors.Is(err, fs.ErrNotExist) {
+        return err
+    }
+    wlog, err := NewLog(filepath.Join(workdir, "log.json"))
+    if err != nil {
+        return err
+    }
+    if backup.Index > 0 {
+        if err := wlog.Reset(backup.Index, backup.Term); err != nil {
+            return err
+        }
+    }
+
+    pState := PState{FileName: pStateFile}
+    pState.State.CurrentTerm = backup.Term
+    return pState.DumpPState()
+}
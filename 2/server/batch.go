@@ -0,0 +1,191 @@
+package main
+
+import (
+    "encoding/json"
+    "fmt"
+    "net/http"
+    "strconv"
+)
+
+type BatchOp struct {
+    Op string `json:"op"` //create, update, delete, cas, increment, append, upsert or delete_if_equals
+    Delta *int64 `json:"delta"` //for increment, 1 if omitted
+    WriteRequest
+}
+
+type BatchRequest struct {
+    Ops []BatchOp `json:"ops"`
+}
+
+type BatchResult struct {
+    Status int `json:"status"`
+    Message string `json:"message,omitempty"`
+    Error string `json:"error,omitempty"`
+    Code string `json:"code,omitempty"` //same as the code of a write error
+    Value *int64 `json:"value,omitempty"` //new value for increment
+    Length *int `json:"length,omitempty"` //new length for append
+}
+
+var batchOps = map[string]int{
+    "create": CREATE,
+    "update": UPDATE,
+    "delete": DELETE,
+    "cas": CAS,
+    "increment": INCREMENT,
+    "append": APPEND,
+    "upsert": UPSERT,
+    "delete_if_equals": DELETE_IF_EQUALS,
+}
+
+//checks the op and converts it to a log entry, returns zero code if it can be appended.
+//created keeps the missing keys written by earlier ops of the batch
+func (state ExternalState) batchEntry(r *http.Request, op BatchOp, created map[string]bool) (LogEntry, int, string) {
+    logOp, ok := batchOps[op.Op]
+    if !ok {
+        return LogEntry{}, http.StatusBadRequest, fmt.Sprintf("Unknown op %q", op.Op)
+    }
+    if op.Key == "" || isSystemKey(op.Key) {
+        return LogEntry{}, http.StatusBadRequest, "Invalid key"
+    }
+    if (logOp == CAS || logOp == DELETE_IF_EQUALS) && op.PrevValue == nil {
+        return LogEntry{}, http.StatusBadRequest, fmt.Sprintf("prev_value is required for %s", op.Op)
+    }
+
+    if code, msg := state.accessError(r, op.Key, AccessWrite); code != 0 {
+        return LogEntry{}, code, msg
+    }
+
+    entry := LogEntry{Op: logOp, Key: op.Key}
+    switch logOp {
+    case DELETE:
+        return entry, 0, ""
+    case DELETE_IF_EQUALS:
+        entry.PrevValue = *op.PrevValue
+        return entry, 0, ""
+    case INCREMENT:
+        delta := int64(1)
+        if op.Delta != nil {
+            delta = *op.Delta
+        }
+        entry.Value = strconv.FormatInt(delta, 10)
+    default:
+        entry.Value, entry.ContentType, entry.Flags = op.Value, op.ContentType, op.Flags
+    }
+    if logOp == CAS {
+        entry.PrevValue = *op.PrevValue
+    }
+
+    current, exists := state.db.Get(op.Key)
+    value := entry.Value
+    if logOp == APPEND {
+        value = current + value
+    }
+    if code, msg := state.writeError(op.Key, value, false); code != 0 {
+        return LogEntry{}, code, msg
+    }
+    if !exists && !created[op.Key] {
+        if code, msg := state.keyLimitError(len(created)); code != 0 {
+            return LogEntry{}, code, msg
+        }
+        created[op.Key] = true
+    }
+    return entry, 0, ""
+}
+
+func batchResult(op int, result CommitResult) BatchResult {
+    if result.Err != nil {
+        return BatchResult{Status: applyErrorStatus(result.Err), Error: result.Err.Error(), Code: applyErrorCode(result.Err)}
+    }
+
+    switch op {
+    case INCREMENT:
+        value, _ := strconv.ParseInt(result.Value, 10, 64)
+        return BatchResult{Status: http.StatusOK, Value: &value}
+    case APPEND:
+        length, _ := strconv.Atoi(result.Value)
+        return BatchResult{Status: http.StatusOK, Length: &length}
+    case UPSERT:
+        if result.Existed {
+            return BatchResult{Status: http.StatusOK, Message: "Entry updated successfully"}
+        }
+        return BatchResult{Status: http.StatusCreated, Message: "Entry created successfully"}
+    }
+
+    if !result.Ok {
+        switch op {
+        case CREATE:
+            return BatchResult{Status: http.StatusConflict, Error: "Entry already exists"}
+        case DELETE_IF_EQUALS:
+            return BatchResult{Status: http.StatusConflict, Error: "Entry not found or has a different value"}
+        }
+        return BatchResult{Status: http.StatusNotFound, Error: "Entry not found"}
+    }
+
+    switch op {
+    case CREATE:
+        return BatchResult{Status: http.StatusCreated, Message: "Entry created successfully"}
+    case DELETE, DELETE_IF_EQUALS:
+        return BatchResult{Status: http.StatusOK, Message: "Entry deleted successfully"}
+    default:
+        return BatchResult{Status: http.StatusOK, Message: "Entry updated successfully"}
+    }
+}
+
+//ops are appended to the log together and applied in order, each one succeeds or fails on its own
+func (state ExternalState) handleBatch(w http.ResponseWriter, r *http.Request) {
+    if r.Method != "POST" {
+        w.Header().Add("Allow", "POST")
+        w.WriteHeader(http.StatusMethodNotAllowed)
+        return
+    }
+
+    if !state.isLeader() {
+        state.redirectToLeader(w, r)
+        return
+    }
+
+    logger := requestLogger(extLogger, r)
+    data, err := readBody(w, r)
+    if err != nil {
+        return
+    }
+
+    var batchRequest BatchRequest
+    if err = json.Unmarshal(data, &batchRequest); err != nil {
+        http.Error(w, fmt.Sprint(err), http.StatusBadRequest)
+        return
+    }
+    if limit := state.limits.maxBatchOps(); limit != 0 && len(batchRequest.Ops) > limit {
+        writeJson(w, http.StatusRequestEntityTooLarge, map[string]string{"error": fmt.Sprintf("Batch has more than %d ops", limit)})
+        return
+    }
+
+    results := make([]BatchResult, len(batchRequest.Ops))
+    var entries []LogEntry
+    var entryIdx []int
+    created := make(map[string]bool)
+    for i := range batchRequest.Ops {
+        batchRequest.Ops[i].decodeB64()
+        entry, code, msg := state.batchEntry(r, batchRequest.Ops[i], created)
+        if code != 0 {
+            results[i] = BatchResult{Status: code, Error: msg}
+            continue
+        }
+        entries = append(entries, entry)
+        entryIdx = append(entryIdx, i)
+    }
+
+    if len(entries) > 0 {
+        commitResults, err := state.env.ApplyBatchSync(entries)
+        if err != nil {
+            writeApplyError(w, err)
+            return
+        }
+        for j, result := range commitResults {
+            results[entryIdx[j]] = batchResult(entries[j].Op, result)
+        }
+    }
+
+    logger.Debug("Batch applied", "ops", len(batchRequest.Ops), "appended", len(entries))
+    writeJson(w, http.StatusOK, map[string][]BatchResult{"results": results})
+}
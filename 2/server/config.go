@@ -4,24 +4,47 @@ import (
     "os"
     "encoding/json"
     "fmt"
+    "net"
+    "strconv"
+    "time"
 )
 
 type NodeConfig struct {
     Host string `json:"host"`
     InternalPort int `json:"internal_port"`
     ExternalPort int `json:"external_port"`
+    Learner bool `json:"learner"` //learners replicate the log and serve reads but do not vote
+    TLS bool `json:"tls"` //node serves both ports over TLS
+    RespPort int `json:"resp_port"` //optional Redis protocol listener, served over TLS too if tls is set
+}
+
+func (node NodeConfig) scheme() string {
+    if node.TLS {
+        return "https"
+    }
+    return "http"
 }
 
 func (node NodeConfig) InternalUri() string {
-    return fmt.Sprintf("http://%s:%d", node.Host, node.InternalPort)
+    return fmt.Sprintf("%s://%s:%d", node.scheme(), node.Host, node.InternalPort)
 }
 
 func (node NodeConfig) ExternalUri() string {
-    return fmt.Sprintf("http://%s:%d", node.Host, node.ExternalPort)
+    return fmt.Sprintf("%s://%s:%d", node.scheme(), node.Host, node.ExternalPort)
 }
 
 type NodesConfig []NodeConfig
 
+//id of the node listening on the internal address host:port
+func (config NodesConfig) internalNode(addr string) (uint64, bool) {
+    for i, node := range config {
+        if net.JoinHostPort(node.Host, strconv.Itoa(node.InternalPort)) == addr {
+            return uint64(i), true
+        }
+    }
+    return 0, false
+}
+
 func NewNodesConfig(fileName string) (config NodesConfig, err error) {
     data, err := os.ReadFile(fileName)
     if err != nil {
@@ -37,6 +60,22 @@ type AppConfig struct {
     VoteRequestTimeoutMs int `json:"vote_request_timeout_ms"`
     AppendEntriesTimeoutMs int `json:"append_entries_timeout_ms"`
     HBIntervalMs int `json:"hb_interval_ms"`
+    ShutdownTimeoutMs int `json:"shutdown_timeout_ms"`
+    CommitTimeoutMs int `json:"commit_timeout_ms"` //blocking lock and election requests and RESP writes give up on a proposal that is not applied in time, 5s if 0
+    Logging LoggingConfig `json:"logging"`
+    TLS TLSConfig `json:"tls"`
+    Auth AuthConfig `json:"auth"`
+    Limits LimitsConfig `json:"limits"`
+    Snapshot SnapshotConfig `json:"snapshot"`
+    Storage StorageConfig `json:"storage"`
+    Ranges RangesConfig `json:"ranges"`
+}
+
+func (config AppConfig) commitTimeout() time.Duration {
+    if config.CommitTimeoutMs == 0 {
+        return 5 * time.Second
+    }
+    return time.Duration(int64(config.CommitTimeoutMs)) * time.Millisecond
 }
 
 func NewAppConfig(fileName string) (config AppConfig, err error) {
@@ -44,6 +83,9 @@ func NewAppConfig(fileName string) (config AppConfig, err error) {
     if err != nil {
         return
     }
-    err = json.Unmarshal(data, &config)
+    if err = json.Unmarshal(data, &config); err != nil {
+        return
+    }
+    err = config.Limits.validate()
     return
 }
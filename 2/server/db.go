@@ -1,83 +1,258 @@
 package main
 
 import (
+    "errors"
+    "math"
+    "strconv"
     "sync"
+    "sync/atomic"
     "strings"
     "context"
-    "log"
 )
 
 type Db struct {
-    data map[string]string
+    data Storage
+    size int64 //bytes in keys and values, system keys are not counted
+    keys int
+    appliedIndex atomic.Uint64
+    applyM sync.Mutex //held while an entry is applied, so snapshots see the data and the applied index together
+    watchers map[string]chan struct{}
+    queues map[string][]uint64 //ids of the items in each queue in FIFO order
+    desc RangeDescriptor //keys this state machine owns, changed only by the apply goroutine
+    onSplit func(desc RangeDescriptor, snapshot *Snapshot) //creates the replica of a range split off, nil when replaying
+    done chan struct{}
     m sync.RWMutex
 }
 
+func (db *Db) applyEntry(entry LogEntry) {
+    db.applyM.Lock()
+    if entry.snapshot != nil {
+        dbLogger.Info("Restoring snapshot", "index", entry.snapshot.Index, "term", entry.snapshot.Term)
+        db.Restore(entry.snapshot)
+        entry.snapshot.Close()
+        db.applyM.Unlock()
+        return
+    }
+    dbLogger.Debug("Applying entry", "term", entry.Term, "op", entry.Op, "key", entry.Key)
+    result := db.CommitEntry(entry)
+    db.commit(entry.index)
+    db.applyM.Unlock()
+    entriesApplied.Inc()
+    if entry.statusChan != nil {
+        *entry.statusChan <- result
+    }
+}
+
 func periodicUpdate(db *Db, ctx context.Context, commitQueue <- chan LogEntry) {
-    log.Print("periodic update started")
+    dbLogger.Info("Periodic update started")
+    defer close(db.done)
     for {
         select {
         case <- ctx.Done():
-            log.Print("quit periodic update")
-            return
-        case entry := <- commitQueue:
-            log.Print("got new commit entry ", entry)
-            status := db.CommitEntry(entry)
-            if entry.statusChan != nil {
-                *entry.statusChan <- status
+            for {
+                select {
+                case entry := <- commitQueue:
+                    db.applyEntry(entry)
+                default:
+                    dbLogger.Info("Quit periodic update")
+                    return
+                }
             }
+        case entry := <- commitQueue:
+            db.applyEntry(entry)
         }
     }
 }
 
-func NewDb(ctx context.Context, commitQueue <- chan LogEntry) *Db {
-    db := Db{data: make(map[string]string),}
+//continues from the state the storage has committed
+func NewDb(ctx context.Context, commitQueue <- chan LogEntry, storage Storage) *Db {
+    db := Db{data: storage, watchers: make(map[string]chan struct{}), queues: make(map[string][]uint64), done: make(chan struct{}),}
+    state := storage.State()
+    db.size = state.Size
+    db.keys = state.Keys
+    db.appliedIndex.Store(state.Index)
+    db.indexQueues()
+    db.loadRange()
     go periodicUpdate(&db, ctx, commitQueue)
 
     return &db
 }
 
-func (db *Db) CommitEntry(entry LogEntry) bool {
+//waits until the commit queue is drained after ctx passed to NewDb is cancelled
+func (db *Db) Wait() {
+    <-db.done
+}
+
+//must be called after Wait
+func (db *Db) Close() error {
+    db.m.Lock()
+    defer db.m.Unlock()
+    return db.data.Close()
+}
+
+//makes the applied state durable, so a restart does not need the log up to the applied index
+func (db *Db) Sync() error {
+    //a half applied entry must not become durable
+    db.applyM.Lock()
+    defer db.applyM.Unlock()
+    db.m.Lock()
+    defer db.m.Unlock()
+    return db.data.Sync()
+}
+
+func (db *Db) commit(index uint64) {
+    db.m.Lock()
+    defer db.m.Unlock()
+
+    db.appliedIndex.Store(index)
+    if err := db.data.Commit(StorageState{Index: index, Size: db.size, Keys: db.keys}); err != nil {
+        fatal(storageLogger, "Error while writing state machine", "index", index, "err", err)
+    }
+}
+
+func (db *Db) CommitEntry(entry LogEntry) CommitResult {
+    switch entry.Op {
+    case CREATE, UPDATE, DELETE, CAS, INCREMENT, APPEND, UPSERT, DELETE_IF_EQUALS:
+        //the key may have moved to another range after the entry was appended
+        if !db.ownsKey(entry.Key) {
+            return CommitResult{Err: ErrWrongRange}
+        }
+    }
+
     switch entry.Op {
     case CREATE:
-        return db.Create(entry.Key, entry.Value)
+        return CommitResult{Ok: db.Create(entry.Key, entry.Item())}
     case UPDATE:
-        return db.Update(entry.Key, entry.Value)
+        return CommitResult{Ok: db.Update(entry.Key, entry.Item())}
     case DELETE:
-        return db.Delete(entry.Key)
+        return CommitResult{Ok: db.Delete(entry.Key)}
     case CAS:
-        return db.Cas(entry.Key, entry.PrevValue, entry.Value)
+        return CommitResult{Ok: db.Cas(entry.Key, entry.PrevValue, entry.Item())}
+    case SET_ROLE:
+        return CommitResult{Ok: true}
+    case AUTH_PUT:
+        return CommitResult{Ok: db.commitAuthPut(entry.Key, entry.Value)}
+    case AUTH_DELETE:
+        return CommitResult{Ok: db.commitAuthDelete(entry.Key)}
+    case ALARM:
+        return CommitResult{Ok: db.commitAlarm(entry.Key, entry.Value)}
+    case INCREMENT:
+        return db.Increment(entry.Key, entry.Value)
+    case APPEND:
+        return db.Append(entry.Key, entry.Item())
+    case UPSERT:
+        return db.Upsert(entry.Key, entry.Item())
+    case DELETE_IF_EQUALS:
+        return CommitResult{Ok: db.DeleteIfEquals(entry.Key, entry.PrevValue)}
+    case LOCK_ACQUIRE:
+        return db.commitLockAcquire(entry)
+    case LOCK_RENEW:
+        return db.commitLockRenew(entry)
+    case LOCK_RELEASE:
+        return db.commitLockRelease(entry)
+    case LOCK_PROCLAIM:
+        return db.commitLockProclaim(entry)
+    case QUEUE_ENQUEUE:
+        return db.commitEnqueue(entry)
+    case QUEUE_DEQUEUE:
+        return db.commitDequeue(entry)
+    case QUEUE_ACK:
+        return db.commitAck(entry)
+    case RANGE_SPLIT:
+        return db.commitSplit(entry)
     default:
-        log.Fatalln("incorrect Op")
+        fatal(dbLogger, "Incorrect op", "op", entry.Op)
     }
-    return false
+    return CommitResult{}
+}
+
+func (db *Db) set(key string, item Item) {
+    if countedKey(key) {
+        if old, ok := db.data.Get(key); ok {
+            db.size -= int64(len(old.Value))
+        } else {
+            db.size += int64(len(key))
+            db.keys += 1
+        }
+        db.size += int64(len(item.Value))
+    }
+    db.data.Put(key, item)
+    db.notify(key)
+}
+
+func (db *Db) remove(key string) {
+    if old, ok := db.data.Get(key); ok && countedKey(key) {
+        db.size -= int64(len(key) + len(old.Value))
+        db.keys -= 1
+    }
+    db.data.Delete(key)
+    db.notify(key)
+}
+
+func (db *Db) notify(key string) {
+    if watcher, ok := db.watchers[key]; ok {
+        close(watcher)
+        delete(db.watchers, key)
+    }
+}
+
+//returns a channel that is closed on the next change of the key
+func (db *Db) Watch(key string) <-chan struct{} {
+    db.m.Lock()
+    defer db.m.Unlock()
+
+    watcher, ok := db.watchers[key]
+    if !ok {
+        watcher = make(chan struct{})
+        db.watchers[key] = watcher
+    }
+    return watcher
+}
+
+//index of the last log entry applied to the state machine
+func (db *Db) AppliedIndex() uint64 {
+    return db.appliedIndex.Load()
+}
+
+func (db *Db) Size() (size int64, keys int) {
+    db.m.RLock()
+    defer db.m.RUnlock()
+
+    return db.size, db.keys
 }
 
 func (db *Db) Get(key string) (string, bool) {
+    item, ok := db.GetItem(key)
+    return item.Value, ok
+}
+
+func (db *Db) GetItem(key string) (Item, bool) {
     db.m.RLock()
     defer db.m.RUnlock()
 
-    val, ok := db.data[key]
-    return strings.Clone(val), ok
+    item, ok := db.data.Get(key)
+    item.Value = strings.Clone(item.Value)
+    return item, ok
 }
 
-func (db *Db) Create(key string, value string) bool {
+func (db *Db) Create(key string, item Item) bool {
     db.m.Lock()
     defer db.m.Unlock()
 
-    if _, ok := db.data[key]; ok {
+    if _, ok := db.data.Get(key); ok {
         return false
     } else {
-        db.data[key] = value
+        db.set(key, item)
         return true
     }
 }
 
-func (db *Db) Update(key string, value string) bool {
+func (db *Db) Update(key string, item Item) bool {
     db.m.Lock()
     defer db.m.Unlock()
 
-    if _, ok := db.data[key]; ok {
-        db.data[key] = value
+    if _, ok := db.data.Get(key); ok {
+        db.set(key, item)
         return true
     } else {
         return false
@@ -88,21 +263,21 @@ func (db *Db) Delete(key string) bool {
     db.m.Lock()
     defer db.m.Unlock()
 
-    if _, ok := db.data[key]; ok {
-        delete(db.data, key)
+    if _, ok := db.data.Get(key); ok {
+        db.remove(key)
         return true
     } else {
         return false
     }
 }
 
-func (db *Db) Cas(key string, prev_val string, new_val string) bool {
+func (db *Db) Cas(key string, prev_val string, new_item Item) bool {
     db.m.Lock()
     defer db.m.Unlock()
 
-    if val, ok := db.data[key]; ok {
-        if val == prev_val {
-            db.data[key] = new_val
+    if item, ok := db.data.Get(key); ok {
+        if item.Value == prev_val {
+            db.set(key, new_item)
             return true;
         } else {
             return false;
@@ -111,3 +286,65 @@ func (db *Db) Cas(key string, prev_val string, new_val string) bool {
         return false
     }
 }
+
+var ErrNotInteger = errors.New("Value is not an integer")
+
+var ErrOverflow = errors.New("Increment overflows int64")
+
+//missing keys start from zero, content type and flags of existing keys are kept
+func (db *Db) Increment(key string, delta string) CommitResult {
+    db.m.Lock()
+    defer db.m.Unlock()
+
+    d, err := strconv.ParseInt(delta, 10, 64)
+    if err != nil {
+        return CommitResult{Err: ErrNotInteger}
+    }
+    item, _ := db.data.Get(key)
+    var val int64
+    if item.Value != "" {
+        if val, err = strconv.ParseInt(item.Value, 10, 64); err != nil {
+            return CommitResult{Err: ErrNotInteger}
+        }
+    }
+    if (d > 0 && val > math.MaxInt64 - d) || (d < 0 && val < math.MinInt64 - d) {
+        return CommitResult{Err: ErrOverflow}
+    }
+
+    item.Value = strconv.FormatInt(val + d, 10)
+    db.set(key, item)
+    return CommitResult{Ok: true, Value: item.Value}
+}
+
+//creates missing keys, returns the new length of the value
+func (db *Db) Append(key string, item Item) CommitResult {
+    db.m.Lock()
+    defer db.m.Unlock()
+
+    if old, ok := db.data.Get(key); ok {
+        old.Value += item.Value
+        item = old
+    }
+    db.set(key, item)
+    return CommitResult{Ok: true, Value: strconv.Itoa(len(item.Value))}
+}
+
+func (db *Db) Upsert(key string, item Item) CommitResult {
+    db.m.Lock()
+    defer db.m.Unlock()
+
+    _, existed := db.data.Get(key)
+    db.set(key, item)
+    return CommitResult{Ok: true, Existed: existed}
+}
+
+func (db *Db) DeleteIfEquals(key string, prev_val string) bool {
+    db.m.Lock()
+    defer db.m.Unlock()
+
+    if item, ok := db.data.Get(key); ok && item.Value == prev_val {
+        db.remove(key)
+        return true
+    }
+    return false
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+    "encoding/json"
+    "math"
+    "net/http"
+    "strings"
+    "time"
+)
+
+//an election is a lock, owner is the candidate and the lock value is what the leader proclaims.
+//User lock names can't contain '/', so election locks don't collide with them
+func electionLock(name string) string {
+    return "election/" + name
+}
+
+type ElectionEvent struct {
+    Name string `json:"name"`
+    Leader *Lock `json:"leader"` //null when there is no leader
+}
+
+func (state ExternalState) currentLeader(name string) *Lock {
+    lock, held := state.db.GetLock(electionLock(name))
+    if !held || lock.expiredAt(time.Now().UnixMilli()) {
+        return nil
+    }
+    return &lock
+}
+
+//streams the current leader as JSON lines, a new line is written when the leader or its value changes
+func (state ExternalState) observeElection(w http.ResponseWriter, r *http.Request, name string) {
+    w.Header().Set("Content-Type", "application/x-ndjson")
+    w.WriteHeader(http.StatusOK)
+    controller := http.NewResponseController(w)
+    encoder := json.NewEncoder(w)
+
+    var last *Lock
+    first := true
+    for {
+        changed := state.db.Watch(lockPrefix + electionLock(name))
+        leader := state.currentLeader(name)
+        if first || (leader == nil) != (last == nil) || (leader != nil && (leader.Token != last.Token || leader.Value != last.Value)) {
+            if err := encoder.Encode(ElectionEvent{Name: name, Leader: leader}); err != nil {
+                return
+            }
+            if err := controller.Flush(); err != nil {
+                return
+            }
+            first = false
+        }
+        last = leader
+
+        //an expired lease is not changed in the db, so wake up at the expiry too
+        wait := time.Duration(math.MaxInt64)
+        if leader != nil {
+            wait = max(time.Until(time.UnixMilli(leader.ExpiresMs)), 10 * time.Millisecond)
+        }
+        timer := time.NewTimer(wait)
+        select {
+        case <- changed:
+        case <- timer.C:
+        case <- r.Context().Done():
+            timer.Stop()
+            return
+        case <- state.serving.Done():
+            timer.Stop()
+            return
+        }
+        timer.Stop()
+    }
+}
+
+//GET /elections/<name> shows the leader, GET .../observe streams leader changes,
+//POST .../campaign blocks until elected unless wait_ms is given, POST .../proclaim, .../keepalive and .../resign
+//take the candidate and the token returned by campaign. Permissions are checked against "elections/<name>"
+func (state ExternalState) handleElection(w http.ResponseWriter, r *http.Request) {
+    name, action, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/elections/"), "/")
+    if !validAuthName(name) {
+        writeJson(w, http.StatusNotFound, map[string]string{"error": "Invalid election name"})
+        return
+    }
+    permKey := "elections/" + name
+
+    lockActions := map[string]string{"campaign": lockAcquire, "proclaim": lockProclaim, "keepalive": lockRenew, "resign": lockRelease}
+    if lockAction, ok := lockActions[action]; ok {
+        if r.Method != "POST" {
+            w.Header().Add("Allow", "POST")
+            w.WriteHeader(http.StatusMethodNotAllowed)
+            return
+        }
+        state.handleLockAction(w, r, electionLock(name), name, permKey, lockAction, -1)
+        return
+    }
+
+    if action != "" && action != "observe" {
+        http.Error(w, "Not found", http.StatusNotFound)
+        return
+    }
+    if r.Method != "GET" {
+        w.Header().Add("Allow", "GET")
+        w.WriteHeader(http.StatusMethodNotAllowed)
+        return
+    }
+    if !state.authorize(w, r, permKey, AccessRead) {
+        return
+    }
+
+    if action == "observe" {
+        state.observeElection(w, r, name)
+        return
+    }
+    leader := state.currentLeader(name)
+    if leader == nil {
+        writeJson(w, http.StatusNotFound, map[string]string{"error": "No leader"})
+        return
+    }
+    writeJson(w, http.StatusOK, ElectionEvent{Name: name, Leader: leader})
+}
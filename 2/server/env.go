@@ -1,13 +1,17 @@
 package main
 
 import (
+    "slices"
     "sync"
     "time"
+    "errors"
 )
 
 type LeaderState struct {
     NextIndex []uint64
     MatchIndex []uint64
+    LastContact []time.Time
+    SendingSnapshot []bool
 }
 
 func NewLeaderState(nodeId uint64, numNodes int, lastLogIndex uint64) *LeaderState {
@@ -19,6 +23,8 @@ func NewLeaderState(nodeId uint64, numNodes int, lastLogIndex uint64) *LeaderSta
     state := LeaderState {
         NextIndex: nextIndex,
         MatchIndex: make([]uint64, numNodes),
+        LastContact: make([]time.Time, numNodes),
+        SendingSnapshot: make([]bool, numNodes),
     }
     state.MatchIndex[nodeId] = ^uint64(0)
     return &state
@@ -34,11 +40,19 @@ type TEnv struct {
     lastHB time.Time
     commitQueue chan LogEntry
     newEntriesAlert Alert
+    configRoles []string
+    snapshotRoles []string //membership at the snapshot, replaces configRoles once the log is compacted
+    roles []string
+    snapshots *SnapshotStore
+    maxUncommitted uint64 //0 means unlimited
+    closing bool
+    closed bool
     m sync.Mutex
 }
 
-func NewEnv(p PState, l Log, logQueueSize uint) TEnv {
-    return TEnv{p: p, l: l, commitQueue: make(chan LogEntry, logQueueSize), newEntriesAlert: NewAlert()}
+func NewEnv(p PState, l Log, snapshots *SnapshotStore, nodesConfig NodesConfig, logQueueSize uint) TEnv {
+    roles := configRoles(nodesConfig)
+    return TEnv{p: p, l: l, snapshots: snapshots, commitQueue: make(chan LogEntry, logQueueSize), newEntriesAlert: NewAlert(), configRoles: roles, roles: logRoles(roles, l)}
 }
 
 func (env *TEnv) WithLock(f func (*TEnv)) {
@@ -48,27 +62,36 @@ func (env *TEnv) WithLock(f func (*TEnv)) {
 }
 
 func (env *TEnv) CommitChanges(leaderCommit uint64) {
+    if env.closed {
+        return
+    }
+
     if env.commitIndex < leaderCommit {
         maxIdx := leaderCommit
-        if uint64(len(env.l.Entries)) < maxIdx {
-            maxIdx = uint64(len(env.l.Entries) - 1)
+        if env.l.LastIndex() < maxIdx {
+            maxIdx = env.l.LastIndex()
         }
 
-        entiresToCommit := env.l.Entries[env.lastApplied + 1 : maxIdx + 1]
+        firstIdx := env.lastApplied + 1
+        entiresToCommit := env.l.Entries[firstIdx - env.l.Offset : maxIdx - env.l.Offset + 1]
         env.lastApplied = maxIdx
+        entriesCommitted.Add(float64(leaderCommit - env.commitIndex))
         env.commitIndex = leaderCommit
-        for _, entry := range entiresToCommit {
+        for i, entry := range entiresToCommit {
+            entry.index = firstIdx + uint64(i)
             env.commitQueue <- entry
         }
     } else {
         maxIdx := env.commitIndex 
-        if uint64(len(env.l.Entries)) < maxIdx {
-            maxIdx = uint64(len(env.l.Entries) - 1)
+        if env.l.LastIndex() < maxIdx {
+            maxIdx = env.l.LastIndex()
         }
 
-        entiresToCommit := env.l.Entries[env.lastApplied + 1 : maxIdx + 1]
+        firstIdx := env.lastApplied + 1
+        entiresToCommit := env.l.Entries[firstIdx - env.l.Offset : maxIdx - env.l.Offset + 1]
         env.lastApplied = maxIdx
-        for _, entry := range entiresToCommit {
+        for i, entry := range entiresToCommit {
+            entry.index = firstIdx + uint64(i)
             env.commitQueue <- entry
         }
     }
@@ -81,11 +104,162 @@ type ApplyRequest struct {
     resp chan bool
 }
 
-func (env *TEnv) ApplyRequestSync(op int, key string, value string, prevValue string) bool {
-    statusChan := make(chan bool, 1)
+type CommitResult struct {
+    Ok bool
+    Value string //result of INCREMENT and APPEND
+    Existed bool //for UPSERT
+    Err error
+}
+
+var ErrShuttingDown = errors.New("Node is shutting down")
+
+//the entry is in the log and may still be committed by the next leader
+var ErrOutcomeUnknown = errors.New("Node is shutting down, the write may still be applied")
+
+var ErrTooManyPending = errors.New("Too many uncommitted entries, retry later")
+
+var ErrNotLeader = errors.New("Node is not the leader, retry on the leader")
+
+var ErrCommitTimeout = errors.New("Write was not applied in time, it may still be applied")
+
+//the entry left the log of this node before it was applied, the new leader may still commit it
+var ErrLeadershipLost = errors.New("Leadership was lost, the write may still be applied")
+
+func (env *TEnv) ApplyRequestSync(op int, key string, value string, prevValue string) (bool, error) {
+    result, err := env.ApplyEntrySync(LogEntry{Op: op, Key: key, Value: value, PrevValue: prevValue,})
+    return result.Ok, err
+}
+
+func (env *TEnv) ApplyEntrySync(entry LogEntry) (CommitResult, error) {
+    results, err := env.ApplyBatchSync([]LogEntry{entry})
+    if err != nil {
+        return CommitResult{}, err
+    }
+    return results[0], results[0].Err
+}
+
+//like ApplyEntrySync, but stops waiting after timeout. The entry stays in the log
+func (env *TEnv) ApplyEntryWithin(entry LogEntry, timeout time.Duration) (CommitResult, error) {
+    statusChans, err := env.ProposeBatch([]LogEntry{entry})
+    if err != nil {
+        return CommitResult{}, err
+    }
+    timer := time.NewTimer(timeout)
+    defer timer.Stop()
+    select {
+    case result := <-statusChans[0]:
+        return result, result.Err
+    case <-timer.C:
+        return CommitResult{}, ErrCommitTimeout
+    }
+}
+
+//appends entries together and waits until each of them is applied
+func (env *TEnv) ApplyBatchSync(entries []LogEntry) ([]CommitResult, error) {
+    defer proposalDuration.ObserveSince(time.Now())
+    statusChans, err := env.ProposeBatch(entries)
+    if err != nil {
+        return nil, err
+    }
+    results := make([]CommitResult, len(entries))
+    for i := range statusChans {
+        results[i] = <-statusChans[i]
+    }
+    return results, nil
+}
+
+//appends entries together without waiting, each channel gets the result of its entry once it is applied
+func (env *TEnv) ProposeBatch(entries []LogEntry) ([]chan CommitResult, error) {
+    statusChans := make([]chan CommitResult, len(entries))
+    var err error
     env.WithLock(func(env *TEnv) {
-        env.l = Append(env.l, LogEntry{Op: op, Key: key, Value: value, PrevValue: prevValue, statusChan: &statusChan,})
+        if env.closing {
+            err = ErrShuttingDown
+            return
+        }
+        //the caller checked leadership before, a follower would append entries of a term it does not lead
+        if env.leaderState == nil {
+            err = ErrNotLeader
+            return
+        }
+        if slices.ContainsFunc(entries, func(entry LogEntry) bool { return entry.Op == SET_ROLE }) && env.roleChangePending() {
+            err = ErrRoleChangePending
+            return
+        }
+        //a batch is admitted whole, so all of its entries count
+        if env.maxUncommitted != 0 && env.l.LastIndex() - env.commitIndex + uint64(len(entries)) > env.maxUncommitted {
+            err = ErrTooManyPending
+            return
+        }
+        now := time.Now().UnixMilli()
+        for i := range entries {
+            entries[i].Term = env.p.State.CurrentTerm
+            entries[i].Time = now
+            statusChans[i] = make(chan CommitResult, 1)
+            entries[i].statusChan = &statusChans[i]
+            applyRoleEntry(env.roles, entries[i])
+        }
+        env.l = AppendBatch(env.l, entries)
     })
+    if err != nil {
+        return nil, err
+    }
     env.newEntriesAlert.Signal()
-    return <-statusChan
+    return statusChans, nil
+}
+
+//entries waiting for their result that are not in the commit queue yet, must be called with the lock held
+func (env *TEnv) pendingProposals() (pending []LogEntry) {
+    for i := env.lastApplied + 1 - env.l.Offset; i < uint64(len(env.l.Entries)); i++ {
+        if env.l.Entries[i].statusChan != nil {
+            entry := env.l.Entries[i]
+            entry.index = env.l.Offset + i
+            pending = append(pending, entry)
+        }
+    }
+    return
+}
+
+//answers the pending entries that a truncation or a snapshot took out of the log,
+//they never reach the state machine through this log. Must be called with the lock held
+func (env *TEnv) failDroppedProposals(pending []LogEntry) {
+    for _, entry := range pending {
+        if entry.index <= env.l.Offset || entry.index > env.l.LastIndex() {
+            *entry.statusChan <- CommitResult{Err: ErrLeadershipLost}
+        }
+    }
+}
+
+//stops accepting new proposals, already appended ones may still be committed
+func (env *TEnv) StopProposals() {
+    env.WithLock(func(env *TEnv) {
+        env.closing = true
+    })
+}
+
+//answers proposals that were not handed to the state machine yet, they may be committed after this node stops
+func (env *TEnv) FailPendingProposals() {
+    env.WithLock(func(env *TEnv) {
+        for i := env.lastApplied + 1 - env.l.Offset; i < uint64(len(env.l.Entries)); i++ {
+            entry := &env.l.Entries[i]
+            if entry.statusChan != nil {
+                *entry.statusChan <- CommitResult{Err: ErrOutcomeUnknown}
+                entry.statusChan = nil
+            }
+        }
+    })
+}
+
+//after Close no more entries are sent to the commit queue
+func (env *TEnv) Close() error {
+    var err error
+    env.WithLock(func(env *TEnv) {
+        env.closing = true
+        env.closed = true
+        if err = env.l.Sync(); err != nil {
+            return
+        }
+        err = env.p.Sync()
+    })
+    return err
 }
@@ -1,24 +1,32 @@
 package main
 
 import (
+    "encoding/json"
+    "io"
     "net/http"
     "context"
     "fmt"
-    "log"
-    "encoding/json"
     "sync/atomic"
     "math/rand"
     "strings"
-    "io"
+    "errors"
+    "time"
 )
 
 type ExternalState struct {
     env *TEnv
     ctx context.Context
+    serving context.Context //cancelled when the server starts shutting down, ends long running requests
     db *Db
+    raft *RaftState
+    ranges *Ranges
     nodes NodesConfig
     nodeId uint64
     roundRobin *atomic.Uint64
+    auth AuthConfig
+    limits LimitsConfig
+    commitTimeout time.Duration
+    storage StorageConfig //engine of the scratch storages states are rebuilt in
 }
 
 func (state ExternalState) isLeader() (isLeader bool) {
@@ -37,15 +45,17 @@ func (state ExternalState) chooseNextFollower() (NodeConfig) {
 }
 
 func getKey(path string) (string, bool) {
-    basePath := "/entry/"
+    return getKeyWithPrefix(path, "/entry/")
+}
 
+func getKeyWithPrefix(path string, basePath string) (string, bool) {
     if !strings.HasPrefix(path, basePath) {
         return "", false
     }
 
     key := strings.TrimPrefix(path, basePath)
 
-    if key == "" {
+    if key == "" || isSystemKey(key) {
         return "", false
     }
 
@@ -73,21 +83,18 @@ func (state ExternalState) getLeaderOrRandom() (NodeConfig) {
 
 func (state ExternalState) redirectToFollower(w http.ResponseWriter, r *http.Request) {
     node := state.chooseNextFollower()
-    uri := node.ExternalUri() + r.URL.Path
+    requestLogger(extLogger, r).Debug("Redirecting read to follower", "node", node.ExternalUri())
+    uri := node.ExternalUri() + r.URL.RequestURI()
     http.Redirect(w, r, uri, http.StatusSeeOther)
 }
 
 func (state ExternalState) redirectToLeader(w http.ResponseWriter, r *http.Request) {
     node := state.getLeaderOrRandom()
-    uri := node.ExternalUri() + r.URL.Path
+    requestLogger(extLogger, r).Debug("Redirecting write to leader", "node", node.ExternalUri())
+    uri := node.ExternalUri() + r.URL.RequestURI()
     http.Redirect(w, r, uri, http.StatusTemporaryRedirect)
 }
 
-type KeyVal struct {
-    Key string `json:"key"`
-    Value string `json:"value"`
-}
-
 func (state ExternalState) handleGet(w http.ResponseWriter, r *http.Request) {
     if state.isLeader() {
         state.redirectToFollower(w, r)
@@ -95,30 +102,13 @@ func (state ExternalState) handleGet(w http.ResponseWriter, r *http.Request) {
     }
 
     if key, ok := getKey(r.URL.Path); ok {
-        if val, found := state.db.Get(key); found {
-            getResp := KeyVal{key, val}
-            resp, err := json.Marshal(getResp)
-            if err != nil {
-                log.Fatal(err)
-            }
-            n, err := w.Write(resp)
-            if err != nil || n < len(resp) {
-                log.Printf("Error while writing response: %v, %d bytes written", err, n)
-                return
-            }
+        if !state.authorize(w, r, key, AccessRead) {
+            return
+        }
+        if item, found := state.db.GetItem(key); found {
+            writeItem(w, r, key, item)
         } else {
-            resp, err := json.Marshal(map[string]string{"error": "Key not found"})
-            if err != nil {
-                log.Fatal(err)
-            }
-
-            w.WriteHeader(http.StatusNotFound)
-            n, err := w.Write(resp)
-            if err != nil || n < len(resp) {
-                log.Printf("Error while writing response: %v, %d bytes written", err, n)
-                return
-            }
-
+            writeJson(w, http.StatusNotFound, map[string]string{"error": "Key not found"})
         }
     } else {
         http.Error(w, "Not found", http.StatusNotFound)
@@ -126,50 +116,83 @@ func (state ExternalState) handleGet(w http.ResponseWriter, r *http.Request) {
 
 }
 
+//reads the body limited by Ranges.ServeHTTP, writes 413 if it is too large
+func readBody(w http.ResponseWriter, r *http.Request) ([]byte, error) {
+    data, err := io.ReadAll(r.Body)
+    if err != nil && !bodyTooLarge(w, err) {
+        requestLogger(extLogger, r).Warn("Error while reading req body", "err", err)
+    }
+    return data, err
+}
+
+func bodyTooLarge(w http.ResponseWriter, err error) bool {
+    var tooLarge *http.MaxBytesError
+    if !errors.As(err, &tooLarge) {
+        return false
+    }
+    writeJson(w, http.StatusRequestEntityTooLarge, map[string]string{"error": fmt.Sprintf("Request body is longer than %d bytes", tooLarge.Limit)})
+    return true
+}
+
+func (state ExternalState) readWriteRequest(w http.ResponseWriter, r *http.Request) (WriteRequest, bool) {
+    request, err := readWriteRequest(r)
+    var badRequest badRequestError
+    if bodyTooLarge(w, err) {
+        return request, false
+    } else if errors.As(err, &badRequest) {
+        http.Error(w, fmt.Sprint(err), http.StatusBadRequest)
+        return request, false
+    } else if err != nil {
+        requestLogger(extLogger, r).Warn("Error while reading req body", "err", err)
+        return request, false
+    }
+    return request, true
+}
+
+//POST /entry takes the key from the JSON body, POST /entry/<key> from the path and accepts raw bodies too
 func (state ExternalState) handleCreate(w http.ResponseWriter, r *http.Request) {
     if !state.isLeader() {
         state.redirectToLeader(w, r)
         return
     }
 
-    var createRequest KeyVal
-    data, err := io.ReadAll(r.Body)
-    if err != nil {
-        log.Printf("Error while reading req body: %v", err)
+    logger := requestLogger(extLogger, r)
+    createRequest, ok := state.readWriteRequest(w, r)
+    if !ok {
         return
     }
 
-    if err = json.Unmarshal(data, &createRequest); err != nil {
-        http.Error(w, fmt.Sprint(err), http.StatusBadRequest)
+    if r.URL.Path != "/entry" {
+        key, ok := getKey(r.URL.Path)
+        if !ok || (createRequest.Key != "" && createRequest.Key != key) {
+            http.Error(w, "Invalid key", http.StatusBadRequest)
+            return
+        }
+        createRequest.Key = key
+    }
+
+    if createRequest.Key == "" || isSystemKey(createRequest.Key) {
+        http.Error(w, "Invalid key", http.StatusBadRequest)
         return
     }
 
-    if state.env.ApplyRequestSync(CREATE, createRequest.Key, createRequest.Value, "") {
-        resp, err := json.Marshal(map[string]string{"message": "Entry created successfully"})
-        if err != nil {
-            log.Fatal(err)
-        }
+    if !state.authorize(w, r, createRequest.Key, AccessWrite) || !state.checkWrite(w, createRequest.Key, createRequest.Value, true) {
+        return
+    }
 
-        w.WriteHeader(http.StatusCreated)
-        n, err := w.Write(resp)
-        if err != nil || n < len(resp) {
-            log.Printf("Error while writing response: %v, %d bytes written", err, n)
-            return
-        }
+    item := createRequest.Item()
+    result, err := state.env.ApplyEntrySync(LogEntry{Op: CREATE, Key: createRequest.Key, Value: item.Value, ContentType: item.ContentType, Flags: item.Flags,})
+    created := result.Ok
+    logger.Debug("Create applied", "key", createRequest.Key, "created", created, "err", err)
+    if err != nil {
+        writeApplyError(w, err)
+        return
+    }
 
+    if created {
+        writeJson(w, http.StatusCreated, map[string]string{"message": "Entry created successfully"})
     } else {
-        resp, err := json.Marshal(map[string]string{"error": "Entry already exists"})
-        if err != nil {
-            log.Fatal(err)
-        }
-
-        w.WriteHeader(http.StatusConflict)
-        n, err := w.Write(resp)
-        if err != nil || n < len(resp) {
-            log.Printf("Error while writing response: %v, %d bytes written", err, n)
-            return
-        }
-
+        writeJson(w, http.StatusConflict, map[string]string{"error": "Entry already exists"})
     }
 
 }
@@ -180,101 +203,148 @@ func (state ExternalState) handleUpdateOrCas(w http.ResponseWriter, r *http.Requ
         return
     }
 
-    var updateRequest struct {
-        PrevValue *string `json:"prev_value"`
-        Value string `json:"value"`
-    }
-
-    data, err := io.ReadAll(r.Body)
-    if err != nil {
-        log.Printf("Error while reading req body: %v", err)
-        return
-    }
-
-    if err = json.Unmarshal(data, &updateRequest); err != nil {
-        http.Error(w, fmt.Sprint(err), http.StatusBadRequest)
+    logger := requestLogger(extLogger, r)
+    updateRequest, ok := state.readWriteRequest(w, r)
+    if !ok {
         return
     }
 
-    applyRequestSync := func (key string) bool {
+    applyRequestSync := func (key string) (bool, error) {
+        entry := LogEntry{Op: UPDATE, Key: key, Value: updateRequest.Value, ContentType: updateRequest.ContentType, Flags: updateRequest.Flags,}
         if updateRequest.PrevValue != nil {
-            return state.env.ApplyRequestSync(CAS, key, updateRequest.Value, *updateRequest.PrevValue)
-        } else {
-            return state.env.ApplyRequestSync(UPDATE, key, updateRequest.Value, "")
+            entry.Op = CAS
+            entry.PrevValue = *updateRequest.PrevValue
         }
+        result, err := state.env.ApplyEntrySync(entry)
+        return result.Ok, err
     }
 
-    if key, ok := getKey(r.URL.Path); ok && applyRequestSync(key) {
-        resp, err := json.Marshal(map[string]string{"message": "Entry updated successfully"})
-        if err != nil {
-            log.Fatal(err)
-        }
-
-        n, err := w.Write(resp)
-        if err != nil || n < len(resp) {
-            log.Printf("Error while writing response: %v, %d bytes written", err, n)
+    key, ok := getKey(r.URL.Path)
+    if ok {
+        if !state.authorize(w, r, key, AccessWrite) || !state.checkWrite(w, key, updateRequest.Value, false) {
             return
         }
-
-    } else {
-        resp, err := json.Marshal(map[string]string{"error": "Entry not found"})
+        var err error
+        ok, err = applyRequestSync(key)
+        logger.Debug("Update applied", "key", key, "cas", updateRequest.PrevValue != nil, "updated", ok, "err", err)
         if err != nil {
-            log.Fatal(err)
-        }
-
-        w.WriteHeader(http.StatusNotFound)
-        n, err := w.Write(resp)
-        if err != nil || n < len(resp) {
-            log.Printf("Error while writing response: %v, %d bytes written", err, n)
+            writeApplyError(w, err)
             return
         }
+    }
 
+    if ok {
+        writeJson(w, http.StatusOK, map[string]string{"message": "Entry updated successfully"})
+    } else {
+        writeJson(w, http.StatusNotFound, map[string]string{"error": "Entry not found"})
     }
 }
 
+//a body with prev_value or prev_value_b64 makes the delete conditional
 func (state ExternalState) handleDelete(w http.ResponseWriter, r *http.Request) {
     if !state.isLeader() {
         state.redirectToLeader(w, r)
         return
     }
 
-    if key, ok := getKey(r.URL.Path); ok && state.env.ApplyRequestSync(DELETE, key, "", "") {
-        resp, err := json.Marshal(map[string]string{"message": "Entry deleted successfully"})
-        if err != nil {
-            log.Fatal(err)
+    logger := requestLogger(extLogger, r)
+    data, err := readBody(w, r)
+    if err != nil {
+        return
+    }
+    var deleteRequest WriteRequest
+    if len(data) > 0 {
+        if err = json.Unmarshal(data, &deleteRequest); err != nil {
+            http.Error(w, fmt.Sprint(err), http.StatusBadRequest)
+            return
         }
+        deleteRequest.decodeB64()
+    }
 
-        n, err := w.Write(resp)
-        if err != nil || n < len(resp) {
-            log.Printf("Error while writing response: %v, %d bytes written", err, n)
+    key, ok := getKey(r.URL.Path)
+    if ok {
+        if !state.authorize(w, r, key, AccessWrite) {
             return
         }
-
-    } else {
-        resp, err := json.Marshal(map[string]string{"error": "Entry not found"})
-        if err != nil {
-            log.Fatal(err)
+        if deleteRequest.PrevValue != nil {
+            ok, err = state.env.ApplyRequestSync(DELETE_IF_EQUALS, key, "", *deleteRequest.PrevValue)
+        } else {
+            ok, err = state.env.ApplyRequestSync(DELETE, key, "", "")
         }
-
-        w.WriteHeader(http.StatusNotFound)
-        n, err := w.Write(resp)
-        if err != nil || n < len(resp) {
-            log.Printf("Error while writing response: %v, %d bytes written", err, n)
+        logger.Debug("Delete applied", "key", key, "conditional", deleteRequest.PrevValue != nil, "deleted", ok, "err", err)
+        if err != nil {
+            writeApplyError(w, err)
             return
         }
+    }
+
+    if ok {
+        writeJson(w, http.StatusOK, map[string]string{"message": "Entry deleted successfully"})
+    } else if deleteRequest.PrevValue != nil {
+        writeJson(w, http.StatusConflict, map[string]string{"error": "Entry not found or has a different value"})
+    } else {
+        writeJson(w, http.StatusNotFound, map[string]string{"error": "Entry not found"})
+    }
+}
 
+func applyErrorStatus(err error) int {
+    switch {
+    case errors.Is(err, ErrTooManyPending):
+        return http.StatusTooManyRequests
+    case errors.Is(err, ErrNotInteger), errors.Is(err, ErrOverflow), errors.Is(err, ErrRoleChangePending):
+        return http.StatusConflict
+    default:
+        return http.StatusServiceUnavailable
     }
 }
 
+//sent in the "code" field of errors of writes that were certainly not applied, so clients can retry them.
+//Other apply errors have no code, the write may still be applied
+const (
+    codeTooManyPending = "too_many_pending"
+    codeWrongRange = "wrong_range" //the key moved to another range before the entry was applied
+    codeShuttingDown = "shutting_down"
+    codeNotLeader = "not_leader"
+)
+
+func applyErrorCode(err error) string {
+    switch {
+    case errors.Is(err, ErrTooManyPending):
+        return codeTooManyPending
+    case errors.Is(err, ErrWrongRange):
+        return codeWrongRange
+    case errors.Is(err, ErrShuttingDown):
+        return codeShuttingDown
+    case errors.Is(err, ErrNotLeader):
+        return codeNotLeader
+    default:
+        return ""
+    }
+}
+
+func writeApplyError(w http.ResponseWriter, err error) {
+    code := applyErrorStatus(err)
+    if code == http.StatusTooManyRequests || errors.Is(err, ErrWrongRange) {
+        w.Header().Set("Retry-After", "1")
+    }
+    body := map[string]string{"error": err.Error()}
+    if errorCode := applyErrorCode(err); errorCode != "" {
+        body["code"] = errorCode
+    }
+    writeJson(w, code, body)
+}
+
 func returnNotAllowed(w http.ResponseWriter) {
+    w.Header().Add("Allow", "GET, POST, PUT, DELETE")
     w.WriteHeader(http.StatusMethodNotAllowed)
-    w.Header().Add("Allow", "GET, PUT, DELETE")
 }
 
 func (state ExternalState) handleEntry(w http.ResponseWriter, r *http.Request) {
     switch (r.Method) {
     case "GET":
         state.handleGet(w, r)
+    case "POST":
+        state.handleCreate(w, r)
     case "PUT":
         state.handleUpdateOrCas(w, r)
     case "DELETE":
@@ -285,23 +355,62 @@ func (state ExternalState) handleEntry(w http.ResponseWriter, r *http.Request) {
 
 }
 
-func NewExtServer(env *TEnv, db *Db, ctx context.Context, nodesConfig NodesConfig, nodeId uint64, appConfig AppConfig) (*http.Server, error) {
-
-    state := ExternalState{
+func NewExtState(env *TEnv, db *Db, raftState *RaftState, ranges *Ranges, nodesConfig NodesConfig, nodeId uint64, appConfig AppConfig) ExternalState {
+    return ExternalState{
         env: env,
-        ctx: ctx,
+        ctx: ranges.raftCtx,
+        serving: ranges.serving,
         db: db,
+        raft: raftState,
+        ranges: ranges,
         nodes: nodesConfig,
         nodeId: nodeId,
         roundRobin: &atomic.Uint64{},
+        auth: appConfig.Auth,
+        limits: appConfig.Limits,
+        commitTimeout: appConfig.commitTimeout(),
+        storage: appConfig.Storage,
     }
+}
 
+func (state ExternalState) serveMux() *http.ServeMux {
     serveMux := http.NewServeMux()
     serveMux.HandleFunc("/entry", state.handleCreate)
     serveMux.HandleFunc("/entry/", state.handleEntry)
+    serveMux.HandleFunc("/increment/", state.handleIncrement)
+    serveMux.HandleFunc("/append/", state.handleAppend)
+    serveMux.HandleFunc("/upsert/", state.handleUpsert)
+    serveMux.HandleFunc("/batch", state.handleBatch)
+    serveMux.HandleFunc("/locks/", state.handleLock)
+    serveMux.HandleFunc("/elections/", state.handleElection)
+    serveMux.HandleFunc("/queues/", state.handleQueue)
+    serveMux.HandleFunc("/admin/promote/", state.requireAdmin(state.handlePromote))
+    serveMux.HandleFunc("/admin/members", state.requireAdmin(state.handleMembers))
+    serveMux.HandleFunc("/admin/members/", state.requireAdmin(state.handleMembers))
+    serveMux.HandleFunc("/admin/transfer-leadership", state.requireAdmin(state.handleTransferLeadership))
+    serveMux.HandleFunc("/admin/snapshot", state.requireAdmin(state.handleSnapshot))
+    serveMux.HandleFunc("/admin/hash", state.requireAdmin(state.handleHash))
+    serveMux.HandleFunc("/admin/backup", state.requireAdmin(state.handleBackup))
+    serveMux.HandleFunc("/admin/ranges", state.requireAdmin(state.handleRanges))
+    serveMux.HandleFunc("/admin/ranges/split", state.requireAdmin(state.handleSplit))
+    serveMux.HandleFunc("/auth/users/", state.handleUsers)
+    serveMux.HandleFunc("/auth/roles/", state.handleRoles)
+    serveMux.HandleFunc("/auth/whoami", state.handleWhoami)
+    serveMux.HandleFunc("/status", handleStatus(state.env, state.nodeId, false))
+    serveMux.HandleFunc("/debug/raft", state.requireAdmin(handleStatus(state.env, state.nodeId, true)))
+    serveMux.HandleFunc("/metrics", handleMetrics)
+    return serveMux
+}
 
-    return &http.Server {
+//requests are routed to the range that owns their key, see Ranges.ServeHTTP
+func NewExtServer(ranges *Ranges, nodesConfig NodesConfig, nodeId uint64, certs *CertStore) (*http.Server, error) {
+    server := &http.Server {
         Addr:           fmt.Sprintf(":%d", nodesConfig[nodeId].ExternalPort),
-        Handler:        serveMux,
-    }, nil
+        Handler:        instrumentHandler(withRequestId(ranges)),
+    }
+    server.RegisterOnShutdown(ranges.stopServing)
+    if certs != nil {
+        server.TLSConfig = certs.ExternalServerConfig()
+    }
+    return server, nil
 }
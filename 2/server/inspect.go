@@ -0,0 +1,461 @@
+package main
+
+import (
+    "bufio"
+    "encoding/binary"
+    "encoding/json"
+    "errors"
+    "flag"
+    "fmt"
+    "io"
+    "os"
+    "path/filepath"
+    "strconv"
+    "strings"
+    "time"
+)
+
+//offline inspection of the files in a workdir, nothing is written to them
+
+var opNames = map[int]string{
+    CREATE: "CREATE",
+    UPDATE: "UPDATE",
+    DELETE: "DELETE",
+    CAS: "CAS",
+    SET_ROLE: "SET_ROLE",
+    AUTH_PUT: "AUTH_PUT",
+    AUTH_DELETE: "AUTH_DELETE",
+    ALARM: "ALARM",
+    INCREMENT: "INCREMENT",
+    APPEND: "APPEND",
+    UPSERT: "UPSERT",
+    DELETE_IF_EQUALS: "DELETE_IF_EQUALS",
+    LOCK_ACQUIRE: "LOCK_ACQUIRE",
+    LOCK_RENEW: "LOCK_RENEW",
+    LOCK_RELEASE: "LOCK_RELEASE",
+    LOCK_PROCLAIM: "LOCK_PROCLAIM",
+    QUEUE_ENQUEUE: "QUEUE_ENQUEUE",
+    QUEUE_DEQUEUE: "QUEUE_DEQUEUE",
+    QUEUE_ACK: "QUEUE_ACK",
+    LOG_START: "LOG_START",
+    RANGE_SPLIT: "RANGE_SPLIT",
+}
+
+func opName(op int) string {
+    if name, ok := opNames[op]; ok {
+        return name
+    }
+    return fmt.Sprintf("UNKNOWN(%d)", op)
+}
+
+type logRecord struct {
+    Index uint64
+    FileOffset int64 //of the length prefix
+    Entry LogEntry
+}
+
+//where the readable part of a log file ends
+type logCorruption struct {
+    FileOffset int64
+    Index uint64 //that the broken record would have had
+    Reason string
+    Truncated bool //the node drops the broken record and everything after it on start
+}
+
+type logFile struct {
+    Name string
+    Offset uint64 //index of the last compacted entry
+    OffsetTerm uint64
+    Records []logRecord
+    Corruption *logCorruption
+}
+
+func (file *logFile) LastIndex() uint64 {
+    return file.Offset + uint64(len(file.Records))
+}
+
+//returns nil if the index is compacted or past the end
+func (file *logFile) Record(index uint64) *logRecord {
+    if index <= file.Offset || index > file.LastIndex() {
+        return nil
+    }
+    return &file.Records[index - file.Offset - 1]
+}
+
+//a workdir stands for the log.json in it
+func logPath(path string) string {
+    if info, err := os.Stat(path); err == nil && info.IsDir() {
+        return filepath.Join(path, "log.json")
+    }
+    return path
+}
+
+//reads the records up to the first broken one, unlike NewLog it does not truncate the file
+func readLogFile(path string) (*logFile, error) {
+    name := logPath(path)
+    file, err := os.Open(name)
+    if err != nil {
+        return nil, err
+    }
+    defer file.Close()
+    info, err := file.Stat()
+    if err != nil {
+        return nil, err
+    }
+
+    log := &logFile{Name: name}
+    reader := bufio.NewReader(file)
+    var fileOffset int64
+    var prevTerm uint64
+    corrupted := func(reason string, truncated bool) {
+        log.Corruption = &logCorruption{FileOffset: fileOffset, Index: log.LastIndex() + 1, Reason: reason, Truncated: truncated}
+    }
+    for {
+        lenData := make([]byte, 4)
+        n, err := io.ReadFull(reader, lenData)
+        if n == 0 && errors.Is(err, io.EOF) {
+            return log, nil
+        } else if errors.Is(err, io.ErrUnexpectedEOF) {
+            corrupted(fmt.Sprintf("length prefix truncated after %d bytes", n), true)
+            return log, nil
+        } else if err != nil {
+            return nil, err
+        }
+
+        //a corrupted length should not make us allocate gigabytes
+        length := int64(binary.LittleEndian.Uint32(lenData))
+        if rest := info.Size() - fileOffset - 4; length > rest {
+            corrupted(fmt.Sprintf("record of %d bytes truncated after %d bytes", length, rest), true)
+            return log, nil
+        }
+        data := make([]byte, length)
+        n, err = io.ReadFull(reader, data)
+        if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+            corrupted(fmt.Sprintf("record of %d bytes truncated after %d bytes", len(data), n), true)
+            return log, nil
+        } else if err != nil {
+            return nil, err
+        }
+
+        var entry LogEntry
+        if err := json.Unmarshal(data, &entry); err != nil {
+            corrupted(fmt.Sprintf("malformed record: %v", err), true)
+            return log, nil
+        }
+
+        switch {
+        case entry.Op == LOG_START && (fileOffset != 0 || log.LastIndex() != 0):
+            corrupted("log start record in the middle of the log", false)
+            return log, nil
+        case entry.Op == LOG_START:
+            if log.Offset, err = strconv.ParseUint(entry.Value, 10, 64); err != nil {
+                corrupted(fmt.Sprintf("malformed log start: %v", err), false)
+                return log, nil
+            }
+            log.OffsetTerm = entry.Term
+            prevTerm = entry.Term
+        case entry.Op < CREATE || entry.Op > RANGE_SPLIT:
+            corrupted(fmt.Sprintf("unknown op %d", entry.Op), false)
+            return log, nil
+        case entry.Term < prevTerm:
+            corrupted(fmt.Sprintf("term %d is less than the term %d of the previous entry", entry.Term, prevTerm), false)
+            return log, nil
+        default:
+            prevTerm = entry.Term
+            log.Records = append(log.Records, logRecord{Index: log.LastIndex() + 1, FileOffset: fileOffset, Entry: entry})
+        }
+        fileOffset += int64(4 + len(data))
+    }
+}
+
+func shorten(value string, limit int) string {
+    if len(value) > limit {
+        return fmt.Sprintf("%q...(%d bytes)", value[:limit], len(value))
+    }
+    return fmt.Sprintf("%q", value)
+}
+
+func describeEntry(entry LogEntry) string {
+    parts := []string{opName(entry.Op), fmt.Sprintf("key=%q", entry.Key)}
+    if entry.Value != "" {
+        parts = append(parts, "value=" + shorten(entry.Value, 60))
+    }
+    if entry.PrevValue != "" {
+        parts = append(parts, "prev=" + shorten(entry.PrevValue, 60))
+    }
+    if entry.TtlMs != 0 {
+        parts = append(parts, fmt.Sprintf("ttl_ms=%d", entry.TtlMs))
+    }
+    if entry.Time != 0 {
+        parts = append(parts, "time=" + time.UnixMilli(entry.Time).UTC().Format(time.RFC3339Nano))
+    }
+    return strings.Join(parts, " ")
+}
+
+func printCorruption(log *logFile) {
+    if log.Corruption != nil {
+        fmt.Printf("%s: corrupted at byte %d, entry %d: %s\n", log.Name, log.Corruption.FileOffset, log.Corruption.Index, log.Corruption.Reason)
+    }
+}
+
+func inspectDump(args []string) int {
+    flags := flag.NewFlagSet("dump", flag.ExitOnError)
+    from := flags.Uint64("from", 0, "first index to print")
+    to := flags.Uint64("to", 0, "last index to print, the end of the log if zero")
+    asJson := flags.Bool("json", false, "print entries as JSON lines")
+    flags.Parse(args)
+    if flags.NArg() != 1 {
+        fmt.Fprintln(os.Stderr, "Usage: inspect dump [-from N] [-to N] [-json] log-or-workdir")
+        return 2
+    }
+
+    log, err := readLogFile(flags.Arg(0))
+    if err != nil {
+        fmt.Fprintln(os.Stderr, err)
+        return 1
+    }
+    if log.Offset > 0 && !*asJson {
+        fmt.Printf("entries up to %d (term %d) are compacted\n", log.Offset, log.OffsetTerm)
+    }
+    for _, record := range log.Records {
+        if record.Index < *from || *to != 0 && record.Index > *to {
+            continue
+        }
+        if *asJson {
+            data, err := json.Marshal(map[string]any{"index": record.Index, "entry": record.Entry})
+            if err != nil {
+                fmt.Fprintln(os.Stderr, err)
+                return 1
+            }
+            fmt.Println(string(data))
+        } else {
+            fmt.Printf("%8d  term %-4d %s\n", record.Index, record.Entry.Term, describeEntry(record.Entry))
+        }
+    }
+    printCorruption(log)
+    return 0
+}
+
+func inspectValidate(args []string) int {
+    if len(args) < 1 {
+        fmt.Fprintln(os.Stderr, "Usage: inspect validate log-or-workdir...")
+        return 2
+    }
+    status := 0
+    for _, path := range args {
+        log, err := readLogFile(path)
+        if err != nil {
+            fmt.Fprintln(os.Stderr, err)
+            status = 1
+            continue
+        }
+        if log.Corruption != nil {
+            printCorruption(log)
+            if log.Corruption.Truncated {
+                fmt.Printf("%s: valid entries end at index %d, the node truncates the rest on start\n", log.Name, log.LastIndex())
+            } else {
+                fmt.Printf("%s: valid entries end at index %d, the node would load the rest as is\n", log.Name, log.LastIndex())
+            }
+            status = 1
+            continue
+        }
+        fmt.Printf("%s: ok, entries %d..%d\n", log.Name, log.Offset + 1, log.LastIndex())
+    }
+    return status
+}
+
+func inspectPState(args []string) int {
+    if len(args) != 1 {
+        fmt.Fprintln(os.Stderr, "Usage: inspect pstate pstate-or-workdir")
+        return 2
+    }
+    name := args[0]
+    if info, err := os.Stat(name); err == nil && info.IsDir() {
+        name = filepath.Join(name, "pstate.json")
+    }
+    data, err := os.ReadFile(name)
+    if err != nil {
+        fmt.Fprintln(os.Stderr, err)
+        return 1
+    }
+    var state PState
+    if err := json.Unmarshal(data, &state.State); err != nil {
+        fmt.Fprintf(os.Stderr, "%s: malformed: %v\n", name, err)
+        return 1
+    }
+    votedFor := "none"
+    if state.State.VotedFor != nil {
+        votedFor = strconv.FormatUint(*state.State.VotedFor, 10)
+    }
+    fmt.Printf("current term: %d\nvoted for: %s\n", state.State.CurrentTerm, votedFor)
+    return 0
+}
+
+func sameEntry(a LogEntry, b LogEntry) bool {
+    dataA, errA := json.Marshal(a)
+    dataB, errB := json.Marshal(b)
+    return errA == nil && errB == nil && string(dataA) == string(dataB)
+}
+
+//compares the logs over the indexes all of them keep, exits with 1 if they diverge
+func inspectDiff(args []string) int {
+    if len(args) < 2 {
+        fmt.Fprintln(os.Stderr, "Usage: inspect diff log-or-workdir log-or-workdir...")
+        return 2
+    }
+    var logs []*logFile
+    var first, last uint64 = 0, ^uint64(0)
+    for _, path := range args {
+        log, err := readLogFile(path)
+        if err != nil {
+            fmt.Fprintln(os.Stderr, err)
+            return 1
+        }
+        printCorruption(log)
+        fmt.Printf("%s: entries %d..%d\n", log.Name, log.Offset + 1, log.LastIndex())
+        logs = append(logs, log)
+        first = max(first, log.Offset + 1)
+        last = min(last, log.LastIndex())
+    }
+
+    for index := first; index <= last; index++ {
+        base := logs[0].Record(index).Entry
+        diverged := false
+        for _, log := range logs[1:] {
+            diverged = diverged || !sameEntry(base, log.Record(index).Entry)
+        }
+        if !diverged {
+            continue
+        }
+        fmt.Printf("logs diverge at index %d:\n", index)
+        for _, log := range logs {
+            entry := log.Record(index).Entry
+            fmt.Printf("  %s: term %d %s\n", log.Name, entry.Term, describeEntry(entry))
+        }
+        return 1
+    }
+
+    if first > last {
+        fmt.Println("logs have no indexes in common")
+    } else {
+        fmt.Printf("logs agree on entries %d..%d\n", first, last)
+    }
+    for _, log := range logs {
+        if log.LastIndex() > last {
+            fmt.Printf("%s has %d more entries\n", log.Name, log.LastIndex() - last)
+        }
+    }
+    return 0
+}
+
+//applies the log of a workdir on top of its snapshot, the log may end with entries that were never committed
+func inspectReplay(args []string) int {
+    flags := flag.NewFlagSet("replay", flag.ExitOnError)
+    index := flags.Uint64("index", 0, "index to replay the log up to, the end of the log if zero")
+    snapshotFile := flags.String("snapshot", "", "snapshot the log continues, snapshot.json next to the log by default")
+    system := flags.Bool("system", false, "print system keys of auth, locks and queues too")
+    asJson := flags.Bool("json", false, "print the state as a snapshot JSON")
+    flags.Parse(args)
+    if flags.NArg() != 1 {
+        fmt.Fprintln(os.Stderr, "Usage: inspect replay [-index N] [-snapshot file] [-system] [-json] log-or-workdir")
+        return 2
+    }
+
+    log, err := readLogFile(flags.Arg(0))
+    if err != nil {
+        fmt.Fprintln(os.Stderr, err)
+        return 1
+    }
+    printCorruption(log)
+    if *snapshotFile == "" {
+        *snapshotFile = filepath.Join(filepath.Dir(log.Name), "snapshot.json")
+    }
+    store, base, err := NewSnapshotStore(*snapshotFile)
+    if err != nil {
+        fmt.Fprintf(os.Stderr, "%s: %v\n", store.fileName, err)
+        return 1
+    }
+    defer base.Close()
+
+    var from uint64
+    if base != nil {
+        from = base.Index
+    }
+    target := *index
+    if target == 0 {
+        target = max(log.LastIndex(), from)
+    }
+    switch {
+    case from < log.Offset:
+        fmt.Fprintf(os.Stderr, "log is compacted up to %d, the snapshot at %d does not cover it\n", log.Offset, from)
+        return 1
+    case target < from:
+        fmt.Fprintf(os.Stderr, "index %d is compacted into the snapshot at %d\n", target, from)
+        return 1
+    case target > log.LastIndex():
+        fmt.Fprintf(os.Stderr, "index %d is past the end of the log at %d\n", target, log.LastIndex())
+        return 1
+    }
+
+    var entries []LogEntry
+    for i := from + 1; i <= target; i++ {
+        entries = append(entries, log.Record(i).Entry)
+    }
+    storage := NewMemoryStorage()
+    state := replay(base, entries, storage, storage.Close)
+    defer state.Close()
+    if base != nil {
+        state.Term = base.Term
+        state.Roles = base.Roles
+    }
+    if record := log.Record(target); record != nil {
+        state.Term = record.Entry.Term
+    }
+
+    if *asJson {
+        if _, err := writeSnapshot(os.Stdout, state); err != nil {
+            fmt.Fprintln(os.Stderr, err)
+            return 1
+        }
+        fmt.Println()
+        return 0
+    }
+    hash, _, err := state.Hash()
+    if err != nil {
+        fmt.Fprintln(os.Stderr, err)
+        return 1
+    }
+    fmt.Printf("state at index %d, term %d, hash %s\n", state.Index, state.Term, hash)
+    state.Ascend(func(key string, item Item) error {
+        if !isSystemKey(key) || *system {
+            fmt.Printf("%q = %s\n", key, shorten(item.Value, 200))
+        }
+        return nil
+    })
+    return 0
+}
+
+func runInspect(args []string) {
+    commands := map[string]func([]string) int{
+        "dump": inspectDump,
+        "validate": inspectValidate,
+        "pstate": inspectPState,
+        "diff": inspectDiff,
+        "replay": inspectReplay,
+    }
+    if len(args) < 1 || commands[args[0]] == nil {
+        fmt.Fprintf(os.Stderr, `Usage: %s inspect command [flags] args
+
+Commands:
+  dump [-from N] [-to N] [-json] log    print the entries with their index, term and op
+  validate log...                       check the records and report where corruption starts
+  pstate pstate                         print the current term and vote
+  diff log log...                       find the first index where the logs diverge
+  replay [-index N] log                 apply the log on top of its snapshot and print the state
+
+A workdir can be passed instead of its log.json or pstate.json.
+`, os.Args[0])
+        os.Exit(2)
+    }
+    os.Exit(commands[args[0]](args[1:]))
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+    "encoding/json"
+    "errors"
+    "fmt"
+    "net/http"
+    "strconv"
+    "strings"
+    "time"
+)
+
+const lockPrefix = sysPrefix + "lock/"
+
+//the fencing token is the log index of the entry that acquired the lock
+type Lock struct {
+    Owner string `json:"owner"`
+    Token uint64 `json:"token"`
+    ExpiresMs int64 `json:"expires_ms"`
+    Value string `json:"value,omitempty"`
+}
+
+func (lock Lock) expiredAt(nowMs int64) bool {
+    return nowMs >= lock.ExpiresMs
+}
+
+func (db *Db) getLock(name string) (lock Lock, ok bool) {
+    item, ok := db.data.Get(lockPrefix + name)
+    if ok && json.Unmarshal([]byte(item.Value), &lock) != nil {
+        fatal(dbLogger, "Malformed lock", "lock", name)
+    }
+    return
+}
+
+//returns the stored JSON, which is also the result of acquire and renew
+func (db *Db) putLock(name string, lock Lock) string {
+    data, err := json.Marshal(lock)
+    if err != nil {
+        fatal(dbLogger, "Error while marshalling lock", "lock", name, "err", err)
+    }
+    db.set(lockPrefix + name, Item{Value: string(data)})
+    return string(data)
+}
+
+func (db *Db) GetLock(name string) (Lock, bool) {
+    db.m.RLock()
+    defer db.m.RUnlock()
+
+    return db.getLock(name)
+}
+
+//expired leases are not removed, the next acquisition just replaces them
+func (db *Db) commitLockAcquire(entry LogEntry) CommitResult {
+    db.m.Lock()
+    defer db.m.Unlock()
+
+    lock, held := db.getLock(entry.Key)
+    if held && !lock.expiredAt(entry.Time) && lock.Owner != entry.Value {
+        return CommitResult{Ok: false}
+    }
+    //repeated acquisition by the same owner extends the lease and keeps the token
+    if !held || lock.expiredAt(entry.Time) {
+        lock = Lock{Owner: entry.Value, Token: entry.index}
+    }
+    lock.ExpiresMs = entry.Time + entry.TtlMs
+    lock.Value = entry.Payload
+    return CommitResult{Ok: true, Value: db.putLock(entry.Key, lock)}
+}
+
+func (db *Db) holdsLock(entry LogEntry) (Lock, bool) {
+    lock, held := db.getLock(entry.Key)
+    return lock, held && lock.Owner == entry.Value && strconv.FormatUint(lock.Token, 10) == entry.PrevValue
+}
+
+//renew and release only need the token to match, which means nobody acquired the lock since
+func (db *Db) commitLockRenew(entry LogEntry) CommitResult {
+    db.m.Lock()
+    defer db.m.Unlock()
+
+    lock, ok := db.holdsLock(entry)
+    if !ok {
+        return CommitResult{Ok: false}
+    }
+    lock.ExpiresMs = entry.Time + entry.TtlMs
+    return CommitResult{Ok: true, Value: db.putLock(entry.Key, lock)}
+}
+
+//changes the value attached to the lock without touching the lease
+func (db *Db) commitLockProclaim(entry LogEntry) CommitResult {
+    db.m.Lock()
+    defer db.m.Unlock()
+
+    lock, ok := db.holdsLock(entry)
+    if !ok {
+        return CommitResult{Ok: false}
+    }
+    lock.Value = entry.Payload
+    return CommitResult{Ok: true, Value: db.putLock(entry.Key, lock)}
+}
+
+func (db *Db) commitLockRelease(entry LogEntry) CommitResult {
+    db.m.Lock()
+    defer db.m.Unlock()
+
+    if _, ok := db.holdsLock(entry); !ok {
+        return CommitResult{Ok: false}
+    }
+    db.remove(lockPrefix + entry.Key)
+    return CommitResult{Ok: true}
+}
+
+type LockRequest struct {
+    Owner string `json:"owner"`
+    Token uint64 `json:"token"` //for renew and release
+    TtlMs int64 `json:"ttl_ms"`
+    WaitMs int64 `json:"wait_ms"` //how long acquire waits for the lock to be released or expire
+    Value string `json:"value"` //attached to the lock on acquire
+}
+
+type LockResponse struct {
+    Name string `json:"name"`
+    Lock
+}
+
+//negative wait means waiting until the lock is acquired or the client is gone
+func (state ExternalState) acquireLock(r *http.Request, name string, request LockRequest) (CommitResult, error) {
+    forever := request.WaitMs < 0
+    deadline := time.Now().Add(time.Duration(request.WaitMs) * time.Millisecond)
+    for {
+        result, err := state.env.ApplyEntryWithin(LogEntry{Op: LOCK_ACQUIRE, Key: name, Value: request.Owner, TtlMs: request.TtlMs, Payload: request.Value,}, state.commitTimeout)
+        if err != nil || result.Ok || (!forever && !time.Now().Before(deadline)) {
+            return result, err
+        }
+
+        //a renewal of the holder is not worth an attempt, only a release or an expired lease is
+        free, err := state.waitLockFree(r, name, forever, deadline)
+        if err != nil || !free {
+            return result, err
+        }
+    }
+}
+
+//waits are checked at least this often in case the lease expiry is missed because of clock differences
+const lockPollInterval = time.Second
+
+//false if the deadline passes while the lock is held
+func (state ExternalState) waitLockFree(r *http.Request, name string, forever bool, deadline time.Time) (bool, error) {
+    for {
+        if !state.isLeader() {
+            return false, ErrNotLeader
+        }
+        //the watch is taken before the check, so a release right after it is not missed
+        changed := state.db.Watch(lockPrefix + name)
+        lock, held := state.db.GetLock(name)
+        if !held || lock.expiredAt(time.Now().UnixMilli()) {
+            return true, nil
+        }
+        if !forever && !time.Now().Before(deadline) {
+            return false, nil
+        }
+
+        wait := time.Until(time.UnixMilli(lock.ExpiresMs))
+        if !forever {
+            wait = min(wait, time.Until(deadline))
+        }
+        timer := time.NewTimer(max(min(wait, lockPollInterval), 10 * time.Millisecond))
+        select {
+        case <- changed:
+        case <- timer.C:
+        case <- r.Context().Done():
+            timer.Stop()
+            return false, r.Context().Err()
+        case <- state.serving.Done():
+            timer.Stop()
+            return false, ErrShuttingDown
+        }
+        timer.Stop()
+    }
+}
+
+func (state ExternalState) writeLockHeld(w http.ResponseWriter, name string) {
+    lock, held := state.db.GetLock(name)
+    if !held {
+        writeJson(w, http.StatusConflict, map[string]string{"error": "Lock is held by another owner"})
+        return
+    }
+    writeJson(w, http.StatusConflict, map[string]any{"error": "Lock is held by another owner", "owner": lock.Owner, "expires_ms": lock.ExpiresMs})
+}
+
+func (state ExternalState) writeCurrentLock(w http.ResponseWriter, r *http.Request, name string, permKey string) {
+    if !state.authorize(w, r, permKey, AccessRead) {
+        return
+    }
+    lock, held := state.db.GetLock(name)
+    if !held || lock.expiredAt(time.Now().UnixMilli()) {
+        writeJson(w, http.StatusNotFound, map[string]string{"error": "Lock is not held"})
+        return
+    }
+    writeJson(w, http.StatusOK, LockResponse{Name: name, Lock: lock})
+}
+
+const (
+    lockAcquire = "acquire"
+    lockRenew = "renew"
+    lockRelease = "release"
+    lockProclaim = "proclaim"
+)
+
+//runs a lock operation on the leader, name is shown in responses instead of the lock name,
+//waitDefault is used for acquire when the request has no wait_ms
+func (state ExternalState) handleLockAction(w http.ResponseWriter, r *http.Request, lockName string, name string, permKey string, action string, waitDefault int64) {
+    if !state.isLeader() {
+        state.redirectToLeader(w, r)
+        return
+    }
+    if !state.authorize(w, r, permKey, AccessWrite) {
+        return
+    }
+
+    logger := requestLogger(extLogger, r)
+    data, err := readBody(w, r)
+    if err != nil {
+        return
+    }
+    lockRequest := LockRequest{WaitMs: waitDefault}
+    if err = json.Unmarshal(data, &lockRequest); err != nil {
+        http.Error(w, fmt.Sprint(err), http.StatusBadRequest)
+        return
+    }
+    if lockRequest.Owner == "" {
+        http.Error(w, "Owner must not be empty", http.StatusBadRequest)
+        return
+    }
+    if (action == lockAcquire || action == lockRenew) && lockRequest.TtlMs <= 0 {
+        http.Error(w, "ttl_ms must be positive", http.StatusBadRequest)
+        return
+    }
+
+    token := strconv.FormatUint(lockRequest.Token, 10)
+    var result CommitResult
+    switch action {
+    case lockAcquire:
+        result, err = state.acquireLock(r, lockName, lockRequest)
+    case lockRenew:
+        result, err = state.env.ApplyEntryWithin(LogEntry{Op: LOCK_RENEW, Key: lockName, Value: lockRequest.Owner, PrevValue: token, TtlMs: lockRequest.TtlMs,}, state.commitTimeout)
+    case lockRelease:
+        result, err = state.env.ApplyEntryWithin(LogEntry{Op: LOCK_RELEASE, Key: lockName, Value: lockRequest.Owner, PrevValue: token,}, state.commitTimeout)
+    case lockProclaim:
+        result, err = state.env.ApplyEntryWithin(LogEntry{Op: LOCK_PROCLAIM, Key: lockName, Value: lockRequest.Owner, PrevValue: token, Payload: lockRequest.Value,}, state.commitTimeout)
+    }
+    logger.Debug("Lock request applied", "lock", lockName, "action", action, "owner", lockRequest.Owner, "ok", result.Ok, "err", err)
+    if err != nil {
+        //the client is gone
+        if r.Context().Err() != nil {
+            return
+        }
+        //the attempts so far failed, so the leader can run the request again
+        if errors.Is(err, ErrNotLeader) {
+            state.redirectToLeader(w, r)
+            return
+        }
+        writeApplyError(w, err)
+        return
+    }
+
+    switch {
+    case action == lockAcquire && !result.Ok:
+        state.writeLockHeld(w, lockName)
+    case !result.Ok:
+        writeJson(w, http.StatusConflict, map[string]string{"error": "Lock is not held with this owner and token"})
+    case action == lockRelease:
+        writeJson(w, http.StatusOK, map[string]string{"message": "Lock released"})
+    default:
+        resp := LockResponse{Name: name}
+        if err := json.Unmarshal([]byte(result.Value), &resp.Lock); err != nil {
+            fatal(extLogger, "Malformed lock", "lock", lockName, "err", err)
+        }
+        writeJson(w, http.StatusOK, resp)
+    }
+}
+
+//POST acquires, PUT renews, DELETE releases and GET shows the holder of /locks/<name>,
+//permissions are checked against the "locks/<name>" key
+func (state ExternalState) handleLock(w http.ResponseWriter, r *http.Request) {
+    name := strings.TrimPrefix(r.URL.Path, "/locks/")
+    if !validAuthName(name) {
+        writeJson(w, http.StatusNotFound, map[string]string{"error": "Invalid lock name"})
+        return
+    }
+    permKey := "locks/" + name
+
+    switch r.Method {
+    case "GET":
+        state.writeCurrentLock(w, r, name, permKey)
+    case "POST":
+        state.handleLockAction(w, r, name, name, permKey, lockAcquire, 0)
+    case "PUT":
+        state.handleLockAction(w, r, name, name, permKey, lockRenew, 0)
+    case "DELETE":
+        state.handleLockAction(w, r, name, name, permKey, lockRelease, 0)
+    default:
+        w.Header().Add("Allow", "GET, POST, PUT, DELETE")
+        w.WriteHeader(http.StatusMethodNotAllowed)
+    }
+}
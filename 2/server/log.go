@@ -1,13 +1,16 @@
 package main
 
 import (
+    "bufio"
     "io"
     "os"
     "encoding/json"
     "encoding/binary"
     "errors"
+    "fmt"
     "io/fs"
-    "log"
+    "strconv"
+    "unicode/utf8"
 )
 
 const (
@@ -15,6 +18,23 @@ const (
     UPDATE
     DELETE
     CAS
+    SET_ROLE
+    AUTH_PUT
+    AUTH_DELETE
+    ALARM
+    INCREMENT //Value keeps the delta as a decimal number
+    APPEND
+    UPSERT
+    DELETE_IF_EQUALS
+    LOCK_ACQUIRE //Key is the lock name, Value the owner, PrevValue the fencing token for renew and release
+    LOCK_RENEW
+    LOCK_RELEASE
+    LOCK_PROCLAIM
+    QUEUE_ENQUEUE
+    QUEUE_DEQUEUE
+    QUEUE_ACK
+    LOG_START //first record of a compacted log, Value keeps the index of the last compacted entry and Term its term
+    RANGE_SPLIT //Key is the first key moved to the new range, Value the id of the new range
 )
 
 type LogEntry struct {
@@ -23,12 +43,62 @@ type LogEntry struct {
     Key string `json:"key"`
     PrevValue string `json:"prev_value"` //for CAS
     Value string `json:"value"`
-    statusChan *chan bool `json:"-"`
+    ContentType string `json:"content_type,omitempty"`
+    Flags uint64 `json:"flags,omitempty"`
+    Time int64 `json:"time,omitempty"` //unix ms on the leader when the entry was appended, the state machine uses it as the current time
+    TtlMs int64 `json:"ttl_ms,omitempty"`
+    Payload string `json:"payload,omitempty"` //value attached to a lock
+    statusChan *chan CommitResult `json:"-"`
+    index uint64 //set when the entry is sent to the state machine
+    snapshot *Snapshot //replaces the state machine instead of being applied, sent after a snapshot is installed
 }
 
+type logEntryFields LogEntry
+
+//values that are not valid UTF-8 are base64 encoded, json.Marshal would replace the invalid bytes otherwise
+type logEntryJson struct {
+    logEntryFields
+    ValueB64 []byte `json:"value_b64,omitempty"`
+    PrevValueB64 []byte `json:"prev_value_b64,omitempty"`
+}
+
+func (entry LogEntry) MarshalJSON() ([]byte, error) {
+    wire := logEntryJson{logEntryFields: logEntryFields(entry)}
+    if !utf8.ValidString(entry.Value) {
+        wire.Value = ""
+        wire.ValueB64 = []byte(entry.Value)
+    }
+    if !utf8.ValidString(entry.PrevValue) {
+        wire.PrevValue = ""
+        wire.PrevValueB64 = []byte(entry.PrevValue)
+    }
+    return json.Marshal(wire)
+}
+
+func (entry *LogEntry) UnmarshalJSON(data []byte) error {
+    var wire logEntryJson
+    if err := json.Unmarshal(data, &wire); err != nil {
+        return err
+    }
+    *entry = LogEntry(wire.logEntryFields)
+    if wire.ValueB64 != nil {
+        entry.Value = string(wire.ValueB64)
+    }
+    if wire.PrevValueB64 != nil {
+        entry.PrevValue = string(wire.PrevValueB64)
+    }
+    return nil
+}
+
+func (entry LogEntry) Item() Item {
+    return Item{Value: entry.Value, ContentType: entry.ContentType, Flags: entry.Flags}
+}
+
+//Entries[0] is a sentinel for the last compacted entry, its index is Offset and the other entries follow it
 type Log struct {
     FilePath string
     Entries []LogEntry
+    Offset uint64
 }
 
 var EntryCorrupted = errors.New("Entry corrupted")
@@ -83,7 +153,7 @@ func NewLog(filePath string) (Log, error) {
     file, err := os.Open(filePath)
     if err != nil {
         if errors.Is(err, fs.ErrNotExist) {
-            log := Log{filePath, []LogEntry{LogEntry{Op: DELETE,}}}
+            log := Log{filePath, []LogEntry{LogEntry{Op: DELETE,}}, 0}
             err = log.DumpLog()
             return log, err
         }
@@ -96,6 +166,7 @@ func NewLog(filePath string) (Log, error) {
     entries = append(entries, LogEntry{Op: DELETE,})
 
     offset := 0
+    var logOffset uint64
     for {
         var entry LogEntry
         n, err := DeserializeEntry(file, &entry)
@@ -103,17 +174,24 @@ func NewLog(filePath string) (Log, error) {
             break;
         } else if errors.Is(err, EntryCorrupted) {
             file.Truncate(int64(offset))
-            log.Printf("File %s is corrupted, truncated at offset %d, entries length is %d", filePath, offset, len(entries))
+            storageLogger.Warn("Log file is corrupted, truncated", "file", filePath, "offset", offset, "entries", len(entries))
             break
         } else if err != nil {
             return Log{}, err
         }
 
         offset += n
+        if entry.Op == LOG_START && len(entries) == 1 {
+            if logOffset, err = strconv.ParseUint(entry.Value, 10, 64); err != nil {
+                return Log{}, fmt.Errorf("Malformed log start in %s: %w", filePath, err)
+            }
+            entries[0] = entry
+            continue
+        }
         entries = append(entries, entry)
     }
 
-    return Log{filePath, entries}, nil
+    return Log{filePath, entries, logOffset}, nil
 }
 
 func (wlog Log) DumpLog() error {
@@ -124,6 +202,9 @@ func (wlog Log) DumpLog() error {
             return name, err
         }
         defer file.Close()
+        if wlog.Offset > 0 {
+            SerializeEntry(wlog.Entries[0], file)
+        }
         for _, entry := range wlog.Entries[1 : len(wlog.Entries)] {
             SerializeEntry(entry, file)
         }
@@ -139,47 +220,128 @@ func (wlog Log) DumpLog() error {
 }
 
 func Append(wlog Log, logEntry LogEntry) Log {
+    return AppendBatch(wlog, []LogEntry{logEntry})
+}
+
+//writes all entries with a single open of the log file
+func AppendBatch(wlog Log, entries []LogEntry) Log {
     file, err := os.OpenFile(wlog.FilePath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
     if err != nil {
-        log.Fatal(err)
+        fatal(storageLogger, "Error while opening log", "file", wlog.FilePath, "err", err)
     }
     defer file.Close()
 
-    if _, err := SerializeEntry(logEntry, file); err != nil {
-        log.Fatal(err)
+    writer := bufio.NewWriter(file)
+    for _, entry := range entries {
+        if _, err := SerializeEntry(entry, writer); err != nil {
+            fatal(storageLogger, "Error while appending to log", "file", wlog.FilePath, "err", err)
+        }
+    }
+    if err := writer.Flush(); err != nil {
+        fatal(storageLogger, "Error while appending to log", "file", wlog.FilePath, "err", err)
     }
 
-    wlog.Entries = append(wlog.Entries, logEntry)
+    wlog.Entries = append(wlog.Entries, entries...)
+    entriesAppended.Add(float64(len(entries)))
     return wlog;
 }
 
+func syncFile(fileName string) error {
+    file, err := os.OpenFile(fileName, os.O_RDWR, 0600)
+    if err != nil {
+        return err
+    }
+    defer file.Close()
+
+    return file.Sync()
+}
+
+func (wlog Log) Sync() error {
+    return syncFile(wlog.FilePath)
+}
+
 func (wlog Log) Back() LogEntry {
     return wlog.Entries[len(wlog.Entries) - 1]
 }
 
+func (wlog Log) LastIndex() uint64 {
+    return wlog.Offset + uint64(len(wlog.Entries) - 1)
+}
+
+//the entry must be in the log, the sentinel is returned for Offset
+func (wlog Log) Entry(index uint64) LogEntry {
+    return wlog.Entries[index - wlog.Offset]
+}
+
+func (wlog Log) Term(index uint64) uint64 {
+    return wlog.Entry(index).Term
+}
+
+//entries from index up to the end of the log, index must be greater than Offset
+func (wlog Log) From(index uint64) []LogEntry {
+    return wlog.Entries[index - wlog.Offset : len(wlog.Entries)]
+}
+
+func (wlog Log) Contains(index uint64) bool {
+    return index >= wlog.Offset && index <= wlog.LastIndex()
+}
+
+//bytes the log takes on disk, compacted entries are gone from the file
+func (wlog Log) FileSize() int64 {
+    info, err := os.Stat(wlog.FilePath)
+    if err != nil {
+        return 0
+    }
+    return info.Size()
+}
+
+func logStart(index uint64, term uint64) LogEntry {
+    return LogEntry{Op: LOG_START, Term: term, Value: strconv.FormatUint(index, 10)}
+}
+
+//drops the entries up to index, which is covered by a snapshot and becomes the new sentinel
+func (wlog *Log) Compact(index uint64) error {
+    if index <= wlog.Offset || index > wlog.LastIndex() {
+        return nil
+    }
+    entries := []LogEntry{logStart(index, wlog.Term(index))}
+    wlog.Entries = append(entries, wlog.From(index + 1)...)
+    wlog.Offset = index
+    return wlog.DumpLog()
+}
+
+//replaces the whole log with a sentinel, used when an installed snapshot does not match the log
+func (wlog *Log) Reset(index uint64, term uint64) error {
+    wlog.Entries = []LogEntry{logStart(index, term)}
+    wlog.Offset = index
+    return wlog.DumpLog()
+}
+
 func (wlog *Log) CheckAndCorrect(prevLogIndex uint64, prevLogTerm uint64) bool {
     var changed bool
     defer func() {
         if changed {
             err := wlog.DumpLog()
             if err != nil {
-                log.Fatal(err)
+                fatal(storageLogger, "Error while rewriting log", "file", wlog.FilePath, "err", err)
             }
         }
     }()
 
-    if int(prevLogIndex) >= len(wlog.Entries) {
+    if prevLogIndex > wlog.LastIndex() || prevLogIndex < wlog.Offset {
         return false
     }
 
-    if int(prevLogIndex) < len(wlog.Entries) - 1 {
+    pos := prevLogIndex - wlog.Offset
+    if prevLogIndex < wlog.LastIndex() {
         changed = true
-        wlog.Entries = wlog.Entries[0 : prevLogIndex + 1]
+        wlog.Entries = wlog.Entries[0 : pos + 1]
     }
 
-    if wlog.Entries[prevLogIndex].Term != prevLogTerm {
+    //compacted entries are committed, so the sentinel can not conflict with the leader
+    if pos > 0 && wlog.Entries[pos].Term != prevLogTerm {
         changed = true
-        wlog.Entries = wlog.Entries[0 : prevLogIndex]
+        wlog.Entries = wlog.Entries[0 : pos]
         return false
     }
 
@@ -187,7 +349,7 @@ func (wlog *Log) CheckAndCorrect(prevLogIndex uint64, prevLogTerm uint64) bool {
 }
 
 func (wlog *Log) AppendEntries(entries []LogEntry) {
-    for _, entry := range entries {
-        *wlog = Append(*wlog, entry)
+    if len(entries) > 0 {
+        *wlog = AppendBatch(*wlog, entries)
     }
 }
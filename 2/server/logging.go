@@ -0,0 +1,153 @@
+package main
+
+import (
+    "context"
+    "crypto/rand"
+    "encoding/hex"
+    "fmt"
+    "log/slog"
+    "net/http"
+    "os"
+    "strings"
+)
+
+//full request dumps, more verbose than debug
+const LevelTrace = slog.Level(-8)
+
+type LoggingConfig struct {
+    Format string `json:"format"` //text or json
+    Level string `json:"level"`
+    Components map[string]string `json:"components"` //component name -> level
+}
+
+var (
+    mainLogger = slog.Default()
+    raftLogger = slog.Default()
+    extLogger = slog.Default()
+    dbLogger = slog.Default()
+    storageLogger = slog.Default()
+    respLogger = slog.Default()
+)
+
+func ParseLevel(name string) (slog.Level, error) {
+    if strings.EqualFold(name, "trace") {
+        return LevelTrace, nil
+    }
+    if name == "" {
+        return slog.LevelInfo, nil
+    }
+
+    var level slog.Level
+    err := level.UnmarshalText([]byte(name))
+    return level, err
+}
+
+func replaceLevelName(groups []string, attr slog.Attr) slog.Attr {
+    if attr.Key == slog.LevelKey && len(groups) == 0 {
+        if level, ok := attr.Value.Any().(slog.Level); ok && level <= LevelTrace {
+            attr.Value = slog.StringValue("TRACE")
+        }
+    }
+    return attr
+}
+
+//parses "raft=debug,external=warn"
+func ParseComponentLevels(spec string) (map[string]string, error) {
+    levels := make(map[string]string)
+    for _, part := range strings.Split(spec, ",") {
+        if part = strings.TrimSpace(part); part == "" {
+            continue
+        }
+        component, level, ok := strings.Cut(part, "=")
+        if !ok {
+            return nil, fmt.Errorf("Invalid component level %q, expected component=level", part)
+        }
+        levels[component] = level
+    }
+    return levels, nil
+}
+
+func newComponentLogger(config LoggingConfig, component string, nodeId uint64) (*slog.Logger, error) {
+    levelName := config.Level
+    if name, ok := config.Components[component]; ok {
+        levelName = name
+    }
+    level, err := ParseLevel(levelName)
+    if err != nil {
+        return nil, fmt.Errorf("Invalid level for component %s: %w", component, err)
+    }
+
+    options := &slog.HandlerOptions{Level: level, ReplaceAttr: replaceLevelName}
+    var handler slog.Handler
+    switch config.Format {
+    case "", "text":
+        handler = slog.NewTextHandler(os.Stderr, options)
+    case "json":
+        handler = slog.NewJSONHandler(os.Stderr, options)
+    default:
+        return nil, fmt.Errorf("Unknown log format %q", config.Format)
+    }
+
+    return slog.New(handler).With("component", component, "node_id", nodeId), nil
+}
+
+func SetupLogging(config LoggingConfig, nodeId uint64) error {
+    loggers := map[string]**slog.Logger{
+        "main": &mainLogger,
+        "raft": &raftLogger,
+        "external": &extLogger,
+        "db": &dbLogger,
+        "storage": &storageLogger,
+        "resp": &respLogger,
+    }
+
+    for component := range config.Components {
+        if _, ok := loggers[component]; !ok {
+            return fmt.Errorf("Unknown log component %q", component)
+        }
+    }
+
+    for component, logger := range loggers {
+        newLogger, err := newComponentLogger(config, component, nodeId)
+        if err != nil {
+            return err
+        }
+        *logger = newLogger
+    }
+
+    //messages from the standard library (e.g. net/http) go through the main logger
+    slog.SetDefault(mainLogger)
+    return nil
+}
+
+func fatal(logger *slog.Logger, msg string, args ...any) {
+    logger.Error(msg, args...)
+    os.Exit(1)
+}
+
+type requestIdKey struct{}
+
+func newRequestId() string {
+    data := make([]byte, 8)
+    rand.Read(data)
+    return hex.EncodeToString(data)
+}
+
+//assigns request id (or takes it from X-Request-Id) to every request
+func withRequestId(handler http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        id := r.Header.Get("X-Request-Id")
+        if id == "" {
+            id = newRequestId()
+        }
+        w.Header().Set("X-Request-Id", id)
+        handler.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIdKey{}, id)))
+    })
+}
+
+func requestLogger(logger *slog.Logger, r *http.Request) *slog.Logger {
+    if id, ok := r.Context().Value(requestIdKey{}).(string); ok {
+        return logger.With("request_id", id, "method", r.Method, "path", r.URL.Path)
+    }
+    return logger
+}
@@ -0,0 +1,775 @@
+package main
+
+import (
+    "bufio"
+    "bytes"
+    "encoding/binary"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "hash/crc32"
+    "hash/fnv"
+    "io/fs"
+    "os"
+    "path/filepath"
+    "slices"
+    "sort"
+    "strings"
+    "sync/atomic"
+)
+
+//Log structured merge tree. Changes go to a memtable that is written out as a sorted table file,
+//the manifest lists the tables together with the state they contain and is replaced atomically.
+//There is no write ahead log, entries applied after the last manifest are applied again from the raft log
+
+const (
+    lsmManifestFile = "MANIFEST"
+    lsmTableSuffix = ".sst"
+    lsmBlockSize = 4096
+    lsmBloomBitsPerKey = 10
+    lsmBloomHashes = 7
+    lsmFooterSize = 24
+    lsmMagic uint32 = 0x4c534d31
+)
+
+type lsmEntry struct {
+    item Item
+    deleted bool
+}
+
+type lsmManifest struct {
+    State StorageState `json:"state"`
+    Tables []uint64 `json:"tables"` //oldest first
+    NextId uint64 `json:"next_id"`
+}
+
+type lsmBlock struct {
+    firstKey string
+    offset int64
+    length int64
+    crc uint32
+}
+
+//immutable sorted file: data blocks, the block index, a bloom filter of the keys and the footer
+type lsmTable struct {
+    id uint64
+    file *os.File
+    size int64
+    blocks []lsmBlock
+    bloom []byte
+    refs atomic.Int32 //the engine and the views using the table, the file is closed by the last one
+}
+
+func (table *lsmTable) release() {
+    if table.refs.Add(-1) == 0 {
+        table.file.Close()
+    }
+}
+
+type Lsm struct {
+    dir string
+    memtableBytes int64
+    memtable map[string]lsmEntry
+    memBytes int64
+    tables []*lsmTable //oldest first
+    obsolete []*lsmTable //removed once a manifest without them is written
+    dirty bool //tables changed since the manifest was written
+    state StorageState //of the last Commit
+    committed StorageState //in the manifest
+    nextId uint64
+}
+
+func OpenLsm(dir string, config StorageConfig) (*Lsm, error) {
+    if err := os.MkdirAll(dir, 0700); err != nil {
+        return nil, err
+    }
+    lsm := &Lsm{dir: dir, memtableBytes: config.MemtableBytes, memtable: make(map[string]lsmEntry), nextId: 1}
+    if lsm.memtableBytes <= 0 {
+        lsm.memtableBytes = 4 << 20
+    }
+
+    var manifest lsmManifest
+    data, err := os.ReadFile(filepath.Join(dir, lsmManifestFile))
+    if err == nil {
+        if err := json.Unmarshal(data, &manifest); err != nil {
+            return nil, fmt.Errorf("Malformed manifest in %s: %w", dir, err)
+        }
+        lsm.committed = manifest.State
+        lsm.state = manifest.State
+        lsm.nextId = manifest.NextId
+    } else if !errors.Is(err, fs.ErrNotExist) {
+        return nil, err
+    }
+
+    listed := make(map[string]bool)
+    for _, id := range manifest.Tables {
+        table, err := openTable(dir, id)
+        if err != nil {
+            lsm.closeTables()
+            return nil, err
+        }
+        lsm.tables = append(lsm.tables, table)
+        listed[table.file.Name()] = true
+    }
+
+    //tables of a flush or compaction that did not reach the manifest
+    files, err := os.ReadDir(dir)
+    if err != nil {
+        lsm.closeTables()
+        return nil, err
+    }
+    for _, file := range files {
+        name := filepath.Join(dir, file.Name())
+        if strings.HasSuffix(name, lsmTableSuffix) && !listed[name] || strings.HasPrefix(file.Name(), lsmManifestFile + "-") {
+            storageLogger.Warn("Removing unused storage file", "file", name)
+            os.Remove(name)
+        }
+    }
+    storageLogger.Info("Storage opened", "dir", dir, "tables", len(lsm.tables), "index", lsm.committed.Index)
+    return lsm, nil
+}
+
+func tableName(dir string, id uint64) string {
+    return filepath.Join(dir, fmt.Sprintf("%08d%s", id, lsmTableSuffix))
+}
+
+func (lsm *Lsm) Get(key string) (Item, bool) {
+    if entry, ok := lsm.memtable[key]; ok {
+        return entry.item, !entry.deleted
+    }
+    for i := len(lsm.tables) - 1; i >= 0; i-- {
+        if entry, ok := lsm.tables[i].get(key); ok {
+            return entry.item, !entry.deleted
+        }
+    }
+    return Item{}, false
+}
+
+func entrySize(key string, entry lsmEntry) int64 {
+    return int64(len(key) + len(entry.item.Value) + len(entry.item.ContentType) + 16)
+}
+
+func (lsm *Lsm) put(key string, entry lsmEntry) {
+    if old, ok := lsm.memtable[key]; ok {
+        lsm.memBytes -= entrySize(key, old)
+    }
+    lsm.memtable[key] = entry
+    lsm.memBytes += entrySize(key, entry)
+    //tables written here are listed in the manifest only at the next Commit
+    if lsm.memBytes >= lsm.memtableBytes {
+        if err := lsm.flush(); err != nil {
+            fatal(storageLogger, "Error while writing table", "dir", lsm.dir, "err", err)
+        }
+    }
+}
+
+func (lsm *Lsm) Put(key string, item Item) {
+    lsm.put(key, lsmEntry{item: item})
+}
+
+func (lsm *Lsm) Delete(key string) {
+    lsm.put(key, lsmEntry{deleted: true})
+}
+
+func (lsm *Lsm) Ascend(start string, f func(key string, item Item) bool) {
+    ascendTables([]lsmIter{newMemIter(lsm.memtable, start)}, lsm.tables, start, f)
+}
+
+//merges the iterators with the ones of the tables, which are oldest first, skipping deleted keys
+func ascendTables(iters []lsmIter, tables []*lsmTable, start string, f func(key string, item Item) bool) {
+    for i := len(tables) - 1; i >= 0; i-- {
+        iters = append(iters, tables[i].iter(start))
+    }
+    mergeIters(iters, func(key string, entry lsmEntry) bool {
+        return entry.deleted || f(key, entry.item)
+    })
+}
+
+//tables of a view stay readable after a compaction removes them
+type lsmView struct {
+    tables []*lsmTable
+}
+
+//the memtable is written out, so the view only needs the tables, which never change
+func (lsm *Lsm) View() StorageView {
+    if err := lsm.flush(); err != nil {
+        fatal(storageLogger, "Error while writing table", "dir", lsm.dir, "err", err)
+    }
+    view := &lsmView{tables: slices.Clone(lsm.tables)}
+    for _, table := range view.tables {
+        table.refs.Add(1)
+    }
+    return view
+}
+
+func (view *lsmView) Ascend(start string, f func(key string, item Item) bool) {
+    ascendTables(nil, view.tables, start, f)
+}
+
+func (view *lsmView) Close() error {
+    for _, table := range view.tables {
+        table.release()
+    }
+    view.tables = nil
+    return nil
+}
+
+func (lsm *Lsm) Clear() {
+    lsm.memtable = make(map[string]lsmEntry)
+    lsm.memBytes = 0
+    lsm.obsolete = append(lsm.obsolete, lsm.tables...)
+    lsm.tables = nil
+    lsm.dirty = true
+}
+
+//the state is written when the memtable is full or the tables changed, in between it is recovered from the raft log
+func (lsm *Lsm) Commit(state StorageState) error {
+    lsm.state = state
+    if lsm.memBytes < lsm.memtableBytes && !lsm.dirty {
+        return nil
+    }
+    return lsm.persist()
+}
+
+func (lsm *Lsm) State() StorageState {
+    return lsm.committed
+}
+
+func (lsm *Lsm) Sync() error {
+    if len(lsm.memtable) == 0 && !lsm.dirty && lsm.state == lsm.committed {
+        return nil
+    }
+    return lsm.persist()
+}
+
+func (lsm *Lsm) Close() error {
+    err := lsm.Sync()
+    lsm.closeTables()
+    return err
+}
+
+func (lsm *Lsm) closeTables() {
+    for _, table := range lsm.tables {
+        table.release()
+    }
+}
+
+func (lsm *Lsm) persist() error {
+    if err := lsm.flush(); err != nil {
+        return err
+    }
+    if err := lsm.writeManifest(); err != nil {
+        return err
+    }
+    return lsm.compact()
+}
+
+//writes the memtable to a new table
+func (lsm *Lsm) flush() error {
+    if len(lsm.memtable) == 0 {
+        return nil
+    }
+    //nothing older to shadow
+    dropDeleted := len(lsm.tables) == 0
+    table, err := lsm.writeTable([]lsmIter{newMemIter(lsm.memtable, "")}, dropDeleted)
+    if err != nil {
+        return err
+    }
+    if table != nil {
+        lsm.tables = append(lsm.tables, table)
+    }
+    lsm.memtable = make(map[string]lsmEntry)
+    lsm.memBytes = 0
+    lsm.dirty = true
+    storageFlushes.Inc()
+    return nil
+}
+
+func (lsm *Lsm) writeManifest() error {
+    manifest := lsmManifest{State: lsm.state, NextId: lsm.nextId, Tables: make([]uint64, 0, len(lsm.tables))}
+    for _, table := range lsm.tables {
+        manifest.Tables = append(manifest.Tables, table.id)
+    }
+    data, err := json.Marshal(manifest)
+    if err != nil {
+        return err
+    }
+
+    file, err := os.CreateTemp(lsm.dir, lsmManifestFile + "-*")
+    if err != nil {
+        return err
+    }
+    _, err = file.Write(data)
+    err = errors.Join(err, file.Sync(), file.Close())
+    if err == nil {
+        err = os.Rename(file.Name(), filepath.Join(lsm.dir, lsmManifestFile))
+    }
+    if err == nil {
+        err = syncDir(lsm.dir)
+    }
+    if err != nil {
+        os.Remove(file.Name())
+        return err
+    }
+
+    lsm.committed = lsm.state
+    lsm.dirty = false
+    //a view may still read the file, it is gone from the directory already
+    for _, table := range lsm.obsolete {
+        os.Remove(table.file.Name())
+        table.release()
+    }
+    lsm.obsolete = nil
+    return nil
+}
+
+func syncDir(dir string) error {
+    file, err := os.Open(dir)
+    if err != nil {
+        return err
+    }
+    defer file.Close()
+    return file.Sync()
+}
+
+//tables of about the same size are merged, so every key is rewritten a logarithmic number of times
+func (lsm *Lsm) compact() error {
+    level := func(table *lsmTable) int {
+        level := 0
+        for size := table.size / lsm.memtableBytes; size > 0; size /= 2 {
+            level += 1
+        }
+        return level
+    }
+
+    for len(lsm.tables) >= 2 {
+        n := len(lsm.tables)
+        older, newer := lsm.tables[n - 2], lsm.tables[n - 1]
+        if level(newer) < level(older) {
+            return nil
+        }
+        //tombstones shadow nothing once the oldest table is merged
+        merged, err := lsm.writeTable([]lsmIter{newer.iter(""), older.iter("")}, n == 2)
+        if err != nil {
+            return err
+        }
+        lsm.tables = lsm.tables[:n - 2]
+        if merged != nil {
+            lsm.tables = append(lsm.tables, merged)
+        }
+        lsm.obsolete = append(lsm.obsolete, older, newer)
+        if err := lsm.writeManifest(); err != nil {
+            return err
+        }
+        storageCompactions.Inc()
+    }
+    return nil
+}
+
+//merges the iterators, newest first, into a new table. Returns nil if nothing is left to write
+func (lsm *Lsm) writeTable(iters []lsmIter, dropDeleted bool) (*lsmTable, error) {
+    id := lsm.nextId
+    lsm.nextId += 1
+    name := tableName(lsm.dir, id)
+    file, err := os.Create(name)
+    if err != nil {
+        return nil, err
+    }
+
+    writer := newTableWriter(file)
+    mergeIters(iters, func(key string, entry lsmEntry) bool {
+        if !entry.deleted || !dropDeleted {
+            writer.add(key, entry)
+        }
+        return true
+    })
+    empty := writer.count == 0
+    err = errors.Join(writer.finish(), file.Sync(), file.Close())
+    if err != nil || empty {
+        os.Remove(name)
+        return nil, err
+    }
+    return openTable(lsm.dir, id)
+}
+
+type tableWriter struct {
+    writer *bufio.Writer
+    offset int64
+    block bytes.Buffer
+    blockFirst string
+    blocks []lsmBlock
+    hashes []uint64
+    count int
+    err error
+}
+
+func newTableWriter(file *os.File) *tableWriter {
+    return &tableWriter{writer: bufio.NewWriter(file)}
+}
+
+func appendString(data []byte, s string) []byte {
+    data = binary.AppendUvarint(data, uint64(len(s)))
+    return append(data, s...)
+}
+
+//key, a deleted flag, then the value, content type and flags of a live key
+func encodeRecord(data []byte, key string, entry lsmEntry) []byte {
+    data = appendString(data, key)
+    if entry.deleted {
+        return append(data, 1)
+    }
+    data = append(data, 0)
+    data = appendString(data, entry.item.Value)
+    data = appendString(data, entry.item.ContentType)
+    return binary.AppendUvarint(data, entry.item.Flags)
+}
+
+func (writer *tableWriter) add(key string, entry lsmEntry) {
+    if writer.block.Len() == 0 {
+        writer.blockFirst = key
+    }
+    writer.block.Write(encodeRecord(nil, key, entry))
+    writer.hashes = append(writer.hashes, keyHash(key))
+    writer.count += 1
+    if writer.block.Len() >= lsmBlockSize {
+        writer.flushBlock()
+    }
+}
+
+func (writer *tableWriter) write(data []byte) {
+    if writer.err != nil {
+        return
+    }
+    _, writer.err = writer.writer.Write(data)
+    writer.offset += int64(len(data))
+}
+
+func (writer *tableWriter) flushBlock() {
+    data := writer.block.Bytes()
+    writer.blocks = append(writer.blocks, lsmBlock{firstKey: writer.blockFirst, offset: writer.offset, length: int64(len(data)), crc: crc32.ChecksumIEEE(data)})
+    writer.write(data)
+    writer.block.Reset()
+}
+
+func (writer *tableWriter) finish() error {
+    if writer.block.Len() > 0 {
+        writer.flushBlock()
+    }
+
+    indexOffset := writer.offset
+    var meta []byte
+    meta = binary.AppendUvarint(meta, uint64(len(writer.blocks)))
+    for _, block := range writer.blocks {
+        meta = appendString(meta, block.firstKey)
+        meta = binary.AppendUvarint(meta, uint64(block.offset))
+        meta = binary.AppendUvarint(meta, uint64(block.length))
+        meta = binary.LittleEndian.AppendUint32(meta, block.crc)
+    }
+    bloomOffset := indexOffset + int64(len(meta))
+    meta = append(meta, newBloom(writer.hashes)...)
+    writer.write(meta)
+
+    footer := binary.LittleEndian.AppendUint64(nil, uint64(indexOffset))
+    footer = binary.LittleEndian.AppendUint64(footer, uint64(bloomOffset))
+    footer = binary.LittleEndian.AppendUint32(footer, crc32.ChecksumIEEE(meta))
+    footer = binary.LittleEndian.AppendUint32(footer, lsmMagic)
+    writer.write(footer)
+    if writer.err != nil {
+        return writer.err
+    }
+    return writer.writer.Flush()
+}
+
+var errTableCorrupted = errors.New("Table corrupted")
+
+func openTable(dir string, id uint64) (table *lsmTable, err error) {
+    name := tableName(dir, id)
+    file, err := os.Open(name)
+    if err != nil {
+        return nil, err
+    }
+    defer func() {
+        if err != nil {
+            file.Close()
+            err = fmt.Errorf("%s: %w", name, err)
+        }
+    }()
+    info, err := file.Stat()
+    if err != nil {
+        return nil, err
+    }
+    if info.Size() < lsmFooterSize {
+        return nil, errTableCorrupted
+    }
+
+    footer := make([]byte, lsmFooterSize)
+    if _, err := file.ReadAt(footer, info.Size() - lsmFooterSize); err != nil {
+        return nil, err
+    }
+    indexOffset := int64(binary.LittleEndian.Uint64(footer))
+    bloomOffset := int64(binary.LittleEndian.Uint64(footer[8:]))
+    if binary.LittleEndian.Uint32(footer[20:]) != lsmMagic || indexOffset < 0 || indexOffset > bloomOffset || bloomOffset > info.Size() - lsmFooterSize {
+        return nil, errTableCorrupted
+    }
+    meta := make([]byte, info.Size() - lsmFooterSize - indexOffset)
+    if _, err := file.ReadAt(meta, indexOffset); err != nil {
+        return nil, err
+    }
+    if crc32.ChecksumIEEE(meta) != binary.LittleEndian.Uint32(footer[16:]) {
+        return nil, errTableCorrupted
+    }
+
+    table = &lsmTable{id: id, file: file, size: info.Size(), bloom: meta[bloomOffset - indexOffset:]}
+    table.refs.Store(1)
+    reader := recordReader{data: meta[:bloomOffset - indexOffset]}
+    count := reader.uvarint()
+    for i := uint64(0); i < count && reader.err == nil; i++ {
+        block := lsmBlock{firstKey: reader.string(), offset: int64(reader.uvarint()), length: int64(reader.uvarint())}
+        block.crc = reader.uint32()
+        table.blocks = append(table.blocks, block)
+    }
+    if reader.err != nil {
+        return nil, reader.err
+    }
+    return table, nil
+}
+
+func (table *lsmTable) readBlock(i int) []byte {
+    block := table.blocks[i]
+    data := make([]byte, block.length)
+    if _, err := table.file.ReadAt(data, block.offset); err != nil {
+        fatal(storageLogger, "Error while reading table", "file", table.file.Name(), "err", err)
+    }
+    if crc32.ChecksumIEEE(data) != block.crc {
+        fatal(storageLogger, "Table block corrupted", "file", table.file.Name(), "offset", block.offset)
+    }
+    return data
+}
+
+//index of the block that may hold key, -1 if key is before the first one
+func (table *lsmTable) findBlock(key string) int {
+    return sort.Search(len(table.blocks), func(i int) bool { return table.blocks[i].firstKey > key }) - 1
+}
+
+func (table *lsmTable) get(key string) (lsmEntry, bool) {
+    if !bloomContains(table.bloom, keyHash(key)) {
+        return lsmEntry{}, false
+    }
+    i := table.findBlock(key)
+    if i < 0 {
+        return lsmEntry{}, false
+    }
+    reader := recordReader{data: table.readBlock(i)}
+    for !reader.done() {
+        recordKey, entry := reader.record()
+        if reader.err != nil {
+            fatal(storageLogger, "Table block corrupted", "file", table.file.Name(), "offset", table.blocks[i].offset)
+        }
+        if recordKey == key {
+            return entry, true
+        } else if recordKey > key {
+            break
+        }
+    }
+    return lsmEntry{}, false
+}
+
+type recordReader struct {
+    data []byte
+    pos int
+    err error
+}
+
+func (reader *recordReader) done() bool {
+    return reader.pos >= len(reader.data) || reader.err != nil
+}
+
+func (reader *recordReader) uvarint() uint64 {
+    if reader.err != nil {
+        return 0
+    }
+    value, n := binary.Uvarint(reader.data[reader.pos:])
+    if n <= 0 {
+        reader.err = errTableCorrupted
+        return 0
+    }
+    reader.pos += n
+    return value
+}
+
+func (reader *recordReader) bytes(n uint64) []byte {
+    if reader.err != nil || n > uint64(len(reader.data) - reader.pos) {
+        reader.err = errTableCorrupted
+        return nil
+    }
+    data := reader.data[reader.pos : reader.pos + int(n)]
+    reader.pos += int(n)
+    return data
+}
+
+func (reader *recordReader) string() string {
+    return string(reader.bytes(reader.uvarint()))
+}
+
+func (reader *recordReader) uint32() uint32 {
+    data := reader.bytes(4)
+    if data == nil {
+        return 0
+    }
+    return binary.LittleEndian.Uint32(data)
+}
+
+func (reader *recordReader) record() (string, lsmEntry) {
+    key := reader.string()
+    deleted := reader.bytes(1)
+    if deleted == nil || deleted[0] == 1 {
+        return key, lsmEntry{deleted: true}
+    }
+    item := Item{Value: reader.string(), ContentType: reader.string()}
+    item.Flags = reader.uvarint()
+    return key, lsmEntry{item: item}
+}
+
+func keyHash(key string) uint64 {
+    h := fnv.New64a()
+    h.Write([]byte(key))
+    return h.Sum64()
+}
+
+func newBloom(hashes []uint64) []byte {
+    bloom := make([]byte, max(8, (len(hashes) * lsmBloomBitsPerKey + 7) / 8))
+    bits := uint64(len(bloom) * 8)
+    for _, hash := range hashes {
+        h1, h2 := hash & 0xffffffff, hash >> 32
+        for i := uint64(0); i < lsmBloomHashes; i++ {
+            bit := (h1 + i * h2) % bits
+            bloom[bit / 8] |= 1 << (bit % 8)
+        }
+    }
+    return bloom
+}
+
+func bloomContains(bloom []byte, hash uint64) bool {
+    bits := uint64(len(bloom) * 8)
+    if bits == 0 {
+        return true
+    }
+    h1, h2 := hash & 0xffffffff, hash >> 32
+    for i := uint64(0); i < lsmBloomHashes; i++ {
+        bit := (h1 + i * h2) % bits
+        if bloom[bit / 8] & (1 << (bit % 8)) == 0 {
+            return false
+        }
+    }
+    return true
+}
+
+//sorted entries of one source, deleted keys included
+type lsmIter interface {
+    valid() bool
+    key() string
+    entry() lsmEntry
+    next()
+}
+
+type memIter struct {
+    memtable map[string]lsmEntry
+    keys []string
+}
+
+func newMemIter(memtable map[string]lsmEntry, start string) *memIter {
+    iter := &memIter{memtable: memtable}
+    for key := range memtable {
+        if key >= start {
+            iter.keys = append(iter.keys, key)
+        }
+    }
+    sort.Strings(iter.keys)
+    return iter
+}
+
+func (iter *memIter) valid() bool {
+    return len(iter.keys) > 0
+}
+
+func (iter *memIter) key() string {
+    return iter.keys[0]
+}
+
+func (iter *memIter) entry() lsmEntry {
+    return iter.memtable[iter.keys[0]]
+}
+
+func (iter *memIter) next() {
+    iter.keys = iter.keys[1:]
+}
+
+type tableIter struct {
+    table *lsmTable
+    block int
+    reader recordReader
+    current string
+    currentEntry lsmEntry
+    ok bool
+}
+
+func (table *lsmTable) iter(start string) *tableIter {
+    iter := &tableIter{table: table, block: max(table.findBlock(start), 0) - 1}
+    iter.next()
+    for iter.ok && iter.current < start {
+        iter.next()
+    }
+    return iter
+}
+
+func (iter *tableIter) valid() bool {
+    return iter.ok
+}
+
+func (iter *tableIter) key() string {
+    return iter.current
+}
+
+func (iter *tableIter) entry() lsmEntry {
+    return iter.currentEntry
+}
+
+func (iter *tableIter) next() {
+    for iter.reader.done() {
+        iter.block += 1
+        if iter.block >= len(iter.table.blocks) {
+            iter.ok = false
+            return
+        }
+        iter.reader = recordReader{data: iter.table.readBlock(iter.block)}
+    }
+    iter.current, iter.currentEntry = iter.reader.record()
+    if iter.reader.err != nil {
+        fatal(storageLogger, "Table block corrupted", "file", iter.table.file.Name(), "offset", iter.table.blocks[iter.block].offset)
+    }
+    iter.ok = true
+}
+
+//calls f for every key in order with the entry of the first iterator that has it, until f returns false
+func mergeIters(iters []lsmIter, f func(key string, entry lsmEntry) bool) {
+    for {
+        first := -1
+        for i, iter := range iters {
+            if iter.valid() && (first < 0 || iter.key() < iters[first].key()) {
+                first = i
+            }
+        }
+        if first < 0 {
+            return
+        }
+        key, entry := iters[first].key(), iters[first].entry()
+        for _, iter := range iters {
+            if iter.valid() && iter.key() == key {
+                iter.next()
+            }
+        }
+        if !f(key, entry) {
+            return
+        }
+    }
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+    "fmt"
+    "os"
+    "path/filepath"
+    "testing"
+)
+
+//small memtable, so a few hundred keys make several tables
+func openTestLsm(t *testing.T, dir string) *Lsm {
+    lsm, err := OpenLsm(dir, StorageConfig{MemtableBytes: 1024})
+    if err != nil {
+        t.Fatal(err)
+    }
+    return lsm
+}
+
+func lsmKey(i int) string {
+    return fmt.Sprintf("key/%04d", i)
+}
+
+//keys seen by Ascend with their values
+func ascendAll(storage StorageView) map[string]string {
+    items := make(map[string]string)
+    var last string
+    storage.Ascend("", func(key string, item Item) bool {
+        if key <= last && last != "" {
+            panic(fmt.Sprintf("Keys out of order: %q after %q", key, last))
+        }
+        last = key
+        items[key] = item.Value
+        return true
+    })
+    return items
+}
+
+func checkItems(t *testing.T, lsm *Lsm, expected map[string]string) {
+    t.Helper()
+    for key, value := range expected {
+        if item, ok := lsm.Get(key); !ok || item.Value != value {
+            t.Fatalf("Get %q returned %q %v, expected %q", key, item.Value, ok, value)
+        }
+    }
+    items := ascendAll(lsm)
+    if len(items) != len(expected) {
+        t.Fatalf("Ascend returned %d keys, expected %d", len(items), len(expected))
+    }
+    for key, value := range items {
+        if expected[key] != value {
+            t.Fatalf("Ascend returned %q for %q, expected %q", value, key, expected[key])
+        }
+    }
+}
+
+func TestLsmRoundTrip(t *testing.T) {
+    dir := t.TempDir()
+    lsm := openTestLsm(t, dir)
+    expected := make(map[string]string)
+    for i := 0; i < 500; i++ {
+        value := fmt.Sprintf("value-%d", i)
+        lsm.Put(lsmKey(i), Item{Value: value, ContentType: "text/plain", Flags: uint64(i)})
+        expected[lsmKey(i)] = value
+    }
+    for i := 0; i < 500; i += 3 {
+        lsm.Delete(lsmKey(i))
+        delete(expected, lsmKey(i))
+    }
+    for i := 1; i < 500; i += 7 {
+        lsm.Put(lsmKey(i), Item{Value: "updated"})
+        expected[lsmKey(i)] = "updated"
+    }
+    state := StorageState{Index: 42, Size: 1000, Keys: len(expected)}
+    if err := lsm.Commit(state); err != nil {
+        t.Fatal(err)
+    }
+    if len(lsm.tables) == 0 {
+        t.Fatalf("Memtable was never flushed")
+    }
+    checkItems(t, lsm, expected)
+    if err := lsm.Close(); err != nil {
+        t.Fatal(err)
+    }
+
+    lsm = openTestLsm(t, dir)
+    defer lsm.Close()
+    if lsm.State() != state {
+        t.Fatalf("Reopened with state %+v, expected %+v", lsm.State(), state)
+    }
+    checkItems(t, lsm, expected)
+    if item, _ := lsm.Get(lsmKey(2)); item.ContentType != "text/plain" || item.Flags != 2 {
+        t.Fatalf("Item fields were not kept: %+v", item)
+    }
+}
+
+func TestLsmTombstoneShadowsOlderTables(t *testing.T) {
+    dir := t.TempDir()
+    lsm := openTestLsm(t, dir)
+    expected := make(map[string]string)
+    for i := 0; i < 300; i++ {
+        lsm.Put(lsmKey(i), Item{Value: "old"})
+        expected[lsmKey(i)] = "old"
+    }
+    if err := lsm.Sync(); err != nil {
+        t.Fatal(err)
+    }
+
+    //the tombstones go to a table smaller than the compacted one, so they are not merged into it
+    lsm.Delete(lsmKey(10))
+    lsm.Delete(lsmKey(200))
+    delete(expected, lsmKey(10))
+    delete(expected, lsmKey(200))
+    if err := lsm.Sync(); err != nil {
+        t.Fatal(err)
+    }
+    if len(lsm.tables) < 2 {
+        t.Fatalf("Tombstones were merged into the older table, %d tables", len(lsm.tables))
+    }
+    if entry, ok := lsm.tables[len(lsm.tables) - 1].get(lsmKey(10)); !ok || !entry.deleted {
+        t.Fatalf("Newest table has no tombstone")
+    }
+    if entry, ok := lsm.tables[0].get(lsmKey(10)); !ok || entry.deleted {
+        t.Fatalf("Oldest table lost the shadowed key")
+    }
+    checkItems(t, lsm, expected)
+    if err := lsm.Close(); err != nil {
+        t.Fatal(err)
+    }
+
+    lsm = openTestLsm(t, dir)
+    defer lsm.Close()
+    checkItems(t, lsm, expected)
+}
+
+//the node stops after tables are written but before the manifest lists them
+func TestLsmReopenAfterCrash(t *testing.T) {
+    dir := t.TempDir()
+    lsm := openTestLsm(t, dir)
+    expected := make(map[string]string)
+    for i := 0; i < 100; i++ {
+        lsm.Put(lsmKey(i), Item{Value: "committed"})
+        expected[lsmKey(i)] = "committed"
+    }
+    state := StorageState{Index: 7, Keys: len(expected)}
+    if err := lsm.Commit(state); err != nil {
+        t.Fatal(err)
+    }
+    if err := lsm.Sync(); err != nil {
+        t.Fatal(err)
+    }
+
+    for i := 0; i < 200; i++ {
+        lsm.Put(lsmKey(i), Item{Value: "lost"})
+    }
+    lsm.Delete(lsmKey(0))
+    if err := lsm.flush(); err != nil {
+        t.Fatal(err)
+    }
+    lsm.closeTables()
+    unlisted := tableName(dir, lsm.nextId - 1)
+    if _, err := os.Stat(unlisted); err != nil {
+        t.Fatalf("Unlisted table was not written: %v", err)
+    }
+    //left by a manifest write that did not finish
+    if err := os.WriteFile(filepath.Join(dir, lsmManifestFile + "-123"), []byte("{"), 0600); err != nil {
+        t.Fatal(err)
+    }
+
+    lsm = openTestLsm(t, dir)
+    defer lsm.Close()
+    if lsm.State() != state {
+        t.Fatalf("Reopened with state %+v, expected %+v", lsm.State(), state)
+    }
+    checkItems(t, lsm, expected)
+    for _, name := range []string{unlisted, filepath.Join(dir, lsmManifestFile + "-123")} {
+        if _, err := os.Stat(name); !os.IsNotExist(err) {
+            t.Fatalf("%s was not removed: %v", name, err)
+        }
+    }
+}
+
+//compactions after the view was taken remove its tables from the directory, the view still reads them
+func TestLsmView(t *testing.T) {
+    lsm := openTestLsm(t, t.TempDir())
+    defer lsm.Close()
+    expected := make(map[string]string)
+    for i := 0; i < 200; i++ {
+        lsm.Put(lsmKey(i), Item{Value: "before"})
+        expected[lsmKey(i)] = "before"
+    }
+    view := lsm.View()
+
+    for i := 0; i < 400; i++ {
+        lsm.Put(lsmKey(i), Item{Value: "after"})
+    }
+    lsm.Delete(lsmKey(5))
+    if err := lsm.Sync(); err != nil {
+        t.Fatal(err)
+    }
+    removed := 0
+    for _, table := range view.(*lsmView).tables {
+        if _, err := os.Stat(table.file.Name()); os.IsNotExist(err) {
+            removed += 1
+        }
+    }
+    if removed == 0 {
+        t.Fatalf("No table of the view was compacted")
+    }
+    items := ascendAll(view)
+    if err := view.Close(); err != nil {
+        t.Fatal(err)
+    }
+    if len(items) != len(expected) {
+        t.Fatalf("View has %d keys, expected %d", len(items), len(expected))
+    }
+    for key, value := range items {
+        if expected[key] != value {
+            t.Fatalf("View has %q for %q, expected %q", value, key, expected[key])
+        }
+    }
+    if item, ok := lsm.Get(lsmKey(7)); !ok || item.Value != "after" {
+        t.Fatalf("Storage lost a write after the view: %+v %v", item, ok)
+    }
+}
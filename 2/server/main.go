@@ -1,11 +1,15 @@
 package main
 
 import (
-    "log"
-    "path/filepath"
     "flag"
     "context"
     "sync"
+    "errors"
+    "net/http"
+    "os"
+    "os/signal"
+    "syscall"
+    "time"
 )
 
 var Flags struct {
@@ -13,6 +17,10 @@ var Flags struct {
     Workdir string
     NodesConfig string
     AppConfig string
+    LogFormat string
+    LogLevel string
+    LogLevels string
+    RestoreFrom string
 }
 
 func init() {
@@ -20,55 +28,106 @@ func init() {
     flag.StringVar(&Flags.Workdir, "workdir", "", "")
     flag.StringVar(&Flags.NodesConfig, "nodes-config", "", "")
     flag.StringVar(&Flags.AppConfig, "app-config", "", "")
+    flag.StringVar(&Flags.LogFormat, "log-format", "", "text or json, overrides logging.format from app config")
+    flag.StringVar(&Flags.LogLevel, "log-level", "", "trace, debug, info, warn or error, overrides logging.level from app config")
+    flag.StringVar(&Flags.LogLevels, "log-levels", "", "per component levels, e.g. raft=debug,external=warn")
+    flag.StringVar(&Flags.RestoreFrom, "restore-from", "", "backup to start a node of a new cluster from, the workdir must have no state")
 }
 
 func ParseFlags() {
     flag.Parse()
     if Flags.NodeId == -1 || Flags.Workdir == "" || Flags.NodesConfig == "" || Flags.AppConfig == "" {
-        log.Fatal("Flags not set", Flags)
+        fatal(mainLogger, "Flags not set", "flags", Flags)
     }
 }
 
+func setupLogging(config LoggingConfig) error {
+    if Flags.LogFormat != "" {
+        config.Format = Flags.LogFormat
+    }
+    if Flags.LogLevel != "" {
+        config.Level = Flags.LogLevel
+    }
+    levels, err := ParseComponentLevels(Flags.LogLevels)
+    if err != nil {
+        return err
+    }
+    if len(levels) > 0 && config.Components == nil {
+        config.Components = make(map[string]string)
+    }
+    for component, level := range levels {
+        config.Components[component] = level
+    }
+
+    return SetupLogging(config, uint64(Flags.NodeId))
+}
+
 func main() {
+    if len(os.Args) > 1 && os.Args[1] == "inspect" {
+        runInspect(os.Args[2:])
+    }
     ParseFlags()
-    log.Print("Launching Node with flags: ", Flags)
 
-    nodesConfig, err := NewNodesConfig(Flags.NodesConfig)
+    appConfig, err := NewAppConfig(Flags.AppConfig)
     if err != nil {
-        log.Fatal("Error while reading nodes config: ", err)
+        fatal(mainLogger, "Error while reading app config", "err", err)
     }
 
-    appConfig, err := NewAppConfig(Flags.AppConfig)
-    if err != nil {
-        log.Fatal("Error while reading app config: ", err)
+    if err = setupLogging(appConfig.Logging); err != nil {
+        fatal(mainLogger, "Error while setting up logging", "err", err)
     }
+    mainLogger.Info("Launching node", "flags", Flags)
 
-    pState, err := NewPState(filepath.Join(Flags.Workdir, "pstate.json"))
+    nodesConfig, err := NewNodesConfig(Flags.NodesConfig)
     if err != nil {
-        log.Fatal("Error while reading pstate: ", err)
+        fatal(mainLogger, "Error while reading nodes config", "err", err)
     }
 
-    raftLog, err := NewLog(filepath.Join(Flags.Workdir, "log.json"))
-    if err != nil {
-        log.Fatal("Error while reading log: ", err)
+    if Flags.RestoreFrom != "" {
+        if err := RestoreWorkdir(Flags.Workdir, Flags.RestoreFrom); err != nil {
+            fatal(mainLogger, "Error while restoring from backup", "err", err)
+        }
     }
 
-    env := NewEnv(pState, raftLog, 100)
+    sigCtx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT)
+    defer stop()
+
+    dbCtx, stopDb := context.WithCancel(context.Background())
+    defer stopDb()
 
-    ctx := context.Background()
+    raftCtx, stopRaft := context.WithCancel(context.Background())
+    defer stopRaft()
 
-    db := NewDb(ctx, env.commitQueue)
+    var certs *CertStore
+    if appConfig.TLS.Enabled() {
+        if certs, err = NewCertStore(appConfig.TLS.ForNode(uint64(Flags.NodeId))); err != nil {
+            fatal(mainLogger, "Error while loading certificates", "err", err)
+        }
+        go certs.Watch(raftCtx)
+    }
+
+    ranges := NewRanges(Flags.Workdir, nodesConfig, uint64(Flags.NodeId), appConfig, certs, raftCtx, dbCtx)
+    if err := ranges.Open(); err != nil {
+        fatal(mainLogger, "Error while opening ranges", "err", err)
+    }
+    RegisterEnvMetrics(ranges.Get(0).env)
+    RegisterDbMetrics(ranges)
 
-    raftServer, err := NewRaftServer(&env, ctx, nodesConfig, uint64(Flags.NodeId), appConfig)
+    raftServer, err := NewRaftServer(ranges, nodesConfig, uint64(Flags.NodeId), certs)
 
     if err != nil {
-        log.Fatal("Error while creating raft server: ", err)
+        fatal(mainLogger, "Error while creating raft server", "err", err)
     }
 
-    extServer, err := NewExtServer(&env, db, ctx, nodesConfig, uint64(Flags.NodeId), appConfig)
+    extServer, err := NewExtServer(ranges, nodesConfig, uint64(Flags.NodeId), certs)
 
     if err != nil {
-        log.Fatal("Error while creating ext server: ", err)
+        fatal(mainLogger, "Error while creating ext server", "err", err)
+    }
+
+    var respServer *RespServer
+    if nodesConfig[Flags.NodeId].RespPort != 0 {
+        respServer = NewRespServer(ranges, nodesConfig, uint64(Flags.NodeId), certs)
     }
 
     var wg sync.WaitGroup
@@ -76,18 +135,102 @@ func main() {
     wg.Add(1)
     go func() {
         defer wg.Done()
-        log.Println("Starting raft server")
-        log.Fatal(raftServer.ListenAndServe())
+        mainLogger.Info("Starting raft server", "addr", raftServer.Addr)
+        if err := serve(raftServer); !errors.Is(err, http.ErrServerClosed) {
+            fatal(mainLogger, "Raft server failed", "err", err)
+        }
     }()
 
     wg.Add(1)
     go func() {
         defer wg.Done()
-        log.Println("Starting ext server")
-        log.Fatal(extServer.ListenAndServe())
+        mainLogger.Info("Starting ext server", "addr", extServer.Addr)
+        if err := serve(extServer); !errors.Is(err, http.ErrServerClosed) {
+            fatal(mainLogger, "Ext server failed", "err", err)
+        }
     }()
 
+    if respServer != nil {
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+            mainLogger.Info("Starting RESP server", "addr", respServer.Addr)
+            if err := respServer.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+                fatal(mainLogger, "RESP server failed", "err", err)
+            }
+        }()
+    }
+
+    <-sigCtx.Done()
+    stop()
+    mainLogger.Info("Shutting down, send the signal again to exit immediately")
+
+    shutdownTimeout := time.Duration(int64(appConfig.ShutdownTimeoutMs)) * time.Millisecond
+    if shutdownTimeout == 0 {
+        shutdownTimeout = 5 * time.Second
+    }
+    shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+    defer cancel()
+
+    for _, rng := range ranges.All() {
+        rng.env.StopProposals()
+    }
+    extStopped := make(chan struct{})
+    go func() {
+        defer close(extStopped)
+        if err := extServer.Shutdown(shutdownCtx); err != nil {
+            mainLogger.Warn("Error while shutting down ext server", "err", err)
+        }
+    }()
+    respStopped := make(chan struct{})
+    go func() {
+        defer close(respStopped)
+        if respServer == nil {
+            return
+        }
+        if err := respServer.Shutdown(shutdownCtx); err != nil {
+            mainLogger.Warn("Error while shutting down RESP server", "err", err)
+        }
+    }()
+
+    //leave time to answer pending requests if the transfers do not succeed
+    transferCtx, cancelTransfer := context.WithTimeout(shutdownCtx, shutdownTimeout / 2)
+    var transfers sync.WaitGroup
+    for _, rng := range ranges.All() {
+        transfers.Add(1)
+        go func() {
+            defer transfers.Done()
+            rng.raft.TransferLeadership(transferCtx)
+        }()
+    }
+    transfers.Wait()
+    cancelTransfer()
+    for _, rng := range ranges.All() {
+        rng.env.FailPendingProposals()
+    }
+    <-extStopped
+    <-respStopped
+
+    //no range is opened after this
+    stopRaft()
+    if err := raftServer.Shutdown(shutdownCtx); err != nil {
+        mainLogger.Warn("Error while shutting down raft server", "err", err)
+    }
     wg.Wait()
 
+    all := ranges.All()
+    for _, rng := range all {
+        if err := rng.env.Close(); err != nil {
+            mainLogger.Error("Error while syncing state", "range", rng.Id, "err", err)
+        }
+    }
 
+    stopDb()
+    for _, rng := range all {
+        rng.db.Wait()
+        if err := rng.db.Close(); err != nil {
+            mainLogger.Error("Error while closing storage", "range", rng.Id, "err", err)
+        }
+    }
+    mainLogger.Info("Node stopped")
 }
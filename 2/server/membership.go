@@ -0,0 +1,155 @@
+package main
+
+import (
+    "errors"
+    "net/http"
+    "slices"
+    "strconv"
+    "strings"
+)
+
+const (
+    RoleVoter = "voter"
+    RoleLearner = "learner"
+    RoleRemoved = "removed" //gets no entries and can not vote or campaign, the node has to stay in the nodes config
+)
+
+func configRoles(nodesConfig NodesConfig) []string {
+    roles := make([]string, len(nodesConfig))
+    for i, node := range nodesConfig {
+        if node.Learner {
+            roles[i] = RoleLearner
+        } else {
+            roles[i] = RoleVoter
+        }
+    }
+    return roles
+}
+
+//SET_ROLE entries keep node id in Key and the new role in Value
+func applyRoleEntry(roles []string, entry LogEntry) {
+    if entry.Op != SET_ROLE {
+        return
+    }
+    id, err := strconv.Atoi(entry.Key)
+    if err != nil || id < 0 || id >= len(roles) {
+        raftLogger.Warn("Ignoring role change for unknown node", "node", entry.Key)
+        return
+    }
+    roles[id] = entry.Value
+}
+
+//membership takes effect as soon as the entry is in the log, not when it is committed
+func logRoles(initial []string, wlog Log) []string {
+    roles := slices.Clone(initial)
+    for _, entry := range wlog.Entries[1:] {
+        applyRoleEntry(roles, entry)
+    }
+    return roles
+}
+
+func (env *TEnv) baseRoles() []string {
+    if env.snapshotRoles != nil {
+        return env.snapshotRoles
+    }
+    return env.configRoles
+}
+
+func (env *TEnv) refreshMembership() {
+    env.roles = logRoles(env.baseRoles(), env.l)
+}
+
+var ErrRoleChangePending = errors.New("Another role change is not committed yet, retry later")
+
+//roles change one at a time, so any two consecutive memberships share a majority. Must be called with the lock held
+func (env *TEnv) roleChangePending() bool {
+    for i := env.commitIndex + 1; i <= env.l.LastIndex(); i++ {
+        if env.l.Entry(i).Op == SET_ROLE {
+            return true
+        }
+    }
+    return false
+}
+
+//membership after the committed entries, the ranges besides range 0 follow the one of range 0
+func (env *TEnv) CommittedRoles() (roles []string) {
+    env.WithLock(func(env *TEnv) {
+        roles = env.rolesAt(env.commitIndex)
+    })
+    return
+}
+
+func (env *TEnv) isVoter(nodeId uint64) bool {
+    return env.roles[nodeId] == RoleVoter
+}
+
+func (env *TEnv) numVoters() (count int) {
+    for _, role := range env.roles {
+        if role == RoleVoter {
+            count += 1
+        }
+    }
+    return
+}
+
+func (env *TEnv) voterMatchIndexes() (indexes []uint64) {
+    for i, idx := range env.leaderState.MatchIndex {
+        if env.isVoter(uint64(i)) {
+            //the match index of the leader itself is the maximum, it would be the commit index of a single voter
+            indexes = append(indexes, min(idx, env.l.LastIndex()))
+        }
+    }
+    return
+}
+
+func (env *TEnv) IsVoter(nodeId uint64) (isVoter bool) {
+    env.WithLock(func(env *TEnv) {
+        isVoter = env.isVoter(nodeId)
+    })
+    return
+}
+
+func (state ExternalState) handlePromote(w http.ResponseWriter, r *http.Request) {
+    if r.Method != "POST" {
+        w.Header().Add("Allow", "POST")
+        w.WriteHeader(http.StatusMethodNotAllowed)
+        return
+    }
+
+    if !state.isLeader() {
+        state.redirectToLeader(w, r)
+        return
+    }
+
+    if !state.changesMembership(w) {
+        return
+    }
+    nodeId, err := strconv.ParseUint(strings.TrimPrefix(r.URL.Path, "/admin/promote/"), 10, 64)
+    if err != nil || nodeId >= uint64(len(state.nodes)) {
+        writeJson(w, http.StatusNotFound, map[string]string{"error": "Node not found"})
+        return
+    }
+
+    var isLearner, caughtUp bool
+    state.env.WithLock(func(env *TEnv) {
+        isLearner = env.roles[nodeId] == RoleLearner
+        caughtUp = env.leaderState != nil && env.leaderState.MatchIndex[nodeId] >= env.commitIndex
+    })
+
+    if !isLearner {
+        writeJson(w, http.StatusConflict, map[string]string{"error": "Node is not a learner"})
+        return
+    }
+    if !caughtUp {
+        writeJson(w, http.StatusConflict, map[string]string{"error": "Learner has not caught up with the leader yet"})
+        return
+    }
+
+    if _, err := state.env.ApplyRequestSync(SET_ROLE, strconv.FormatUint(nodeId, 10), RoleVoter, ""); err != nil {
+        writeApplyError(w, err)
+        return
+    }
+
+    requestLogger(extLogger, r).Info("Learner promoted to voter", "node", nodeId)
+    writeJson(w, http.StatusOK, map[string]string{"message": "Node promoted successfully"})
+}
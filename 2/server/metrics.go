@@ -0,0 +1,293 @@
+package main
+
+import (
+    "net/http"
+    "fmt"
+    "io"
+    "math"
+    "os"
+    "sort"
+    "strings"
+    "strconv"
+    "sync"
+    "time"
+)
+
+type collector interface {
+    writeTo(w io.Writer)
+}
+
+var registry struct {
+    collectors []collector
+    m sync.Mutex
+}
+
+func register(c collector) {
+    registry.m.Lock()
+    defer registry.m.Unlock()
+    registry.collectors = append(registry.collectors, c)
+}
+
+func escapeLabelValue(value string) string {
+    return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
+
+func formatLabels(names []string, key string, extra ...string) string {
+    var pairs []string
+    if len(names) > 0 {
+        for i, value := range strings.Split(key, "\x00") {
+            pairs = append(pairs, fmt.Sprintf(`%s="%s"`, names[i], escapeLabelValue(value)))
+        }
+    }
+    for i := 0; i + 1 < len(extra); i += 2 {
+        pairs = append(pairs, fmt.Sprintf(`%s="%s"`, extra[i], extra[i + 1]))
+    }
+    if len(pairs) == 0 {
+        return ""
+    }
+    return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatFloat(v float64) string {
+    if math.IsInf(v, 1) {
+        return "+Inf"
+    }
+    return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func labelsKey(labels []string, values []string) string {
+    if len(values) != len(labels) {
+        fatal(mainLogger, "Wrong number of label values", "expected", len(labels), "got", len(values))
+    }
+    return strings.Join(values, "\x00")
+}
+
+type CounterVec struct {
+    name string
+    help string
+    labels []string
+    values map[string]float64
+    m sync.Mutex
+}
+
+func NewCounterVec(name string, help string, labels ...string) *CounterVec {
+    counter := &CounterVec{name: name, help: help, labels: labels, values: make(map[string]float64)}
+    register(counter)
+    return counter
+}
+
+func (counter *CounterVec) Add(delta float64, labelValues ...string) {
+    key := labelsKey(counter.labels, labelValues)
+    counter.m.Lock()
+    defer counter.m.Unlock()
+    counter.values[key] += delta
+}
+
+func (counter *CounterVec) Inc(labelValues ...string) {
+    counter.Add(1, labelValues...)
+}
+
+func (counter *CounterVec) writeTo(w io.Writer) {
+    counter.m.Lock()
+    defer counter.m.Unlock()
+
+    fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", counter.name, counter.help, counter.name)
+    if len(counter.labels) == 0 && len(counter.values) == 0 {
+        fmt.Fprintf(w, "%s 0\n", counter.name)
+        return
+    }
+    keys := make([]string, 0, len(counter.values))
+    for key := range counter.values {
+        keys = append(keys, key)
+    }
+    sort.Strings(keys)
+    for _, key := range keys {
+        fmt.Fprintf(w, "%s%s %s\n", counter.name, formatLabels(counter.labels, key), formatFloat(counter.values[key]))
+    }
+}
+
+type histogramValue struct {
+    counts []uint64
+    sum float64
+    count uint64
+}
+
+type HistogramVec struct {
+    name string
+    help string
+    labels []string
+    buckets []float64
+    values map[string]*histogramValue
+    m sync.Mutex
+}
+
+var latencyBuckets = []float64{0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+func NewHistogramVec(name string, help string, buckets []float64, labels ...string) *HistogramVec {
+    histogram := &HistogramVec{name: name, help: help, labels: labels, buckets: buckets, values: make(map[string]*histogramValue)}
+    register(histogram)
+    return histogram
+}
+
+func (histogram *HistogramVec) Observe(v float64, labelValues ...string) {
+    key := labelsKey(histogram.labels, labelValues)
+    histogram.m.Lock()
+    defer histogram.m.Unlock()
+
+    value, ok := histogram.values[key]
+    if !ok {
+        value = &histogramValue{counts: make([]uint64, len(histogram.buckets))}
+        histogram.values[key] = value
+    }
+    for i, bound := range histogram.buckets {
+        if v <= bound {
+            value.counts[i] += 1
+        }
+    }
+    value.sum += v
+    value.count += 1
+}
+
+func (histogram *HistogramVec) ObserveSince(start time.Time, labelValues ...string) {
+    histogram.Observe(time.Since(start).Seconds(), labelValues...)
+}
+
+func (histogram *HistogramVec) writeTo(w io.Writer) {
+    histogram.m.Lock()
+    defer histogram.m.Unlock()
+
+    fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", histogram.name, histogram.help, histogram.name)
+    keys := make([]string, 0, len(histogram.values))
+    for key := range histogram.values {
+        keys = append(keys, key)
+    }
+    sort.Strings(keys)
+    for _, key := range keys {
+        value := histogram.values[key]
+        for i, bound := range histogram.buckets {
+            fmt.Fprintf(w, "%s_bucket%s %d\n", histogram.name, formatLabels(histogram.labels, key, "le", formatFloat(bound)), value.counts[i])
+        }
+        fmt.Fprintf(w, "%s_bucket%s %d\n", histogram.name, formatLabels(histogram.labels, key, "le", "+Inf"), value.count)
+        fmt.Fprintf(w, "%s_sum%s %s\n", histogram.name, formatLabels(histogram.labels, key), formatFloat(value.sum))
+        fmt.Fprintf(w, "%s_count%s %d\n", histogram.name, formatLabels(histogram.labels, key), value.count)
+    }
+}
+
+type GaugeFunc struct {
+    name string
+    help string
+    f func() float64
+}
+
+func NewGaugeFunc(name string, help string, f func() float64) *GaugeFunc {
+    gauge := &GaugeFunc{name: name, help: help, f: f}
+    register(gauge)
+    return gauge
+}
+
+func (gauge *GaugeFunc) writeTo(w io.Writer) {
+    fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %s\n", gauge.name, gauge.help, gauge.name, gauge.name, formatFloat(gauge.f()))
+}
+
+var (
+    electionsStarted = NewCounterVec("raft_elections_started_total", "Number of elections started by this node.")
+    electionsWon = NewCounterVec("raft_elections_won_total", "Number of elections won by this node.")
+    termChanges = NewCounterVec("raft_term_changes_total", "Number of times the current term changed.")
+    appendEntriesDuration = NewHistogramVec("raft_append_entries_duration_seconds", "Latency of AppendEntries RPCs sent by the leader.", latencyBuckets, "peer")
+    appendEntriesFailures = NewCounterVec("raft_append_entries_failures_total", "Number of failed AppendEntries RPCs sent by the leader.", "peer")
+    entriesAppended = NewCounterVec("raft_entries_appended_total", "Number of entries appended to the local log.")
+    entriesCommitted = NewCounterVec("raft_entries_committed_total", "Number of entries known to be committed.")
+    entriesApplied = NewCounterVec("raft_entries_applied_total", "Number of entries applied to the state machine.")
+    snapshotsTaken = NewCounterVec("raft_snapshots_taken_total", "Number of snapshots of the local state machine.")
+    snapshotsSent = NewCounterVec("raft_snapshots_sent_total", "Number of snapshots installed on followers by the leader.", "peer")
+    snapshotsInstalled = NewCounterVec("raft_snapshots_installed_total", "Number of snapshots received from the leader.")
+    storageFlushes = NewCounterVec("kv_storage_flushes_total", "Number of memtables written to tables by the disk engine.")
+    storageCompactions = NewCounterVec("kv_storage_compactions_total", "Number of table merges done by the disk engine.")
+    rangeSplits = NewCounterVec("kv_range_splits_total", "Number of range splits started by this node.")
+    rangesOpened = NewCounterVec("kv_ranges_opened_total", "Number of range replicas created on this node.")
+    proposalDuration = NewHistogramVec("raft_proposal_duration_seconds", "Time from proposal to application of an entry in ApplyRequestSync.", latencyBuckets)
+    extRequestDuration = NewHistogramVec("http_request_duration_seconds", "Latency of external API requests.", latencyBuckets, "method", "status")
+    respCommandDuration = NewHistogramVec("resp_command_duration_seconds", "Latency of commands of the Redis protocol listener.", latencyBuckets, "command", "result")
+)
+
+func RegisterEnvMetrics(env *TEnv) {
+    logPath := env.l.FilePath
+    NewGaugeFunc("raft_commit_queue_depth", "Number of committed entries waiting to be applied.", func() float64 {
+        return float64(len(env.commitQueue))
+    })
+    NewGaugeFunc("raft_log_file_size_bytes", "Size of the log file on disk.", func() float64 {
+        info, err := os.Stat(logPath)
+        if err != nil {
+            return 0
+        }
+        return float64(info.Size())
+    })
+}
+
+func RegisterDbMetrics(ranges *Ranges) {
+    NewGaugeFunc("kv_db_size_bytes", "Bytes taken by keys and values.", func() float64 {
+        size, _ := ranges.Size()
+        return float64(size)
+    })
+    NewGaugeFunc("kv_keys", "Number of keys in the database.", func() float64 {
+        _, keys := ranges.Size()
+        return float64(keys)
+    })
+    NewGaugeFunc("kv_ranges", "Number of ranges this node has replicas of.", func() float64 {
+        return float64(len(ranges.All()))
+    })
+    NewGaugeFunc("kv_space_alarm", "1 if the space quota alarm is raised.", func() float64 {
+        if ranges.root.NoSpaceAlarm() {
+            return 1
+        }
+        return 0
+    })
+}
+
+func handleMetrics(w http.ResponseWriter, r *http.Request) {
+    registry.m.Lock()
+    collectors := registry.collectors
+    registry.m.Unlock()
+
+    w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+    for _, c := range collectors {
+        c.writeTo(w)
+    }
+}
+
+type statusRecorder struct {
+    http.ResponseWriter
+    status int
+}
+
+func (recorder *statusRecorder) WriteHeader(status int) {
+    if recorder.status == 0 {
+        recorder.status = status
+    }
+    recorder.ResponseWriter.WriteHeader(status)
+}
+
+func (recorder *statusRecorder) Write(data []byte) (int, error) {
+    if recorder.status == 0 {
+        recorder.status = http.StatusOK
+    }
+    return recorder.ResponseWriter.Write(data)
+}
+
+func (recorder *statusRecorder) Flush() {
+    if flusher, ok := recorder.ResponseWriter.(http.Flusher); ok {
+        flusher.Flush()
+    }
+}
+
+func instrumentHandler(handler http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        start := time.Now()
+        recorder := &statusRecorder{ResponseWriter: w}
+        handler.ServeHTTP(recorder, r)
+        if recorder.status == 0 {
+            recorder.status = http.StatusOK
+        }
+        extRequestDuration.ObserveSince(start, r.Method, strconv.Itoa(recorder.status))
+    })
+}
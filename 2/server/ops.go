@@ -0,0 +1,131 @@
+package main
+
+import (
+    "encoding/json"
+    "fmt"
+    "net/http"
+    "strconv"
+)
+
+//common part of the single key write endpoints, returns the key if the request may proceed on this node
+func (state ExternalState) writeKey(w http.ResponseWriter, r *http.Request, method string, basePath string) (string, bool) {
+    if r.Method != method {
+        w.Header().Add("Allow", method)
+        w.WriteHeader(http.StatusMethodNotAllowed)
+        return "", false
+    }
+
+    if !state.isLeader() {
+        state.redirectToLeader(w, r)
+        return "", false
+    }
+
+    key, ok := getKeyWithPrefix(r.URL.Path, basePath)
+    if !ok {
+        http.Error(w, "Not found", http.StatusNotFound)
+        return "", false
+    }
+    return key, state.authorize(w, r, key, AccessWrite)
+}
+
+//POST /increment/<key> with optional {"delta": n}, missing keys start from zero
+func (state ExternalState) handleIncrement(w http.ResponseWriter, r *http.Request) {
+    key, ok := state.writeKey(w, r, "POST", "/increment/")
+    if !ok {
+        return
+    }
+
+    logger := requestLogger(extLogger, r)
+    data, err := readBody(w, r)
+    if err != nil {
+        return
+    }
+    incrementRequest := struct {
+        Delta int64 `json:"delta"`
+    }{Delta: 1}
+    if len(data) > 0 {
+        if err = json.Unmarshal(data, &incrementRequest); err != nil {
+            http.Error(w, fmt.Sprint(err), http.StatusBadRequest)
+            return
+        }
+    }
+
+    delta := strconv.FormatInt(incrementRequest.Delta, 10)
+    _, exists := state.db.Get(key)
+    if !state.checkWrite(w, key, delta, !exists) {
+        return
+    }
+
+    result, err := state.env.ApplyEntrySync(LogEntry{Op: INCREMENT, Key: key, Value: delta,})
+    logger.Debug("Increment applied", "key", key, "delta", delta, "value", result.Value, "err", err)
+    if err != nil {
+        writeApplyError(w, err)
+        return
+    }
+
+    value, _ := strconv.ParseInt(result.Value, 10, 64)
+    writeJson(w, http.StatusOK, map[string]any{"key": key, "value": value})
+}
+
+//POST /append/<key> with the same body as create, missing keys are created
+func (state ExternalState) handleAppend(w http.ResponseWriter, r *http.Request) {
+    key, ok := state.writeKey(w, r, "POST", "/append/")
+    if !ok {
+        return
+    }
+
+    logger := requestLogger(extLogger, r)
+    appendRequest, ok := state.readWriteRequest(w, r)
+    if !ok {
+        return
+    }
+
+    //the size limit applies to the resulting value
+    current, exists := state.db.Get(key)
+    if !state.checkWrite(w, key, current + appendRequest.Value, !exists) {
+        return
+    }
+
+    item := appendRequest.Item()
+    result, err := state.env.ApplyEntrySync(LogEntry{Op: APPEND, Key: key, Value: item.Value, ContentType: item.ContentType, Flags: item.Flags,})
+    logger.Debug("Append applied", "key", key, "length", result.Value, "err", err)
+    if err != nil {
+        writeApplyError(w, err)
+        return
+    }
+
+    length, _ := strconv.Atoi(result.Value)
+    writeJson(w, http.StatusOK, map[string]any{"key": key, "length": length})
+}
+
+//PUT /upsert/<key> with the same body as create, stores the value whether the key exists or not
+func (state ExternalState) handleUpsert(w http.ResponseWriter, r *http.Request) {
+    key, ok := state.writeKey(w, r, "PUT", "/upsert/")
+    if !ok {
+        return
+    }
+
+    logger := requestLogger(extLogger, r)
+    upsertRequest, ok := state.readWriteRequest(w, r)
+    if !ok {
+        return
+    }
+    _, exists := state.db.Get(key)
+    if !state.checkWrite(w, key, upsertRequest.Value, !exists) {
+        return
+    }
+
+    item := upsertRequest.Item()
+    result, err := state.env.ApplyEntrySync(LogEntry{Op: UPSERT, Key: key, Value: item.Value, ContentType: item.ContentType, Flags: item.Flags,})
+    logger.Debug("Upsert applied", "key", key, "existed", result.Existed, "err", err)
+    if err != nil {
+        writeApplyError(w, err)
+        return
+    }
+
+    if result.Existed {
+        writeJson(w, http.StatusOK, map[string]string{"message": "Entry updated successfully"})
+    } else {
+        writeJson(w, http.StatusCreated, map[string]string{"message": "Entry created successfully"})
+    }
+}
@@ -0,0 +1,351 @@
+package main
+
+import (
+    "encoding/json"
+    "fmt"
+    "math"
+    "net/http"
+    "slices"
+    "strconv"
+    "strings"
+    "time"
+)
+
+//items are kept under "<queuePrefix><name>/<id>" with the delivery state of dequeued items in ".../<id>/lease",
+//item ids and receipts are the log indexes of the enqueue and dequeue entries
+const queuePrefix = sysPrefix + "queue/"
+
+func queueItemKey(name string, id uint64) string {
+    return fmt.Sprintf("%s%s/%020d", queuePrefix, name, id)
+}
+
+func queueLeaseKey(name string, id uint64) string {
+    return queueItemKey(name, id) + queueLeaseSuffix
+}
+
+const queueLeaseSuffix = "/lease"
+
+//queue items take space like user keys, so they count to the size and key limits. Other system keys are bookkeeping
+func countedKey(key string) bool {
+    if !isSystemKey(key) {
+        return true
+    }
+    return strings.HasPrefix(key, queuePrefix) && !strings.HasSuffix(key, queueLeaseSuffix)
+}
+
+type QueueLease struct {
+    Receipt uint64 `json:"receipt"`
+    VisibleAtMs int64 `json:"visible_at_ms"`
+    Deliveries int `json:"deliveries"`
+}
+
+type QueueMessage struct {
+    Id uint64 `json:"id"`
+    Value *string `json:"value,omitempty"`
+    ValueB64 []byte `json:"value_b64,omitempty"`
+    ContentType string `json:"content_type,omitempty"`
+    Flags uint64 `json:"flags,omitempty"`
+    Receipt uint64 `json:"receipt,omitempty"`
+    Deliveries int `json:"deliveries"`
+    VisibleAtMs int64 `json:"visible_at_ms,omitempty"`
+}
+
+func (db *Db) getQueueLease(name string, id uint64) (lease QueueLease, ok bool) {
+    item, ok := db.data.Get(queueLeaseKey(name, id))
+    if ok && json.Unmarshal([]byte(item.Value), &lease) != nil {
+        fatal(dbLogger, "Malformed queue lease", "queue", name, "id", id)
+    }
+    return
+}
+
+func (db *Db) queueMessage(name string, id uint64, lease QueueLease) QueueMessage {
+    item, _ := db.data.Get(queueItemKey(name, id))
+    msg := QueueMessage{Id: id, ContentType: item.ContentType, Flags: item.Flags, Receipt: lease.Receipt, Deliveries: lease.Deliveries, VisibleAtMs: lease.VisibleAtMs}
+    msg.Value, msg.ValueB64 = jsonValue(item.Value)
+    return msg
+}
+
+//returns the first item visible at nowMs, or the time the first leased item becomes visible again
+func (db *Db) firstVisible(name string, nowMs int64) (id uint64, lease QueueLease, found bool, nextVisibleMs int64) {
+    nextVisibleMs = math.MaxInt64
+    for _, id := range db.queues[name] {
+        lease, leased := db.getQueueLease(name, id)
+        if !leased || lease.VisibleAtMs <= nowMs {
+            return id, lease, true, 0
+        }
+        nextVisibleMs = min(nextVisibleMs, lease.VisibleAtMs)
+    }
+    return 0, QueueLease{}, false, nextVisibleMs
+}
+
+//QUEUE_ENQUEUE entries keep the queue name in Key and the item in Value, ContentType and Flags
+func (db *Db) commitEnqueue(entry LogEntry) CommitResult {
+    db.m.Lock()
+    defer db.m.Unlock()
+
+    db.set(queueItemKey(entry.Key, entry.index), entry.Item())
+    db.queues[entry.Key] = append(db.queues[entry.Key], entry.index)
+    db.notify(queuePrefix + entry.Key)
+    return CommitResult{Ok: true, Value: strconv.FormatUint(entry.index, 10)}
+}
+
+//QUEUE_DEQUEUE entries keep the visibility timeout in TtlMs, the result is the message JSON
+func (db *Db) commitDequeue(entry LogEntry) CommitResult {
+    db.m.Lock()
+    defer db.m.Unlock()
+
+    id, lease, found, _ := db.firstVisible(entry.Key, entry.Time)
+    if !found {
+        return CommitResult{Ok: false}
+    }
+
+    lease = QueueLease{Receipt: entry.index, VisibleAtMs: entry.Time + entry.TtlMs, Deliveries: lease.Deliveries + 1}
+    data, err := json.Marshal(lease)
+    if err != nil {
+        fatal(dbLogger, "Error while marshalling queue lease", "queue", entry.Key, "err", err)
+    }
+    db.set(queueLeaseKey(entry.Key, id), Item{Value: string(data)})
+
+    data, err = json.Marshal(db.queueMessage(entry.Key, id, lease))
+    if err != nil {
+        fatal(dbLogger, "Error while marshalling queue message", "queue", entry.Key, "err", err)
+    }
+    return CommitResult{Ok: true, Value: string(data)}
+}
+
+//QUEUE_ACK entries keep the item id in Value and the receipt in PrevValue,
+//the receipt only matches if the item was not delivered again since
+func (db *Db) commitAck(entry LogEntry) CommitResult {
+    db.m.Lock()
+    defer db.m.Unlock()
+
+    id, err := strconv.ParseUint(entry.Value, 10, 64)
+    if err != nil {
+        return CommitResult{Ok: false}
+    }
+    lease, leased := db.getQueueLease(entry.Key, id)
+    if !leased || strconv.FormatUint(lease.Receipt, 10) != entry.PrevValue {
+        return CommitResult{Ok: false}
+    }
+
+    db.remove(queueItemKey(entry.Key, id))
+    db.remove(queueLeaseKey(entry.Key, id))
+    db.queues[entry.Key] = slices.DeleteFunc(db.queues[entry.Key], func(itemId uint64) bool { return itemId == id })
+    if len(db.queues[entry.Key]) == 0 {
+        delete(db.queues, entry.Key)
+    }
+    return CommitResult{Ok: true}
+}
+
+func (db *Db) PeekQueue(name string, nowMs int64) (QueueMessage, bool, int64) {
+    db.m.RLock()
+    defer db.m.RUnlock()
+
+    id, lease, found, nextVisibleMs := db.firstVisible(name, nowMs)
+    if !found {
+        return QueueMessage{}, false, nextVisibleMs
+    }
+    msg := db.queueMessage(name, id, lease)
+    msg.Receipt, msg.VisibleAtMs = 0, 0
+    return msg, true, 0
+}
+
+func (db *Db) QueueStats(name string, nowMs int64) (length int, inFlight int) {
+    db.m.RLock()
+    defer db.m.RUnlock()
+
+    for _, id := range db.queues[name] {
+        if lease, leased := db.getQueueLease(name, id); leased && lease.VisibleAtMs > nowMs {
+            inFlight += 1
+        }
+    }
+    return len(db.queues[name]), inFlight
+}
+
+type DequeueRequest struct {
+    VisibilityTimeoutMs int64 `json:"visibility_timeout_ms"`
+    WaitMs int64 `json:"wait_ms"` //how long to wait for an item if the queue has no visible ones
+}
+
+const defaultVisibilityTimeout = 30 * time.Second
+
+func (state ExternalState) dequeue(r *http.Request, name string, request DequeueRequest) (CommitResult, error) {
+    deadline := time.Now().Add(time.Duration(request.WaitMs) * time.Millisecond)
+    for {
+        //the watch is taken before the check, so an enqueue right after it is not missed
+        changed := state.db.Watch(queuePrefix + name)
+        //a dequeue entry is proposed only if the local state has a visible item, so waiting consumers don't fill the log
+        _, found, nextVisibleMs := state.db.PeekQueue(name, time.Now().UnixMilli())
+        if found {
+            result, err := state.env.ApplyEntrySync(LogEntry{Op: QUEUE_DEQUEUE, Key: name, TtlMs: request.VisibilityTimeoutMs,})
+            if err != nil || result.Ok {
+                return result, err
+            }
+            continue
+        }
+        if !time.Now().Before(deadline) {
+            return CommitResult{Ok: false}, nil
+        }
+
+        wait := time.Until(deadline)
+        if nextVisibleMs != math.MaxInt64 {
+            wait = min(wait, max(time.Until(time.UnixMilli(nextVisibleMs)), 10 * time.Millisecond))
+        }
+        timer := time.NewTimer(wait)
+        select {
+        case <- changed:
+        case <- timer.C:
+        case <- r.Context().Done():
+            timer.Stop()
+            return CommitResult{}, r.Context().Err()
+        case <- state.serving.Done():
+            timer.Stop()
+            return CommitResult{}, ErrShuttingDown
+        }
+        timer.Stop()
+    }
+}
+
+//POST /queues/<name> enqueues with the same body as create, POST .../dequeue takes an item for visibility_timeout_ms,
+//POST .../ack removes it with {"id", "receipt"}, GET .../peek shows the first visible item and GET /queues/<name> the length.
+//Permissions are checked against "queues/<name>"
+func (state ExternalState) handleQueue(w http.ResponseWriter, r *http.Request) {
+    name, action, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/queues/"), "/")
+    if !validAuthName(name) {
+        writeJson(w, http.StatusNotFound, map[string]string{"error": "Invalid queue name"})
+        return
+    }
+    permKey := "queues/" + name
+
+    method := map[string]string{"": "POST", "dequeue": "POST", "ack": "POST", "peek": "GET"}[action]
+    if action == "" && r.Method == "GET" {
+        method = "GET"
+    }
+    if method == "" {
+        http.Error(w, "Not found", http.StatusNotFound)
+        return
+    }
+    if r.Method != method {
+        w.Header().Add("Allow", method)
+        w.WriteHeader(http.StatusMethodNotAllowed)
+        return
+    }
+
+    if method == "GET" {
+        if !state.authorize(w, r, permKey, AccessRead) {
+            return
+        }
+        if action == "" {
+            length, inFlight := state.db.QueueStats(name, time.Now().UnixMilli())
+            writeJson(w, http.StatusOK, map[string]any{"name": name, "length": length, "in_flight": inFlight})
+            return
+        }
+        if msg, found, _ := state.db.PeekQueue(name, time.Now().UnixMilli()); found {
+            writeJson(w, http.StatusOK, msg)
+        } else {
+            writeJson(w, http.StatusNotFound, map[string]string{"error": "Queue has no visible items"})
+        }
+        return
+    }
+
+    if !state.isLeader() {
+        state.redirectToLeader(w, r)
+        return
+    }
+    if !state.authorize(w, r, permKey, AccessWrite) {
+        return
+    }
+
+    switch action {
+    case "":
+        state.handleEnqueue(w, r, name, permKey)
+    case "dequeue":
+        state.handleDequeue(w, r, name)
+    case "ack":
+        state.handleAck(w, r, name)
+    }
+}
+
+func (state ExternalState) handleEnqueue(w http.ResponseWriter, r *http.Request, name string, permKey string) {
+    logger := requestLogger(extLogger, r)
+    enqueueRequest, ok := state.readWriteRequest(w, r)
+    if !ok {
+        return
+    }
+    if !state.checkWrite(w, permKey, enqueueRequest.Value, true) {
+        return
+    }
+
+    item := enqueueRequest.Item()
+    result, err := state.env.ApplyEntrySync(LogEntry{Op: QUEUE_ENQUEUE, Key: name, Value: item.Value, ContentType: item.ContentType, Flags: item.Flags,})
+    logger.Debug("Enqueue applied", "queue", name, "id", result.Value, "err", err)
+    if err != nil {
+        writeApplyError(w, err)
+        return
+    }
+    id, _ := strconv.ParseUint(result.Value, 10, 64)
+    writeJson(w, http.StatusCreated, map[string]any{"id": id})
+}
+
+func (state ExternalState) handleDequeue(w http.ResponseWriter, r *http.Request, name string) {
+    logger := requestLogger(extLogger, r)
+    data, err := readBody(w, r)
+    if err != nil {
+        return
+    }
+    dequeueRequest := DequeueRequest{VisibilityTimeoutMs: defaultVisibilityTimeout.Milliseconds()}
+    if len(data) > 0 {
+        if err = json.Unmarshal(data, &dequeueRequest); err != nil {
+            http.Error(w, fmt.Sprint(err), http.StatusBadRequest)
+            return
+        }
+    }
+    if dequeueRequest.VisibilityTimeoutMs <= 0 {
+        http.Error(w, "visibility_timeout_ms must be positive", http.StatusBadRequest)
+        return
+    }
+
+    result, err := state.dequeue(r, name, dequeueRequest)
+    logger.Debug("Dequeue applied", "queue", name, "ok", result.Ok, "err", err)
+    if err != nil {
+        //the client is gone
+        if r.Context().Err() != nil {
+            return
+        }
+        writeApplyError(w, err)
+        return
+    }
+    if !result.Ok {
+        writeJson(w, http.StatusNotFound, map[string]string{"error": "Queue has no visible items"})
+        return
+    }
+    writeJson(w, http.StatusOK, json.RawMessage(result.Value))
+}
+
+func (state ExternalState) handleAck(w http.ResponseWriter, r *http.Request, name string) {
+    logger := requestLogger(extLogger, r)
+    data, err := readBody(w, r)
+    if err != nil {
+        return
+    }
+    var ackRequest struct {
+        Id uint64 `json:"id"`
+        Receipt uint64 `json:"receipt"`
+    }
+    if err = json.Unmarshal(data, &ackRequest); err != nil {
+        http.Error(w, fmt.Sprint(err), http.StatusBadRequest)
+        return
+    }
+
+    result, err := state.env.ApplyEntrySync(LogEntry{Op: QUEUE_ACK, Key: name, Value: strconv.FormatUint(ackRequest.Id, 10), PrevValue: strconv.FormatUint(ackRequest.Receipt, 10),})
+    logger.Debug("Ack applied", "queue", name, "id", ackRequest.Id, "ok", result.Ok, "err", err)
+    if err != nil {
+        writeApplyError(w, err)
+        return
+    }
+    if !result.Ok {
+        writeJson(w, http.StatusConflict, map[string]string{"error": "Item is not delivered with this receipt"})
+        return
+    }
+    writeJson(w, http.StatusOK, map[string]string{"message": "Item acknowledged"})
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+    "encoding/json"
+    "fmt"
+    "slices"
+    "strconv"
+    "testing"
+)
+
+//state machine with entries applied one after another, as the log would commit them
+type testLog struct {
+    db *Db
+    index uint64
+}
+
+func newTestLog() *testLog {
+    return &testLog{db: newStateMachine(NewMemoryStorage())}
+}
+
+func (log *testLog) commit(entry LogEntry) CommitResult {
+    log.index += 1
+    entry.index = log.index
+    result := log.db.CommitEntry(entry)
+    log.db.appliedIndex.Store(log.index)
+    return result
+}
+
+func (log *testLog) enqueue(t *testing.T, name string, value string) uint64 {
+    t.Helper()
+    result := log.commit(LogEntry{Op: QUEUE_ENQUEUE, Key: name, Value: value})
+    id, err := strconv.ParseUint(result.Value, 10, 64)
+    if !result.Ok || err != nil {
+        t.Fatalf("Enqueue to %s returned %+v", name, result)
+    }
+    return id
+}
+
+//returns false if no item is visible at nowMs
+func (log *testLog) dequeue(t *testing.T, name string, nowMs int64, timeoutMs int64) (QueueMessage, bool) {
+    t.Helper()
+    result := log.commit(LogEntry{Op: QUEUE_DEQUEUE, Key: name, Time: nowMs, TtlMs: timeoutMs})
+    if !result.Ok {
+        return QueueMessage{}, false
+    }
+    var msg QueueMessage
+    if err := json.Unmarshal([]byte(result.Value), &msg); err != nil {
+        t.Fatal(err)
+    }
+    return msg, true
+}
+
+func (log *testLog) ack(name string, id uint64, receipt uint64) bool {
+    return log.commit(LogEntry{Op: QUEUE_ACK, Key: name, Value: strconv.FormatUint(id, 10), PrevValue: strconv.FormatUint(receipt, 10)}).Ok
+}
+
+func messageValue(msg QueueMessage) string {
+    if msg.Value == nil {
+        return ""
+    }
+    return *msg.Value
+}
+
+func TestQueueOrder(t *testing.T) {
+    log := newTestLog()
+    //more than 10 items, so ids of different lengths are compared
+    var ids []uint64
+    for i := 0; i < 12; i++ {
+        ids = append(ids, log.enqueue(t, "jobs", fmt.Sprintf("job-%d", i)))
+        log.enqueue(t, "other", "noise")
+    }
+
+    for i := 0; i < 12; i++ {
+        msg, ok := log.dequeue(t, "jobs", 1000, 100)
+        if !ok || msg.Id != ids[i] || messageValue(msg) != fmt.Sprintf("job-%d", i) {
+            t.Fatalf("Dequeue %d returned %+v %v, expected item %d", i, msg, ok, ids[i])
+        }
+        if msg.Deliveries != 1 || msg.Receipt != log.index || msg.VisibleAtMs != 1100 {
+            t.Fatalf("Unexpected lease of the first delivery %+v", msg)
+        }
+    }
+    if msg, ok := log.dequeue(t, "jobs", 1000, 100); ok {
+        t.Fatalf("Dequeue from a queue with every item in flight returned %+v", msg)
+    }
+    if length, inFlight := log.db.QueueStats("jobs", 1000); length != 12 || inFlight != 12 {
+        t.Fatalf("Queue has %d items with %d in flight", length, inFlight)
+    }
+}
+
+func TestQueueVisibilityTimeout(t *testing.T) {
+    log := newTestLog()
+    first := log.enqueue(t, "jobs", "a")
+    second := log.enqueue(t, "jobs", "b")
+
+    msg, _ := log.dequeue(t, "jobs", 1000, 100)
+    if msg.Id != first {
+        t.Fatalf("Dequeued %+v before the first item", msg)
+    }
+    if msg, _ := log.dequeue(t, "jobs", 1050, 100); msg.Id != second {
+        t.Fatalf("Dequeued %+v instead of the second item", msg)
+    }
+    if peeked, found, nextVisibleMs := log.db.PeekQueue("jobs", 1099); found || nextVisibleMs != 1100 {
+        t.Fatalf("Peek before the timeout returned %+v %v %d", peeked, found, nextVisibleMs)
+    }
+
+    //the first item is back once its lease ends, with a new receipt
+    again, ok := log.dequeue(t, "jobs", 1100, 100)
+    if !ok || again.Id != first || again.Deliveries != 2 || again.Receipt == msg.Receipt {
+        t.Fatalf("Item was not delivered again after the timeout: %+v, first delivery %+v", again, msg)
+    }
+}
+
+func TestQueueStaleReceipt(t *testing.T) {
+    log := newTestLog()
+    id := log.enqueue(t, "jobs", "a")
+    stale, _ := log.dequeue(t, "jobs", 1000, 100)
+    current, _ := log.dequeue(t, "jobs", 2000, 100)
+
+    if log.ack("jobs", id, stale.Receipt) {
+        t.Fatalf("Receipt of an expired delivery was accepted")
+    }
+    if log.ack("jobs", id + 1, current.Receipt) {
+        t.Fatalf("Receipt was accepted for another item")
+    }
+    if !log.ack("jobs", id, current.Receipt) {
+        t.Fatalf("Receipt of the current delivery was refused")
+    }
+    if log.ack("jobs", id, current.Receipt) {
+        t.Fatalf("Item was acknowledged twice")
+    }
+    if length, _ := log.db.QueueStats("jobs", 2000); length != 0 {
+        t.Fatalf("Acknowledged item is still queued, length %d", length)
+    }
+    if _, ok := log.db.queues["jobs"]; ok {
+        t.Fatalf("Empty queue was kept")
+    }
+}
+
+//ids of the queues are not stored, a restored replica rebuilds them from the item keys
+func TestQueueRestore(t *testing.T) {
+    log := newTestLog()
+    for i := 0; i < 12; i++ {
+        log.enqueue(t, "jobs", fmt.Sprintf("job-%d", i))
+    }
+    log.enqueue(t, "mail", "hello")
+    acked, _ := log.dequeue(t, "jobs", 1000, 100)
+    log.ack("jobs", acked.Id, acked.Receipt)
+    leased, _ := log.dequeue(t, "jobs", 1000, 100)
+
+    snapshot := log.db.Snapshot()
+    defer snapshot.Close()
+    restored := &testLog{db: newStateMachine(NewMemoryStorage()), index: log.index}
+    restored.db.Restore(snapshot)
+
+    for _, name := range []string{"jobs", "mail"} {
+        if !slices.Equal(restored.db.queues[name], log.db.queues[name]) {
+            t.Fatalf("Queue %s was restored with ids %v, expected %v", name, restored.db.queues[name], log.db.queues[name])
+        }
+    }
+    if length, inFlight := restored.db.QueueStats("jobs", 1000); length != 11 || inFlight != 1 {
+        t.Fatalf("Restored queue has %d items with %d in flight", length, inFlight)
+    }
+
+    //both replicas deliver the same items from here on, the leased item comes back with its delivery count
+    var msg QueueMessage
+    for _, nowMs := range []int64{1000, 1000, 1100} {
+        expected, _ := log.dequeue(t, "jobs", nowMs, 100)
+        msg, _ = restored.dequeue(t, "jobs", nowMs, 100)
+        if msg.Id != expected.Id || messageValue(msg) != messageValue(expected) || msg.Receipt != expected.Receipt || msg.Deliveries != expected.Deliveries {
+            t.Fatalf("Restored replica delivered %+v, expected %+v", msg, expected)
+        }
+    }
+    if msg.Id != leased.Id || msg.Deliveries != 2 {
+        t.Fatalf("Lease taken before the snapshot was lost, delivered %+v", msg)
+    }
+    if !restored.ack("jobs", msg.Id, msg.Receipt) {
+        t.Fatalf("Receipt of the restored replica was refused")
+    }
+}
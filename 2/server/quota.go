@@ -0,0 +1,173 @@
+package main
+
+import (
+    "fmt"
+    "net/http"
+    "time"
+)
+
+//zero values mean no limit
+type LimitsConfig struct {
+    MaxKeySize int `json:"max_key_size"`
+    MaxValueSize int `json:"max_value_size"`
+    MaxKeys int `json:"max_keys"`
+    QuotaBytes int64 `json:"quota_bytes"` //space alarm is raised when keys, values and the raft logs take more than this
+    MaxUncommittedEntries int `json:"max_uncommitted_entries"` //requires max_batch_ops of at most this, a batch is appended whole
+    QuotaCheckIntervalMs int `json:"quota_check_interval_ms"`
+    MaxBatchOps int `json:"max_batch_ops"`
+}
+
+const noSpaceAlarmKey = sysPrefix + "alarm/nospace"
+
+//the alarm is cleared automatically once the database shrinks below this share of the quota
+const alarmClearRatio = 0.9
+
+//without a configured size a range compacts its log once it takes this share of the quota,
+//deletes still grow the log while the alarm is raised
+const logQuotaShare = 4
+
+//JSON escapes a byte of a value to at most 6, the value and the previous value of a CAS may both be in the body
+const bodyValueFactor = 12
+
+//room for the other fields of a request
+const bodyOverhead = 64 << 10
+
+//batches without an op limit are bounded as if they had this many
+const bodyBatchOps = 1000
+
+//a batch larger than the uncommitted limit could never be appended, so retrying it would not help
+func (limits LimitsConfig) validate() error {
+    if limits.MaxUncommittedEntries != 0 && (limits.MaxBatchOps == 0 || limits.MaxBatchOps > limits.MaxUncommittedEntries) {
+        return fmt.Errorf("max_batch_ops has to be set to at most max_uncommitted_entries (%d)", limits.MaxUncommittedEntries)
+    }
+    return nil
+}
+
+//batches and multi-key writes with more ops are refused. Zero means no limit
+func (limits LimitsConfig) maxBatchOps() int {
+    if limits.MaxUncommittedEntries != 0 && (limits.MaxBatchOps == 0 || limits.MaxBatchOps > limits.MaxUncommittedEntries) {
+        return limits.MaxUncommittedEntries
+    }
+    return limits.MaxBatchOps
+}
+
+//request bodies are read whole, their size follows the value size limit. Zero means no limit
+func (limits LimitsConfig) maxBodySize(path string) int64 {
+    if limits.MaxValueSize == 0 {
+        return 0
+    }
+    size := bodyValueFactor * int64(limits.MaxValueSize + limits.MaxKeySize) + bodyOverhead
+    if path == "/batch" {
+        ops := limits.maxBatchOps()
+        if ops == 0 {
+            ops = bodyBatchOps
+        }
+        size *= int64(ops)
+    }
+    return size
+}
+
+//RESP arguments are keys, values or short options, so none is longer than the larger of the limits. Zero means no limit
+func (limits LimitsConfig) maxBulkSize() int {
+    if limits.MaxValueSize == 0 {
+        return 0
+    }
+    return max(limits.MaxValueSize, limits.MaxKeySize)
+}
+
+//ALARM entries keep the alarm name in Key and "on" or "off" in Value
+func (db *Db) commitAlarm(name string, value string) bool {
+    db.m.Lock()
+    defer db.m.Unlock()
+
+    key := sysPrefix + "alarm/" + name
+    if value == "on" {
+        db.set(key, Item{Value: value})
+    } else {
+        db.remove(key)
+    }
+    return true
+}
+
+func (db *Db) NoSpaceAlarm() bool {
+    _, ok := db.Get(noSpaceAlarmKey)
+    return ok
+}
+
+//the leader of range 0 raises and clears the space alarm through its log for all ranges, so every node enforces it
+func (state ExternalState) periodicQuotaCheck() {
+    if state.limits.QuotaBytes == 0 {
+        return
+    }
+
+    interval := time.Duration(int64(state.limits.QuotaCheckIntervalMs)) * time.Millisecond
+    if interval == 0 {
+        interval = time.Second
+    }
+    ticker := time.NewTicker(interval)
+    defer ticker.Stop()
+
+    for {
+        select {
+        case <- ticker.C:
+            if !state.isLeader() {
+                continue
+            }
+
+            size, _ := state.ranges.Size()
+            size += state.ranges.LogSize()
+            alarm := state.db.NoSpaceAlarm()
+            var value string
+            if !alarm && size > state.limits.QuotaBytes {
+                value = "on"
+            } else if alarm && float64(size) < float64(state.limits.QuotaBytes) * alarmClearRatio {
+                value = "off"
+            } else {
+                continue
+            }
+
+            extLogger.Warn("Changing space alarm", "alarm", value, "size", size, "quota", state.limits.QuotaBytes)
+            if _, err := state.env.ApplyRequestSync(ALARM, "nospace", value, ""); err != nil {
+                extLogger.Warn("Error while changing space alarm", "err", err)
+            }
+
+        case <- state.ctx.Done():
+            return
+        }
+    }
+}
+
+//checks size limits and the space alarm before a write that stores the value, writes 413/507 otherwise
+func (state ExternalState) checkWrite(w http.ResponseWriter, key string, value string, creates bool) bool {
+    code, msg := state.writeError(key, value, creates)
+    if code != 0 {
+        writeJson(w, code, map[string]string{"error": msg})
+        return false
+    }
+    return true
+}
+
+//returns zero code if the write is within limits
+func (state ExternalState) writeError(key string, value string, creates bool) (int, string) {
+    if state.limits.MaxKeySize != 0 && len(key) > state.limits.MaxKeySize {
+        return http.StatusRequestEntityTooLarge, fmt.Sprintf("Key is longer than %d bytes", state.limits.MaxKeySize)
+    }
+    if state.limits.MaxValueSize != 0 && len(value) > state.limits.MaxValueSize {
+        return http.StatusRequestEntityTooLarge, fmt.Sprintf("Value is longer than %d bytes", state.limits.MaxValueSize)
+    }
+    if state.rootDb().NoSpaceAlarm() {
+        return http.StatusInsufficientStorage, "Space quota exceeded, only reads and deletes are allowed"
+    }
+    if creates {
+        return state.keyLimitError(0)
+    }
+    return 0, ""
+}
+
+//pending keys are created by earlier ops of the same request
+func (state ExternalState) keyLimitError(pending int) (int, string) {
+    if _, keys := state.ranges.Size(); state.limits.MaxKeys != 0 && keys + pending >= state.limits.MaxKeys {
+        return http.StatusInsufficientStorage, fmt.Sprintf("Key limit of %d is reached", state.limits.MaxKeys)
+    }
+    return 0, ""
+}
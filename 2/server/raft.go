@@ -6,13 +6,15 @@ import (
     "fmt"
     "encoding/json"
     "io"
-    "log"
     "time"
     "sync/atomic"
     "math/rand"
     "bytes"
     "sync"
     "slices"
+    "log/slog"
+    "errors"
+    "os"
 )
 
 type RaftState struct {
@@ -23,6 +25,9 @@ type RaftState struct {
     appConfig AppConfig
     gotHb *atomic.Bool
     isLeader *atomic.Bool
+    client *http.Client
+    prefix string //of the internal routes of the range, empty for range 0
+    logger *slog.Logger
 }
 
 type VoteRequest struct {
@@ -41,7 +46,7 @@ func (state RaftState) HandleRequestVote(w http.ResponseWriter, r *http.Request)
     var voteRequest VoteRequest
     data, err := io.ReadAll(r.Body)
     if err != nil {
-        log.Printf("Error while reading req body: %v", err)
+        state.logger.Warn("Error while reading req body", "err", err)
         return
     }
 
@@ -49,15 +54,20 @@ func (state RaftState) HandleRequestVote(w http.ResponseWriter, r *http.Request)
         http.Error(w, fmt.Sprint(err), 400)
         return
     }
+    if !checkPeerNode(w, r, voteRequest.CandidateId) {
+        return
+    }
 
     var voteResponse VoteResponse
     state.env.WithLock(func(env *TEnv) {
-        if voteRequest.Term < env.p.State.CurrentTerm {
+        //removed nodes do not get the entries any more, so they would disrupt the cluster with their terms
+        if voteRequest.Term < env.p.State.CurrentTerm || voteRequest.CandidateId < uint64(len(env.roles)) && env.roles[voteRequest.CandidateId] == RoleRemoved {
             voteResponse.Term = env.p.State.CurrentTerm
             voteResponse.VoteGranted = false
             return
         }
         if voteRequest.Term > env.p.State.CurrentTerm {
+            termChanges.Inc()
             state.isLeader.Store(false)
             env.p.State.CurrentTerm = voteRequest.Term
             env.leaderState = nil
@@ -67,7 +77,7 @@ func (state RaftState) HandleRequestVote(w http.ResponseWriter, r *http.Request)
 
         voteResponse.Term = env.p.State.CurrentTerm
 
-        if env.p.State.VotedFor != nil {
+        if env.p.State.VotedFor != nil || !env.isVoter(state.nodeId) {
             voteResponse.VoteGranted = false
             return
         }
@@ -76,7 +86,7 @@ func (state RaftState) HandleRequestVote(w http.ResponseWriter, r *http.Request)
             voteResponse.VoteGranted = true
             env.p.SetVote(voteRequest.CandidateId)
         } else if voteRequest.LastLogTerm == env.l.Back().Term {
-            if voteRequest.LastLogIndex >= uint64(len(env.l.Entries) - 1) {
+            if voteRequest.LastLogIndex >= env.l.LastIndex() {
                 voteResponse.VoteGranted = true
                 env.p.SetVote(voteRequest.CandidateId)
             } else {
@@ -85,61 +95,60 @@ func (state RaftState) HandleRequestVote(w http.ResponseWriter, r *http.Request)
         } else {
             voteResponse.VoteGranted = false
         }
+
+        //granting a vote restarts the election timeout, a leader that handed over leadership would start an election otherwise
+        if voteResponse.VoteGranted {
+            state.gotHb.Store(true)
+        }
     })
 
-    log.Printf("VoteRequest: %v \n VoteResponse: %v", voteRequest, voteResponse)
+    state.logger.Info("Vote requested", "term", voteRequest.Term, "candidate", voteRequest.CandidateId,
+        "last_log_index", voteRequest.LastLogIndex, "last_log_term", voteRequest.LastLogTerm,
+        "current_term", voteResponse.Term, "granted", voteResponse.VoteGranted)
 
-    resp, err := json.Marshal(voteResponse)
-    if err != nil {
-        log.Fatal(err)
-    }
-
-    n, err := w.Write(resp)
-    if err != nil || n < len(resp) {
-        log.Printf("Error while writing response: %v, %d bytes written", err, n)
-        return
-    }
+    writeRaftResponse(w, voteResponse)
 }
 
-func (state RaftState) requestVoteFrom(ctx context.Context, node NodeConfig, votedChan chan <- VoteResponse) {
+func (state RaftState) requestVoteFrom(ctx context.Context, peerId uint64, node NodeConfig, votedChan chan <- VoteResponse) {
     voteRequest := VoteRequest{
         Term: state.env.p.State.CurrentTerm,
         CandidateId: state.nodeId,
-        LastLogIndex: uint64(len(state.env.l.Entries) - 1),
+        LastLogIndex: state.env.l.LastIndex(),
         LastLogTerm: state.env.l.Back().Term,
     }
 
 
+    logger := state.logger.With("peer", peerId, "term", voteRequest.Term)
     body, err := json.Marshal(voteRequest)
     if err != nil {
-        log.Fatal(err)
+        fatal(logger, "Error while marshaling vote request", "err", err)
     }
 
-    request, err := http.NewRequestWithContext(ctx, "POST", node.InternalUri() + "/request_vote", bytes.NewReader(body))
+    request, err := http.NewRequestWithContext(ctx, "POST", node.InternalUri() + state.prefix + "/request_vote", bytes.NewReader(body))
     if err != nil {
-        log.Fatal(err)
+        fatal(logger, "Error while creating vote request", "err", err)
     }
-    resp, err := http.DefaultClient.Do(request)
+    resp, err := state.client.Do(request)
     if err != nil {
-        log.Print(err)
+        logger.Warn("Vote request failed", "err", err)
         return
     }
 
     var voteResponse VoteResponse
     respBody, err := io.ReadAll(resp.Body)
     if err != nil {
-        log.Print(err)
+        logger.Warn("Error while reading vote response", "err", err)
         return
     }
     resp.Body.Close()
 
     if resp.StatusCode / 100 != 2 {
-        log.Printf("Non Ok response from node: %d, %s\n", resp.StatusCode, resp.Status)
+        logger.Warn("Non Ok response from node", "status", resp.StatusCode)
         return
     }
 
     if err = json.Unmarshal(respBody, &voteResponse); err != nil {
-        log.Print(err)
+        logger.Warn("Error while parsing vote response", "err", err)
         return
     }
 
@@ -149,64 +158,84 @@ func (state RaftState) requestVoteFrom(ctx context.Context, node NodeConfig, vot
 }
 
 func (state RaftState) leaderHB(ctx context.Context, env *TEnv, nodeId uint64, node NodeConfig) {
-    log.Println("Start leaderHB to node ", node)
+    //the entries the follower needs are compacted
+    if env.leaderState.NextIndex[nodeId] <= env.l.Offset {
+        if !env.leaderState.SendingSnapshot[nodeId] {
+            env.leaderState.SendingSnapshot[nodeId] = true
+            go state.sendSnapshot(env.p.State.CurrentTerm, nodeId, node)
+        }
+        return
+    }
+
     prevIdx := env.leaderState.NextIndex[nodeId] - 1
-    if prevIdx >= uint64(len(env.l.Entries)) {
-        prevIdx = uint64(len(env.l.Entries) - 1)
+    if prevIdx > env.l.LastIndex() {
+        prevIdx = env.l.LastIndex()
     }
     appendRequest := AppendRequest {
         Term: env.p.State.CurrentTerm,
         LeaderId: state.nodeId,
         PrevLogIndex: prevIdx,
-        PrevLogTerm: env.l.Entries[prevIdx].Term,
-        Entries: env.l.Entries[prevIdx + 1 : len(env.l.Entries)],
+        PrevLogTerm: env.l.Term(prevIdx),
+        Entries: env.l.From(prevIdx + 1),
         LeaderCommit: env.commitIndex,
     }
 
+    logger := state.logger.With("peer", nodeId, "term", appendRequest.Term)
+    logger.Log(ctx, LevelTrace, "Sending append entries", "prev_log_index", prevIdx, "entries", len(appendRequest.Entries), "leader_commit", appendRequest.LeaderCommit)
 
     body, err := json.Marshal(appendRequest)
     if err != nil {
-        log.Fatal(err)
+        fatal(logger, "Error while marshaling append request", "err", err)
     }
 
-    request, err := http.NewRequestWithContext(ctx, "POST", node.InternalUri() + "/append_entries", bytes.NewReader(body))
+    request, err := http.NewRequestWithContext(ctx, "POST", node.InternalUri() + state.prefix + "/append_entries", bytes.NewReader(body))
     if err != nil {
-        log.Fatal(err)
+        fatal(logger, "Error while creating append request", "err", err)
     }
-    resp, err := http.DefaultClient.Do(request)
+    peer := fmt.Sprint(nodeId)
+    start := time.Now()
+    resp, err := state.client.Do(request)
     if err != nil {
-        log.Print(err)
+        appendEntriesFailures.Inc(peer)
+        logger.Warn("Append entries failed", "err", err)
         return
     }
 
     var appendResponse AppendResponse
     respBody, err := io.ReadAll(resp.Body)
     if err != nil {
-        log.Print(err)
+        appendEntriesFailures.Inc(peer)
+        logger.Warn("Error while reading append response", "err", err)
         return
     }
     resp.Body.Close()
+    appendEntriesDuration.ObserveSince(start, peer)
 
     if resp.StatusCode / 100 != 2 {
-        log.Printf("Non Ok response from node: %d, %s\n", resp.StatusCode, resp.Status)
+        appendEntriesFailures.Inc(peer)
+        logger.Warn("Non Ok response from node", "status", resp.StatusCode)
         return
     }
 
     if err = json.Unmarshal(respBody, &appendResponse); err != nil {
-        log.Print(err)
+        appendEntriesFailures.Inc(peer)
+        logger.Warn("Error while parsing append response", "err", err)
         return
     }
 
     if appendResponse.Term > env.p.State.CurrentTerm {
+        logger.Info("Peer has greater term, stepping down", "peer_term", appendResponse.Term)
         state.isLeader.Store(false)
         return
     }
 
     if appendResponse.Success {
-        env.leaderState.NextIndex[nodeId] = uint64(len(env.l.Entries))
-        env.leaderState.MatchIndex[nodeId] = uint64(len(env.l.Entries) - 1)
+        env.leaderState.NextIndex[nodeId] = env.l.LastIndex() + 1
+        env.leaderState.MatchIndex[nodeId] = env.l.LastIndex()
+        env.leaderState.LastContact[nodeId] = time.Now()
     } else {
         env.leaderState.NextIndex[nodeId] -= 1
+        logger.Debug("Log mismatch, decreasing next index", "next_index", env.leaderState.NextIndex[nodeId])
     }
 }
 
@@ -233,7 +262,7 @@ func calcCommitIndex(matchIndex []uint64) (maxIdx uint64) {
         maxIdx = prevIdx
     }
 
-    log.Printf("Calc - Indexes: %v\n MaxIdx: %d\n", indexes, maxIdx)
+    raftLogger.Log(context.Background(), LevelTrace, "Commit index calculated", "indexes", indexes, "index", maxIdx)
 
     return
 
@@ -246,7 +275,7 @@ func (state RaftState) leaderHBBroadcast() (isLeader bool) {
             isLeader = state.isLeader.Load()
             if !isLeader {
 
-                log.Println("I am not leader anymore")
+                state.logger.Debug("I am not leader anymore")
                 return
             }
             requestsTimeout := time.Duration(int64(state.appConfig.AppendEntriesTimeoutMs)) * time.Millisecond
@@ -254,7 +283,7 @@ func (state RaftState) leaderHBBroadcast() (isLeader bool) {
             defer cancelFunc()
             var wg sync.WaitGroup
             for i, node := range state.nodesConfig {
-                if i == int(state.nodeId) {
+                if i == int(state.nodeId) || env.roles[i] == RoleRemoved {
                     continue
                 }
 
@@ -265,8 +294,9 @@ func (state RaftState) leaderHBBroadcast() (isLeader bool) {
                 }(&wg, uint64(i), node)
             }
 
-            newCommitIndex := calcCommitIndex(env.leaderState.MatchIndex)
+            newCommitIndex := calcCommitIndex(env.voterMatchIndexes())
             if env.commitIndex < newCommitIndex {
+                entriesCommitted.Add(float64(newCommitIndex - env.commitIndex))
                 env.commitIndex = newCommitIndex
                 env.CommitChanges(newCommitIndex)
             }
@@ -274,7 +304,7 @@ func (state RaftState) leaderHBBroadcast() (isLeader bool) {
             wg.Wait()
         })
     } else {
-        log.Println("I am not leader anymore")
+        state.logger.Log(state.ctx, LevelTrace, "I am not leader anymore")
     }
     return
 }
@@ -285,18 +315,18 @@ func (state RaftState) periodicLeaderHB() {
     for {
         select {
         case <- ticker.C:
-            log.Println("Periodic hb")
+            state.logger.Log(state.ctx, LevelTrace, "Periodic hb")
             state.leaderHBBroadcast()
 
         case <- state.env.newEntriesAlert.C:
             if state.isLeader.Load() {
-                log.Println("Got new entries, forced hb")
+                state.logger.Log(state.ctx, LevelTrace, "Got new entries, forced hb")
                 ticker.Reset(hbPeriod)
                 state.leaderHBBroadcast()
             }
 
         case <- state.ctx.Done():
-            log.Println("Finished periodic leader hb")
+            state.logger.Info("Finished periodic leader hb")
             return
         }
     }
@@ -310,12 +340,14 @@ func (state RaftState) AlreadyLeader() (alreadyLeader bool) {
 }
 
 func (state RaftState) TryBecomeLeader() {
-    if state.AlreadyLeader() {
+    if state.AlreadyLeader() || !state.env.IsVoter(state.nodeId) {
         return
     }
 
     state.env.WithLock(func(env *TEnv) {
         votedChan := make(chan VoteResponse, len(state.nodesConfig))
+        electionsStarted.Inc()
+        termChanges.Inc()
         env.p.State.CurrentTerm += 1
         env.p.State.VotedFor = &state.nodeId
         env.p.DumpPState()
@@ -324,12 +356,13 @@ func (state RaftState) TryBecomeLeader() {
         requestsTimeout := time.Duration(int64(state.appConfig.VoteRequestTimeoutMs)) * time.Millisecond
         ctx, cancelFunc := context.WithTimeout(state.ctx, requestsTimeout)
         for i, node := range state.nodesConfig {
-            if i == int(state.nodeId) {
+            if i == int(state.nodeId) || !env.isVoter(uint64(i)) {
                 continue
             }
 
-            go state.requestVoteFrom(ctx, node, votedChan)
+            go state.requestVoteFrom(ctx, uint64(i), node, votedChan)
         }
+        numVoters := env.numVoters()
 
         becameLeader := func() bool {
             defer cancelFunc()
@@ -338,7 +371,7 @@ func (state RaftState) TryBecomeLeader() {
             for {
                 select {
                 case <-ctx.Done():
-                    log.Print("Vote Requests timed out")
+                    state.logger.Info("Vote requests timed out", "term", env.p.State.CurrentTerm)
                     return false
                 case resp := <- votedChan:
                     if resp.VoteGranted {
@@ -348,16 +381,17 @@ func (state RaftState) TryBecomeLeader() {
                     }
 
                     if resp.Term > env.p.State.CurrentTerm {
+                        termChanges.Inc()
                         env.p.State.CurrentTerm = resp.Term
                         env.p.State.VotedFor = nil
                         env.p.DumpPState()
                         return false
                     }
 
-                    if trueCount > len(state.nodesConfig) / 2 {
+                    if trueCount > numVoters / 2 {
                         return true
                     }
-                    if falseCount > len(state.nodesConfig) / 2 {
+                    if falseCount > numVoters / 2 {
                         return false
                     }
                 }
@@ -366,9 +400,10 @@ func (state RaftState) TryBecomeLeader() {
         }()
 
         if becameLeader {
-            log.Printf("I (nodeId: %d) became leader in term %d\n", state.nodeId, env.p.State.CurrentTerm)
+            state.logger.Info("Became leader", "term", env.p.State.CurrentTerm, "index", env.l.LastIndex())
+            electionsWon.Inc()
             env.leaderId = &state.nodeId
-            env.leaderState = NewLeaderState(state.nodeId, len(state.nodesConfig), uint64(len(env.l.Entries) - 1))
+            env.leaderState = NewLeaderState(state.nodeId, len(state.nodesConfig), env.l.LastIndex())
 
             state.isLeader.Store(true)
 
@@ -397,7 +432,7 @@ func (state RaftState) HandleAppendEntries(w http.ResponseWriter, r *http.Reques
     var appendRequest AppendRequest
     data, err := io.ReadAll(r.Body)
     if err != nil {
-        log.Printf("Error while reading req body: %v", err)
+        state.logger.Warn("Error while reading req body", "err", err)
         w.WriteHeader(500)
         return
     }
@@ -406,6 +441,9 @@ func (state RaftState) HandleAppendEntries(w http.ResponseWriter, r *http.Reques
         http.Error(w, fmt.Sprint(err), 400)
         return
     }
+    if !checkPeerNode(w, r, appendRequest.LeaderId) {
+        return
+    }
 
     var appendResponse AppendResponse
     state.env.WithLock(func(env *TEnv) {
@@ -415,16 +453,43 @@ func (state RaftState) HandleAppendEntries(w http.ResponseWriter, r *http.Reques
             return
         } else {
             state.gotHb.Store(true)
+            env.lastHB = time.Now()
             state.isLeader.Store(false)
             env.leaderState = nil
             env.leaderId = &appendRequest.LeaderId
+            if appendRequest.Term != env.p.State.CurrentTerm {
+                termChanges.Inc()
+            }
             env.p.State.CurrentTerm = appendRequest.Term
             env.p.State.VotedFor = &appendRequest.LeaderId
             env.p.DumpPState()
         }
 
 
-        if (!env.l.CheckAndCorrect(appendRequest.PrevLogIndex, appendRequest.PrevLogTerm)) {
+        lastIndex := env.l.LastIndex()
+        defer func() {
+            if env.l.LastIndex() < lastIndex || slices.ContainsFunc(appendRequest.Entries, func(entry LogEntry) bool { return entry.Op == SET_ROLE }) {
+                env.refreshMembership()
+            }
+        }()
+
+        //entries up to the offset are in the snapshot already
+        if appendRequest.PrevLogIndex < env.l.Offset {
+            skip := env.l.Offset - appendRequest.PrevLogIndex
+            if skip >= uint64(len(appendRequest.Entries)) {
+                appendResponse.Term = env.p.State.CurrentTerm
+                appendResponse.Success = true
+                return
+            }
+            appendRequest.Entries = appendRequest.Entries[skip:]
+            appendRequest.PrevLogIndex = env.l.Offset
+            appendRequest.PrevLogTerm = env.l.Entries[0].Term
+        }
+
+        pending := env.pendingProposals()
+        matched := env.l.CheckAndCorrect(appendRequest.PrevLogIndex, appendRequest.PrevLogTerm)
+        env.failDroppedProposals(pending)
+        if (!matched) {
             appendResponse.Term = env.p.State.CurrentTerm
             appendResponse.Success = false
             return
@@ -439,17 +504,187 @@ func (state RaftState) HandleAppendEntries(w http.ResponseWriter, r *http.Reques
 
     })
 
-    log.Printf("AppendRequest: %v \n AppendResponse: %v", appendRequest, appendResponse)
+    logger := state.logger.With("leader", appendRequest.LeaderId, "term", appendRequest.Term)
+    if len(appendRequest.Entries) > 0 || !appendResponse.Success {
+        logger.Debug("Append entries handled", "prev_log_index", appendRequest.PrevLogIndex, "prev_log_term", appendRequest.PrevLogTerm,
+            "entries", len(appendRequest.Entries), "leader_commit", appendRequest.LeaderCommit, "success", appendResponse.Success)
+    }
+    logger.Log(r.Context(), LevelTrace, "Append entries request", "request", appendRequest, "response", appendResponse)
+
+    writeRaftResponse(w, appendResponse)
+}
+
+type InstallSnapshotRequest struct {
+    Term uint64 `json:"term"`
+    LeaderId uint64 `json:"leader_id"`
+    Snapshot *Snapshot `json:"snapshot"`
+}
+
+//the snapshot goes last, so its items are streamed
+func writeInstallSnapshot(w io.Writer, request InstallSnapshotRequest) error {
+    if _, err := fmt.Fprintf(w, `{"term":%d,"leader_id":%d,"snapshot":`, request.Term, request.LeaderId); err != nil {
+        return err
+    }
+    if _, err := writeSnapshot(w, request.Snapshot); err != nil {
+        return err
+    }
+    _, err := io.WriteString(w, "}")
+    return err
+}
+
+//the items of the snapshot are left in the body
+func readInstallSnapshot(body io.Reader) (request InstallSnapshotRequest, err error) {
+    decoder := json.NewDecoder(body)
+    _, err = decodeFields(decoder, func(key string) (bool, error) {
+        switch key {
+        case "term":
+            return false, decoder.Decode(&request.Term)
+        case "leader_id":
+            return false, decoder.Decode(&request.LeaderId)
+        case "snapshot":
+            snapshot, err := readSnapshot(decoder)
+            request.Snapshot = snapshot
+            return true, err
+        default:
+            return false, skipValue(decoder)
+        }
+    })
+    if err == nil && request.Snapshot == nil {
+        err = errors.New("Request has no snapshot")
+    }
+    return
+}
+
+//snapshots are streamed from the file in a separate goroutine, so heartbeats to the other followers are not delayed
+func (state RaftState) sendSnapshot(term uint64, nodeId uint64, node NodeConfig) {
+    logger := state.logger.With("peer", nodeId, "term", term)
+    var installed uint64
+    defer state.env.WithLock(func(env *TEnv) {
+        if env.leaderState == nil || env.p.State.CurrentTerm != term {
+            return
+        }
+        env.leaderState.SendingSnapshot[nodeId] = false
+        if installed != 0 {
+            env.leaderState.NextIndex[nodeId] = max(env.leaderState.NextIndex[nodeId], installed + 1)
+            env.leaderState.MatchIndex[nodeId] = max(env.leaderState.MatchIndex[nodeId], installed)
+            env.leaderState.LastContact[nodeId] = time.Now()
+        }
+    })
+
+    snapshot, err := state.env.snapshots.Load()
+    if err != nil || snapshot == nil {
+        logger.Error("Error while reading snapshot", "err", err)
+        return
+    }
+    index := snapshot.Index
+    body, writer := io.Pipe()
+    go func() {
+        err := writeInstallSnapshot(writer, InstallSnapshotRequest{Term: term, LeaderId: state.nodeId, Snapshot: snapshot})
+        writer.CloseWithError(errors.Join(err, snapshot.Close()))
+    }()
+    defer body.Close()
+
+    timeout := time.Duration(int64(state.appConfig.Snapshot.InstallTimeoutMs)) * time.Millisecond
+    if timeout == 0 {
+        timeout = 10 * time.Second
+    }
+    ctx, cancel := context.WithTimeout(state.ctx, timeout)
+    defer cancel()
+    request, err := http.NewRequestWithContext(ctx, "POST", node.InternalUri() + state.prefix + "/install_snapshot", body)
+    if err != nil {
+        fatal(logger, "Error while creating install snapshot request", "err", err)
+    }
+    logger.Info("Sending snapshot", "index", index)
+    resp, err := state.client.Do(request)
+    if err != nil {
+        logger.Warn("Install snapshot failed", "err", err)
+        return
+    }
+
+    var response AppendResponse
+    respBody, err := io.ReadAll(resp.Body)
+    resp.Body.Close()
+    if err != nil {
+        logger.Warn("Error while reading install snapshot response", "err", err)
+        return
+    }
+    if resp.StatusCode / 100 != 2 {
+        logger.Warn("Non Ok response from node", "status", resp.StatusCode)
+        return
+    }
+    if err = json.Unmarshal(respBody, &response); err != nil {
+        logger.Warn("Error while parsing install snapshot response", "err", err)
+        return
+    }
+
+    if response.Term > term {
+        logger.Info("Peer has greater term, stepping down", "peer_term", response.Term)
+        state.isLeader.Store(false)
+        return
+    }
+    if response.Success {
+        snapshotsSent.Inc(fmt.Sprint(nodeId))
+        logger.Info("Snapshot installed", "index", index)
+        installed = index
+    }
+}
+
+//the snapshot is written to a file before the lock is taken, the lock is held only to install it
+func (state RaftState) HandleInstallSnapshot(w http.ResponseWriter, r *http.Request) {
+    request, err := readInstallSnapshot(r.Body)
+    if err != nil {
+        http.Error(w, fmt.Sprint(err), 400)
+        return
+    }
+    if !checkPeerNode(w, r, request.LeaderId) {
+        return
+    }
+    fileName, items, err := state.env.snapshots.write(request.Snapshot)
+    if err != nil {
+        state.logger.Warn("Error while writing received snapshot", "err", err)
+        http.Error(w, fmt.Sprint(err), 400)
+        return
+    }
+
+    var response AppendResponse
+    state.env.WithLock(func(env *TEnv) {
+        response.Term = env.p.State.CurrentTerm
+        if request.Term < env.p.State.CurrentTerm {
+            os.Remove(fileName)
+            return
+        }
+
+        state.gotHb.Store(true)
+        env.lastHB = time.Now()
+        state.isLeader.Store(false)
+        env.leaderState = nil
+        env.leaderId = &request.LeaderId
+        if request.Term != env.p.State.CurrentTerm {
+            termChanges.Inc()
+        }
+        env.p.State.CurrentTerm = request.Term
+        env.p.State.VotedFor = &request.LeaderId
+        env.p.DumpPState()
+
+        env.installSnapshot(request.Snapshot, fileName)
+        response.Term = env.p.State.CurrentTerm
+        response.Success = true
+    })
+
+    state.logger.Info("Install snapshot handled", "leader", request.LeaderId, "term", request.Term,
+        "index", request.Snapshot.Index, "snapshot_term", request.Snapshot.Term, "items", items, "success", response.Success)
+    writeRaftResponse(w, response)
+}
 
-    resp, err := json.Marshal(appendResponse)
+func writeRaftResponse(w http.ResponseWriter, v any) {
+    resp, err := json.Marshal(v)
     if err != nil {
-        log.Fatal(err)
+        fatal(raftLogger, "Error while marshaling response", "err", err)
     }
 
     n, err := w.Write(resp)
     if err != nil || n < len(resp) {
-        log.Printf("Error while writing response: %v, %d bytes written", err, n)
-        return
+        raftLogger.Warn("Error while writing response", "err", err, "written", n)
     }
 }
 
@@ -458,23 +693,155 @@ func calcDeadline(durationMs int, randomShiftMs int) time.Duration {
 }
 
 func (state RaftState) periodicCheckHb() {
-    log.Print("Periodic check heartbeat started")
+    state.logger.Info("Periodic check heartbeat started")
     for {
         timer := time.NewTimer(calcDeadline(state.appConfig.HBTimeout, state.appConfig.RandomShift))
         select {
             case <- timer.C:
                 if !state.isLeader.Load() && !state.gotHb.Swap(false) {
-                    log.Print("No heartbeats, initiate revote")
+                    state.logger.Info("No heartbeats, initiate revote")
                     state.TryBecomeLeader()
                 }
             case <- state.ctx.Done():
-                log.Print("Periodic check heartbeat exited")
+                state.logger.Info("Periodic check heartbeat exited")
                 return
         }
     }
 }
 
-func NewRaftServer(env *TEnv, ctx context.Context, nodesConfig NodesConfig, nodeId uint64, appConfig AppConfig) (*http.Server, error) {
+type TimeoutNowRequest struct {
+    Term uint64 `json:"term"`
+    LeaderId uint64 `json:"leader_id"`
+}
+
+func (state RaftState) HandleTimeoutNow(w http.ResponseWriter, r *http.Request) {
+    var timeoutNowRequest TimeoutNowRequest
+    data, err := io.ReadAll(r.Body)
+    if err != nil {
+        state.logger.Warn("Error while reading req body", "err", err)
+        w.WriteHeader(500)
+        return
+    }
+
+    if err = json.Unmarshal(data, &timeoutNowRequest); err != nil {
+        http.Error(w, fmt.Sprint(err), 400)
+        return
+    }
+    if !checkPeerNode(w, r, timeoutNowRequest.LeaderId) {
+        return
+    }
+
+    var currentTerm uint64
+    var closing bool
+    state.env.WithLock(func(env *TEnv) {
+        currentTerm = env.p.State.CurrentTerm
+        closing = env.closing
+    })
+
+    //a node that is shutting down would take leadership only to lose it again
+    if closing {
+        http.Error(w, ErrShuttingDown.Error(), http.StatusServiceUnavailable)
+        return
+    }
+    if timeoutNowRequest.Term != currentTerm {
+        http.Error(w, fmt.Sprintf("Stale term %d, current term is %d", timeoutNowRequest.Term, currentTerm), http.StatusConflict)
+        return
+    }
+
+    state.logger.Info("Leader asked to start election now", "leader", timeoutNowRequest.LeaderId, "term", currentTerm)
+    go state.TryBecomeLeader()
+    w.WriteHeader(http.StatusOK)
+}
+
+//preferred is -1 to choose any follower
+func (state RaftState) chooseTransferTarget(preferred int) (target int, term uint64, ok bool) {
+    state.env.WithLock(func(env *TEnv) {
+        if env.leaderState == nil {
+            return
+        }
+
+        term = env.p.State.CurrentTerm
+        lastIndex := env.l.LastIndex()
+        for i := range state.nodesConfig {
+            if (preferred < 0 || i == preferred) && i != int(state.nodeId) && env.isVoter(uint64(i)) && env.leaderState.MatchIndex[i] == lastIndex {
+                target = i
+                ok = true
+                return
+            }
+        }
+    })
+    return
+}
+
+//hands leadership over to an up to date follower, returns false if this node is still the leader
+func (state RaftState) TransferLeadership(ctx context.Context) bool {
+    return state.TransferLeadershipTo(ctx, -1)
+}
+
+//waits until the target voter catches up, any follower may be chosen if target is -1
+func (state RaftState) TransferLeadershipTo(ctx context.Context, preferred int) bool {
+    if !state.isLeader.Load() {
+        return true
+    }
+
+    var target int
+    var term uint64
+    for {
+        var ok bool
+        if target, term, ok = state.chooseTransferTarget(preferred); ok {
+            break
+        }
+        if !state.leaderHBBroadcast() {
+            return true
+        }
+        select {
+        case <- ctx.Done():
+            state.logger.Warn("No up to date follower to transfer leadership to")
+            return false
+        case <- time.After(time.Duration(int64(state.appConfig.HBIntervalMs)) * time.Millisecond):
+        }
+    }
+
+    logger := state.logger.With("peer", target, "term", term)
+    logger.Info("Transferring leadership")
+    body, err := json.Marshal(TimeoutNowRequest{Term: term, LeaderId: state.nodeId})
+    if err != nil {
+        fatal(logger, "Error while marshaling timeout now request", "err", err)
+    }
+
+    request, err := http.NewRequestWithContext(ctx, "POST", state.nodesConfig[target].InternalUri() + state.prefix + "/timeout_now", bytes.NewReader(body))
+    if err != nil {
+        fatal(logger, "Error while creating timeout now request", "err", err)
+    }
+    resp, err := state.client.Do(request)
+    if err != nil {
+        logger.Warn("Timeout now request failed", "err", err)
+        return false
+    }
+    resp.Body.Close()
+
+    if resp.StatusCode / 100 != 2 {
+        logger.Warn("Non Ok response from node", "status", resp.StatusCode)
+        return false
+    }
+
+    ticker := time.NewTicker(10 * time.Millisecond)
+    defer ticker.Stop()
+    for state.isLeader.Load() {
+        select {
+        case <- ticker.C:
+        case <- ctx.Done():
+            logger.Warn("Leadership transfer timed out")
+            return false
+        }
+    }
+
+    logger.Info("Leadership transferred")
+    return true
+}
+
+//starts the elections and heartbeats of one range, its handlers are registered by the server
+func NewRaftState(env *TEnv, ctx context.Context, nodesConfig NodesConfig, nodeId uint64, appConfig AppConfig, client *http.Client, rangeId uint64) *RaftState {
     raftState := RaftState{
         env: env,
         ctx: ctx,
@@ -483,17 +850,43 @@ func NewRaftServer(env *TEnv, ctx context.Context, nodesConfig NodesConfig, node
         appConfig: appConfig,
         gotHb: &atomic.Bool{},
         isLeader: &atomic.Bool{},
+        client: client,
+        prefix: rangePrefix(rangeId),
+        logger: raftLogger,
+    }
+    if rangeId != 0 {
+        raftState.logger = raftLogger.With("range", rangeId)
     }
 
     go raftState.periodicCheckHb()
     go raftState.periodicLeaderHB()
+    return &raftState
+}
+
+func (state RaftState) registerHandlers(serveMux *http.ServeMux) {
+    serveMux.HandleFunc("/request_vote", state.HandleRequestVote)
+    serveMux.HandleFunc("/append_entries", state.HandleAppendEntries)
+    serveMux.HandleFunc("/timeout_now", state.HandleTimeoutNow)
+    serveMux.HandleFunc("/install_snapshot", state.HandleInstallSnapshot)
+    serveMux.HandleFunc("/status", handleStatus(state.env, state.nodeId, false))
+    serveMux.HandleFunc("/debug/raft", handleStatus(state.env, state.nodeId, true))
+}
 
+//range 0 is served at the root as before ranges existed, the others under /ranges/<id>
+func NewRaftServer(ranges *Ranges, nodesConfig NodesConfig, nodeId uint64, certs *CertStore) (*http.Server, error) {
     serveMux := http.NewServeMux()
-    serveMux.HandleFunc("/request_vote", raftState.HandleRequestVote)
-    serveMux.HandleFunc("/append_entries", raftState.HandleAppendEntries)
+    ranges.Get(0).raft.registerHandlers(serveMux)
+    serveMux.HandleFunc("/split", ranges.Get(0).handleProposeSplit)
+    serveMux.HandleFunc("/metrics", handleMetrics)
+    serveMux.HandleFunc("/ranges", ranges.handleList)
+    serveMux.HandleFunc("/ranges/", ranges.handleInternal)
 
-    return &http.Server {
+    server := &http.Server {
         Addr:           fmt.Sprintf(":%d", nodesConfig[nodeId].InternalPort),
         Handler:        serveMux,
-    }, nil
+    }
+    if certs != nil {
+        server.TLSConfig = certs.InternalServerConfig(nodesConfig)
+    }
+    return server, nil
 }
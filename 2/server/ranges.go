@@ -0,0 +1,938 @@
+package main
+
+import (
+    "bytes"
+    "cmp"
+    "context"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io"
+    "io/fs"
+    "net/http"
+    "os"
+    "path/filepath"
+    "slices"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+)
+
+//the key space is split into ranges, each one replicated by its own raft group. Every node keeps a replica
+//of every range with the same members, so the groups share the processes and the ports while their leaders
+//are spread over the nodes. Range 0 keeps the workdir and the routes of a node from before ranges existed
+//and owns the system keys: users, locks, queues and the space alarm. Membership is changed through range 0,
+//the leaders of the other ranges make the same changes through their own logs
+
+const (
+    rangeKey = sysPrefix + "range" //descriptor of the range in its own state machine, missing for the whole key space
+    rangeIdKey = sysPrefix + "ranges/last_id" //counter in range 0 the ids of new ranges come from
+    rangesDir = "ranges"
+)
+
+type RangesConfig struct {
+    SplitKeys int `json:"split_keys"` //a range with more keys is split in the middle, 0 disables automatic splits
+    CheckIntervalMs int `json:"check_interval_ms"` //for splits, missing replicas and leader placement, 5s by default
+}
+
+type RangeDescriptor struct {
+    Id uint64 `json:"id"`
+    Start string `json:"start"`
+    End string `json:"end"` //exclusive, empty for the end of the key space
+}
+
+func (desc RangeDescriptor) Contains(key string) bool {
+    return key >= desc.Start && (desc.End == "" || key < desc.End)
+}
+
+func (desc RangeDescriptor) item() ItemResponse {
+    data, err := json.Marshal(desc)
+    if err != nil {
+        fatal(dbLogger, "Error while marshaling range descriptor", "err", err)
+    }
+    value := string(data)
+    return ItemResponse{Key: rangeKey, Value: &value}
+}
+
+var ErrWrongRange = errors.New("Key belongs to another range, retry later")
+
+var ErrRangeStart = errors.New("Key already starts a range")
+
+var ErrNoRangeLeader = errors.New("Range has no leader, retry later")
+
+func rangePrefix(id uint64) string {
+    if id == 0 {
+        return ""
+    }
+    return fmt.Sprintf("/ranges/%d", id)
+}
+
+//system keys always stay in range 0
+func (db *Db) ownsKey(key string) bool {
+    return isSystemKey(key) || db.desc.Contains(key)
+}
+
+func (db *Db) Range() RangeDescriptor {
+    db.m.RLock()
+    defer db.m.RUnlock()
+    return db.desc
+}
+
+func (db *Db) loadRange() {
+    db.desc = RangeDescriptor{}
+    if item, ok := db.data.Get(rangeKey); ok {
+        if err := json.Unmarshal([]byte(item.Value), &db.desc); err != nil {
+            fatal(dbLogger, "Malformed range descriptor", "value", item.Value, "err", err)
+        }
+    }
+}
+
+//RANGE_SPLIT moves the keys from Key to the end of the range to the new range with the id in Value. Every
+//replica creates the new range from the same keys, entries for them appended here later fail with ErrWrongRange.
+//Payload has the roles of range 0 when the split was proposed, without them the new range starts with the nodes config
+func (db *Db) commitSplit(entry LogEntry) CommitResult {
+    id, err := strconv.ParseUint(entry.Value, 10, 64)
+    if err != nil || id == 0 || isSystemKey(entry.Key) || entry.Key <= db.desc.Start || !db.desc.Contains(entry.Key) {
+        return CommitResult{}
+    }
+    var roles []string
+    if entry.Payload != "" && json.Unmarshal([]byte(entry.Payload), &roles) != nil {
+        dbLogger.Warn("Ignoring malformed roles of split", "roles", entry.Payload)
+        roles = nil
+    }
+
+    moved := RangeDescriptor{Id: id, Start: entry.Key, End: db.desc.End}
+    //the keys are copied to the new range from a view taken before they are removed here
+    db.m.Lock()
+    view := db.data.View()
+    view.Ascend(moved.Start, func(key string, item Item) bool {
+        if !moved.Contains(key) {
+            return false
+        }
+        db.remove(key)
+        return true
+    })
+    db.desc.End = moved.Start
+    db.data.Put(rangeKey, db.desc.item().item())
+    db.m.Unlock()
+    defer view.Close()
+
+    //the descriptor is a system key, so it sorts before the moved keys
+    items := func(f func(key string, item Item) error) error {
+        if err := f(rangeKey, moved.item().item()); err != nil {
+            return err
+        }
+        return viewItems(view, moved.Start, moved.Contains)(f)
+    }
+    //the new range has to exist before the split becomes durable here
+    if db.onSplit != nil {
+        db.onSplit(moved, &Snapshot{Index: 1, Term: 1, Roles: roles, items: items})
+    }
+    return CommitResult{Ok: true}
+}
+
+//user key in the middle of the range, a split there leaves half of the keys on each side
+func (db *Db) middleKey() (middle string, ok bool) {
+    db.m.RLock()
+    defer db.m.RUnlock()
+
+    //queue items are counted with the keys but stay in range 0
+    skip := db.keys
+    for _, ids := range db.queues {
+        skip -= len(ids)
+    }
+    skip /= 2
+    //system keys sort before the others
+    start := max(db.desc.Start, "\x01")
+    db.data.Ascend(start, func(key string, item Item) bool {
+        if !db.desc.Contains(key) {
+            return false
+        }
+        if skip > 0 {
+            skip--
+            return true
+        }
+        middle, ok = key, key > db.desc.Start
+        return false
+    })
+    return
+}
+
+//replica of a range on this node
+type Range struct {
+    Id uint64
+    env *TEnv
+    db *Db
+    raft *RaftState
+    ext ExternalState
+    internal http.Handler //raft routes without the prefix of the range
+    external http.Handler
+}
+
+//the replica follows the range once it got the descriptor, a replica opened empty has to catch up first
+func (rng *Range) ready() bool {
+    return rng.db.Range().Id == rng.Id
+}
+
+type SplitRequest struct {
+    Key string `json:"key"`
+    Id uint64 `json:"id"`
+}
+
+//the leader of range 0 hands out the id, the leader of the split range appends the split to its log
+func (rng *Range) proposeSplit(key string, id uint64) (bool, error) {
+    if !rng.ext.isLeader() {
+        return false, ErrNoRangeLeader
+    }
+    //every replica creates the new range with the membership of range 0 the entry carries
+    roles, err := json.Marshal(rng.ext.ranges.Get(0).env.CommittedRoles())
+    if err != nil {
+        return false, err
+    }
+    result, err := rng.env.ApplyEntrySync(LogEntry{Op: RANGE_SPLIT, Key: key, Value: strconv.FormatUint(id, 10), Payload: string(roles)})
+    return result.Ok, err
+}
+
+//POST <range prefix>/split on the internal port, ok is false if the key is not inside the range any more
+func (rng *Range) handleProposeSplit(w http.ResponseWriter, r *http.Request) {
+    if r.Method != "POST" {
+        w.Header().Add("Allow", "POST")
+        w.WriteHeader(http.StatusMethodNotAllowed)
+        return
+    }
+
+    var request SplitRequest
+    data, err := io.ReadAll(r.Body)
+    if err != nil {
+        rng.raft.logger.Warn("Error while reading req body", "err", err)
+        w.WriteHeader(500)
+        return
+    }
+    if err = json.Unmarshal(data, &request); err != nil {
+        http.Error(w, fmt.Sprint(err), 400)
+        return
+    }
+
+    ok, err := rng.proposeSplit(request.Key, request.Id)
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusServiceUnavailable)
+        return
+    }
+    rng.raft.logger.Info("Split applied", "key", request.Key, "new_range", request.Id, "ok", ok)
+    writeRaftResponse(w, map[string]bool{"ok": ok})
+}
+
+//leaders are spread over the voters by range id, returns the voter to hand leadership to if it is reachable
+func (rng *Range) transferTarget(nodeId uint64, hbTimeout time.Duration) (target uint64, ok bool) {
+    rng.env.WithLock(func(env *TEnv) {
+        if env.leaderState == nil {
+            return
+        }
+        var voters []uint64
+        for i := range env.roles {
+            if env.isVoter(uint64(i)) {
+                voters = append(voters, uint64(i))
+            }
+        }
+        if len(voters) == 0 {
+            return
+        }
+        target = voters[rng.Id % uint64(len(voters))]
+        ok = target != nodeId && time.Since(env.leaderState.LastContact[target]) < hbTimeout
+    })
+    return
+}
+
+//replicas of all ranges on this node
+type Ranges struct {
+    workdir string
+    nodesConfig NodesConfig
+    nodeId uint64
+    appConfig AppConfig
+    client *http.Client
+    raftCtx context.Context //stops the raft groups
+    dbCtx context.Context //stops the state machines
+    serving context.Context //cancelled when the ext server starts shutting down, ends long running requests
+    stopServing context.CancelFunc
+    root *Db //state machine of range 0
+    ranges map[uint64]*Range
+    opening map[uint64]*sync.Mutex //held while the replica of a range is created, so it is created once
+    m sync.RWMutex
+}
+
+func NewRanges(workdir string, nodesConfig NodesConfig, nodeId uint64, appConfig AppConfig, certs *CertStore, raftCtx context.Context, dbCtx context.Context) *Ranges {
+    serving, stopServing := context.WithCancel(raftCtx)
+    return &Ranges{
+        workdir: workdir,
+        nodesConfig: nodesConfig,
+        nodeId: nodeId,
+        appConfig: appConfig,
+        client: NewNodeClient(certs, nodesConfig),
+        raftCtx: raftCtx,
+        dbCtx: dbCtx,
+        serving: serving,
+        stopServing: stopServing,
+        ranges: make(map[uint64]*Range),
+        opening: make(map[uint64]*sync.Mutex),
+    }
+}
+
+//opens range 0 in the workdir and the replicas of the other ranges under it
+func (ranges *Ranges) Open() error {
+    root, err := ranges.open(0, ranges.workdir)
+    if err != nil {
+        return err
+    }
+    ranges.root = root.db
+    ranges.m.Lock()
+    ranges.ranges[0] = root
+    ranges.m.Unlock()
+
+    entries, err := os.ReadDir(filepath.Join(ranges.workdir, rangesDir))
+    if err != nil && !errors.Is(err, fs.ErrNotExist) {
+        return err
+    }
+    for _, entry := range entries {
+        id, err := strconv.ParseUint(entry.Name(), 10, 64)
+        if err != nil || id == 0 {
+            continue
+        }
+        //a replica without pstate was not created completely, applying the split creates it again
+        if _, err := os.Stat(filepath.Join(ranges.workdir, rangesDir, entry.Name(), "pstate.json")); err != nil {
+            continue
+        }
+        if err := ranges.ensure(id, nil); err != nil {
+            return fmt.Errorf("Error while opening range %d: %w", id, err)
+        }
+    }
+    go ranges.periodicCheck()
+    return nil
+}
+
+//the state machine resumes or is restored before the raft group starts
+func (ranges *Ranges) open(id uint64, workdir string) (*Range, error) {
+    logger := mainLogger
+    if id != 0 {
+        logger = mainLogger.With("range", id)
+    }
+
+    pState, err := NewPState(filepath.Join(workdir, "pstate.json"))
+    if err != nil {
+        return nil, fmt.Errorf("Error while reading pstate: %w", err)
+    }
+    raftLog, err := NewLog(filepath.Join(workdir, "log.json"))
+    if err != nil {
+        return nil, fmt.Errorf("Error while reading log: %w", err)
+    }
+    snapshots, snapshot, err := NewSnapshotStore(filepath.Join(workdir, "snapshot.json"))
+    if err != nil {
+        return nil, fmt.Errorf("Error while reading snapshot: %w", err)
+    }
+    defer snapshot.Close()
+    removeScratchStorages(workdir)
+
+    env := NewEnv(pState, raftLog, snapshots, ranges.nodesConfig, 100)
+    if snapshot != nil {
+        env.RestoreSnapshot(snapshot)
+    }
+    env.maxUncommitted = uint64(ranges.appConfig.Limits.MaxUncommittedEntries)
+
+    storage, err := OpenStorage(ranges.appConfig.Storage, workdir)
+    if err != nil {
+        return nil, fmt.Errorf("Error while opening storage: %w", err)
+    }
+    db := NewDb(ranges.dbCtx, env.commitQueue, storage)
+    switch applied := db.AppliedIndex(); {
+    case snapshot != nil && snapshot.Index > applied:
+        logger.Info("Restoring snapshot", "index", snapshot.Index, "term", snapshot.Term)
+        db.Restore(snapshot)
+    case applied > 0 && !env.ResumeApplied(applied):
+        //the log lost a tail the state machine has applied already
+        logger.Warn("State machine is ahead of the log, rebuilding it", "applied", applied)
+        if snapshot == nil {
+            snapshot = &Snapshot{}
+        }
+        db.Restore(snapshot)
+    case applied > 0:
+        logger.Info("Resuming state machine", "applied", applied)
+    }
+    //entries reach the state machine only once the raft group runs
+    db.onSplit = ranges.split
+
+    raftState := NewRaftState(&env, ranges.raftCtx, ranges.nodesConfig, ranges.nodeId, ranges.appConfig, ranges.client, id)
+    snapshotConfig := ranges.appConfig.Snapshot
+    if snapshotConfig.LogBytes == 0 {
+        snapshotConfig.LogBytes = ranges.appConfig.Limits.QuotaBytes / logQuotaShare
+    }
+    go periodicSnapshot(ranges.raftCtx, &env, db, snapshotConfig)
+
+    rng := &Range{Id: id, env: &env, db: db, raft: raftState}
+    rng.ext = NewExtState(&env, db, raftState, ranges, ranges.nodesConfig, ranges.nodeId, ranges.appConfig)
+    if id == 0 {
+        go rng.ext.periodicQuotaCheck()
+    }
+
+    internal := http.NewServeMux()
+    raftState.registerHandlers(internal)
+    internal.HandleFunc("/split", rng.handleProposeSplit)
+    rng.internal = internal
+    rng.external = rng.ext.serveMux()
+    return rng, nil
+}
+
+//opens the replica of the range, creating its workdir from the snapshot if there is none.
+//A nil snapshot creates an empty replica that gets the state from the leader of the range
+func (ranges *Ranges) ensure(id uint64, snapshot *Snapshot) error {
+    //writing the workdir and restoring it take long for a large range, the map is locked only to add the replica
+    lock := ranges.openingLock(id)
+    lock.Lock()
+    defer lock.Unlock()
+    if ranges.Get(id) != nil {
+        return nil
+    }
+
+    workdir := filepath.Join(ranges.workdir, rangesDir, strconv.FormatUint(id, 10))
+    if _, err := os.Stat(filepath.Join(workdir, "pstate.json")); errors.Is(err, fs.ErrNotExist) {
+        if snapshot == nil {
+            snapshot = &Snapshot{}
+        }
+        if err := restoreWorkdir(workdir, snapshot); err != nil {
+            return err
+        }
+    } else if err != nil {
+        return err
+    }
+
+    //the node is stopping, the replica is opened on the next start
+    if ranges.raftCtx.Err() != nil {
+        return nil
+    }
+    rng, err := ranges.open(id, workdir)
+    if err != nil {
+        return err
+    }
+
+    ranges.m.Lock()
+    ranges.ranges[id] = rng
+    ranges.m.Unlock()
+    rangesOpened.Inc()
+    mainLogger.Info("Range opened", "range", id)
+    return nil
+}
+
+func (ranges *Ranges) openingLock(id uint64) *sync.Mutex {
+    ranges.m.Lock()
+    defer ranges.m.Unlock()
+    lock, ok := ranges.opening[id]
+    if !ok {
+        lock = &sync.Mutex{}
+        ranges.opening[id] = lock
+    }
+    return lock
+}
+
+//called by the state machine of the split range, every replica creates the new range from the same snapshot
+func (ranges *Ranges) split(desc RangeDescriptor, snapshot *Snapshot) {
+    if err := ranges.ensure(desc.Id, snapshot); err != nil {
+        fatal(mainLogger, "Error while creating range", "range", desc.Id, "err", err)
+    }
+}
+
+func (ranges *Ranges) Get(id uint64) *Range {
+    ranges.m.RLock()
+    defer ranges.m.RUnlock()
+    return ranges.ranges[id]
+}
+
+//ordered by id
+func (ranges *Ranges) All() []*Range {
+    ranges.m.RLock()
+    defer ranges.m.RUnlock()
+
+    all := make([]*Range, 0, len(ranges.ranges))
+    for _, rng := range ranges.ranges {
+        all = append(all, rng)
+    }
+    slices.SortFunc(all, func(a, b *Range) int {
+        return cmp.Compare(a.Id, b.Id)
+    })
+    return all
+}
+
+//keys and values of all ranges
+func (ranges *Ranges) Size() (size int64, keys int) {
+    for _, rng := range ranges.All() {
+        rangeSize, rangeKeys := rng.db.Size()
+        size += rangeSize
+        keys += rangeKeys
+    }
+    return
+}
+
+//bytes the logs of all ranges take on this node
+func (ranges *Ranges) LogSize() (size int64) {
+    for _, rng := range ranges.All() {
+        rng.env.WithLock(func(env *TEnv) {
+            size += env.l.FileSize()
+        })
+    }
+    return
+}
+
+//the range with the greatest start not after the key, it may have split off the key already
+func (ranges *Ranges) lookup(key string) (found *Range) {
+    var start string
+    for _, rng := range ranges.All() {
+        desc := rng.db.Range()
+        if desc.Id == rng.Id && desc.Start <= key && (found == nil || desc.Start > start) {
+            found, start = rng, desc.Start
+        }
+    }
+    return
+}
+
+//splits the range holding the key so that the key starts a new range, runs on the leader of range 0
+func (ranges *Ranges) Split(ctx context.Context, key string) (RangeDescriptor, error) {
+    source := ranges.lookup(key)
+    desc := source.db.Range()
+    if !desc.Contains(key) {
+        return RangeDescriptor{}, ErrWrongRange
+    }
+    if key == desc.Start {
+        return RangeDescriptor{}, ErrRangeStart
+    }
+
+    result, err := ranges.Get(0).env.ApplyEntrySync(LogEntry{Op: INCREMENT, Key: rangeIdKey, Value: "1"})
+    if err != nil {
+        return RangeDescriptor{}, err
+    }
+    id, _ := strconv.ParseUint(result.Value, 10, 64)
+
+    var ok bool
+    if source.ext.isLeader() {
+        ok, err = source.proposeSplit(key, id)
+    } else {
+        ok, err = ranges.requestSplit(ctx, source, key, id)
+    }
+    if err != nil {
+        return RangeDescriptor{}, err
+    }
+    //another split moved the key in the meantime
+    if !ok {
+        return RangeDescriptor{}, ErrWrongRange
+    }
+    rangeSplits.Inc()
+    return RangeDescriptor{Id: id, Start: key, End: desc.End}, nil
+}
+
+func (ranges *Ranges) requestSplit(ctx context.Context, source *Range, key string, id uint64) (bool, error) {
+    var leaderId *uint64
+    source.env.WithLock(func(env *TEnv) {
+        leaderId = env.leaderId
+    })
+    if leaderId == nil {
+        return false, ErrNoRangeLeader
+    }
+
+    body, err := json.Marshal(SplitRequest{Key: key, Id: id})
+    if err != nil {
+        return false, err
+    }
+    uri := ranges.nodesConfig[*leaderId].InternalUri() + rangePrefix(source.Id) + "/split"
+    request, err := http.NewRequestWithContext(ctx, "POST", uri, bytes.NewReader(body))
+    if err != nil {
+        return false, err
+    }
+    resp, err := ranges.client.Do(request)
+    if err != nil {
+        return false, err
+    }
+    defer resp.Body.Close()
+    respBody, err := io.ReadAll(resp.Body)
+    if err != nil {
+        return false, err
+    }
+    if resp.StatusCode / 100 != 2 {
+        return false, fmt.Errorf("Split request to node %d failed with status %d: %s", *leaderId, resp.StatusCode, strings.TrimSpace(string(respBody)))
+    }
+
+    var response struct {
+        Ok bool `json:"ok"`
+    }
+    if err = json.Unmarshal(respBody, &response); err != nil {
+        return false, err
+    }
+    return response.Ok, nil
+}
+
+//GET /ranges on the internal port lists the ids of the ranges this node has replicas of
+func (ranges *Ranges) handleList(w http.ResponseWriter, r *http.Request) {
+    if r.Method != "GET" {
+        w.Header().Add("Allow", "GET")
+        w.WriteHeader(http.StatusMethodNotAllowed)
+        return
+    }
+
+    ids := []uint64{}
+    for _, rng := range ranges.All() {
+        ids = append(ids, rng.Id)
+    }
+    writeRaftResponse(w, ids)
+}
+
+//routes of range <id> on the internal port are served under /ranges/<id>
+func (ranges *Ranges) handleInternal(w http.ResponseWriter, r *http.Request) {
+    idStr, _, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/ranges/"), "/")
+    id, err := strconv.ParseUint(idStr, 10, 64)
+    var rng *Range
+    if err == nil && id != 0 {
+        rng = ranges.Get(id)
+    }
+    if rng == nil {
+        http.Error(w, "No such range", http.StatusNotFound)
+        return
+    }
+    http.StripPrefix(rangePrefix(id), rng.internal).ServeHTTP(w, r)
+}
+
+func (ranges *Ranges) fetchList(ctx context.Context, node NodeConfig) ([]uint64, error) {
+    request, err := http.NewRequestWithContext(ctx, "GET", node.InternalUri() + "/ranges", nil)
+    if err != nil {
+        return nil, err
+    }
+    resp, err := ranges.client.Do(request)
+    if err != nil {
+        return nil, err
+    }
+    defer resp.Body.Close()
+    if resp.StatusCode / 100 != 2 {
+        return nil, fmt.Errorf("Non Ok response %d", resp.StatusCode)
+    }
+    var ids []uint64
+    err = json.NewDecoder(resp.Body).Decode(&ids)
+    return ids, err
+}
+
+func (ranges *Ranges) timeout() time.Duration {
+    return 2 * time.Duration(int64(ranges.appConfig.HBTimeout)) * time.Millisecond
+}
+
+//a node that was down while a range was split opens an empty replica, the leader of the range sends it a snapshot
+func (ranges *Ranges) openMissing() {
+    for i, node := range ranges.nodesConfig {
+        if uint64(i) == ranges.nodeId {
+            continue
+        }
+        ctx, cancel := context.WithTimeout(ranges.raftCtx, ranges.timeout())
+        ids, err := ranges.fetchList(ctx, node)
+        cancel()
+        if err != nil {
+            mainLogger.Debug("Error while listing ranges of peer", "peer", i, "err", err)
+            continue
+        }
+        for _, id := range ids {
+            if ranges.Get(id) != nil {
+                continue
+            }
+            mainLogger.Info("Opening missing replica", "range", id, "peer", i)
+            if err := ranges.ensure(id, nil); err != nil {
+                mainLogger.Error("Error while opening missing replica", "range", id, "err", err)
+            }
+        }
+    }
+}
+
+func (ranges *Ranges) splitLarge() {
+    limit := ranges.appConfig.Ranges.SplitKeys
+    if limit == 0 || !ranges.Get(0).ext.isLeader() {
+        return
+    }
+
+    for _, rng := range ranges.All() {
+        _, keys := rng.db.Size()
+        if keys <= limit || !rng.ready() {
+            continue
+        }
+        key, ok := rng.db.middleKey()
+        if !ok {
+            continue
+        }
+        ctx, cancel := context.WithTimeout(ranges.raftCtx, ranges.timeout())
+        desc, err := ranges.Split(ctx, key)
+        cancel()
+        if err != nil {
+            mainLogger.Warn("Error while splitting range", "range", rng.Id, "keys", keys, "err", err)
+            continue
+        }
+        mainLogger.Info("Range split", "range", rng.Id, "new_range", desc.Id, "keys", keys)
+    }
+}
+
+//the leaders of the ranges besides range 0 change the roles that differ from range 0 one at a time
+func (ranges *Ranges) followRoles() {
+    all := ranges.All()
+    if len(all) < 2 {
+        return
+    }
+
+    roles := all[0].env.CommittedRoles()
+    for _, rng := range all[1:] {
+        if !rng.ext.isLeader() {
+            continue
+        }
+        ctx, cancel := context.WithTimeout(ranges.raftCtx, ranges.timeout())
+        if err := rng.followRoles(ctx, roles, ranges.nodeId); err != nil {
+            mainLogger.Warn("Error while following the roles of range 0", "range", rng.Id, "err", err)
+        }
+        cancel()
+    }
+}
+
+//proposes the first role change towards roles that this range allows now, with the same checks as
+//a change through /admin/members. The leader hands leadership over before its own role changes
+func (rng *Range) followRoles(ctx context.Context, roles []string, leaderId uint64) error {
+    node, role := -1, ""
+    var transfer bool
+    rng.env.WithLock(func(env *TEnv) {
+        if env.leaderState == nil || env.roleChangePending() {
+            return
+        }
+        for i, target := range roles {
+            current := env.roles[i]
+            switch {
+            case current == target:
+            case uint64(i) == leaderId:
+                transfer = true
+                return
+            //a removed node gets no entries, it catches up as a learner first
+            case target == RoleVoter && current == RoleRemoved:
+                node, role = i, RoleLearner
+                return
+            case target == RoleVoter && env.leaderState.MatchIndex[i] < env.commitIndex:
+            case current == RoleVoter && env.numVoters() - 1 < 2:
+            default:
+                node, role = i, target
+                return
+            }
+        }
+    })
+
+    if transfer {
+        rng.raft.TransferLeadershipTo(ctx, -1)
+        return nil
+    }
+    if node < 0 {
+        return nil
+    }
+    _, err := rng.env.ApplyEntryWithin(LogEntry{Op: SET_ROLE, Key: strconv.Itoa(node), Value: role}, rng.ext.commitTimeout)
+    if err == nil {
+        mainLogger.Info("Role changed to follow range 0", "range", rng.Id, "node", node, "role", role)
+    }
+    return err
+}
+
+//a single range keeps the leader it has, moving it would not spread any load
+func (ranges *Ranges) balanceLeaders() {
+    all := ranges.All()
+    if len(all) < 2 {
+        return
+    }
+
+    hbTimeout := time.Duration(int64(ranges.appConfig.HBTimeout)) * time.Millisecond
+    for _, rng := range all {
+        target, ok := rng.transferTarget(ranges.nodeId, hbTimeout)
+        if !ok {
+            continue
+        }
+        ctx, cancel := context.WithTimeout(ranges.raftCtx, ranges.timeout())
+        if rng.raft.TransferLeadershipTo(ctx, int(target)) {
+            mainLogger.Info("Leadership moved to preferred node", "range", rng.Id, "node", target)
+        }
+        cancel()
+    }
+}
+
+func (ranges *Ranges) periodicCheck() {
+    interval := time.Duration(int64(ranges.appConfig.Ranges.CheckIntervalMs)) * time.Millisecond
+    if interval == 0 {
+        interval = 5 * time.Second
+    }
+    ticker := time.NewTicker(interval)
+    defer ticker.Stop()
+
+    for {
+        select {
+        case <- ticker.C:
+            ranges.openMissing()
+            ranges.splitLarge()
+            ranges.followRoles()
+            ranges.balanceLeaders()
+        case <- ranges.raftCtx.Done():
+            return
+        }
+    }
+}
+
+var keyRoutes = []string{"/entry/", "/increment/", "/append/", "/upsert/"}
+
+//keys of POST /entry and POST /batch are in the body, which is left for the handler
+func bodyKeys(r *http.Request) ([]string, error) {
+    data, err := io.ReadAll(r.Body)
+    r.Body = io.NopCloser(bytes.NewReader(data))
+    if err != nil {
+        return nil, err
+    }
+
+    if r.URL.Path == "/entry" {
+        var request WriteRequest
+        if !isJsonBody(r) || json.Unmarshal(data, &request) != nil || request.Key == "" {
+            return nil, nil
+        }
+        return []string{request.Key}, nil
+    }
+
+    var request BatchRequest
+    if json.Unmarshal(data, &request) != nil {
+        return nil, nil
+    }
+    var keys []string
+    for _, op := range request.Ops {
+        if op.Key != "" {
+            keys = append(keys, op.Key)
+        }
+    }
+    return keys, nil
+}
+
+//returns zero code if the request may go to the range
+func (ranges *Ranges) route(r *http.Request) (*Range, int, string) {
+    path := r.URL.Path
+    if param := r.URL.Query().Get("range"); param != "" && (strings.HasPrefix(path, "/admin/") || path == "/status" || path == "/debug/raft") {
+        id, err := strconv.ParseUint(param, 10, 64)
+        if err != nil || ranges.Get(id) == nil {
+            return nil, http.StatusNotFound, "No such range"
+        }
+        return ranges.Get(id), 0, ""
+    }
+
+    var keys []string
+    for _, prefix := range keyRoutes {
+        if key, ok := getKeyWithPrefix(path, prefix); ok {
+            keys = []string{key}
+        }
+    }
+    if r.Method == "POST" && (path == "/entry" || path == "/batch") {
+        var err error
+        var tooLarge *http.MaxBytesError
+        if keys, err = bodyKeys(r); errors.As(err, &tooLarge) {
+            return nil, http.StatusRequestEntityTooLarge, fmt.Sprintf("Request body is longer than %d bytes", tooLarge.Limit)
+        }
+    }
+    if len(keys) == 0 {
+        return ranges.Get(0), 0, ""
+    }
+
+    rng := ranges.lookup(keys[0])
+    for _, key := range keys {
+        if ranges.lookup(key) != rng {
+            return nil, http.StatusUnprocessableEntity, "Keys of the batch belong to different ranges"
+        }
+        //the replica applied a split while the new range is being opened
+        if !rng.db.Range().Contains(key) && !isSystemKey(key) {
+            return nil, http.StatusServiceUnavailable, ErrWrongRange.Error()
+        }
+    }
+    return rng, 0, ""
+}
+
+//requests of the external API go to the range owning their key, everything else to range 0.
+//Admin and status requests take the range from the range parameter
+func (ranges *Ranges) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+    //keys are read from the body before the request is authorized
+    if limit := ranges.appConfig.Limits.maxBodySize(r.URL.Path); limit != 0 {
+        r.Body = http.MaxBytesReader(w, r.Body, limit)
+    }
+    rng, code, msg := ranges.route(r)
+    if code != 0 {
+        body := map[string]string{"error": msg}
+        if code == http.StatusServiceUnavailable {
+            w.Header().Set("Retry-After", "1")
+            body["code"] = codeWrongRange
+        }
+        writeJson(w, code, body)
+        return
+    }
+    rng.external.ServeHTTP(w, r)
+}
+
+func (state ExternalState) rootDb() *Db {
+    return state.ranges.root
+}
+
+type RangeStatus struct {
+    RangeDescriptor
+    LeaderId *uint64 `json:"leader_id"`
+    Ready bool `json:"ready"` //false until an empty replica gets the state of the range
+    AppliedIndex uint64 `json:"applied_index"`
+    Keys int `json:"keys"`
+    Size int64 `json:"size"`
+}
+
+//GET /admin/ranges returns the routing table of this node with the replicas it keeps
+func (state ExternalState) handleRanges(w http.ResponseWriter, r *http.Request) {
+    if r.Method != "GET" {
+        w.Header().Add("Allow", "GET")
+        w.WriteHeader(http.StatusMethodNotAllowed)
+        return
+    }
+
+    statuses := []RangeStatus{}
+    for _, rng := range state.ranges.All() {
+        status := RangeStatus{RangeDescriptor: rng.db.Range(), Ready: rng.ready(), AppliedIndex: rng.db.AppliedIndex()}
+        status.Id = rng.Id
+        status.Size, status.Keys = rng.db.Size()
+        rng.env.WithLock(func(env *TEnv) {
+            status.LeaderId = env.leaderId
+        })
+        statuses = append(statuses, status)
+    }
+    writeJson(w, http.StatusOK, statuses)
+}
+
+//POST /admin/ranges/split?key=<key> splits the range holding the key, the key starts the new range
+func (state ExternalState) handleSplit(w http.ResponseWriter, r *http.Request) {
+    if r.Method != "POST" {
+        w.Header().Add("Allow", "POST")
+        w.WriteHeader(http.StatusMethodNotAllowed)
+        return
+    }
+
+    //ids are handed out by range 0
+    root := state.ranges.Get(0).ext
+    if !root.isLeader() {
+        root.redirectToLeader(w, r)
+        return
+    }
+
+    key := r.URL.Query().Get("key")
+    if key == "" || isSystemKey(key) {
+        writeJson(w, http.StatusBadRequest, map[string]string{"error": "Invalid key"})
+        return
+    }
+
+    logger := requestLogger(extLogger, r)
+    ctx, cancel := context.WithTimeout(r.Context(), state.ranges.timeout())
+    defer cancel()
+    desc, err := state.ranges.Split(ctx, key)
+    if errors.Is(err, ErrRangeStart) {
+        writeJson(w, http.StatusConflict, map[string]string{"error": err.Error()})
+        return
+    } else if err != nil {
+        logger.Warn("Error while splitting range", "key", key, "err", err)
+        writeApplyError(w, err)
+        return
+    }
+    logger.Info("Range split", "range", desc.Id, "start", desc.Start, "end", desc.End)
+    writeJson(w, http.StatusOK, desc)
+}
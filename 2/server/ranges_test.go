@@ -0,0 +1,272 @@
+package main
+
+import (
+    "encoding/json"
+    "errors"
+    "net/http"
+    "net/http/httptest"
+    "net/url"
+    "path/filepath"
+    "slices"
+    "strings"
+    "testing"
+)
+
+//range 0 with keys on both sides of m and the space alarm, a system key
+func newSplitLog(t *testing.T) *testLog {
+    t.Helper()
+    log := newTestLog()
+    for _, key := range []string{"a", "l", "m", "x", "z"} {
+        if !log.commit(LogEntry{Op: CREATE, Key: key, Value: "value-" + key}).Ok {
+            t.Fatalf("Create of %s failed", key)
+        }
+    }
+    log.commit(LogEntry{Op: ALARM, Key: "nospace", Value: "on"})
+    return log
+}
+
+//commits the split of the log at key, returns the state machine of the new range restored from the split
+func (log *testLog) split(t *testing.T, key string, id string, roles []string) (*Db, *Snapshot) {
+    t.Helper()
+    var moved *Db
+    var snapshot *Snapshot
+    log.db.onSplit = func(desc RangeDescriptor, split *Snapshot) {
+        moved = newStateMachine(NewMemoryStorage())
+        moved.Restore(split)
+        snapshot = split
+    }
+    payload, _ := json.Marshal(roles)
+    if !log.commit(LogEntry{Op: RANGE_SPLIT, Key: key, Value: id, Payload: string(payload)}).Ok {
+        t.Fatalf("Split at %s was refused", key)
+    }
+    if moved == nil {
+        t.Fatalf("Split at %s created no range", key)
+    }
+    return moved, snapshot
+}
+
+func TestSplitMovesKeys(t *testing.T) {
+    log := newSplitLog(t)
+    moved, _ := log.split(t, "m", "1", nil)
+
+    if desc := log.db.Range(); desc != (RangeDescriptor{Id: 0, Start: "", End: "m"}) {
+        t.Fatalf("Split range has descriptor %+v", desc)
+    }
+    if desc := moved.Range(); desc != (RangeDescriptor{Id: 1, Start: "m", End: ""}) {
+        t.Fatalf("New range has descriptor %+v", desc)
+    }
+    for _, key := range []string{"a", "l", "m", "x", "z"} {
+        _, left := log.db.Get(key)
+        value, right := moved.Get(key)
+        if left == (key >= "m") || right != (key >= "m") {
+            t.Fatalf("Key %s is in the split range %v and in the new range %v", key, left, right)
+        }
+        if right && value != "value-" + key {
+            t.Fatalf("Key %s moved with value %q", key, value)
+        }
+    }
+    //system keys stay in range 0
+    if !log.db.NoSpaceAlarm() || moved.NoSpaceAlarm() {
+        t.Fatalf("Space alarm moved out of range 0")
+    }
+    _, left := log.db.Size()
+    _, right := moved.Size()
+    if left != 2 || right != 3 {
+        t.Fatalf("Split range counts %d keys and the new range %d", left, right)
+    }
+}
+
+//entries are appended before the split and committed after it, the keys are not in the range any more
+func TestSplitRefusesMovedKeys(t *testing.T) {
+    log := newSplitLog(t)
+    log.split(t, "m", "1", nil)
+
+    for _, entry := range []LogEntry{
+        {Op: UPSERT, Key: "x", Value: "late"},
+        {Op: CREATE, Key: "y", Value: "late"},
+        {Op: DELETE, Key: "z"},
+        {Op: INCREMENT, Key: "m", Value: "1"},
+    } {
+        if result := log.commit(entry); result.Ok || !errors.Is(result.Err, ErrWrongRange) {
+            t.Fatalf("Entry %v of %s returned %+v after the split", entry.Op, entry.Key, result)
+        }
+    }
+    if _, ok := log.db.Get("y"); ok {
+        t.Fatalf("Key created in the split range after the split")
+    }
+    if result := log.commit(LogEntry{Op: UPSERT, Key: "b", Value: "kept"}); !result.Ok {
+        t.Fatalf("Write of a key left in the range returned %+v", result)
+    }
+}
+
+func TestSplitRefusesBadKeys(t *testing.T) {
+    log := newSplitLog(t)
+    log.split(t, "m", "1", nil)
+
+    for _, entry := range []LogEntry{
+        {Op: RANGE_SPLIT, Key: "", Value: "2"}, //start of the range
+        {Op: RANGE_SPLIT, Key: "x", Value: "2"}, //outside of the range
+        {Op: RANGE_SPLIT, Key: noSpaceAlarmKey, Value: "2"},
+        {Op: RANGE_SPLIT, Key: "f", Value: "0"},
+        {Op: RANGE_SPLIT, Key: "f", Value: "two"},
+    } {
+        if log.commit(entry).Ok {
+            t.Fatalf("Split at %q with id %q was applied", entry.Key, entry.Value)
+        }
+    }
+    if desc := log.db.Range(); desc.End != "m" {
+        t.Fatalf("Refused split changed the descriptor to %+v", desc)
+    }
+}
+
+//a split in the middle leaves half of the user keys on each side, queue items are not counted
+func TestMiddleKey(t *testing.T) {
+    log := newSplitLog(t)
+    log.enqueue(t, "jobs", "a")
+    log.enqueue(t, "jobs", "b")
+    if key, ok := log.db.middleKey(); !ok || key != "m" {
+        t.Fatalf("Middle key is %q %v", key, ok)
+    }
+
+    //the only key starts the range, there is nothing to split off
+    moved, _ := newSplitLog(t).split(t, "z", "1", nil)
+    if key, ok := moved.middleKey(); ok {
+        t.Fatalf("Range with the start key alone has middle key %q", key)
+    }
+}
+
+//the replica of the new range starts with the roles of range 0 the split carries instead of the nodes config
+func TestSplitAdoptsRoles(t *testing.T) {
+    nodesConfig := NodesConfig{{}, {}, {}, {}}
+    roles := []string{RoleVoter, RoleRemoved, RoleVoter, RoleLearner}
+    log := newSplitLog(t)
+    _, snapshot := log.split(t, "m", "1", roles)
+    if !slices.Equal(snapshot.Roles, roles) {
+        t.Fatalf("Split carries roles %v, expected %v", snapshot.Roles, roles)
+    }
+
+    for _, test := range []struct {
+        roles []string
+        payload string
+        expected []string
+    }{
+        {roles, "", roles},
+        {nil, "", configRoles(nodesConfig)},
+        {nil, "not json", configRoles(nodesConfig)},
+    } {
+        split := newSplitLog(t)
+        var created *Snapshot
+        workdir := filepath.Join(t.TempDir(), "1")
+        split.db.onSplit = func(desc RangeDescriptor, snapshot *Snapshot) {
+            created = snapshot
+            if err := restoreWorkdir(workdir, snapshot); err != nil {
+                t.Fatal(err)
+            }
+        }
+        payload := test.payload
+        if test.roles != nil {
+            data, _ := json.Marshal(test.roles)
+            payload = string(data)
+        }
+        split.commit(LogEntry{Op: RANGE_SPLIT, Key: "m", Value: "1", Payload: payload})
+        if created == nil {
+            t.Fatalf("Split with roles %q created no range", payload)
+        }
+
+        //as Ranges.open does for the workdir of a new range
+        pState, err := NewPState(filepath.Join(workdir, "pstate.json"))
+        if err != nil {
+            t.Fatal(err)
+        }
+        raftLog, err := NewLog(filepath.Join(workdir, "log.json"))
+        if err != nil {
+            t.Fatal(err)
+        }
+        snapshots, restored, err := NewSnapshotStore(filepath.Join(workdir, "snapshot.json"))
+        if err != nil || restored == nil {
+            t.Fatalf("Snapshot of the new range %v: %v", restored, err)
+        }
+        env := NewEnv(pState, raftLog, snapshots, nodesConfig, 1)
+        env.RestoreSnapshot(restored)
+        restored.Close()
+        if committed := env.CommittedRoles(); !slices.Equal(committed, test.expected) {
+            t.Fatalf("New range with roles %q starts with roles %v, expected %v", payload, committed, test.expected)
+        }
+    }
+}
+
+//replicas of range 0 and of the range split off at m, the state machine of range 2 is not restored yet
+func newTestRanges(t *testing.T) *Ranges {
+    t.Helper()
+    log := newSplitLog(t)
+    moved, _ := log.split(t, "m", "1", nil)
+    return &Ranges{ranges: map[uint64]*Range{
+        0: {Id: 0, db: log.db},
+        1: {Id: 1, db: moved},
+        2: {Id: 2, db: newStateMachine(NewMemoryStorage())},
+    }}
+}
+
+func TestRouteByKey(t *testing.T) {
+    ranges := newTestRanges(t)
+
+    batch := func(keys ...string) string {
+        var request BatchRequest
+        for _, key := range keys {
+            request.Ops = append(request.Ops, BatchOp{Op: "upsert", WriteRequest: WriteRequest{Key: key}})
+        }
+        data, _ := json.Marshal(request)
+        return string(data)
+    }
+    for _, test := range []struct {
+        method string
+        target string
+        body string
+        rangeId uint64
+        code int
+    }{
+        {"GET", "/entry/a", "", 0, 0},
+        {"GET", "/entry/l", "", 0, 0},
+        {"GET", "/entry/m", "", 1, 0},
+        {"PUT", "/upsert/zz", "", 1, 0},
+        {"POST", "/increment/x", "", 1, 0},
+        {"POST", "/entry", `{"key":"x","value":"1"}`, 1, 0},
+        {"POST", "/entry", `{"key":"b","value":"1"}`, 0, 0},
+        {"POST", "/batch", batch("m", "n", "z"), 1, 0},
+        {"POST", "/batch", batch("a", "z"), 0, http.StatusUnprocessableEntity},
+        //system keys and requests without a key stay in range 0
+        {"POST", "/batch", batch("x", sysPrefix + "locks/a"), 0, http.StatusUnprocessableEntity},
+        {"GET", "/entry/" + url.PathEscape(sysPrefix + "locks/a"), "", 0, 0},
+        {"GET", "/status", "", 0, 0},
+        {"GET", "/admin/members?range=1", "", 1, 0},
+        {"GET", "/admin/members?range=2", "", 2, 0},
+        {"GET", "/admin/members?range=7", "", 0, http.StatusNotFound},
+        {"GET", "/entry/a?range=1", "", 0, 0},
+    } {
+        r := httptest.NewRequest(test.method, test.target, strings.NewReader(test.body))
+        rng, code, msg := ranges.route(r)
+        if code != test.code {
+            t.Fatalf("%s %s was routed with code %d %q, expected %d", test.method, test.target, code, msg, test.code)
+        }
+        if code == 0 && rng.Id != test.rangeId {
+            t.Fatalf("%s %s was routed to range %d, expected %d", test.method, test.target, rng.Id, test.rangeId)
+        }
+    }
+}
+
+//the replica of range 0 applied the split before the replica of the new range was opened
+func TestRouteDuringSplit(t *testing.T) {
+    ranges := newTestRanges(t)
+    delete(ranges.ranges, 1)
+
+    if rng := ranges.lookup("x"); rng == nil || rng.Id != 0 {
+        t.Fatalf("Key x was looked up in %+v", rng)
+    }
+    _, code, msg := ranges.route(httptest.NewRequest("GET", "/entry/x", nil))
+    if code != http.StatusServiceUnavailable || msg != ErrWrongRange.Error() {
+        t.Fatalf("Key of the range being opened was routed with %d %q", code, msg)
+    }
+    if rng, code, _ := ranges.route(httptest.NewRequest("GET", "/entry/a", nil)); code != 0 || rng.Id != 0 {
+        t.Fatalf("Key left in range 0 was routed with %d", code)
+    }
+}
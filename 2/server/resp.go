@@ -0,0 +1,762 @@
+package main
+
+import (
+    "bufio"
+    "context"
+    "crypto/tls"
+    "errors"
+    "fmt"
+    "io"
+    "log/slog"
+    "math"
+    "net"
+    "net/http"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+)
+
+//Redis protocol front-end. Commands are mapped onto the ops of the range owning their keys, writes on a
+//node that does not lead the range are answered with MOVED to the leader as redis-cli -c expects.
+//Pipelined writes are appended to the log one after another without waiting for each other to commit,
+//other commands wait for the writes before them, so replies keep the order of the commands
+
+const (
+    respMaxBulk = 512 << 20 //proto-max-bulk-len of Redis
+    respMaxArgs = 1024 * 1024
+    respMaxInline = 64 << 10
+    respMaxPending = 1024 //pipelined writes waiting to be applied per connection
+    //limits before AUTH, as in Redis
+    respMaxUnauthArgs = 10
+    respMaxUnauthBulk = 16 << 10
+)
+
+//error reply, kind is the first word of it, e.g. ERR or MOVED
+type respError struct {
+    kind string
+    msg string
+}
+
+func (err respError) Error() string {
+    return err.kind + " " + err.msg
+}
+
+var errRespSyntax = respError{"ERR", "Syntax error"}
+
+//a protocol error closes the connection after the reply
+type respProtocolError struct {
+    msg string
+}
+
+func (err respProtocolError) Error() string {
+    return "Protocol error: " + err.msg
+}
+
+type respCommand struct {
+    nargs [2]int //min and max number of arguments after the name, -1 for no limit
+    write bool //replies through propose, commands before it are not waited for
+    run func(session *respSession, args []string) error
+}
+
+var respCommands = map[string]respCommand{
+    "PING": {[2]int{0, 1}, false, (*respSession).ping},
+    "ECHO": {[2]int{1, 1}, false, (*respSession).echo},
+    "QUIT": {[2]int{0, 0}, false, (*respSession).quit},
+    "SELECT": {[2]int{1, 1}, false, (*respSession).selectDb},
+    "AUTH": {[2]int{1, 2}, false, (*respSession).auth},
+    "GET": {[2]int{1, 1}, false, (*respSession).get},
+    "SET": {[2]int{2, 3}, true, (*respSession).set},
+    "DEL": {[2]int{1, -1}, true, (*respSession).del},
+    "EXISTS": {[2]int{1, -1}, false, (*respSession).exists},
+    "INCR": {[2]int{1, 1}, true, (*respSession).incr},
+    "INCRBY": {[2]int{2, 2}, true, (*respSession).incrBy},
+    "DECR": {[2]int{1, 1}, true, (*respSession).decr},
+    "DECRBY": {[2]int{2, 2}, true, (*respSession).decrBy},
+    "CAS": {[2]int{3, 3}, true, (*respSession).cas},
+}
+
+//commands accepted before AUTH
+func respNoAuth(name string) bool {
+    name = strings.ToUpper(name)
+    return name == "AUTH" || name == "QUIT"
+}
+
+type RespServer struct {
+    Addr string
+    ranges *Ranges
+    nodes NodesConfig
+    tlsConfig *tls.Config
+    listener net.Listener
+    conns map[net.Conn]struct{}
+    closing bool
+    m sync.Mutex
+    wg sync.WaitGroup
+}
+
+func NewRespServer(ranges *Ranges, nodesConfig NodesConfig, nodeId uint64, certs *CertStore) *RespServer {
+    server := &RespServer{
+        Addr: fmt.Sprintf(":%d", nodesConfig[nodeId].RespPort),
+        ranges: ranges,
+        nodes: nodesConfig,
+        conns: make(map[net.Conn]struct{}),
+    }
+    if certs != nil {
+        server.tlsConfig = certs.ExternalServerConfig()
+    }
+    return server
+}
+
+//returns http.ErrServerClosed after Shutdown, like the http servers
+func (server *RespServer) ListenAndServe() error {
+    listener, err := net.Listen("tcp", server.Addr)
+    if err != nil {
+        return err
+    }
+    if server.tlsConfig != nil {
+        listener = tls.NewListener(listener, server.tlsConfig)
+    }
+
+    server.m.Lock()
+    if server.closing {
+        server.m.Unlock()
+        listener.Close()
+        return http.ErrServerClosed
+    }
+    server.listener = listener
+    server.m.Unlock()
+
+    var connId uint64
+    for {
+        conn, err := listener.Accept()
+        if errors.Is(err, net.ErrClosed) {
+            return http.ErrServerClosed
+        } else if err != nil {
+            respLogger.Warn("Error while accepting connection", "err", err)
+            time.Sleep(100 * time.Millisecond)
+            continue
+        }
+
+        server.m.Lock()
+        if server.closing {
+            server.m.Unlock()
+            conn.Close()
+            continue
+        }
+        server.conns[conn] = struct{}{}
+        server.wg.Add(1)
+        server.m.Unlock()
+
+        connId++
+        go server.serveConn(conn, connId)
+    }
+}
+
+//commands already read are answered, writes still waiting to be applied get TRYAGAIN. Connections are closed once ctx is done
+func (server *RespServer) Shutdown(ctx context.Context) error {
+    server.ranges.stopServing()
+    server.m.Lock()
+    server.closing = true
+    if server.listener != nil {
+        server.listener.Close()
+    }
+    //wakes up connections waiting for the next command
+    for conn := range server.conns {
+        conn.SetReadDeadline(time.Now())
+    }
+    server.m.Unlock()
+
+    done := make(chan struct{})
+    go func() {
+        server.wg.Wait()
+        close(done)
+    }()
+    select {
+    case <- done:
+        return nil
+    case <- ctx.Done():
+        server.m.Lock()
+        for conn := range server.conns {
+            conn.Close()
+        }
+        server.m.Unlock()
+        return ctx.Err()
+    }
+}
+
+//command whose reply is not written yet
+type respPending struct {
+    name string
+    start time.Time
+    wait func() error //writes the reply or returns the error to reply with
+}
+
+type respSession struct {
+    server *RespServer
+    logger *slog.Logger
+    reader *bufio.Reader
+    writer *bufio.Writer
+    token string //set by AUTH
+    pending []respPending
+    wait func() error //set by propose for the command being executed
+}
+
+func (server *RespServer) serveConn(conn net.Conn, connId uint64) {
+    defer server.wg.Done()
+    defer func() {
+        server.m.Lock()
+        delete(server.conns, conn)
+        server.m.Unlock()
+        conn.Close()
+    }()
+
+    session := &respSession{
+        server: server,
+        logger: respLogger.With("conn", connId, "remote", conn.RemoteAddr().String()),
+        reader: bufio.NewReaderSize(conn, respMaxInline),
+        writer: bufio.NewWriter(conn),
+    }
+    session.logger.Debug("Connection accepted")
+    for {
+        args, err := session.readCommand()
+        var protocolErr respProtocolError
+        var refused respError
+        quit := false
+        if errors.As(err, &protocolErr) {
+            session.logger.Info("Closing connection", "err", err)
+            session.drain()
+            session.writeError(respError{"ERR", protocolErr.Error()})
+            session.writer.Flush()
+            return
+        } else if errors.As(err, &refused) {
+            session.refuse(args[0], refused)
+        } else if err != nil {
+            //pipelined writes read before Shutdown are still answered
+            session.drain()
+            session.writer.Flush()
+            session.logger.Debug("Connection closed", "err", err)
+            return
+        } else if len(args) == 0 {
+            continue
+        } else {
+            quit = session.execute(args)
+        }
+        //pipelined commands are answered together
+        idle := session.reader.Buffered() == 0
+        if quit || idle || len(session.pending) >= respMaxPending {
+            session.drain()
+        }
+        if quit || idle {
+            if err := session.writer.Flush(); err != nil {
+                session.logger.Debug("Error while writing replies", "err", err)
+                return
+            }
+        }
+        if quit {
+            return
+        }
+    }
+}
+
+func (session *respSession) readLine() (string, error) {
+    line, err := session.reader.ReadSlice('\n')
+    if errors.Is(err, bufio.ErrBufferFull) {
+        return "", respProtocolError{"too big inline request"}
+    } else if err != nil {
+        return "", err
+    }
+    return strings.TrimSuffix(strings.TrimSuffix(string(line), "\n"), "\r"), nil
+}
+
+//arrays of bulk strings as clients send them, or inline commands typed in telnet. Before AUTH the limits are small
+//and only the name of a command is kept, a command other than AUTH is returned with its name and a NOAUTH error
+func (session *respSession) readCommand() ([]string, error) {
+    line, err := session.readLine()
+    if err != nil {
+        return nil, err
+    }
+    if !strings.HasPrefix(line, "*") {
+        return strings.Fields(line), nil
+    }
+
+    authenticated := session.authenticated()
+    n, err := strconv.Atoi(line[1:])
+    if err != nil || n > respMaxArgs {
+        return nil, respProtocolError{"invalid multibulk length"}
+    }
+    if !authenticated && n > respMaxUnauthArgs {
+        return nil, respProtocolError{"unauthenticated multibulk length"}
+    }
+    args := make([]string, 0, min(max(n, 0), 16))
+    for len(args) < n {
+        //the buffer grows as data arrives instead of trusting the length
+        var arg strings.Builder
+        if err := session.readBulk(&arg, authenticated); err != nil {
+            return nil, err
+        }
+        args = append(args, arg.String())
+
+        if !authenticated && len(args) == 1 && !respNoAuth(args[0]) {
+            for i := 1; i < n; i++ {
+                if err := session.readBulk(io.Discard, false); err != nil {
+                    return nil, err
+                }
+            }
+            return args, respError{"NOAUTH", "Authentication required"}
+        }
+    }
+    return args, nil
+}
+
+//copies a bulk string to w, its length is checked against the limits before it is read
+func (session *respSession) readBulk(w io.Writer, authenticated bool) error {
+    line, err := session.readLine()
+    if err != nil {
+        return err
+    }
+    if !strings.HasPrefix(line, "$") {
+        return respProtocolError{fmt.Sprintf("expected '$', got %q", line)}
+    }
+    size, err := strconv.Atoi(line[1:])
+    if err != nil || size < 0 || size > respMaxBulk {
+        return respProtocolError{"invalid bulk length"}
+    }
+    if !authenticated && size > respMaxUnauthBulk {
+        return respProtocolError{"unauthenticated bulk length"}
+    }
+    if limit := session.root().limits.maxBulkSize(); authenticated && limit != 0 && size > limit {
+        return respProtocolError{fmt.Sprintf("bulk string is longer than %d bytes", limit)}
+    }
+
+    if _, err := io.CopyN(w, session.reader, int64(size)); err != nil {
+        return err
+    }
+    if line, err = session.readLine(); err != nil {
+        return err
+    }
+    if line != "" {
+        return respProtocolError{"bulk string is longer than its length"}
+    }
+    return nil
+}
+
+func (session *respSession) writeSimple(s string) {
+    fmt.Fprintf(session.writer, "+%s\r\n", s)
+}
+
+func (session *respSession) writeError(err respError) {
+    //line breaks would end the reply early
+    msg := strings.NewReplacer("\r", " ", "\n", " ").Replace(err.msg)
+    fmt.Fprintf(session.writer, "-%s %s\r\n", err.kind, msg)
+}
+
+func (session *respSession) writeInt(n int64) {
+    fmt.Fprintf(session.writer, ":%d\r\n", n)
+}
+
+func (session *respSession) writeBulk(s string) {
+    fmt.Fprintf(session.writer, "$%d\r\n%s\r\n", len(s), s)
+}
+
+func (session *respSession) writeNil() {
+    session.writer.WriteString("$-1\r\n")
+}
+
+//returns true if the connection has to be closed
+func (session *respSession) execute(args []string) bool {
+    start := time.Now()
+    name := strings.ToUpper(args[0])
+    command, ok := respCommands[name]
+    nargs := len(args) - 1
+    //reads have to see the writes before them
+    if !command.write {
+        session.drain()
+    }
+
+    var err error
+    session.wait = nil
+    switch {
+    case !ok:
+        name = "unknown"
+        err = respError{"ERR", fmt.Sprintf("Unknown command '%s'", args[0])}
+    case nargs < command.nargs[0] || (command.nargs[1] >= 0 && nargs > command.nargs[1]):
+        err = respError{"ERR", fmt.Sprintf("Wrong number of arguments for '%s' command", strings.ToLower(name))}
+    case !respNoAuth(name) && !session.authenticated():
+        err = respError{"NOAUTH", "Authentication required"}
+    default:
+        err = command.run(session, args[1:])
+    }
+
+    wait := session.wait
+    if wait == nil {
+        wait = func() error {
+            return err
+        }
+    }
+    session.pending = append(session.pending, respPending{name: name, start: start, wait: wait})
+    if !command.write {
+        session.drain()
+    }
+    return ok && name == "QUIT"
+}
+
+//answers a command that was not read whole with err
+func (session *respSession) refuse(arg string, err error) {
+    name := strings.ToUpper(arg)
+    if _, ok := respCommands[name]; !ok {
+        name = "unknown"
+    }
+    session.drain()
+    session.pending = append(session.pending, respPending{name: name, start: time.Now(), wait: func() error {
+        return err
+    }})
+    session.drain()
+}
+
+//writes the replies of the pending commands in order
+func (session *respSession) drain() {
+    for _, pending := range session.pending {
+        result := "ok"
+        if err := pending.wait(); err != nil {
+            var reply respError
+            if !errors.As(err, &reply) {
+                reply = respError{"ERR", err.Error()}
+            }
+            session.writeError(reply)
+            result = strings.ToLower(reply.kind)
+        }
+        respCommandDuration.ObserveSince(pending.start, strings.ToLower(pending.name), result)
+        session.logger.Debug("Command executed", "command", pending.name, "result", result)
+    }
+    session.pending = session.pending[:0]
+}
+
+//appends the entries to the log, reply is called with their results once they are applied
+func (session *respSession) propose(rng *Range, entries []LogEntry, reply func(results []CommitResult)) error {
+    statusChans, err := rng.env.ProposeBatch(entries)
+    if err != nil {
+        return respApplyError(err)
+    }
+    //a new leader may never commit the entries, so the wait ends after the commit timeout or once the server shuts down
+    deadline := time.Now().Add(rng.ext.commitTimeout)
+    serving := rng.ext.serving
+    session.wait = func() error {
+        timer := time.NewTimer(time.Until(deadline))
+        defer timer.Stop()
+        results := make([]CommitResult, len(statusChans))
+        for i := range statusChans {
+            select {
+            case results[i] = <-statusChans[i]:
+            case <-timer.C:
+                return respApplyError(ErrCommitTimeout)
+            case <-serving.Done():
+                return respApplyError(ErrOutcomeUnknown)
+            }
+        }
+        for _, result := range results {
+            if result.Err != nil {
+                return respApplyError(result.Err)
+            }
+        }
+        reply(results)
+        return nil
+    }
+    return nil
+}
+
+func (session *respSession) authenticated() bool {
+    return !session.root().auth.Enabled || session.token != ""
+}
+
+//external state of range 0, which keeps users and the space alarm
+func (session *respSession) root() ExternalState {
+    return session.server.ranges.Get(0).ext
+}
+
+func (session *respSession) authorize(key string, access Access) error {
+    root := session.root()
+    if !root.auth.Enabled {
+        return nil
+    }
+    code, msg := root.tokenAccess(session.logger, session.token, key, access)
+    switch code {
+    case 0:
+        return nil
+    case http.StatusUnauthorized:
+        return respError{"NOAUTH", msg}
+    default:
+        return respError{"NOPERM", msg}
+    }
+}
+
+func (session *respSession) moved(rng *Range) error {
+    var leaderId *uint64
+    rng.env.WithLock(func(env *TEnv) {
+        leaderId = env.leaderId
+    })
+    if leaderId == nil {
+        return respError{"TRYAGAIN", ErrNoRangeLeader.Error()}
+    }
+    leader := session.server.nodes[*leaderId]
+    if leader.RespPort == 0 {
+        return respError{"ERR", fmt.Sprintf("Leader %d has no RESP listener", *leaderId)}
+    }
+    return respError{"MOVED", fmt.Sprintf("%d %s:%d", rng.Id, leader.Host, leader.RespPort)}
+}
+
+//range owning all keys, reads are served by this replica and writes only by the leader of the range
+func (session *respSession) route(keys []string, access Access) (*Range, error) {
+    var rng *Range
+    for _, key := range keys {
+        if key == "" || isSystemKey(key) {
+            return nil, respError{"ERR", "Invalid key"}
+        }
+        if err := session.authorize(key, access); err != nil {
+            return nil, err
+        }
+        found := session.server.ranges.lookup(key)
+        if rng != nil && found != rng {
+            return nil, respError{"CROSSSLOT", "Keys belong to different ranges"}
+        }
+        rng = found
+        //the replica applied a split while the new range is being opened
+        if !rng.db.Range().Contains(key) {
+            return nil, respError{"TRYAGAIN", ErrWrongRange.Error()}
+        }
+    }
+    if access >= AccessWrite && !rng.ext.isLeader() {
+        return nil, session.moved(rng)
+    }
+    return rng, nil
+}
+
+func checkRespWrite(rng *Range, key string, value string, creates bool) error {
+    code, msg := rng.ext.writeError(key, value, creates)
+    switch code {
+    case 0:
+        return nil
+    case http.StatusInsufficientStorage:
+        return respError{"OOM", msg}
+    default:
+        return respError{"ERR", msg}
+    }
+}
+
+func respApplyError(err error) error {
+    if errors.Is(err, ErrNotInteger) || errors.Is(err, ErrOverflow) {
+        return respError{"ERR", err.Error()}
+    }
+    return respError{"TRYAGAIN", err.Error()}
+}
+
+func (session *respSession) ping(args []string) error {
+    if len(args) == 1 {
+        session.writeBulk(args[0])
+    } else {
+        session.writeSimple("PONG")
+    }
+    return nil
+}
+
+func (session *respSession) echo(args []string) error {
+    session.writeBulk(args[0])
+    return nil
+}
+
+func (session *respSession) quit(args []string) error {
+    session.writeSimple("OK")
+    return nil
+}
+
+//there is a single database
+func (session *respSession) selectDb(args []string) error {
+    if args[0] != "0" {
+        return respError{"ERR", "DB index is out of range"}
+    }
+    session.writeSimple("OK")
+    return nil
+}
+
+//AUTH [username] token, the username has to be the one of the token if given. Root token is accepted with "default" only
+func (session *respSession) auth(args []string) error {
+    root := session.root()
+    if !root.auth.Enabled {
+        return respError{"ERR", "Authentication is disabled"}
+    }
+
+    token, username := args[len(args) - 1], "default"
+    if len(args) == 2 {
+        username = args[0]
+    }
+    valid := false
+    if root.auth.isRootToken(token) {
+        valid = username == "default"
+    } else if name, user := root.rootDb().UserByToken(token); user != nil {
+        valid = username == "default" || username == name
+    }
+    //a failed AUTH keeps the connection authenticated as before, as in Redis
+    if !valid {
+        return respError{"WRONGPASS", "Invalid username-token pair"}
+    }
+    session.token = token
+    session.writeSimple("OK")
+    return nil
+}
+
+func (session *respSession) get(args []string) error {
+    rng, err := session.route(args, AccessRead)
+    if err != nil {
+        return err
+    }
+    if item, found := rng.db.GetItem(args[0]); found {
+        session.writeBulk(item.Value)
+    } else {
+        session.writeNil()
+    }
+    return nil
+}
+
+//SET key value [NX|XX], NX and XX reply nil if the key exists or does not exist
+func (session *respSession) set(args []string) error {
+    key, value, op := args[0], args[1], UPSERT
+    if len(args) == 3 {
+        switch strings.ToUpper(args[2]) {
+        case "NX":
+            op = CREATE
+        case "XX":
+            op = UPDATE
+        default:
+            return errRespSyntax
+        }
+    }
+
+    rng, err := session.route(args[:1], AccessWrite)
+    if err != nil {
+        return err
+    }
+    _, exists := rng.db.Get(key)
+    if err := checkRespWrite(rng, key, value, op != UPDATE && !exists); err != nil {
+        return err
+    }
+
+    return session.propose(rng, []LogEntry{{Op: op, Key: key, Value: value,}}, func(results []CommitResult) {
+        if op != UPSERT && !results[0].Ok {
+            session.writeNil()
+        } else {
+            session.writeSimple("OK")
+        }
+    })
+}
+
+//keys are deleted in one batch, so they have to belong to one range and are limited like the ops of a batch
+func (session *respSession) del(args []string) error {
+    if limit := session.root().limits.maxBatchOps(); limit != 0 && len(args) > limit {
+        return respError{"ERR", fmt.Sprintf("DEL of more than %d keys", limit)}
+    }
+    rng, err := session.route(args, AccessWrite)
+    if err != nil {
+        return err
+    }
+
+    entries := make([]LogEntry, len(args))
+    for i, key := range args {
+        entries[i] = LogEntry{Op: DELETE, Key: key}
+    }
+    return session.propose(rng, entries, func(results []CommitResult) {
+        var deleted int64
+        for _, result := range results {
+            if result.Ok {
+                deleted++
+            }
+        }
+        session.writeInt(deleted)
+    })
+}
+
+//a key given several times is counted several times, as in Redis
+func (session *respSession) exists(args []string) error {
+    rng, err := session.route(args, AccessRead)
+    if err != nil {
+        return err
+    }
+    var found int64
+    for _, key := range args {
+        if _, ok := rng.db.Get(key); ok {
+            found++
+        }
+    }
+    session.writeInt(found)
+    return nil
+}
+
+func (session *respSession) increment(key string, delta int64) error {
+    rng, err := session.route([]string{key}, AccessWrite)
+    if err != nil {
+        return err
+    }
+    value := strconv.FormatInt(delta, 10)
+    _, exists := rng.db.Get(key)
+    if err := checkRespWrite(rng, key, value, !exists); err != nil {
+        return err
+    }
+
+    return session.propose(rng, []LogEntry{{Op: INCREMENT, Key: key, Value: value,}}, func(results []CommitResult) {
+        n, _ := strconv.ParseInt(results[0].Value, 10, 64)
+        session.writeInt(n)
+    })
+}
+
+func parseDelta(arg string) (int64, error) {
+    delta, err := strconv.ParseInt(arg, 10, 64)
+    if err != nil {
+        return 0, respError{"ERR", ErrNotInteger.Error()}
+    }
+    return delta, nil
+}
+
+func (session *respSession) incr(args []string) error {
+    return session.increment(args[0], 1)
+}
+
+func (session *respSession) incrBy(args []string) error {
+    delta, err := parseDelta(args[1])
+    if err != nil {
+        return err
+    }
+    return session.increment(args[0], delta)
+}
+
+func (session *respSession) decr(args []string) error {
+    return session.increment(args[0], -1)
+}
+
+func (session *respSession) decrBy(args []string) error {
+    delta, err := parseDelta(args[1])
+    if err != nil {
+        return err
+    }
+    if delta == math.MinInt64 {
+        return respError{"ERR", ErrOverflow.Error()}
+    }
+    return session.increment(args[0], -delta)
+}
+
+//CAS key expected value replies 1 if the value was replaced and 0 if the key is missing or has another value
+func (session *respSession) cas(args []string) error {
+    key, expected, value := args[0], args[1], args[2]
+    rng, err := session.route(args[:1], AccessWrite)
+    if err != nil {
+        return err
+    }
+    if err := checkRespWrite(rng, key, value, false); err != nil {
+        return err
+    }
+
+    return session.propose(rng, []LogEntry{{Op: CAS, Key: key, Value: value, PrevValue: expected,}}, func(results []CommitResult) {
+        if results[0].Ok {
+            session.writeInt(1)
+        } else {
+            session.writeInt(0)
+        }
+    })
+}
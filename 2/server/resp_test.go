@@ -0,0 +1,252 @@
+package main
+
+import (
+    "bufio"
+    "context"
+    "crypto/sha256"
+    "encoding/hex"
+    "errors"
+    "io"
+    "net"
+    "path/filepath"
+    "slices"
+    "strconv"
+    "strings"
+    "testing"
+    "time"
+)
+
+//leader of range 0 on a single node, appended entries are applied once commit is called
+type respTestNode struct {
+    server *RespServer
+    env *TEnv
+    stopServing context.CancelFunc
+}
+
+func newRespTestNode(t *testing.T, auth AuthConfig, limits LimitsConfig, commitTimeout time.Duration) *respTestNode {
+    t.Helper()
+    workdir := t.TempDir()
+    pState, err := NewPState(filepath.Join(workdir, "pstate.json"))
+    if err != nil {
+        t.Fatal(err)
+    }
+    raftLog, err := NewLog(filepath.Join(workdir, "log.json"))
+    if err != nil {
+        t.Fatal(err)
+    }
+    snapshots, _, err := NewSnapshotStore(filepath.Join(workdir, "snapshot.json"))
+    if err != nil {
+        t.Fatal(err)
+    }
+    nodesConfig := NodesConfig{{Host: "localhost"}}
+    env := NewEnv(pState, raftLog, snapshots, nodesConfig, 100)
+    env.leaderState = NewLeaderState(0, len(nodesConfig), 0)
+
+    ctx, cancel := context.WithCancel(context.Background())
+    t.Cleanup(cancel)
+    serving, stopServing := context.WithCancel(ctx)
+    db := NewDb(ctx, env.commitQueue, NewMemoryStorage())
+    ranges := &Ranges{nodesConfig: nodesConfig, root: db}
+    rng := &Range{Id: 0, env: &env, db: db}
+    rng.ext = ExternalState{env: &env, ctx: ctx, serving: serving, db: db, ranges: ranges, nodes: nodesConfig, auth: auth, limits: limits, commitTimeout: commitTimeout}
+    ranges.ranges = map[uint64]*Range{0: rng}
+
+    server := &RespServer{ranges: ranges, nodes: nodesConfig, conns: make(map[net.Conn]struct{})}
+    return &respTestNode{server: server, env: &env, stopServing: stopServing}
+}
+
+//applies the entries appended so far, as if a majority had them
+func (node *respTestNode) commit() {
+    node.env.WithLock(func(env *TEnv) {
+        if env.l.LastIndex() > env.commitIndex {
+            env.CommitChanges(env.l.LastIndex())
+        }
+    })
+}
+
+func (node *respTestNode) session(input string) *respSession {
+    return &respSession{
+        server: node.server,
+        logger: respLogger,
+        reader: bufio.NewReaderSize(strings.NewReader(input), respMaxInline),
+        writer: bufio.NewWriter(io.Discard),
+    }
+}
+
+//sends the commands in a single write and reads the replies until the connection is closed or n are read
+func (node *respTestNode) roundTrip(t *testing.T, commands string, n int) []string {
+    t.Helper()
+    client, conn := net.Pipe()
+    defer client.Close()
+    client.SetDeadline(time.Now().Add(5 * time.Second))
+    node.server.wg.Add(1)
+    go node.server.serveConn(conn, 1)
+    go client.Write([]byte(commands))
+
+    reader := bufio.NewReader(client)
+    var replies []string
+    for len(replies) < n {
+        line, err := reader.ReadString('\n')
+        if errors.Is(err, io.EOF) {
+            break
+        } else if err != nil {
+            t.Fatalf("Error after replies %q: %v", replies, err)
+        }
+        reply := strings.TrimSuffix(line, "\r\n")
+        //bulk strings are kept with their length
+        if size, err := strconv.Atoi(strings.TrimPrefix(reply, "$")); strings.HasPrefix(reply, "$") && err == nil && size >= 0 {
+            data := make([]byte, size + 2)
+            if _, err := io.ReadFull(reader, data); err != nil {
+                t.Fatal(err)
+            }
+            reply += " " + string(data[:size])
+        }
+        replies = append(replies, reply)
+    }
+    return replies
+}
+
+func bulkArray(args ...string) string {
+    var command strings.Builder
+    command.WriteString("*" + strconv.Itoa(len(args)) + "\r\n")
+    for _, arg := range args {
+        command.WriteString("$" + strconv.Itoa(len(arg)) + "\r\n" + arg + "\r\n")
+    }
+    return command.String()
+}
+
+func TestRespReadCommand(t *testing.T) {
+    rootToken := sha256.Sum256([]byte("secret"))
+    auth := AuthConfig{Enabled: true, RootTokenSha256: hex.EncodeToString(rootToken[:])}
+    limits := LimitsConfig{MaxValueSize: 100}
+    ping := bulkArray("PING")
+
+    for _, test := range []struct {
+        name string
+        auth AuthConfig
+        token string
+        input string
+        args []string
+        err string //start of the error, empty if the command is read whole
+    }{
+        {"array", AuthConfig{}, "", bulkArray("SET", "k", "v"), []string{"SET", "k", "v"}, ""},
+        {"binary bulk", AuthConfig{}, "", bulkArray("SET", "k", "a\r\nb\x00"), []string{"SET", "k", "a\r\nb\x00"}, ""},
+        {"empty bulk", AuthConfig{}, "", bulkArray("ECHO", ""), []string{"ECHO", ""}, ""},
+        {"empty array", AuthConfig{}, "", "*0\r\n", []string{}, ""},
+        {"null array", AuthConfig{}, "", "*-1\r\n", []string{}, ""},
+        {"inline", AuthConfig{}, "", "GET k\r\n", []string{"GET", "k"}, ""},
+        {"inline spaces", AuthConfig{}, "", "  set\tk   v \n", []string{"set", "k", "v"}, ""},
+        {"inline empty", AuthConfig{}, "", "\r\n", []string{}, ""},
+        {"inline too long", AuthConfig{}, "", strings.Repeat("a", respMaxInline + 1) + "\r\n", nil, "Protocol error: too big inline request"},
+        {"array length not a number", AuthConfig{}, "", "*x\r\n", nil, "Protocol error: invalid multibulk length"},
+        {"array too long", AuthConfig{}, "", "*" + strconv.Itoa(respMaxArgs + 1) + "\r\n", nil, "Protocol error: invalid multibulk length"},
+        {"simple string in array", AuthConfig{}, "", "*1\r\n+PING\r\n", nil, "Protocol error: expected '$'"},
+        {"bulk length not a number", AuthConfig{}, "", "*1\r\n$x\r\n", nil, "Protocol error: invalid bulk length"},
+        {"negative bulk length", AuthConfig{}, "", "*1\r\n$-1\r\n", nil, "Protocol error: invalid bulk length"},
+        {"bulk too long", AuthConfig{}, "", "*1\r\n$" + strconv.Itoa(respMaxBulk + 1) + "\r\n", nil, "Protocol error: invalid bulk length"},
+        {"bulk longer than its length", AuthConfig{}, "", "*1\r\n$3\r\nPINGX\r\n", nil, "Protocol error: bulk string is longer than its length"},
+        {"truncated array", AuthConfig{}, "", "*2\r\n$3\r\nGET\r\n", nil, "EOF"},
+        {"truncated bulk", AuthConfig{}, "", "*1\r\n$10\r\nPING", nil, "EOF"},
+        {"value size limit", auth, "secret", bulkArray("SET", "k", strings.Repeat("v", 101)), nil, "Protocol error: bulk string is longer than 100 bytes"},
+        {"value within limit", auth, "secret", bulkArray("SET", "k", strings.Repeat("v", 100)), []string{"SET", "k", strings.Repeat("v", 100)}, ""},
+        //before AUTH
+        {"auth", auth, "", bulkArray("AUTH", "secret"), []string{"AUTH", "secret"}, ""},
+        {"quit", auth, "", bulkArray("quit"), []string{"quit"}, ""},
+        {"inline before auth", auth, "", "GET k\r\n", []string{"GET", "k"}, ""},
+        {"command before auth", auth, "", bulkArray("SET", "k", "v"), []string{"SET"}, "NOAUTH"},
+        {"array too long before auth", auth, "", "*" + strconv.Itoa(respMaxUnauthArgs + 1) + "\r\n", nil, "Protocol error: unauthenticated multibulk length"},
+        {"bulk too long before auth", auth, "", "*2\r\n$4\r\nAUTH\r\n$" + strconv.Itoa(respMaxUnauthBulk + 1) + "\r\n", nil, "Protocol error: unauthenticated bulk length"},
+        {"arguments too long before auth", auth, "", "*2\r\n$3\r\nSET\r\n$" + strconv.Itoa(respMaxUnauthBulk + 1) + "\r\n", nil, "Protocol error: unauthenticated bulk length"},
+    } {
+        node := newRespTestNode(t, test.auth, limits, time.Second)
+        input := test.input
+        if test.err != "EOF" {
+            input += ping
+        }
+        session := node.session(input)
+        session.token = test.token
+        args, err := session.readCommand()
+
+        if test.err == "" && err != nil || test.err != "" && (err == nil || !strings.HasPrefix(err.Error(), test.err)) {
+            t.Fatalf("%s: read returned %v, expected error %q", test.name, err, test.err)
+        }
+        if test.args != nil && !slices.Equal(args, test.args) {
+            t.Fatalf("%s: read %q, expected %q", test.name, args, test.args)
+        }
+        var protocolErr respProtocolError
+        if errors.As(err, &protocolErr) || errors.Is(err, io.EOF) {
+            continue
+        }
+        //the whole command was read, the next one follows. Reading AUTH does not authenticate the session
+        next, err := session.readCommand()
+        var refused respError
+        if err != nil && !(errors.As(err, &refused) && refused.kind == "NOAUTH" && test.token == "") || !slices.Equal(next, []string{"PING"}) {
+            t.Fatalf("%s: next command read as %q: %v", test.name, next, err)
+        }
+    }
+}
+
+//replies come in the order of the commands, reads wait for the writes before them
+func TestRespPipeline(t *testing.T) {
+    node := newRespTestNode(t, AuthConfig{}, LimitsConfig{MaxUncommittedEntries: 2, MaxBatchOps: 2}, 5 * time.Second)
+    done := make(chan struct{})
+    defer close(done)
+    go func() {
+        for {
+            select {
+            case <- done:
+                return
+            case <- time.After(time.Millisecond):
+                node.commit()
+            }
+        }
+    }()
+
+    commands := "SET a 1\r\nINCR a\r\nGET a\r\n" + bulkArray("SET", "b", "x") + "EXISTS a b c\r\nDEL a b c\r\nDEL a b\r\nNOPE\r\nGET a\r\nQUIT\r\nPING\r\n"
+    expected := []string{
+        "+OK",
+        ":2",
+        "$1 2",
+        "+OK",
+        ":2",
+        "-ERR DEL of more than 2 keys",
+        ":2",
+        "-ERR Unknown command 'NOPE'",
+        "$-1",
+        "+OK",
+    }
+    if replies := node.roundTrip(t, commands, len(expected) + 1); !slices.Equal(replies, expected) {
+        t.Fatalf("Pipeline replied %q, expected %q", replies, expected)
+    }
+}
+
+//replies read before a protocol error are written before it and the connection is closed
+func TestRespProtocolError(t *testing.T) {
+    node := newRespTestNode(t, AuthConfig{}, LimitsConfig{}, time.Second)
+    replies := node.roundTrip(t, "PING\r\nECHO x\r\n*1\r\n$-5\r\nPING\r\n", 4)
+    expected := []string{"+PONG", "$1 x", "-ERR Protocol error: invalid bulk length"}
+    if !slices.Equal(replies, expected) {
+        t.Fatalf("Connection replied %q, expected %q", replies, expected)
+    }
+}
+
+//a write that is not applied is answered once the commit timeout passes or the server shuts down
+func TestRespWriteTimeout(t *testing.T) {
+    node := newRespTestNode(t, AuthConfig{}, LimitsConfig{}, 100 * time.Millisecond)
+    start := time.Now()
+    replies := node.roundTrip(t, "SET a 1\r\nPING\r\n", 2)
+    expected := []string{"-TRYAGAIN " + ErrCommitTimeout.Error(), "+PONG"}
+    if !slices.Equal(replies, expected) {
+        t.Fatalf("Unapplied write replied %q, expected %q", replies, expected)
+    }
+    if elapsed := time.Since(start); elapsed < 100 * time.Millisecond {
+        t.Fatalf("Write timed out after %v", elapsed)
+    }
+
+    node = newRespTestNode(t, AuthConfig{}, LimitsConfig{}, time.Hour)
+    time.AfterFunc(100 * time.Millisecond, node.stopServing)
+    replies = node.roundTrip(t, "SET a 1\r\n", 1)
+    if expected := []string{"-TRYAGAIN " + ErrOutcomeUnknown.Error()}; !slices.Equal(replies, expected) {
+        t.Fatalf("Write during shutdown replied %q, expected %q", replies, expected)
+    }
+}
@@ -0,0 +1,576 @@
+package main
+
+import (
+    "bufio"
+    "context"
+    "crypto/sha256"
+    "encoding/binary"
+    "encoding/hex"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "hash"
+    "io"
+    "io/fs"
+    "os"
+    "path/filepath"
+    "slices"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+)
+
+type SnapshotConfig struct {
+    LogEntries uint64 `json:"log_entries"` //a snapshot is taken once the log keeps this many applied entries, 0 disables automatic snapshots
+    CheckIntervalMs int `json:"check_interval_ms"`
+    InstallTimeoutMs int `json:"install_timeout_ms"` //for sending a snapshot to a follower that is behind the compacted log
+    LogBytes int64 `json:"log_bytes"` //a snapshot is also taken once the log file grows beyond this, defaults to a share of the space quota
+}
+
+//state machine after applying the log up to Index, system keys included.
+//Roles keep the membership at Index because the compacted SET_ROLE entries are lost.
+//The items are streamed from a storage view or a file and never held in memory together
+type Snapshot struct {
+    Index uint64 `json:"index"`
+    Term uint64 `json:"term"`
+    Roles []string `json:"roles"`
+    items ItemSource //nil for an empty state machine, items read from a file can be read once
+    closers []func() error
+}
+
+//calls f for the items in key order until it returns an error
+type ItemSource func(f func(key string, item Item) error) error
+
+func (item ItemResponse) item() Item {
+    value := string(item.ValueB64)
+    if item.Value != nil {
+        value = *item.Value
+    }
+    return Item{Value: value, ContentType: item.ContentType, Flags: item.Flags}
+}
+
+//items of the view from start while contains accepts them
+func viewItems(view StorageView, start string, contains func(key string) bool) ItemSource {
+    return func(f func(key string, item Item) error) (err error) {
+        view.Ascend(start, func(key string, item Item) bool {
+            if !contains(key) {
+                return false
+            }
+            err = f(key, item)
+            return err == nil
+        })
+        return
+    }
+}
+
+func allKeys(key string) bool {
+    return true
+}
+
+func (snapshot *Snapshot) Ascend(f func(key string, item Item) error) error {
+    if snapshot.items == nil {
+        return nil
+    }
+    return snapshot.items(f)
+}
+
+//releases the view or the file the items come from, nil is allowed
+func (snapshot *Snapshot) Close() error {
+    if snapshot == nil {
+        return nil
+    }
+    var err error
+    for _, closer := range snapshot.closers {
+        err = errors.Join(err, closer())
+    }
+    snapshot.closers = nil
+    return err
+}
+
+func writeHashString(h hash.Hash, s string) {
+    binary.Write(h, binary.LittleEndian, uint64(len(s)))
+    h.Write([]byte(s))
+}
+
+//hex sha256 of the items, equal on replicas that applied the same entries
+func (snapshot *Snapshot) Hash() (string, int, error) {
+    h := sha256.New()
+    items := 0
+    err := snapshot.Ascend(func(key string, item Item) error {
+        writeHashString(h, key)
+        writeHashString(h, item.Value)
+        writeHashString(h, item.ContentType)
+        binary.Write(h, binary.LittleEndian, item.Flags)
+        items += 1
+        return nil
+    })
+    return hex.EncodeToString(h.Sum(nil)), items, err
+}
+
+//the snapshot is one JSON object with the items last, so it is written and read one item at a time
+func writeSnapshot(w io.Writer, snapshot *Snapshot) (items int, err error) {
+    header, err := json.Marshal(snapshot)
+    if err != nil {
+        return 0, err
+    }
+    writer := bufio.NewWriter(w)
+    writer.Write(header[:len(header) - 1])
+    writer.WriteString(`,"items":[`)
+    err = snapshot.Ascend(func(key string, item Item) error {
+        value, valueB64 := jsonValue(item.Value)
+        data, err := json.Marshal(ItemResponse{Key: key, Value: value, ValueB64: valueB64, ContentType: item.ContentType, Flags: item.Flags})
+        if err != nil {
+            return err
+        }
+        if items > 0 {
+            writer.WriteString(",\n")
+        }
+        items += 1
+        _, err = writer.Write(data)
+        return err
+    })
+    if err != nil {
+        return items, err
+    }
+    writer.WriteString("]}")
+    return items, writer.Flush()
+}
+
+func expectDelim(decoder *json.Decoder, delim json.Delim) error {
+    token, err := decoder.Token()
+    if err != nil {
+        return err
+    }
+    if token != delim {
+        return fmt.Errorf("Expected %v, got %v", delim, token)
+    }
+    return nil
+}
+
+//calls field for the keys of the object until it returns stop, field decodes or skips the value.
+//Returns false if the object ended before
+func decodeFields(decoder *json.Decoder, field func(key string) (stop bool, err error)) (bool, error) {
+    if err := expectDelim(decoder, '{'); err != nil {
+        return false, err
+    }
+    for decoder.More() {
+        token, err := decoder.Token()
+        if err != nil {
+            return false, err
+        }
+        key, _ := token.(string)
+        if stop, err := field(key); stop || err != nil {
+            return stop, err
+        }
+    }
+    return false, expectDelim(decoder, '}')
+}
+
+func skipValue(decoder *json.Decoder) error {
+    var value json.RawMessage
+    return decoder.Decode(&value)
+}
+
+//decodes the fields before the items, the items are decoded from the decoder while they are iterated
+func readSnapshot(decoder *json.Decoder) (*Snapshot, error) {
+    snapshot := &Snapshot{}
+    hasItems, err := decodeFields(decoder, func(key string) (bool, error) {
+        switch key {
+        case "index":
+            return false, decoder.Decode(&snapshot.Index)
+        case "term":
+            return false, decoder.Decode(&snapshot.Term)
+        case "roles":
+            return false, decoder.Decode(&snapshot.Roles)
+        case "items":
+            return true, expectDelim(decoder, '[')
+        default:
+            return false, skipValue(decoder)
+        }
+    })
+    if err != nil || !hasItems {
+        return snapshot, err
+    }
+    snapshot.items = func(f func(key string, item Item) error) error {
+        for decoder.More() {
+            var item ItemResponse
+            if err := decoder.Decode(&item); err != nil {
+                return err
+            }
+            if err := f(item.Key, item.item()); err != nil {
+                return err
+            }
+        }
+        if err := expectDelim(decoder, ']'); err != nil {
+            return err
+        }
+        //a truncated snapshot misses the end of the object
+        for decoder.More() {
+            if _, err := decoder.Token(); err != nil {
+                return err
+            }
+            if err := skipValue(decoder); err != nil {
+                return err
+            }
+        }
+        return expectDelim(decoder, '}')
+    }
+    return snapshot, nil
+}
+
+//snapshot of the applied state, Term and Roles are left to the caller. The items are read from a view
+//of the storage, so applying entries goes on while they are read
+func (db *Db) Snapshot() *Snapshot {
+    db.applyM.Lock()
+    defer db.applyM.Unlock()
+    db.m.Lock()
+    defer db.m.Unlock()
+
+    view := db.data.View()
+    return &Snapshot{Index: db.appliedIndex.Load(), items: viewItems(view, "", allKeys), closers: []func() error{view.Close}}
+}
+
+//replaces the whole state, watchers of all keys are woken up
+func (db *Db) Restore(snapshot *Snapshot) {
+    db.m.Lock()
+    defer db.m.Unlock()
+
+    db.data.Clear()
+    db.size = 0
+    db.keys = 0
+    err := snapshot.Ascend(func(key string, item Item) error {
+        db.set(key, item)
+        return nil
+    })
+    if err != nil {
+        fatal(storageLogger, "Error while reading snapshot", "index", snapshot.Index, "err", err)
+    }
+    for key := range db.watchers {
+        db.notify(key)
+    }
+    db.indexQueues()
+    db.loadRange()
+    db.appliedIndex.Store(snapshot.Index)
+    if err := db.data.Commit(StorageState{Index: snapshot.Index, Size: db.size, Keys: db.keys}); err != nil {
+        fatal(storageLogger, "Error while writing state machine", "index", snapshot.Index, "err", err)
+    }
+}
+
+//rebuilds the ids of the queue items, which are ordered by id and whose keys sort the same way
+func (db *Db) indexQueues() {
+    db.queues = make(map[string][]uint64)
+    ascendPrefix(db.data, queuePrefix, func(key string, item Item) {
+        rest := strings.TrimPrefix(key, queuePrefix)
+        if strings.HasSuffix(rest, "/lease") {
+            return
+        }
+        slash := strings.LastIndex(rest, "/")
+        id, err := strconv.ParseUint(rest[slash + 1:], 10, 64)
+        if slash < 0 || err != nil {
+            dbLogger.Warn("Ignoring malformed queue item", "key", key)
+            return
+        }
+        db.queues[rest[:slash]] = append(db.queues[rest[:slash]], id)
+    })
+}
+
+//state machine that is not fed by a commit queue, for replaying entries
+func newStateMachine(storage Storage) *Db {
+    return &Db{data: storage, watchers: make(map[string]chan struct{}), queues: make(map[string][]uint64), done: make(chan struct{}),}
+}
+
+//applies entries that follow the base snapshot, which is nil for the beginning of the log, to the empty storage.
+//The storage is closed with the returned snapshot
+func replay(base *Snapshot, entries []LogEntry, storage Storage, closeStorage func() error) *Snapshot {
+    db := newStateMachine(storage)
+    var index uint64
+    if base != nil {
+        db.Restore(base)
+        index = base.Index
+    }
+    for _, entry := range entries {
+        index += 1
+        entry.index = index
+        db.CommitEntry(entry)
+        db.appliedIndex.Store(index)
+    }
+    snapshot := db.Snapshot()
+    snapshot.closers = append(snapshot.closers, closeStorage)
+    return snapshot
+}
+
+//the snapshot file is replaced atomically, the log is compacted only after it is written
+type SnapshotStore struct {
+    fileName string
+    index uint64 //of the stored snapshot
+    m sync.Mutex
+}
+
+//the loaded snapshot reads its items from the file until it is closed
+func NewSnapshotStore(fileName string) (*SnapshotStore, *Snapshot, error) {
+    store := &SnapshotStore{fileName: fileName}
+    snapshot, err := store.Load()
+    if snapshot != nil {
+        store.index = snapshot.Index
+    }
+    return store, snapshot, err
+}
+
+//returns nil if there is no snapshot yet, the items are read from the file until the snapshot is closed
+func (store *SnapshotStore) Load() (*Snapshot, error) {
+    return openSnapshot(store.fileName)
+}
+
+func openSnapshot(fileName string) (*Snapshot, error) {
+    file, err := os.Open(fileName)
+    if errors.Is(err, fs.ErrNotExist) {
+        return nil, nil
+    } else if err != nil {
+        return nil, err
+    }
+    snapshot, err := readSnapshot(json.NewDecoder(file))
+    if err != nil {
+        file.Close()
+        return nil, err
+    }
+    snapshot.closers = append(snapshot.closers, file.Close)
+    return snapshot, nil
+}
+
+//writes the snapshot next to the stored one, replace puts the file in its place
+func (store *SnapshotStore) write(snapshot *Snapshot) (string, int, error) {
+    file, err := os.CreateTemp(filepath.Dir(store.fileName), "snapshot-*")
+    if err != nil {
+        return "", 0, err
+    }
+    items, err := writeSnapshot(file, snapshot)
+    err = errors.Join(err, file.Sync(), file.Close())
+    if err != nil {
+        os.Remove(file.Name())
+        return "", 0, err
+    }
+    return file.Name(), items, nil
+}
+
+//the written file is removed instead if the stored snapshot is not older
+func (store *SnapshotStore) replace(fileName string, index uint64) error {
+    store.m.Lock()
+    defer store.m.Unlock()
+
+    if store.index >= index {
+        os.Remove(fileName)
+        return nil
+    }
+    if err := os.Rename(fileName, store.fileName); err != nil {
+        os.Remove(fileName)
+        return err
+    }
+    store.index = index
+    return nil
+}
+
+//returns the number of items written, nothing is written if the stored snapshot is not older
+func (store *SnapshotStore) Save(snapshot *Snapshot) (int, error) {
+    if store.Index() >= snapshot.Index {
+        return 0, nil
+    }
+    fileName, items, err := store.write(snapshot)
+    if err != nil {
+        return 0, err
+    }
+    return items, store.replace(fileName, snapshot.Index)
+}
+
+func (store *SnapshotStore) Index() uint64 {
+    store.m.Lock()
+    defer store.m.Unlock()
+    return store.index
+}
+
+//membership after the entries up to index, which must be in the log
+func (env *TEnv) rolesAt(index uint64) []string {
+    roles := slices.Clone(env.baseRoles())
+    for i := env.l.Offset + 1; i <= index; i++ {
+        applyRoleEntry(roles, env.l.Entry(i))
+    }
+    return roles
+}
+
+//continues from a snapshot loaded at startup, the state machine is restored by the caller
+func (env *TEnv) RestoreSnapshot(snapshot *Snapshot) {
+    env.WithLock(func(env *TEnv) {
+        //the node could stop between writing the snapshot and compacting the log
+        if !env.l.Contains(snapshot.Index) || env.l.Term(snapshot.Index) != snapshot.Term {
+            if err := env.l.Reset(snapshot.Index, snapshot.Term); err != nil {
+                fatal(storageLogger, "Error while rewriting log", "file", env.l.FilePath, "err", err)
+            }
+        } else if err := env.l.Compact(snapshot.Index); err != nil {
+            fatal(storageLogger, "Error while rewriting log", "file", env.l.FilePath, "err", err)
+        }
+        env.snapshotRoles = snapshot.Roles
+        env.refreshMembership()
+        env.commitIndex = snapshot.Index
+        env.lastApplied = snapshot.Index
+    })
+}
+
+//installs a snapshot sent by the leader and written to fileName by the store, must be called with the lock held
+func (env *TEnv) installSnapshot(snapshot *Snapshot, fileName string) {
+    if snapshot.Index <= env.commitIndex {
+        os.Remove(fileName)
+        return
+    }
+    //the file stays readable after it replaces the stored snapshot, even if a later one replaces it too
+    installed, err := openSnapshot(fileName)
+    if err == nil {
+        err = env.snapshots.replace(fileName, snapshot.Index)
+    }
+    if err != nil {
+        fatal(storageLogger, "Error while writing snapshot", "file", env.snapshots.fileName, "err", err)
+    }
+
+    pending := env.pendingProposals()
+    if env.l.Contains(snapshot.Index) && env.l.Term(snapshot.Index) == snapshot.Term {
+        err = env.l.Compact(snapshot.Index)
+    } else {
+        err = env.l.Reset(snapshot.Index, snapshot.Term)
+    }
+    if err != nil {
+        fatal(storageLogger, "Error while rewriting log", "file", env.l.FilePath, "err", err)
+    }
+    env.failDroppedProposals(pending)
+
+    env.snapshotRoles = snapshot.Roles
+    env.refreshMembership()
+    env.commitIndex = snapshot.Index
+    env.lastApplied = snapshot.Index
+    snapshotsInstalled.Inc()
+    env.commitQueue <- LogEntry{index: snapshot.Index, snapshot: installed}
+}
+
+type SnapshotInfo struct {
+    Index uint64 `json:"index"`
+    Term uint64 `json:"term"`
+    Items int `json:"items"`
+    Compacted uint64 `json:"compacted"` //entries dropped from the log
+}
+
+//snapshots the applied state and drops the log entries it covers
+func (env *TEnv) TakeSnapshot(db *Db) (info SnapshotInfo, err error) {
+    snapshot := db.Snapshot()
+    defer snapshot.Close()
+    var covered bool
+    env.WithLock(func(env *TEnv) {
+        if snapshot.Index <= env.l.Offset {
+            info = SnapshotInfo{Index: env.l.Offset, Term: env.l.Entries[0].Term}
+            return
+        }
+        covered = true
+        snapshot.Term = env.l.Term(snapshot.Index)
+        snapshot.Roles = env.rolesAt(snapshot.Index)
+    })
+    if !covered {
+        return
+    }
+
+    items, err := env.snapshots.Save(snapshot)
+    if err != nil {
+        return
+    }
+    //a disk engine that resumes from its own state on restart needs the log after the state only
+    if err = db.Sync(); err != nil {
+        return
+    }
+    snapshotsTaken.Inc()
+    info = SnapshotInfo{Index: snapshot.Index, Term: snapshot.Term, Items: items}
+    env.WithLock(func(env *TEnv) {
+        if snapshot.Index > env.l.Offset {
+            info.Compacted = snapshot.Index - env.l.Offset
+        }
+        err = env.l.Compact(snapshot.Index)
+    })
+    storageLogger.Info("Snapshot taken", "index", info.Index, "term", info.Term, "items", info.Items, "compacted", info.Compacted)
+    return
+}
+
+var ErrCompacted = errors.New("Index is compacted, use a later one")
+
+var ErrNotCommitted = errors.New("Index is not committed on this node yet")
+
+//state machine at index rebuilt from the snapshot and the log in a scratch storage of the configured engine,
+//0 means the current state. The caller closes the returned snapshot
+func (env *TEnv) StateAt(db *Db, index uint64, config StorageConfig) (*Snapshot, error) {
+    current := db.Snapshot()
+    if index == 0 || index == current.Index {
+        return current, nil
+    }
+    current.Close()
+
+    var base *Snapshot
+    var entries []LogEntry
+    var err error
+    env.WithLock(func(env *TEnv) {
+        if index > env.commitIndex {
+            err = ErrNotCommitted
+            return
+        }
+        if base, err = env.snapshots.Load(); err != nil {
+            return
+        }
+        var from uint64
+        if base != nil {
+            from = base.Index
+        }
+        if index < from || from < env.l.Offset {
+            err = ErrCompacted
+            return
+        }
+        entries = slices.Clone(env.l.Entries[from + 1 - env.l.Offset : index + 1 - env.l.Offset])
+    })
+    defer base.Close()
+    if err != nil {
+        return nil, err
+    }
+    storage, closeStorage, err := openScratchStorage(config, filepath.Dir(env.snapshots.fileName))
+    if err != nil {
+        return nil, err
+    }
+    return replay(base, entries, storage, closeStorage), nil
+}
+
+func periodicSnapshot(ctx context.Context, env *TEnv, db *Db, config SnapshotConfig) {
+    if config.LogEntries == 0 && config.LogBytes == 0 {
+        return
+    }
+
+    interval := time.Duration(int64(config.CheckIntervalMs)) * time.Millisecond
+    if interval == 0 {
+        interval = 10 * time.Second
+    }
+    ticker := time.NewTicker(interval)
+    defer ticker.Stop()
+
+    for {
+        select {
+        case <- ticker.C:
+            var offset uint64
+            var logSize int64
+            env.WithLock(func(env *TEnv) {
+                offset = env.l.Offset
+                logSize = env.l.FileSize()
+            })
+            applied := db.AppliedIndex()
+            entriesDue := config.LogEntries != 0 && applied >= offset + config.LogEntries
+            bytesDue := config.LogBytes != 0 && logSize > config.LogBytes && applied > offset
+            if !entriesDue && !bytesDue {
+                continue
+            }
+            if _, err := env.TakeSnapshot(db); err != nil {
+                storageLogger.Error("Error while taking snapshot", "err", err)
+            }
+        case <- ctx.Done():
+            return
+        }
+    }
+}
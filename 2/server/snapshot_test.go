@@ -0,0 +1,84 @@
+package main
+
+import (
+    "bytes"
+    "encoding/json"
+    "fmt"
+    "testing"
+)
+
+func testSnapshot(n int) *Snapshot {
+    storage := NewMemoryStorage()
+    for i := 0; i < n; i++ {
+        storage.Put(fmt.Sprintf("key/%03d", i), Item{Value: fmt.Sprintf("value-%d", i), Flags: uint64(i)})
+    }
+    storage.Put("binary", Item{Value: "\xff\x00"})
+    return &Snapshot{Index: 10, Term: 3, Roles: []string{RoleVoter, RoleLearner}, items: viewItems(storage, "", allKeys)}
+}
+
+func TestSnapshotRoundTrip(t *testing.T) {
+    var buffer bytes.Buffer
+    written, err := writeSnapshot(&buffer, testSnapshot(100))
+    if err != nil || written != 101 {
+        t.Fatalf("Wrote %d items: %v", written, err)
+    }
+    //the stream is a plain JSON object
+    if !json.Valid(buffer.Bytes()) {
+        t.Fatalf("Snapshot is not valid JSON")
+    }
+
+    snapshot, err := readSnapshot(json.NewDecoder(bytes.NewReader(buffer.Bytes())))
+    if err != nil {
+        t.Fatal(err)
+    }
+    if snapshot.Index != 10 || snapshot.Term != 3 || len(snapshot.Roles) != 2 {
+        t.Fatalf("Unexpected header %+v", snapshot)
+    }
+    expected, _, _ := testSnapshot(100).Hash()
+    hash, items, err := snapshot.Hash()
+    if err != nil || items != 101 || hash != expected {
+        t.Fatalf("Read %d items with hash %s, expected %s: %v", items, hash, expected, err)
+    }
+}
+
+func TestSnapshotTruncated(t *testing.T) {
+    var buffer bytes.Buffer
+    if _, err := writeSnapshot(&buffer, testSnapshot(10)); err != nil {
+        t.Fatal(err)
+    }
+    data := buffer.Bytes()
+    for _, size := range []int{len(data) - 1, len(data) - 2, bytes.LastIndexByte(data, '\n') + 1} {
+        snapshot, err := readSnapshot(json.NewDecoder(bytes.NewReader(data[:size])))
+        if err == nil {
+            _, _, err = snapshot.Hash()
+        }
+        if err == nil {
+            t.Fatalf("Snapshot truncated to %d of %d bytes was read", size, len(data))
+        }
+    }
+}
+
+//items are read from the end of the object whatever the order of the other fields
+func TestSnapshotFieldOrder(t *testing.T) {
+    data := `{"term":2,"extra":{"a":[1]},"index":5,"roles":null,"items":[{"key":"a","value":"1"},{"key":"b","value_b64":"/w=="}]}`
+    snapshot, err := readSnapshot(json.NewDecoder(bytes.NewReader([]byte(data))))
+    if err != nil {
+        t.Fatal(err)
+    }
+    if snapshot.Index != 5 || snapshot.Term != 2 {
+        t.Fatalf("Unexpected header %+v", snapshot)
+    }
+    var keys []string
+    err = snapshot.Ascend(func(key string, item Item) error {
+        keys = append(keys, key + "=" + item.Value)
+        return nil
+    })
+    if err != nil || fmt.Sprint(keys) != "[a=1 b=\xff]" {
+        t.Fatalf("Read %q: %v", keys, err)
+    }
+
+    empty, err := readSnapshot(json.NewDecoder(bytes.NewReader([]byte(`{"index":0}`))))
+    if err != nil || empty.Ascend(func(string, Item) error { return nil }) != nil {
+        t.Fatalf("Snapshot without items was not read: %v", err)
+    }
+}
@@ -3,7 +3,6 @@ package main
 import (
     "os"
     "encoding/json"
-    "log"
     "errors"
     "io/fs"
 )
@@ -35,24 +34,28 @@ func NewPState(fileName string) (state PState, err error) {
 func (state *PState)SetCurrentTerm (curr uint64) {
     state.State.CurrentTerm = curr
     if err := state.DumpPState(); err != nil {
-        log.Fatal(err)
+        fatal(storageLogger, "Error while writing pstate", "file", state.FileName, "err", err)
     }
 }
 
 func (state *PState)ResetVote () {
     state.State.VotedFor = nil
     if err := state.DumpPState(); err != nil {
-        log.Fatal(err)
+        fatal(storageLogger, "Error while writing pstate", "file", state.FileName, "err", err)
     }
 }
 
 func (state *PState)SetVote (vote uint64) {
     state.State.VotedFor = &vote
     if err := state.DumpPState(); err != nil {
-        log.Fatal(err)
+        fatal(storageLogger, "Error while writing pstate", "file", state.FileName, "err", err)
     }
 }
 
+func (state PState) Sync() error {
+    return syncFile(state.FileName)
+}
+
 func (state PState) DumpPState() error {
     name, err := func() (string, error) {
         file, err := os.CreateTemp("", "*")
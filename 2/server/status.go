@@ -0,0 +1,133 @@
+package main
+
+import (
+    "net/http"
+    "encoding/json"
+    "time"
+)
+
+type PeerStatus struct {
+    NodeId uint64 `json:"node_id"`
+    NextIndex uint64 `json:"next_index"`
+    MatchIndex uint64 `json:"match_index"`
+    Learner bool `json:"learner"`
+    SinceLastHBMs *int64 `json:"since_last_hb_ms"` //nil if there was no successful hb yet
+}
+
+type LogEntryStatus struct {
+    Index uint64 `json:"index"`
+    Term uint64 `json:"term"`
+    Op int `json:"op"`
+    Key string `json:"key"`
+}
+
+type DebugStatus struct {
+    SinceLeaderHBMs *int64 `json:"since_leader_hb_ms"`
+    CommitQueueLen int `json:"commit_queue_len"`
+    CommitQueueCap int `json:"commit_queue_cap"`
+    LogTail []LogEntryStatus `json:"log_tail"`
+}
+
+type NodeStatus struct {
+    NodeId uint64 `json:"node_id"`
+    Role string `json:"role"`
+    CurrentTerm uint64 `json:"current_term"`
+    VotedFor *uint64 `json:"voted_for"`
+    LeaderId *uint64 `json:"leader_id"`
+    CommitIndex uint64 `json:"commit_index"`
+    LastApplied uint64 `json:"last_applied"`
+    LogLength int `json:"log_length"`
+    SnapshotIndex uint64 `json:"snapshot_index"` //entries up to it are compacted
+    Peers []PeerStatus `json:"peers,omitempty"`
+    Debug *DebugStatus `json:"debug,omitempty"`
+}
+
+const debugLogTailSize = 20
+
+func sinceMs(t time.Time) *int64 {
+    if t.IsZero() {
+        return nil
+    }
+    ms := time.Since(t).Milliseconds()
+    return &ms
+}
+
+func (env *TEnv) Status(nodeId uint64, debug bool) (status NodeStatus) {
+    env.WithLock(func(env *TEnv) {
+        status = NodeStatus{
+            NodeId: nodeId,
+            Role: "follower",
+            CurrentTerm: env.p.State.CurrentTerm,
+            VotedFor: env.p.State.VotedFor,
+            LeaderId: env.leaderId,
+            CommitIndex: env.commitIndex,
+            LastApplied: env.lastApplied,
+            LogLength: int(env.l.LastIndex() + 1),
+            SnapshotIndex: env.l.Offset,
+        }
+
+        if !env.isVoter(nodeId) {
+            status.Role = env.roles[nodeId]
+        }
+
+        if env.leaderState != nil {
+            status.Role = "leader"
+            for i := range env.leaderState.NextIndex {
+                if uint64(i) == nodeId {
+                    continue
+                }
+                status.Peers = append(status.Peers, PeerStatus{
+                    NodeId: uint64(i),
+                    NextIndex: env.leaderState.NextIndex[i],
+                    MatchIndex: env.leaderState.MatchIndex[i],
+                    Learner: !env.isVoter(uint64(i)),
+                    SinceLastHBMs: sinceMs(env.leaderState.LastContact[i]),
+                })
+            }
+        }
+
+        if !debug {
+            return
+        }
+
+        status.Debug = &DebugStatus{
+            SinceLeaderHBMs: sinceMs(env.lastHB),
+            CommitQueueLen: len(env.commitQueue),
+            CommitQueueCap: cap(env.commitQueue),
+        }
+        first := env.l.Offset + 1
+        if env.l.LastIndex() > debugLogTailSize {
+            first = max(first, env.l.LastIndex() - debugLogTailSize + 1)
+        }
+        for i := first; i <= env.l.LastIndex(); i++ {
+            entry := env.l.Entry(i)
+            status.Debug.LogTail = append(status.Debug.LogTail, LogEntryStatus{i, entry.Term, entry.Op, entry.Key})
+        }
+    })
+    return
+}
+
+func writeJson(w http.ResponseWriter, code int, v any) {
+    resp, err := json.Marshal(v)
+    if err != nil {
+        fatal(extLogger, "Error while marshaling response", "err", err)
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(code)
+    n, err := w.Write(resp)
+    if err != nil || n < len(resp) {
+        extLogger.Warn("Error while writing response", "err", err, "written", n)
+    }
+}
+
+func handleStatus(env *TEnv, nodeId uint64, debug bool) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        if r.Method != "GET" {
+            w.Header().Add("Allow", "GET")
+            w.WriteHeader(http.StatusMethodNotAllowed)
+            return
+        }
+        writeJson(w, http.StatusOK, env.Status(nodeId, debug))
+    }
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+    "errors"
+    "fmt"
+    "maps"
+    "os"
+    "path/filepath"
+    "sort"
+    "strings"
+)
+
+//directory of the disk engine inside the workdir
+const storageDir = "data"
+
+type StorageConfig struct {
+    Engine string `json:"engine"` //memory or lsm, memory by default
+    MemtableBytes int64 `json:"memtable_bytes"` //changes kept in memory before they are written to a table, 4MB by default
+}
+
+//what the state machine keeps next to the data, a durable engine returns the last committed one on open
+type StorageState struct {
+    Index uint64 `json:"index"` //last applied log entry
+    Size int64 `json:"size"`
+    Keys int `json:"keys"`
+}
+
+//ordered key value store behind Db. Reads may run concurrently, writes are serialized by Db.m.
+//Read errors of durable engines are fatal, the data can not be trusted after them
+type Storage interface {
+    Get(key string) (Item, bool)
+    Put(key string, item Item)
+    Delete(key string)
+    //calls f for the keys from start in order until it returns false
+    Ascend(start string, f func(key string, item Item) bool)
+    //drops all keys, a durable engine forgets them only at the next Commit
+    Clear()
+    //the changes and the state become durable together, the engine decides when, at the latest on Close
+    Commit(state StorageState) error
+    //makes the last committed state durable now
+    Sync() error
+    State() StorageState
+    //copy of the data that later writes do not change, read without Db.m. Taken with Db.m held for writing
+    View() StorageView
+    Close() error
+}
+
+//items of a storage at the moment the view was taken, must be closed
+type StorageView interface {
+    Ascend(start string, f func(key string, item Item) bool)
+    Close() error
+}
+
+func OpenStorage(config StorageConfig, workdir string) (Storage, error) {
+    switch config.Engine {
+    case "", "memory":
+        return NewMemoryStorage(), nil
+    case "lsm":
+        return OpenLsm(filepath.Join(workdir, storageDir), config)
+    default:
+        return nil, fmt.Errorf("Unknown storage engine %q", config.Engine)
+    }
+}
+
+//workdirs of states rebuilt from the log, left behind if the node stopped while rebuilding
+const scratchPattern = "replay-*"
+
+//empty storage of the configured engine inside workdir, the returned function closes and removes it
+func openScratchStorage(config StorageConfig, workdir string) (Storage, func() error, error) {
+    if config.Engine == "" || config.Engine == "memory" {
+        storage := NewMemoryStorage()
+        return storage, storage.Close, nil
+    }
+    dir, err := os.MkdirTemp(workdir, scratchPattern)
+    if err != nil {
+        return nil, nil, err
+    }
+    storage, err := OpenStorage(config, dir)
+    if err != nil {
+        os.RemoveAll(dir)
+        return nil, nil, err
+    }
+    return storage, func() error { return errors.Join(storage.Close(), os.RemoveAll(dir)) }, nil
+}
+
+func removeScratchStorages(workdir string) {
+    dirs, _ := filepath.Glob(filepath.Join(workdir, scratchPattern))
+    for _, dir := range dirs {
+        storageLogger.Warn("Removing unused storage", "dir", dir)
+        os.RemoveAll(dir)
+    }
+}
+
+//continues after the entries a durable state machine applied before the restart,
+//returns false if the log does not have them anymore
+func (env *TEnv) ResumeApplied(index uint64) (ok bool) {
+    env.WithLock(func(env *TEnv) {
+        if index > env.l.LastIndex() {
+            return
+        }
+        ok = true
+        if index > env.lastApplied {
+            env.lastApplied = index
+            env.commitIndex = max(env.commitIndex, index)
+        }
+    })
+    return
+}
+
+//everything is lost on restart and rebuilt from the snapshot and the log
+type MemoryStorage struct {
+    data map[string]Item
+}
+
+func NewMemoryStorage() *MemoryStorage {
+    return &MemoryStorage{data: make(map[string]Item)}
+}
+
+func (storage *MemoryStorage) Get(key string) (Item, bool) {
+    item, ok := storage.data[key]
+    return item, ok
+}
+
+func (storage *MemoryStorage) Put(key string, item Item) {
+    storage.data[key] = item
+}
+
+func (storage *MemoryStorage) Delete(key string) {
+    delete(storage.data, key)
+}
+
+func (storage *MemoryStorage) Ascend(start string, f func(key string, item Item) bool) {
+    keys := make([]string, 0, len(storage.data))
+    for key := range storage.data {
+        if key >= start {
+            keys = append(keys, key)
+        }
+    }
+    sort.Strings(keys)
+    for _, key := range keys {
+        if !f(key, storage.data[key]) {
+            return
+        }
+    }
+}
+
+func (storage *MemoryStorage) Clear() {
+    storage.data = make(map[string]Item)
+}
+
+func (storage *MemoryStorage) Commit(state StorageState) error {
+    return nil
+}
+
+func (storage *MemoryStorage) Sync() error {
+    return nil
+}
+
+func (storage *MemoryStorage) State() StorageState {
+    return StorageState{}
+}
+
+//the data is in memory anyway, so the view is a copy of it
+func (storage *MemoryStorage) View() StorageView {
+    return &MemoryStorage{data: maps.Clone(storage.data)}
+}
+
+func (storage *MemoryStorage) Close() error {
+    return nil
+}
+
+//calls f for the keys with the prefix in order
+func ascendPrefix(storage Storage, prefix string, f func(key string, item Item)) {
+    storage.Ascend(prefix, func(key string, item Item) bool {
+        if !strings.HasPrefix(key, prefix) {
+            return false
+        }
+        f(key, item)
+        return true
+    })
+}
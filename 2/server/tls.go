@@ -0,0 +1,273 @@
+package main
+
+import (
+    "context"
+    "crypto/tls"
+    "crypto/x509"
+    "errors"
+    "fmt"
+    "net"
+    "net/http"
+    "os"
+    "slices"
+    "strconv"
+    "strings"
+    "sync/atomic"
+    "time"
+)
+
+type TLSConfig struct {
+    CertFile string `json:"cert_file"` //{node_id} is replaced with the id of the node, each node needs its own certificate
+    KeyFile string `json:"key_file"`
+    CAFile string `json:"ca_file"` //cluster CA, used for mTLS on the internal port
+    ExternalClientAuth bool `json:"external_client_auth"` //require client certs signed by the cluster CA on the external port
+    ReloadIntervalMs int `json:"reload_interval_ms"`
+}
+
+func (config TLSConfig) Enabled() bool {
+    return config.CertFile != ""
+}
+
+func (config TLSConfig) ForNode(nodeId uint64) TLSConfig {
+    id := strconv.FormatUint(nodeId, 10)
+    config.CertFile = strings.ReplaceAll(config.CertFile, "{node_id}", id)
+    config.KeyFile = strings.ReplaceAll(config.KeyFile, "{node_id}", id)
+    return config
+}
+
+//keeps the node certificate and the cluster CA, reloads them when files change
+type CertStore struct {
+    config TLSConfig
+    cert atomic.Pointer[tls.Certificate]
+    pool atomic.Pointer[x509.CertPool]
+    modTimes map[string]time.Time
+}
+
+func NewCertStore(config TLSConfig) (*CertStore, error) {
+    if config.KeyFile == "" || config.CAFile == "" {
+        return nil, errors.New("key_file and ca_file are required when cert_file is set")
+    }
+
+    store := &CertStore{config: config, modTimes: make(map[string]time.Time)}
+    if err := store.load(); err != nil {
+        return nil, err
+    }
+    return store, nil
+}
+
+func (store *CertStore) files() []string {
+    return []string{store.config.CertFile, store.config.KeyFile, store.config.CAFile}
+}
+
+func (store *CertStore) load() error {
+    modTimes := make(map[string]time.Time)
+    for _, fileName := range store.files() {
+        info, err := os.Stat(fileName)
+        if err != nil {
+            return err
+        }
+        modTimes[fileName] = info.ModTime()
+    }
+
+    cert, err := tls.LoadX509KeyPair(store.config.CertFile, store.config.KeyFile)
+    if err != nil {
+        return err
+    }
+
+    caData, err := os.ReadFile(store.config.CAFile)
+    if err != nil {
+        return err
+    }
+    pool := x509.NewCertPool()
+    if !pool.AppendCertsFromPEM(caData) {
+        return fmt.Errorf("No certificates found in %s", store.config.CAFile)
+    }
+
+    store.cert.Store(&cert)
+    store.pool.Store(pool)
+    store.modTimes = modTimes
+    return nil
+}
+
+func (store *CertStore) changed() bool {
+    for _, fileName := range store.files() {
+        info, err := os.Stat(fileName)
+        if err != nil || !info.ModTime().Equal(store.modTimes[fileName]) {
+            return true
+        }
+    }
+    return false
+}
+
+func (store *CertStore) Watch(ctx context.Context) {
+    interval := time.Duration(int64(store.config.ReloadIntervalMs)) * time.Millisecond
+    if interval == 0 {
+        interval = 10 * time.Second
+    }
+    ticker := time.NewTicker(interval)
+    defer ticker.Stop()
+
+    for {
+        select {
+        case <- ticker.C:
+            if !store.changed() {
+                continue
+            }
+            if err := store.load(); err != nil {
+                mainLogger.Warn("Error while reloading certificates, keeping the old ones", "err", err)
+            } else {
+                mainLogger.Info("Certificates reloaded", "cert_file", store.config.CertFile)
+            }
+        case <- ctx.Done():
+            return
+        }
+    }
+}
+
+func (store *CertStore) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+    return store.cert.Load(), nil
+}
+
+func (store *CertStore) getClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+    return store.cert.Load(), nil
+}
+
+//verifies the peer against the current CA pool, so a reloaded CA is picked up without restart
+func (store *CertStore) verifyPeer(state tls.ConnectionState, usage x509.ExtKeyUsage, dnsName string) (*x509.Certificate, error) {
+    if len(state.PeerCertificates) == 0 {
+        return nil, errors.New("Peer did not present a certificate")
+    }
+
+    intermediates := x509.NewCertPool()
+    for _, cert := range state.PeerCertificates[1:] {
+        intermediates.AddCert(cert)
+    }
+    peer := state.PeerCertificates[0]
+    _, err := peer.Verify(x509.VerifyOptions{
+        Roots: store.pool.Load(),
+        Intermediates: intermediates,
+        DNSName: dnsName,
+        KeyUsages: []x509.ExtKeyUsage{usage},
+    })
+    return peer, err
+}
+
+//node certificates name their node with a DNS SAN or common name node-<id>, nodes may share a host
+func nodeCertName(nodeId uint64) string {
+    return fmt.Sprintf("node-%d", nodeId)
+}
+
+func certBelongsTo(cert *x509.Certificate, nodeId uint64) bool {
+    name := nodeCertName(nodeId)
+    return cert.Subject.CommonName == name || slices.Contains(cert.DNSNames, name)
+}
+
+//the certificate has to name a node and be valid for the host of that node
+func verifyNodeIdentity(cert *x509.Certificate, nodesConfig NodesConfig) error {
+    for i, node := range nodesConfig {
+        if certBelongsTo(cert, uint64(i)) && cert.VerifyHostname(node.Host) == nil {
+            return nil
+        }
+    }
+    return fmt.Errorf("Certificate %q does not belong to any cluster node", cert.Subject.CommonName)
+}
+
+//the node a raft request claims to come from has to be the one of the client certificate, writes 403 otherwise
+func checkPeerNode(w http.ResponseWriter, r *http.Request, nodeId uint64) bool {
+    if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 || certBelongsTo(r.TLS.PeerCertificates[0], nodeId) {
+        return true
+    }
+    http.Error(w, fmt.Sprintf("Certificate does not belong to node %d", nodeId), http.StatusForbidden)
+    return false
+}
+
+func (store *CertStore) InternalServerConfig(nodesConfig NodesConfig) *tls.Config {
+    return &tls.Config{
+        MinVersion: tls.VersionTLS12,
+        GetCertificate: store.getCertificate,
+        ClientAuth: tls.RequireAnyClientCert,
+        VerifyConnection: func(state tls.ConnectionState) error {
+            peer, err := store.verifyPeer(state, x509.ExtKeyUsageClientAuth, "")
+            if err != nil {
+                return err
+            }
+            return verifyNodeIdentity(peer, nodesConfig)
+        },
+    }
+}
+
+func (store *CertStore) ExternalServerConfig() *tls.Config {
+    config := &tls.Config{
+        MinVersion: tls.VersionTLS12,
+        GetCertificate: store.getCertificate,
+    }
+    if store.config.ExternalClientAuth {
+        config.ClientAuth = tls.RequireAnyClientCert
+        config.VerifyConnection = func(state tls.ConnectionState) error {
+            _, err := store.verifyPeer(state, x509.ExtKeyUsageClientAuth, "")
+            return err
+        }
+    }
+    return config
+}
+
+//the server certificate has to be the one of the node being dialed, as the servers check the certificates of their peers
+func (store *CertStore) ClientConfig(nodeId uint64) *tls.Config {
+    return &tls.Config{
+        MinVersion: tls.VersionTLS12,
+        //the server certificate is checked in VerifyConnection against the reloadable CA pool
+        InsecureSkipVerify: true,
+        GetClientCertificate: store.getClientCertificate,
+        VerifyConnection: func(state tls.ConnectionState) error {
+            peer, err := store.verifyPeer(state, x509.ExtKeyUsageServerAuth, state.ServerName)
+            if err != nil {
+                return err
+            }
+            if !certBelongsTo(peer, nodeId) {
+                return fmt.Errorf("Certificate %q does not belong to node %d", peer.Subject.CommonName, nodeId)
+            }
+            return nil
+        },
+    }
+}
+
+//client for requests to other nodes, plain http.DefaultClient if TLS is disabled.
+//TLS connections are dialed to internal addresses of the config only, so the node of each one is known
+func NewNodeClient(store *CertStore, nodesConfig NodesConfig) *http.Client {
+    if store == nil {
+        return http.DefaultClient
+    }
+
+    dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+    transport := http.DefaultTransport.(*http.Transport).Clone()
+    transport.DialTLSContext = func(ctx context.Context, network string, addr string) (net.Conn, error) {
+        nodeId, ok := nodesConfig.internalNode(addr)
+        if !ok {
+            return nil, fmt.Errorf("%s is not the internal address of a cluster node", addr)
+        }
+        host, _, err := net.SplitHostPort(addr)
+        if err != nil {
+            return nil, err
+        }
+        conn, err := dialer.DialContext(ctx, network, addr)
+        if err != nil {
+            return nil, err
+        }
+        config := store.ClientConfig(nodeId)
+        config.ServerName = host
+        tlsConn := tls.Client(conn, config)
+        if err := tlsConn.HandshakeContext(ctx); err != nil {
+            conn.Close()
+            return nil, err
+        }
+        return tlsConn, nil
+    }
+    return &http.Client{Transport: transport}
+}
+
+func serve(server *http.Server) error {
+    if server.TLSConfig != nil {
+        return server.ListenAndServeTLS("", "")
+    }
+    return server.ListenAndServe()
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+    "encoding/json"
+    "io"
+    "mime"
+    "net/http"
+    "strconv"
+    "strings"
+    "unicode/utf8"
+)
+
+type Item struct {
+    Value string
+    ContentType string
+    Flags uint64
+}
+
+//body of create and update requests, value_b64 and prev_value_b64 carry binary values in JSON
+type WriteRequest struct {
+    Key string `json:"key"`
+    Value string `json:"value"`
+    ValueB64 []byte `json:"value_b64"`
+    PrevValue *string `json:"prev_value"`
+    PrevValueB64 []byte `json:"prev_value_b64"`
+    ContentType string `json:"content_type"`
+    Flags uint64 `json:"flags"`
+}
+
+type ItemResponse struct {
+    Key string `json:"key"`
+    Value *string `json:"value,omitempty"`
+    ValueB64 []byte `json:"value_b64,omitempty"`
+    ContentType string `json:"content_type,omitempty"`
+    Flags uint64 `json:"flags,omitempty"`
+}
+
+//JSON is used for requests without Content-Type and for form encoded ones, which is what curl -d sends
+func isJsonBody(r *http.Request) bool {
+    contentType := r.Header.Get("Content-Type")
+    if contentType == "" {
+        return true
+    }
+    mediaType, _, err := mime.ParseMediaType(contentType)
+    return err != nil || mediaType == "application/json" || mediaType == "application/x-www-form-urlencoded"
+}
+
+type badRequestError struct {
+    error
+}
+
+//raw bodies are stored as is with the request Content-Type and flags from the X-Flags header
+func readWriteRequest(r *http.Request) (request WriteRequest, err error) {
+    data, err := io.ReadAll(r.Body)
+    if err != nil {
+        return
+    }
+
+    if !isJsonBody(r) {
+        request.Value = string(data)
+        request.ContentType = r.Header.Get("Content-Type")
+        if flags := r.Header.Get("X-Flags"); flags != "" {
+            if request.Flags, err = strconv.ParseUint(flags, 10, 64); err != nil {
+                err = badRequestError{err}
+            }
+        }
+        return
+    }
+
+    if err = json.Unmarshal(data, &request); err != nil {
+        err = badRequestError{err}
+        return
+    }
+    request.decodeB64()
+    return
+}
+
+func (request *WriteRequest) decodeB64() {
+    if request.ValueB64 != nil {
+        request.Value = string(request.ValueB64)
+    }
+    if request.PrevValueB64 != nil {
+        prevValue := string(request.PrevValueB64)
+        request.PrevValue = &prevValue
+    }
+}
+
+func (request WriteRequest) Item() Item {
+    return Item{Value: request.Value, ContentType: request.ContentType, Flags: request.Flags}
+}
+
+//values that are not valid UTF-8 are returned base64 encoded in value_b64
+func jsonValue(value string) (*string, []byte) {
+    if utf8.ValidString(value) {
+        return &value, nil
+    }
+    return nil, []byte(value)
+}
+
+func wantsRaw(r *http.Request, item Item) bool {
+    if raw := r.URL.Query().Get("raw"); raw != "" {
+        return raw != "0" && raw != "false"
+    }
+    accept := r.Header.Get("Accept")
+    if strings.Contains(accept, "application/json") {
+        return false
+    }
+    return strings.Contains(accept, "application/octet-stream") || (item.ContentType != "" && strings.Contains(accept, item.ContentType))
+}
+
+func writeItem(w http.ResponseWriter, r *http.Request, key string, item Item) {
+    if wantsRaw(r, item) {
+        contentType := item.ContentType
+        if contentType == "" {
+            contentType = "application/octet-stream"
+        }
+        w.Header().Set("Content-Type", contentType)
+        w.Header().Set("X-Flags", strconv.FormatUint(item.Flags, 10))
+        w.WriteHeader(http.StatusOK)
+        if n, err := io.WriteString(w, item.Value); err != nil {
+            extLogger.Warn("Error while writing response", "err", err, "written", n)
+        }
+        return
+    }
+
+    resp := ItemResponse{Key: key, ContentType: item.ContentType, Flags: item.Flags}
+    resp.Value, resp.ValueB64 = jsonValue(item.Value)
+    writeJson(w, http.StatusOK, resp)
+}